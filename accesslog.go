@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AccessLogJSON   = "json"
+	AccessLogCommon = "common"
+	AccessLogKV     = "kv"
+)
+
+// accessOut receives the access log, one record per line.
+var accessOut = struct {
+	sync.Mutex
+	w io.Writer
+}{w: os.Stdout}
+
+// accessRecord summarizes a connection once it's over.
+type accessRecord struct {
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	Profile       string    `json:"profile"`
+	Conn          string    `json:"conn"`
+	ID            string    `json:"conn_id"`
+	Client        string    `json:"client"`
+	ServerName    string    `json:"server_name,omitempty"`
+	ClientSubject string    `json:"client_subject,omitempty"`
+	Destination   string    `json:"destination,omitempty"`
+	BytesUp       int64     `json:"bytes_up"`   // client to destination
+	BytesDown     int64     `json:"bytes_down"` // destination to client
+	Reason        string    `json:"reason"`     // why the connection closed
+	err           error     // what ended the connection, if it failed
+}
+
+func (a *accessRecord) fail(msg string, err error) {
+	a.Reason = msg
+	a.err = err
+	if err != nil {
+		a.Reason += ": " + err.Error()
+	}
+}
+
+// add counts the bytes of a direction that ended.
+func (a *accessRecord) add(c conConculsion) {
+	if strings.HasSuffix(c.ident, ":ltd") {
+		a.BytesUp += c.xfer
+	} else {
+		a.BytesDown += c.xfer
+	}
+}
+
+func (a *accessRecord) setTLS(cs *tls.ConnectionState) {
+	a.ServerName = cs.ServerName
+	if len(cs.PeerCertificates) > 0 {
+		a.ClientSubject = cs.PeerCertificates[0].Subject.String()
+	}
+}
+
+// setDestination takes the address the connection went to, which for several
+// destinations is the one picked.
+func (a *accessRecord) setDestination(c net.Conn, addr string) {
+	a.Destination = addr
+	if bc, ok := c.(*backendConn); ok {
+		a.Destination = bc.be.addr
+	}
+}
+
+func (a *accessRecord) write(format string) {
+	var b strings.Builder
+	switch format {
+	case AccessLogJSON:
+		line, err := json.Marshal(a)
+		if err != nil {
+			return
+		}
+		b.Write(line)
+	case AccessLogCommon:
+		// like Apache's common format, with the client certificate subject as
+		// the user and the route as the request
+		host := a.Client
+		if h, _, err := net.SplitHostPort(a.Client); err == nil {
+			host = h
+		}
+		fmt.Fprintf(&b, "%s - %s [%s] %q %q %d %d %.3f", host, orDash(a.ClientSubject), a.Start.Format("02/Jan/2006:15:04:05 -0700"),
+			orDash(a.ServerName)+" -> "+orDash(a.Destination), a.Reason, a.BytesDown, a.BytesUp, a.End.Sub(a.Start).Seconds())
+	case AccessLogKV:
+		kv := func(k, v string) {
+			if b.Len() > 0 {
+				b.WriteByte(' ')
+			}
+			if len(v) < 1 || strings.ContainsAny(v, " \"=\t\n") {
+				v = strconv.Quote(v)
+			}
+			b.WriteString(k + "=" + v)
+		}
+		kv("start", a.Start.Format(time.RFC3339Nano))
+		kv("end", a.End.Format(time.RFC3339Nano))
+		kv("profile", a.Profile)
+		kv("conn", a.Conn)
+		kv("conn_id", a.ID)
+		kv("client", a.Client)
+		kv("server_name", a.ServerName)
+		kv("client_subject", a.ClientSubject)
+		kv("destination", a.Destination)
+		kv("bytes_up", strconv.FormatInt(a.BytesUp, 10))
+		kv("bytes_down", strconv.FormatInt(a.BytesDown, 10))
+		kv("reason", a.Reason)
+	default:
+		return
+	}
+	b.WriteByte('\n')
+
+	accessOut.Lock()
+	defer accessOut.Unlock()
+	io.WriteString(accessOut.w, b.String())
+}
+
+func orDash(s string) string {
+	if len(s) < 1 {
+		return "-"
+	}
+	return s
+}
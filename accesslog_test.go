@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureAccess collects the access log for the rest of the test.
+func captureAccess(t *testing.T) *logBuffer {
+	lb := &logBuffer{}
+	accessOut.Lock()
+	prev := accessOut.w
+	accessOut.w = lb
+	accessOut.Unlock()
+	t.Cleanup(func() {
+		accessOut.Lock()
+		accessOut.w = prev
+		accessOut.Unlock()
+	})
+	return lb
+}
+
+func TestAccessRecordWrite(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	a := &accessRecord{Start: start, End: start.Add(1500 * time.Millisecond), Profile: "web", Conn: "web$1#0", ID: "abc",
+		Client: "192.0.2.1:40000", ClientSubject: "CN=alice", Destination: "10.0.0.1:443", BytesUp: 10, BytesDown: 20}
+	a.fail("error dialing", errors.New("refused"))
+	for _, c := range []struct{ format, want string }{
+		{AccessLogCommon, `192.0.2.1 - CN=alice [01/May/2024:12:00:00 +0000] "- -> 10.0.0.1:443" "error dialing: refused" 20 10 1.500` + "\n"},
+		{AccessLogKV, `start=2024-05-01T12:00:00Z end=2024-05-01T12:00:01.5Z profile=web conn=web$1#0 conn_id=abc client=192.0.2.1:40000 server_name="" client_subject="CN=alice" destination=10.0.0.1:443 bytes_up=10 bytes_down=20 reason="error dialing: refused"` + "\n"},
+		{"", ""},
+	} {
+		lb := captureAccess(t)
+		a.write(c.format)
+		if got := lb.String(); got != c.want {
+			t.Errorf("%q format wrote\n%s\nwant\n%s", c.format, got, c.want)
+		}
+	}
+
+	lb := captureAccess(t)
+	a.write(AccessLogJSON)
+	var got map[string]any
+	if err := json.Unmarshal([]byte(lb.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["client_subject"] != "CN=alice" || got["bytes_down"] != 20.0 || got["reason"] != "error dialing: refused" {
+		t.Errorf("got %v", got)
+	}
+	if _, ok := got["server_name"]; ok {
+		t.Error("empty server name written")
+	}
+}
+
+func TestInstanceAccessLogFormat(t *testing.T) {
+	lb := captureAccess(t)
+	inst := testInstance(t, &Profile{Proxy: testBanner(t, "dest"), AccessLogFormat: AccessLogJSON})
+	if got := readsBanner(t, inst.ListenAddr()); got != "dest\n" {
+		t.Fatalf("got %q", got)
+	}
+	waitFor(t, "the access log", func() bool { return strings.HasSuffix(lb.String(), "\n") })
+	var a accessRecord
+	if err := json.Unmarshal([]byte(lb.String()), &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Profile != "test" || a.BytesDown != 5 || !strings.HasPrefix(a.Client, "127.0.0.1:") || len(a.ID) < 1 {
+		t.Errorf("got %+v", a)
+	}
+
+	p := &Profile{AccessLogFormat: "apache"}
+	if err := p.Resolve(); err == nil || !strings.Contains(err.Error(), "AccessLogFormat") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeManager builds the autocert manager obtaining the listen certificate of
+// a profile. Certificates are kept in the cache directory so restarts and
+// reloads don't issue new ones.
+func acmeManager(p *Profile) (*autocert.Manager, error) {
+	dir := p.ListenACMECacheDir
+	if len(dir) < 1 {
+		ucd, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(ucd, "mtlsproxy", "acme")
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(dir),
+		HostPolicy: autocert.HostWhitelist(p.ListenACMEDomains...),
+		Email:      p.ListenACMEEmail,
+	}
+	if len(p.ListenACMEDirectory) > 0 {
+		m.Client = &acme.Client{DirectoryURL: p.ListenACMEDirectory}
+	}
+	return m, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func TestACMEManager(t *testing.T) {
+	dir := t.TempDir()
+	p := &Profile{ListenACMEDomains: []string{"example.test", "www.example.test"}, ListenACMEEmail: "ops@example.test", ListenACMEDirectory: "https://acme.example.test/directory", ListenACMECacheDir: dir}
+	m, err := acmeManager(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"example.test", "www.example.test"} {
+		if err := m.HostPolicy(context.Background(), name); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+	if err := m.HostPolicy(context.Background(), "other.test"); err == nil {
+		t.Error("certificate allowed for a domain not listed")
+	}
+	if m.Cache != autocert.DirCache(dir) {
+		t.Errorf("cache %v, want %s", m.Cache, dir)
+	}
+	if m.Client == nil || m.Client.DirectoryURL != p.ListenACMEDirectory {
+		t.Errorf("client %+v doesn't use the directory", m.Client)
+	}
+	if m.Email != p.ListenACMEEmail {
+		t.Errorf("email %q", m.Email)
+	}
+
+	m, err = acmeManager(&Profile{ListenACMEDomains: []string{"example.test"}})
+	if err != nil {
+		t.Skip(err)
+	}
+	if m.Client != nil {
+		t.Error("client set without a directory")
+	}
+	if d, ok := m.Cache.(autocert.DirCache); !ok || filepath.Base(string(d)) != "acme" {
+		t.Errorf("default cache %v", m.Cache)
+	}
+}
+
+func TestResolveACME(t *testing.T) {
+	p := &Profile{Name: "test", Listen: ":0", Proxy: "127.0.0.1:1", ListenACMEDomains: []string{"example.test"}}
+	if err := p.Resolve(); err != nil {
+		t.Fatal(err)
+	}
+	if !p.listenCertificate() {
+		t.Error("ACME isn't a listen certificate")
+	}
+	p = &Profile{Name: "test", Listen: ":0", Proxy: "127.0.0.1:1", ListenACMEDomains: []string{"example.test"}, ListenCertRaw: "cert.pem"}
+	if err := p.Resolve(); err == nil || !strings.Contains(err.Error(), "ACME") {
+		t.Errorf("ACME with a listen certificate: got %v", err)
+	}
+}
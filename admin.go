@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// adminServer is the HTTP counterpart of the control server, for status and
+// control without a gRPC client.
+type adminServer struct {
+	s *Supervisor
+}
+
+// profileStatus is how the admin server shows a profile.
+type profileStatus struct {
+	Name        string `json:"name"`
+	Listen      string `json:"listen"`
+	Proxy       string `json:"proxy"`
+	Protocol    string `json:"protocol,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Stopped     bool   `json:"stopped"`
+	Draining    bool   `json:"draining"` // stopped, with connections still open
+	Disabled    bool   `json:"disabled"` // in the configuration, and not started through the admin server
+	Degraded    bool   `json:"degraded"` // failed to start, retried in the background
+	StartError  string `json:"start_error,omitempty"`
+	StartCode   string `json:"start_error_code,omitempty"`
+	Listening   bool   `json:"listening"`
+	ListenError string `json:"listen_error,omitempty"`
+	ListenCode  string `json:"listen_error_code,omitempty"`
+	LastError   string `json:"last_error,omitempty"` // what ended the last failed connection
+	LastCode    string `json:"last_error_code,omitempty"`
+	Active      int64  `json:"active"`
+	BytesUp     int64  `json:"bytes_up"`   // read from clients, including open connections
+	BytesDown   int64  `json:"bytes_down"` // read from destinations
+}
+
+// startAdminServer starts the admin HTTP server when an address is
+// configured. Like the control server it always requires mTLS.
+func startAdminServer(c *Configurations, s *Supervisor) error {
+	if len(c.AdminListen) < 1 {
+		return nil
+	}
+
+	tlsconf, err := controlTLSConfig(c)
+	if err != nil {
+		return err
+	}
+
+	l, err := listenSocket("tcp", c.AdminListen)
+	if err != nil {
+		return err
+	}
+
+	mux := newAdminMux(s)
+	go func() {
+		if err := http.Serve(tls.NewListener(l, tlsconf), mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("admin server stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// newAdminMux has the routes of the admin API, served by the admin server and
+// the control socket.
+func newAdminMux(s *Supervisor) *http.ServeMux {
+	a := &adminServer{s: s}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/profiles", a.listProfiles)
+	mux.HandleFunc("/profiles/", a.profile)
+	mux.HandleFunc("/reload", a.reload)
+	mux.HandleFunc("/loglevel", a.logLevel)
+	mux.HandleFunc("/version", a.version)
+	return mux
+}
+
+func (a *adminServer) statuses() []profileStatus {
+	var ps []profileStatus
+	for _, inst := range a.s.Instances() {
+		p := inst.Profile()
+		st := profileStatus{Name: p.Name, Listen: p.Listen, Proxy: p.Proxy, Protocol: p.Protocol, Source: p.Source, Active: inst.Active()}
+		var err error
+		st.Listening, err = inst.ListenStatus()
+		if err != nil {
+			st.ListenError, st.ListenCode = err.Error(), errorCode(err)
+		}
+		st.LastError, st.LastCode, _ = inst.LastError()
+		st.BytesUp, st.BytesDown = inst.Bytes()
+		ps = append(ps, st)
+	}
+	for _, p := range a.s.Stopped() {
+		st := profileStatus{Name: p.Name, Listen: p.Listen, Proxy: p.Proxy, Protocol: p.Protocol, Source: p.Source, Stopped: true}
+		if inst := a.s.Draining(p.Name); inst != nil {
+			st.Draining, st.Active = true, inst.Active()
+			st.BytesUp, st.BytesDown = inst.Bytes()
+		}
+		ps = append(ps, st)
+	}
+	for _, p := range a.s.Disabled() {
+		ps = append(ps, profileStatus{Name: p.Name, Listen: p.Listen, Proxy: p.Proxy, Protocol: p.Protocol, Source: p.Source, Disabled: true})
+	}
+	for _, d := range a.s.Degraded() {
+		p := d.p
+		ps = append(ps, profileStatus{Name: p.Name, Listen: p.Listen, Proxy: p.Proxy, Protocol: p.Protocol, Source: p.Source, Degraded: true, StartError: d.err.Error(), StartCode: errorCode(d.err)})
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].Name < ps[j].Name })
+	return ps
+}
+
+// connStatus is how the admin server shows a connection.
+type connStatus struct {
+	Ident      string    `json:"ident"`
+	ID         string    `json:"id"`
+	Client     string    `json:"client"`
+	Backend    string    `json:"backend"`
+	BytesUp    int64     `json:"bytes_up"`
+	BytesDown  int64     `json:"bytes_down"`
+	Start      time.Time `json:"start"`
+	AgeSeconds float64   `json:"age_seconds"`
+}
+
+func (a *adminServer) instance(name string) *Instance {
+	for _, inst := range a.s.Instances() {
+		if inst.Profile().Name == name {
+			return inst
+		}
+	}
+	return nil
+}
+
+// listProfiles is GET /profiles.
+func (a *adminServer) listProfiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	ps := a.statuses()
+	if ps == nil {
+		ps = []profileStatus{}
+	}
+	adminJSON(w, http.StatusOK, ps)
+}
+
+// profile is GET /profiles/NAME, POST /profiles/NAME/stop,
+// POST /profiles/NAME/start and the connections of the profile.
+func (a *adminServer) profile(w http.ResponseWriter, r *http.Request) {
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/profiles/"), "/")
+	action, ident, _ := strings.Cut(action, "/")
+	switch {
+	case action == "connections":
+		a.connections(w, r, name, ident)
+	case action == "loglevel":
+		a.profileLogLevel(w, r, name)
+	case len(action) < 1:
+		if r.Method != http.MethodGet {
+			adminError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		for _, st := range a.statuses() {
+			if st.Name == name {
+				adminJSON(w, http.StatusOK, st)
+				return
+			}
+		}
+		adminError(w, http.StatusNotFound, "no profile "+name)
+	case action == "stop" || action == "start":
+		if r.Method != http.MethodPost {
+			adminError(w, http.StatusMethodNotAllowed, "use POST")
+			return
+		}
+		var err error
+		if action == "stop" {
+			err = a.s.StopProfile(name)
+		} else {
+			err = a.s.StartProfile(name)
+		}
+		if err != nil {
+			adminFailure(w, http.StatusConflict, action, err)
+			return
+		}
+		slog.Info("profile "+action+" requested through the admin server", "profile", name)
+		adminJSON(w, http.StatusAccepted, map[string]string{"profile": name, "action": action})
+	default:
+		adminError(w, http.StatusNotFound, "unknown action "+action)
+	}
+}
+
+// connections is GET /profiles/NAME/connections,
+// DELETE /profiles/NAME/connections/IDENT and the captures of connections.
+func (a *adminServer) connections(w http.ResponseWriter, r *http.Request, name, ident string) {
+	inst := a.instance(name)
+	if inst == nil {
+		adminError(w, http.StatusNotFound, "no running profile "+name)
+		return
+	}
+	if ident, ok := strings.CutSuffix(ident, "/capture"); ok {
+		a.capture(w, r, inst, ident)
+		return
+	}
+	if len(ident) > 0 {
+		if r.Method != http.MethodDelete {
+			adminError(w, http.StatusMethodNotAllowed, "use DELETE")
+			return
+		}
+		if !inst.CloseConnection(ident) {
+			adminError(w, http.StatusNotFound, "no connection "+ident)
+			return
+		}
+		adminJSON(w, http.StatusOK, map[string]string{"profile": name, "closed": ident})
+		return
+	}
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	now := time.Now()
+	cs := []connStatus{}
+	for _, lc := range inst.Connections() {
+		cs = append(cs, connStatus{
+			Ident:      lc.ident,
+			ID:         lc.id,
+			Client:     lc.client,
+			Backend:    lc.backend,
+			BytesUp:    lc.up.Load(),
+			BytesDown:  lc.down.Load(),
+			Start:      lc.start,
+			AgeSeconds: now.Sub(lc.start).Seconds(),
+		})
+	}
+	adminJSON(w, http.StatusOK, cs)
+}
+
+// captureRequest is the optional body of starting a capture.
+type captureRequest struct {
+	MaxBytes int64  `json:"max_bytes"`
+	Duration string `json:"duration"`
+}
+
+// capture is POST and DELETE /profiles/NAME/connections/IDENT/capture.
+func (a *adminServer) capture(w http.ResponseWriter, r *http.Request, inst *Instance, ident string) {
+	switch r.Method {
+	case http.MethodPost:
+		if len(a.s.c.CaptureDir) < 1 {
+			adminError(w, http.StatusConflict, "captures aren't enabled, there is no capture directory")
+			return
+		}
+		cr := captureRequest{MaxBytes: defaultCaptureBytes}
+		if err := json.NewDecoder(r.Body).Decode(&cr); err != nil && !errors.Is(err, io.EOF) {
+			adminError(w, http.StatusBadRequest, "reading request: "+err.Error())
+			return
+		}
+		d := defaultCaptureDuration
+		if len(cr.Duration) > 0 {
+			var err error
+			if d, err = time.ParseDuration(cr.Duration); err != nil || d <= 0 {
+				adminError(w, http.StatusBadRequest, "duration isn't a positive Go duration: "+cr.Duration)
+				return
+			}
+		}
+		if cr.MaxBytes < 1 {
+			adminError(w, http.StatusBadRequest, "max_bytes isn't positive")
+			return
+		}
+		path, err := inst.CaptureConnection(ident, a.s.c.CaptureDir, cr.MaxBytes, d)
+		if err != nil {
+			adminError(w, http.StatusConflict, "capturing: "+err.Error())
+			return
+		}
+		adminJSON(w, http.StatusOK, map[string]string{"profile": inst.ident, "conn": ident, "file": path})
+	case http.MethodDelete:
+		if !inst.StopCapture(ident) {
+			adminError(w, http.StatusNotFound, "no capture of "+ident)
+			return
+		}
+		adminJSON(w, http.StatusOK, map[string]string{"profile": inst.ident, "conn": ident, "stopped": "capture"})
+	default:
+		adminError(w, http.StatusMethodNotAllowed, "use POST or DELETE")
+	}
+}
+
+// levelRequest is the body of log level changes.
+type levelRequest struct {
+	Level string `json:"level"`
+}
+
+func readLevel(r *http.Request) (slog.Level, error) {
+	var lr levelRequest
+	if err := json.NewDecoder(r.Body).Decode(&lr); err != nil {
+		return 0, fmt.Errorf("reading request: %w", err)
+	}
+	return parseLevel(lr.Level)
+}
+
+// logLevel is GET and PUT /loglevel, for the global level.
+func (a *adminServer) logLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		l, err := readLevel(r)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		levels.global.Set(l)
+		slog.Info("log level changed through the admin server", "log_level", levelName(l))
+	default:
+		adminError(w, http.StatusMethodNotAllowed, "use GET or PUT")
+		return
+	}
+	adminJSON(w, http.StatusOK, levelRequest{Level: strings.ToLower(levelName(levels.global.Level()))})
+}
+
+// profileLogLevel is GET, PUT and DELETE /profiles/NAME/loglevel, DELETE
+// goes back to the level from the config.
+func (a *adminServer) profileLogLevel(w http.ResponseWriter, r *http.Request, name string) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		l, err := readLevel(r)
+		if err != nil {
+			adminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		levels.override(name, &l)
+		slog.Info("log level changed through the admin server", "profile", name, "log_level", levelName(l))
+	case http.MethodDelete:
+		levels.override(name, nil)
+	default:
+		adminError(w, http.StatusMethodNotAllowed, "use GET, PUT or DELETE")
+		return
+	}
+	adminJSON(w, http.StatusOK, map[string]string{"profile": name, "level": strings.ToLower(levelName(levels.of(name)))})
+}
+
+// reload is POST /reload, the same as sending HUP, and GET /reload for the
+// outcome of the last one.
+func (a *adminServer) reload(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		st, err := a.s.LastReload()
+		if err != nil {
+			adminError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		adminJSON(w, http.StatusOK, st)
+		return
+	}
+	if r.Method != http.MethodPost {
+		adminError(w, http.StatusMethodNotAllowed, "use GET or POST")
+		return
+	}
+	if err := a.s.Reload(); err != nil {
+		adminFailure(w, http.StatusConflict, "reloading", err)
+		return
+	}
+	adminJSON(w, http.StatusOK, map[string]string{"result": "reloaded"})
+}
+
+// version is GET /version, the build that is running.
+func (a *adminServer) version(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	adminJSON(w, http.StatusOK, getBuildInfo())
+}
+
+func adminJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func adminError(w http.ResponseWriter, code int, msg string) {
+	adminJSON(w, code, map[string]string{"error": msg})
+}
+
+// adminFailure is adminError for an operational failure, with its code.
+func adminFailure(w http.ResponseWriter, code int, doing string, err error) {
+	adminJSON(w, code, map[string]string{"error": doing + ": " + err.Error(), "code": errorCode(err)})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// adminDo sends a request with body to the admin API of s.
+func adminDo(s *Supervisor, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	newAdminMux(s).ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+func TestAdminConnections(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: testEcho(t)})
+	s := &Supervisor{insts: []*Instance{inst}}
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c) {
+		t.Fatal("no echo")
+	}
+
+	w := adminDo(s, http.MethodGet, "/profiles/test/connections", "")
+	var cs []connStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &cs); err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 1 || cs[0].Client != c.LocalAddr().String() || cs[0].BytesUp != 5 || cs[0].BytesDown != 5 {
+		t.Fatalf("got %+v", cs)
+	}
+
+	for _, r := range []struct {
+		method, path string
+		code         int
+	}{
+		{http.MethodGet, "/profiles/other/connections", http.StatusNotFound},
+		{http.MethodPost, "/profiles/test/connections", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/profiles/test/connections/" + cs[0].Ident, http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/profiles/test/connections/test$9#9", http.StatusNotFound},
+	} {
+		if w := adminDo(s, r.method, r.path, ""); w.Code != r.code {
+			t.Errorf("%s %s: got %d, want %d", r.method, r.path, w.Code, r.code)
+		}
+	}
+
+	if w := adminDo(s, http.MethodDelete, "/profiles/test/connections/"+cs[0].Ident, ""); w.Code != http.StatusOK {
+		t.Fatalf("got %d: %s", w.Code, w.Body)
+	}
+	if !closed(c) {
+		t.Error("connection still open")
+	}
+	waitFor(t, "the connection to be gone", func() bool { return len(inst.Connections()) < 1 })
+}
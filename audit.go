@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditOut is the audit log of client identities, kept apart from the other
+// logs and only ever appended to.
+var auditOut struct {
+	sync.Mutex
+	path string
+	f    *os.File
+}
+
+// auditRecord is a client certificate a profile accepted or denied.
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	Profile     string    `json:"profile"`
+	Conn        string    `json:"conn"`
+	Client      string    `json:"client"`
+	Subject     string    `json:"subject"`
+	Serial      string    `json:"serial"`
+	Fingerprint string    `json:"fingerprint"` // SHA-256 of the certificate
+	Issuer      string    `json:"issuer"`
+	Outcome     string    `json:"outcome"` // accepted or denied
+	Reason      string    `json:"reason,omitempty"`
+}
+
+func openAuditLog(c *Configurations) error {
+	if len(c.AuditLog) < 1 {
+		return nil
+	}
+	auditOut.Lock()
+	defer auditOut.Unlock()
+	auditOut.path = c.AuditLog
+	return reopenAuditLocked()
+}
+
+// reopenAuditLog opens the file again after it was rotated.
+func reopenAuditLog() error {
+	auditOut.Lock()
+	defer auditOut.Unlock()
+	if auditOut.f == nil {
+		return nil
+	}
+	return reopenAuditLocked()
+}
+
+func reopenAuditLocked() error {
+	f, err := os.OpenFile(auditOut.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if auditOut.f != nil {
+		auditOut.f.Close()
+	}
+	auditOut.f = f
+	return nil
+}
+
+func audit(profile, conn, client string, cert *x509.Certificate, outcome, reason string) {
+	auditOut.Lock()
+	defer auditOut.Unlock()
+	if auditOut.f == nil {
+		return
+	}
+	sum := sha256.Sum256(cert.Raw)
+	line, err := json.Marshal(auditRecord{
+		Time:        time.Now(),
+		Profile:     profile,
+		Conn:        conn,
+		Client:      client,
+		Subject:     cert.Subject.String(),
+		Serial:      cert.SerialNumber.String(),
+		Fingerprint: hex.EncodeToString(sum[:]),
+		Issuer:      cert.Issuer.String(),
+		Outcome:     outcome,
+		Reason:      reason,
+	})
+	if err != nil {
+		return
+	}
+	if _, err := auditOut.f.Write(append(line, '\n')); err != nil {
+		slog.Error("error writing audit log", "path", auditOut.path, "err", err)
+	}
+}
+
+// auditAccepted records the client certificate of a connection, if it had one.
+func auditAccepted(profile, conn, client string, cs *tls.ConnectionState) {
+	if cs != nil && len(cs.PeerCertificates) > 0 {
+		audit(profile, conn, client, cs.PeerCertificates[0], "accepted", "")
+	}
+}
+
+// deniedCert is the client certificate a failed handshake was about, nil if
+// the handshake failed before one was checked.
+func deniedCert(err error) *x509.Certificate {
+	var denied *deniedCertError
+	var verification *tls.CertificateVerificationError
+	switch {
+	case errors.As(err, &denied):
+		return denied.leaf
+	case errors.As(err, &verification) && len(verification.UnverifiedCertificates) > 0:
+		return verification.UnverifiedCertificates[0]
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openAudit writes the audit log to a file of the test, which is returned.
+func openAudit(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := openAuditLog(&Configurations{AuditLog: path}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		auditOut.Lock()
+		auditOut.f.Close()
+		auditOut.f = nil
+		auditOut.Unlock()
+	})
+	return path
+}
+
+func readAudit(t *testing.T, path string) []auditRecord {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var recs []auditRecord
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var rec auditRecord
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			t.Fatalf("%q: %v", s.Text(), err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+func TestAuditLog(t *testing.T) {
+	path := openAudit(t)
+	ca, other := newTestCA(t), newTestCA(t)
+	p := &Profile{Proxy: testEcho(t), ListenAllowedCNs: []string{"alice"}}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+	unknown := ca.clientConfig(t, "carol")
+	unknown.Certificates = other.clientConfig(t, "carol").Certificates
+
+	if _, err := tlsEchoes(inst.ListenAddr(), ca.clientConfig(t, "alice")); err != nil {
+		t.Fatal(err)
+	}
+	tlsEchoes(inst.ListenAddr(), ca.clientConfig(t, "bob"))
+	tlsEchoes(inst.ListenAddr(), unknown)
+	waitFor(t, "the audit records", func() bool { return len(readAudit(t, path)) == 3 })
+
+	want := []struct{ subject, outcome, reason string }{
+		{"CN=alice", "accepted", ""},
+		{"CN=bob", "denied", "not_allowed"},
+		{"CN=carol", "denied", "unknown_ca"},
+	}
+	for i, rec := range readAudit(t, path) {
+		if rec.Subject != want[i].subject || rec.Outcome != want[i].outcome || rec.Reason != want[i].reason || rec.Profile != inst.ident || len(rec.Fingerprint) != 64 {
+			t.Errorf("got %+v, want %+v", rec, want[i])
+		}
+	}
+
+	// after rotation the records go to a new file
+	os.Rename(path, path+".1")
+	if err := reopenAuditLog(); err != nil {
+		t.Fatal(err)
+	}
+	tlsEchoes(inst.ListenAddr(), ca.clientConfig(t, "alice"))
+	waitFor(t, "the record in the new file", func() bool { return len(readAudit(t, path)) == 1 })
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// Paths starting with these are read from AWS Secrets Manager, optionally a
+// key of a JSON secret after #, and Systems Manager Parameter Store instead of
+// files, so keys don't have to be written to disk.
+const (
+	schemeSecretsManager = "aws-sm://"
+	schemeParameterStore = "ssm://"
+)
+
+const (
+	defaultAWSRefresh = 5 * time.Minute
+	awsTimeout        = 30 * time.Second
+)
+
+// awsSecret is a value read from AWS, kept until the next refresh. A stale
+// value is read again and only used when that fails.
+type awsSecret struct {
+	value []byte
+	stale bool
+}
+
+var (
+	awsSecrets   = make(map[string]*awsSecret)
+	awsSecretsMu sync.Mutex
+
+	awsConfig     aws.Config
+	awsConfigErr  error
+	awsConfigOnce sync.Once
+)
+
+func isAWSSecret(path string) bool {
+	return strings.HasPrefix(path, schemeSecretsManager) || strings.HasPrefix(path, schemeParameterStore)
+}
+
+// readFile reads the file at path, or the secret or parameter from AWS.
+func readFile(path string) ([]byte, error) {
+	if !isAWSSecret(path) {
+		return os.ReadFile(path)
+	}
+
+	awsSecretsMu.Lock()
+	defer awsSecretsMu.Unlock()
+	s, ok := awsSecrets[path]
+	if ok && !s.stale {
+		return s.value, nil
+	}
+	b, err := fetchAWSSecret(path)
+	if err != nil {
+		if !ok {
+			return nil, err
+		}
+		// tried again on the next refresh
+		slog.Error("error refreshing secret from AWS", "secret", path, "err", err)
+		s.stale = false
+		return s.value, nil
+	}
+	awsSecrets[path] = &awsSecret{value: b}
+	return b, nil
+}
+
+// expireAWSSecrets makes the next read of every secret go to AWS.
+func expireAWSSecrets() {
+	awsSecretsMu.Lock()
+	defer awsSecretsMu.Unlock()
+	for _, s := range awsSecrets {
+		s.stale = true
+	}
+}
+
+func fetchAWSSecret(path string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), awsTimeout)
+	defer cancel()
+
+	// credentials and region come from the environment, shared config or the
+	// role of the instance
+	awsConfigOnce.Do(func() {
+		awsConfig, awsConfigErr = config.LoadDefaultConfig(context.Background(), config.WithEC2IMDSRegion())
+	})
+	if awsConfigErr != nil {
+		return nil, fmt.Errorf("loading AWS configuration: %w", awsConfigErr)
+	}
+
+	if id, ok := strings.CutPrefix(path, schemeSecretsManager); ok {
+		id, key, _ := strings.Cut(id, "#")
+		client := secretsmanager.NewFromConfig(awsConfig, func(o *secretsmanager.Options) {
+			if r := arnRegion(id); len(r) > 0 {
+				o.Region = r
+			}
+		})
+		out, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(id)})
+		if err != nil {
+			return nil, err
+		}
+		b := out.SecretBinary
+		if out.SecretString != nil {
+			b = []byte(*out.SecretString)
+		}
+		if len(key) < 1 {
+			return b, nil
+		}
+		var fields map[string]string
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return nil, fmt.Errorf("secret %s isn't a JSON object: %w", id, err)
+		}
+		v, ok := fields[key]
+		if !ok {
+			return nil, fmt.Errorf("secret %s has no key %q", id, key)
+		}
+		return []byte(v), nil
+	}
+
+	name := strings.TrimPrefix(path, schemeParameterStore)
+	// ssm://prod/tls/key is the parameter /prod/tls/key
+	if !strings.HasPrefix(name, "/") && !strings.HasPrefix(name, "arn:") && strings.Contains(name, "/") {
+		name = "/" + name
+	}
+	client := ssm.NewFromConfig(awsConfig, func(o *ssm.Options) {
+		if r := arnRegion(name); len(r) > 0 {
+			o.Region = r
+		}
+	})
+	out, err := client.GetParameter(ctx, &ssm.GetParameterInput{Name: aws.String(name), WithDecryption: aws.Bool(true)})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(aws.ToString(out.Parameter.Value)), nil
+}
+
+// arnRegion is the region of an ARN, empty for names.
+func arnRegion(id string) string {
+	parts := strings.SplitN(id, ":", 5)
+	if len(parts) < 5 || parts[0] != "arn" {
+		return ""
+	}
+	return parts[3]
+}
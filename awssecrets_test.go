@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestAWSPaths(t *testing.T) {
+	for path, want := range map[string]bool{
+		"aws-sm://proxy-tls#key": true,
+		"ssm://prod/tls/key":     true,
+		"/etc/tls/key.pem":       false,
+		"s3://bucket/key.pem":    false,
+	} {
+		if got := isAWSSecret(path); got != want {
+			t.Errorf("%s: got %v", path, got)
+		}
+	}
+	for id, want := range map[string]string{
+		"arn:aws:secretsmanager:eu-west-1:123456789012:secret:proxy-tls": "eu-west-1",
+		"arn:aws:ssm:us-east-2:123456789012:parameter/prod/tls/key":      "us-east-2",
+		"proxy-tls": "",
+		"/prod/tls": "",
+	} {
+		if got := arnRegion(id); got != want {
+			t.Errorf("%s: got %q, want %q", id, got, want)
+		}
+	}
+}
+
+// testAWS answers GetSecretValue and GetParameter with the values, and
+// counts the requests. Values missing are answered with an error.
+type testAWS struct {
+	mu       sync.Mutex
+	values   map[string]string // by secret ID or parameter name
+	requests int
+}
+
+func (a *testAWS) serve(t *testing.T) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		a.requests++
+		var in struct{ SecretId, Name string }
+		json.NewDecoder(r.Body).Decode(&in)
+		v, ok := a.values[in.SecretId+in.Name]
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"__type": "ResourceNotFoundException", "message": "not found"})
+			return
+		}
+		switch r.Header.Get("X-Amz-Target") {
+		case "secretsmanager.GetSecretValue":
+			json.NewEncoder(w).Encode(map[string]string{"SecretString": v})
+		case "AmazonSSM.GetParameter":
+			json.NewEncoder(w).Encode(map[string]any{"Parameter": map[string]string{"Value": v}})
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv("AWS_ENDPOINT_URL", srv.URL)
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	// the configuration and the secrets are kept for the life of the process
+	awsConfigOnce = sync.Once{}
+	t.Cleanup(func() {
+		awsConfigOnce = sync.Once{}
+		awsSecretsMu.Lock()
+		defer awsSecretsMu.Unlock()
+		awsSecrets = make(map[string]*awsSecret)
+	})
+}
+
+func (a *testAWS) count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.requests
+}
+
+func TestInstanceAWSSecrets(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "proxy")
+	tlsJSON, _ := json.Marshal(map[string]string{"cert": certPEM, "key": keyPEM})
+	a := &testAWS{values: map[string]string{"proxy-tls": string(tlsJSON), "/prod/tls/ca": ca.pem}}
+	a.serve(t)
+
+	p := &Profile{Proxy: testBanner(t, "dest"), ListenCertPath: "aws-sm://proxy-tls#cert", ListenPrivatePath: "aws-sm://proxy-tls#key", ListenAuthorityPath: "ssm://prod/tls/ca"}
+	inst := testInstance(t, p)
+	if got := banner(t, inst.ListenAddr(), ca.clientConfig(t, "client")); got != "dest\n" {
+		t.Errorf("got %q", got)
+	}
+	if !p.usesAWSSecrets() || len(p.filePaths()) > 0 {
+		t.Errorf("AWS paths %v watched", p.filePaths())
+	}
+
+	// read once until the next refresh, then the last value is kept when
+	// AWS fails
+	n := a.count()
+	if b, err := readFile("ssm://prod/tls/ca"); err != nil || string(b) != ca.pem || a.count() != n {
+		t.Errorf("got %v, %d requests", err, a.count()-n)
+	}
+	a.mu.Lock()
+	delete(a.values, "/prod/tls/ca")
+	a.mu.Unlock()
+	expireAWSSecrets()
+	if b, err := readFile("ssm://prod/tls/ca"); err != nil || string(b) != ca.pem || a.count() != n+1 {
+		t.Errorf("got %v, %d requests after a failed refresh", err, a.count()-n)
+	}
+
+	for path, want := range map[string]string{
+		"aws-sm://proxy-tls#missing": `no key "missing"`,
+		"aws-sm:///prod/tls/ca#key":  "ResourceNotFoundException",
+		"ssm://prod/tls/other":       "ResourceNotFoundException",
+	} {
+		if _, err := readFile(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", path, err, want)
+		}
+	}
+}
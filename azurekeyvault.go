@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+const (
+	defaultAzureRefresh = 5 * time.Minute
+	azureTimeout        = 30 * time.Second
+	azureAPIVersion     = "7.4"
+)
+
+// azureCert is the latest version of a certificate in Azure Key Vault, shared
+// by the profiles using it. A stale one is checked for a new version on the
+// next read.
+type azureCert struct {
+	version    string
+	certRaw    string
+	privateRaw string        // empty with remote keys
+	signer     crypto.Signer // with remote keys
+	stale      bool
+}
+
+var (
+	azureCerts   = make(map[string]*azureCert)
+	azureCertsMu sync.Mutex
+
+	azureCred     azcore.TokenCredential
+	azureCredErr  error
+	azureCredOnce sync.Once
+
+	azureClient = &http.Client{
+		Timeout:   azureTimeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment},
+	}
+)
+
+// azureCertificate returns the latest version of the certificate, keeping the
+// last one read when Key Vault can't be reached.
+func azureCertificate(vault, name string, remote bool) (*azureCert, error) {
+	azureCertsMu.Lock()
+	defer azureCertsMu.Unlock()
+
+	key := vault + "|" + name + "|" + fmt.Sprint(remote)
+	ac, ok := azureCerts[key]
+	if ok && !ac.stale {
+		return ac, nil
+	}
+	nu, err := readAzureCert(vault, name, remote, ac)
+	if err != nil {
+		if !ok {
+			return nil, err
+		}
+		// looked for again on the next refresh
+		slog.Error("error reading certificate from Azure Key Vault", "vault", vault, "certificate", name, "err", err)
+		ac.stale = false
+		return ac, nil
+	}
+	if nu != ac {
+		slog.Info("certificate read from Azure Key Vault", "vault", vault, "certificate", name, "version", nu.version)
+	}
+	nu.stale = false
+	azureCerts[key] = nu
+	return nu, nil
+}
+
+// expireAzureCerts makes the next read of every certificate look for a new
+// version.
+func expireAzureCerts() {
+	azureCertsMu.Lock()
+	defer azureCertsMu.Unlock()
+	for _, ac := range azureCerts {
+		ac.stale = true
+	}
+}
+
+// readAzureCert reads the certificate, returning last when its version didn't
+// change. The certificate and its key are read from the secret backing it,
+// with remote keys only the certificate is read and the key signs in Key Vault.
+func readAzureCert(vault, name string, remote bool, last *azureCert) (*azureCert, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), azureTimeout)
+	defer cancel()
+
+	var meta struct {
+		ID  string `json:"id"`
+		KID string `json:"kid"`
+		SID string `json:"sid"`
+		CER []byte `json:"cer"`
+	}
+	u, err := url.JoinPath(vault, "certificates", name)
+	if err != nil {
+		return nil, err
+	}
+	if err := azureDo(ctx, http.MethodGet, u, nil, &meta); err != nil {
+		return nil, err
+	}
+	version := path.Base(meta.ID)
+	if last != nil && last.version == version {
+		return last, nil
+	}
+
+	ac := &azureCert{version: version}
+	if remote {
+		if len(meta.CER) < 1 {
+			return nil, errors.New("no certificate in the response of Key Vault")
+		}
+		ac.certRaw = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: meta.CER}))
+		certs, err := parseCertificates(ac.certRaw)
+		if err != nil {
+			return nil, err
+		}
+		ac.signer = &azureSigner{kid: meta.KID, pub: certs[0].PublicKey}
+		return ac, nil
+	}
+
+	var secret struct {
+		Value       string `json:"value"`
+		ContentType string `json:"contentType"`
+	}
+	if err := azureDo(ctx, http.MethodGet, meta.SID, nil, &secret); err != nil {
+		return nil, fmt.Errorf("reading the key, set AzureRemoteKeys when it isn't exportable: %w", err)
+	}
+	if secret.ContentType == "application/x-pkcs12" {
+		b, err := base64.StdEncoding.DecodeString(secret.Value)
+		if err != nil {
+			return nil, err
+		}
+		if ac.certRaw, ac.privateRaw, err = decodeP12(b, ""); err != nil {
+			return nil, err
+		}
+		return ac, nil
+	}
+
+	var certs, keys bytes.Buffer
+	rest := []byte(secret.Value)
+	for {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			pem.Encode(&keys, block)
+		} else {
+			pem.Encode(&certs, block)
+		}
+	}
+	if certs.Len() < 1 || keys.Len() < 1 {
+		return nil, errors.New("the secret of the certificate has no certificate or no key")
+	}
+	ac.certRaw, ac.privateRaw = certs.String(), keys.String()
+	return ac, nil
+}
+
+// azureDo makes a request to Key Vault with a token of the managed identity,
+// or the other credentials of DefaultAzureCredential.
+func azureDo(ctx context.Context, method, rawURL string, in, out any) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	azureCredOnce.Do(func() {
+		azureCred, azureCredErr = azidentity.NewDefaultAzureCredential(nil)
+	})
+	if azureCredErr != nil {
+		return fmt.Errorf("loading Azure credentials: %w", azureCredErr)
+	}
+	// the scope of NAME.vault.azure.net is https://vault.azure.net
+	_, domain, _ := strings.Cut(u.Hostname(), ".")
+	token, err := azureCred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{"https://" + domain + "/.default"}})
+	if err != nil {
+		return err
+	}
+
+	q := u.Query()
+	q.Set("api-version", azureAPIVersion)
+	u.RawQuery = q.Encode()
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.Token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := azureClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&e)
+		return fmt.Errorf("%s %s: %s: %s %s", method, u.Path, resp.Status, e.Error.Code, e.Error.Message)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+// azureSigner signs with a key that stays in Key Vault.
+type azureSigner struct {
+	kid string // with the version
+	pub crypto.PublicKey
+}
+
+func (s *azureSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+func (s *azureSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	var bits string
+	switch opts.HashFunc() {
+	case crypto.SHA256:
+		bits = "256"
+	case crypto.SHA384:
+		bits = "384"
+	case crypto.SHA512:
+		bits = "512"
+	default:
+		return nil, fmt.Errorf("hash %v isn't supported by Key Vault", opts.HashFunc())
+	}
+	var alg string
+	switch s.pub.(type) {
+	case *rsa.PublicKey:
+		alg = "RS" + bits
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			alg = "PS" + bits
+		}
+	case *ecdsa.PublicKey:
+		alg = "ES" + bits
+	default:
+		return nil, fmt.Errorf("%T keys aren't supported", s.pub)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), azureTimeout)
+	defer cancel()
+	var out struct {
+		Value string `json:"value"`
+	}
+	in := map[string]string{"alg": alg, "value": base64.RawURLEncoding.EncodeToString(digest)}
+	if err := azureDo(ctx, http.MethodPost, s.kid+"/sign", in, &out); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(out.Value, "="))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s.pub.(*ecdsa.PublicKey); !ok {
+		return sig, nil
+	}
+	// Key Vault returns r and s concatenated, TLS wants them in ASN.1
+	half := len(sig) / 2
+	return asn1.Marshal(struct{ R, S *big.Int }{
+		new(big.Int).SetBytes(sig[:half]),
+		new(big.Int).SetBytes(sig[half:]),
+	})
+}
+
+// resolveAzure sets the listen and send certificates the profile reads from
+// Azure Key Vault.
+func (p *Profile) resolveAzure() error {
+	if !p.usesAzure() {
+		return nil
+	}
+	if len(p.AzureKeyVault) < 1 {
+		return errors.New("AzureKeyVault is required for Azure Key Vault certificates")
+	}
+	if len(p.ListenAzureCertificate) > 0 {
+		if len(p.ListenCertRaw) > 0 || len(p.ListenCertPath) > 0 || len(p.ListenP12Path) > 0 || len(p.ListenVaultRole) > 0 {
+			return errors.New("a listen Azure Key Vault certificate can't be combined with another listen certificate")
+		}
+		ac, err := azureCertificate(p.AzureKeyVault, p.ListenAzureCertificate, p.AzureRemoteKeys)
+		if err != nil {
+			return withCode(codeCertParse, fmt.Errorf("listen certificate from Azure Key Vault: %w", err))
+		}
+		p.ListenCertRaw, p.ListenPrivateRaw, p.listenSigner = ac.certRaw, ac.privateRaw, ac.signer
+	}
+	if len(p.SendAzureCertificate) > 0 {
+		if len(p.SendCertRaw) > 0 || len(p.SendCertPath) > 0 || len(p.SendP12Path) > 0 || len(p.SendVaultRole) > 0 {
+			return errors.New("a send Azure Key Vault certificate can't be combined with another send certificate")
+		}
+		ac, err := azureCertificate(p.AzureKeyVault, p.SendAzureCertificate, p.AzureRemoteKeys)
+		if err != nil {
+			return withCode(codeCertParse, fmt.Errorf("send certificate from Azure Key Vault: %w", err))
+		}
+		p.SendCertRaw, p.SendPrivateRaw, p.sendSigner = ac.certRaw, ac.privateRaw, ac.signer
+	}
+	return nil
+}
+
+// usesAzure reports if the profile has certificates in Azure Key Vault.
+func (p *Profile) usesAzure() bool {
+	return len(p.ListenAzureCertificate) > 0 || len(p.SendAzureCertificate) > 0
+}
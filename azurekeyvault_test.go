@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+type testAzureCred struct{}
+
+func (testAzureCred) GetToken(context.Context, policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+// testKeyVault serves the certificate web of Key Vault, its secret and
+// signing with its key. Every call to issue makes a new version.
+type testKeyVault struct {
+	mu      sync.Mutex
+	ca      *testCA
+	url     string
+	version int
+	certPEM string
+	keyPEM  string
+	signs   int
+	down    bool
+}
+
+func (kv *testKeyVault) issue(t *testing.T) {
+	t.Helper()
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.version++
+	kv.certPEM, kv.keyPEM = kv.ca.issue(t, "proxy")
+}
+
+func (kv *testKeyVault) serve(t *testing.T) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		kv.mu.Lock()
+		defer kv.mu.Unlock()
+		if kv.down || r.Header.Get("Authorization") != "Bearer token" || r.URL.Query().Get("api-version") != azureAPIVersion {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]any{"error": map[string]string{"code": "Forbidden", "message": "no access"}})
+			return
+		}
+		version := fmt.Sprintf("v%d", kv.version)
+		block, _ := pem.Decode([]byte(kv.certPEM))
+		switch {
+		case r.URL.Path == "/certificates/web":
+			json.NewEncoder(w).Encode(map[string]any{
+				"id":  kv.url + "/certificates/web/" + version,
+				"kid": kv.url + "/keys/web/" + version,
+				"sid": kv.url + "/secrets/web/" + version,
+				"cer": block.Bytes,
+			})
+		case r.URL.Path == "/secrets/web/"+version:
+			json.NewEncoder(w).Encode(map[string]string{"value": kv.keyPEM + kv.certPEM, "contentType": "application/x-pem-file"})
+		case r.URL.Path == "/keys/web/"+version+"/sign":
+			var in struct{ Alg, Value string }
+			json.NewDecoder(r.Body).Decode(&in)
+			digest, _ := base64.RawURLEncoding.DecodeString(in.Value)
+			pair, _ := tls.X509KeyPair([]byte(kv.certPEM), []byte(kv.keyPEM))
+			sr, ss, err := ecdsa.Sign(rand.Reader, pair.PrivateKey.(*ecdsa.PrivateKey), digest)
+			if err != nil || in.Alg != "ES256" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			kv.signs++
+			sig := append(sr.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+			json.NewEncoder(w).Encode(map[string]string{"value": base64.RawURLEncoding.EncodeToString(sig)})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]any{"error": map[string]string{"code": "NotFound", "message": r.URL.Path}})
+		}
+	}))
+	t.Cleanup(srv.Close)
+	kv.url = srv.URL
+	kv.issue(t)
+
+	azureCredOnce = sync.Once{}
+	azureCredOnce.Do(func() { azureCred, azureCredErr = testAzureCred{}, nil })
+	t.Cleanup(func() {
+		azureCredOnce = sync.Once{}
+		azureCertsMu.Lock()
+		defer azureCertsMu.Unlock()
+		azureCerts = make(map[string]*azureCert)
+	})
+}
+
+func TestInstanceAzureKeyVault(t *testing.T) {
+	ca := newTestCA(t)
+	kv := &testKeyVault{ca: ca}
+	kv.serve(t)
+
+	p := &Profile{Proxy: testBanner(t, "dest"), AzureKeyVault: kv.url, ListenAzureCertificate: "web", ListenAuthorityRaw: ca.pem}
+	inst := testInstance(t, p)
+	if got := banner(t, inst.ListenAddr(), ca.clientConfig(t, "client")); got != "dest\n" {
+		t.Errorf("got %q", got)
+	}
+
+	// the key stays in Key Vault, it signs the handshakes
+	remote := &Profile{Name: "remote", Proxy: testBanner(t, "dest"), AzureKeyVault: kv.url, ListenAzureCertificate: "web", AzureRemoteKeys: true, ListenAuthorityRaw: ca.pem}
+	inst = testInstance(t, remote)
+	if len(remote.ListenPrivateRaw) > 0 {
+		t.Error("remote key was read")
+	}
+	got := banner(t, inst.ListenAddr(), ca.clientConfig(t, "client"))
+	kv.mu.Lock()
+	signs := kv.signs
+	kv.mu.Unlock()
+	if got != "dest\n" || signs < 1 {
+		t.Errorf("got %q with %d signatures", got, signs)
+	}
+
+	// a version is only read once, a new one after the refresh
+	first, err := azureCertificate(kv.url, "web", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expireAzureCerts()
+	if ac, err := azureCertificate(kv.url, "web", false); err != nil || ac != first {
+		t.Errorf("got %v for the same version", err)
+	}
+	kv.issue(t)
+	expireAzureCerts()
+	second, err := azureCertificate(kv.url, "web", false)
+	if err != nil || second.version != "v2" || second.certRaw == first.certRaw {
+		t.Errorf("got %v for a new version", err)
+	}
+
+	// the last version is kept while Key Vault can't be reached
+	kv.mu.Lock()
+	kv.down = true
+	kv.mu.Unlock()
+	expireAzureCerts()
+	if ac, err := azureCertificate(kv.url, "web", false); err != nil || ac != second {
+		t.Errorf("got %v while Key Vault is down", err)
+	}
+	if _, err := azureCertificate(kv.url, "other", false); err == nil || !strings.Contains(err.Error(), "Forbidden") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestResolveAzureErrors(t *testing.T) {
+	for _, c := range []struct {
+		p    Profile
+		want string
+	}{
+		{Profile{ListenAzureCertificate: "web"}, "AzureKeyVault is required"},
+		{Profile{AzureKeyVault: "https://kv.vault.azure.net", ListenAzureCertificate: "web", ListenCertPath: "cert.pem"}, "can't be combined"},
+		{Profile{AzureKeyVault: "https://kv.vault.azure.net", SendAzureCertificate: "web", SendVaultRole: "web"}, "can't be combined"},
+	} {
+		if err := c.p.resolveAzure(); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%+v: got %v, want %q", c.p, err, c.want)
+		}
+	}
+	if err := (&Profile{}).resolveAzure(); err != nil {
+		t.Errorf("got %v without Azure", err)
+	}
+}
+
+func TestAzureFromEnvironment(t *testing.T) {
+	t.Setenv(EnvProfilePrefix+"WEB"+EnvAzureKeyVaultSuffix, "https://kv.vault.azure.net")
+	t.Setenv(EnvProfilePrefix+"WEB"+EnvListenAzureCertificateSuffix, "web")
+	t.Setenv(EnvProfilePrefix+"WEB"+EnvSendAzureCertificateSuffix, "client")
+	p := envProfile(t, "WEB")
+	if p.ListenAzureCertificate != "web" || p.SendAzureCertificate != "client" || len(p.ListenCertRaw) > 0 || len(p.SendCertRaw) > 0 {
+		t.Errorf("got %q and %q, raw %q and %q", p.ListenAzureCertificate, p.SendAzureCertificate, p.ListenCertRaw, p.SendCertRaw)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	BalanceRoundRobin       = "round-robin"
+	BalanceLeastConnections = "least-connections"
+	BalanceRandom           = "random"
+	BalanceFailover         = "failover"
+)
+
+// backendRetry is how long a destination that couldn't be reached is skipped
+// while others are available.
+const backendRetry = 10 * time.Second
+
+var (
+	backendActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mtlsproxy_backend_active_connections",
+		Help: "Connections currently open to each destination address.",
+	}, []string{"profile", "backend"})
+	backendConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mtlsproxy_backend_connections_total",
+		Help: "Connections made to each destination address.",
+	}, []string{"profile", "backend"})
+	backendFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mtlsproxy_backend_failures_total",
+		Help: "Failed attempts to connect to each destination address.",
+	}, []string{"profile", "backend"})
+)
+
+func init() {
+	prometheus.MustRegister(backendActive, backendConnections, backendFailures)
+}
+
+// balancer spreads connections over the destination addresses of a profile.
+type balancer struct {
+	ident    string
+	policy   string
+	backends []*backend
+	next     atomic.Uint64
+}
+
+type backend struct {
+	addr      string
+	active    atomic.Int64
+	downUntil atomic.Int64 // unix nanoseconds
+	unhealthy atomic.Bool  // failing health checks
+}
+
+func newBalancer(ident, policy string, addrs []string) *balancer {
+	b := &balancer{ident: ident, policy: policy}
+	for _, a := range addrs {
+		b.backends = append(b.backends, &backend{addr: a})
+	}
+	return b
+}
+
+// order lists the backends in the order they should be tried, the ones that
+// recently failed or fail their health checks go last.
+func (b *balancer) order() []*backend {
+	n := len(b.backends)
+	var start int
+	switch b.policy {
+	case BalanceFailover:
+		start = 0 // always the first address that is up, in the listed order
+	case BalanceRandom:
+		start = rand.Intn(n)
+	case BalanceLeastConnections:
+		// start at the least busy, ties broken round-robin
+		offset := int(b.next.Add(1) % uint64(n))
+		start = offset
+		for i := 1; i < n; i++ {
+			j := (offset + i) % n
+			if b.backends[j].active.Load() < b.backends[start].active.Load() {
+				start = j
+			}
+		}
+	default:
+		start = int(b.next.Add(1) % uint64(n))
+	}
+
+	now := time.Now().UnixNano()
+	healthy := make([]*backend, 0, n)
+	var down []*backend
+	for i := 0; i < n; i++ {
+		be := b.backends[(start+i)%n]
+		if be.downUntil.Load() > now || be.unhealthy.Load() {
+			down = append(down, be)
+		} else {
+			healthy = append(healthy, be)
+		}
+	}
+	return append(healthy, down...)
+}
+
+// down tells if every backend recently failed or fails its health checks.
+func (b *balancer) down() bool {
+	now := time.Now().UnixNano()
+	for _, be := range b.backends {
+		if be.downUntil.Load() <= now && !be.unhealthy.Load() {
+			return false
+		}
+	}
+	return true
+}
+
+// connect dials the backends in order until one answers.
+func (b *balancer) connect(dial func(string) (net.Conn, error)) (net.Conn, error) {
+	var err error
+	for _, be := range b.order() {
+		var c net.Conn
+		c, err = dial(be.addr)
+		if err != nil {
+			be.downUntil.Store(time.Now().Add(backendRetry).UnixNano())
+			backendFailures.WithLabelValues(b.ident, be.addr).Inc()
+			slog.Warn("destination unreachable", "profile", b.ident, "destination", be.addr, "err", err)
+			continue
+		}
+		be.downUntil.Store(0)
+		be.active.Add(1)
+		backendActive.WithLabelValues(b.ident, be.addr).Inc()
+		backendConnections.WithLabelValues(b.ident, be.addr).Inc()
+		return &backendConn{Conn: c, b: b, be: be}, nil
+	}
+	return nil, err
+}
+
+// backendConn gives back the backend's connection slot when closed.
+type backendConn struct {
+	net.Conn
+	b     *balancer
+	be    *backend
+	close sync.Once
+}
+
+func (c *backendConn) Close() error {
+	c.close.Do(func() {
+		c.be.active.Add(-1)
+		backendActive.WithLabelValues(c.b.ident, c.be.addr).Dec()
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func addrs(bes []*backend) []string {
+	var s []string
+	for _, be := range bes {
+		s = append(s, be.addr)
+	}
+	return s
+}
+
+// pipeDial connects to any address with an in-memory pipe, failing the
+// addresses listed in down.
+func pipeDial(down ...string) func(string) (net.Conn, error) {
+	return func(addr string) (net.Conn, error) {
+		for _, d := range down {
+			if d == addr {
+				return nil, errors.New("connection refused")
+			}
+		}
+		c, _ := net.Pipe()
+		return c, nil
+	}
+}
+
+func TestBalancerRoundRobin(t *testing.T) {
+	b := newBalancer("test", BalanceRoundRobin, []string{"a", "b", "c"})
+	seen := make(map[string]int)
+	for i := 0; i < 6; i++ {
+		seen[b.order()[0].addr]++
+	}
+	if seen["a"] != 2 || seen["b"] != 2 || seen["c"] != 2 {
+		t.Errorf("started at %v, want each twice", seen)
+	}
+}
+
+func TestBalancerLeastConnections(t *testing.T) {
+	b := newBalancer("test", BalanceLeastConnections, []string{"a", "b"})
+	first, err := b.connect(pipeDial())
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy := first.(*backendConn).be.addr
+	for i := 0; i < 3; i++ {
+		c, err := b.connect(pipeDial())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.(*backendConn).be.addr; got == busy {
+			t.Errorf("connection %d went to the busy %s", i, got)
+		}
+		c.Close()
+	}
+	first.Close()
+	first.Close()
+	if n := b.backends[0].active.Load() + b.backends[1].active.Load(); n != 0 {
+		t.Errorf("%d connections still counted after closing", n)
+	}
+}
+
+func TestBalancerSkipsDown(t *testing.T) {
+	b := newBalancer("test", BalanceRoundRobin, []string{"a", "b"})
+	for i := 0; i < 4; i++ {
+		c, err := b.connect(pipeDial("a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.(*backendConn).be.addr; got != "b" {
+			t.Errorf("connection %d went to %s", i, got)
+		}
+		c.Close()
+	}
+	if got := addrs(b.order()); got[1] != "a" {
+		t.Errorf("unreachable destination not tried last: %v", got)
+	}
+	if b.down() {
+		t.Error("down with a destination reachable")
+	}
+	if _, err := b.connect(pipeDial("a", "b")); err == nil {
+		t.Error("connected with every destination down")
+	}
+	if !b.down() {
+		t.Error("not down with every destination unreachable")
+	}
+}
+
+func TestInstanceBalance(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: testBanner(t, "a") + "," + testBanner(t, "b")})
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		seen[readsBanner(t, inst.ListenAddr())] = true
+	}
+	if !seen["a\n"] || !seen["b\n"] {
+		t.Errorf("reached %v, want both destinations", seen)
+	}
+}
+
+func TestResolveBalance(t *testing.T) {
+	p := &Profile{Name: "test", Listen: ":0", Proxy: "127.0.0.1:1,127.0.0.1:2", Balance: "weighted"}
+	if err := p.Resolve(); err == nil {
+		t.Error("resolved an unknown balance policy")
+	}
+}
+
+func TestBalancerFailover(t *testing.T) {
+	b := newBalancer("test", BalanceFailover, []string{"primary", "secondary", "tertiary"})
+	for i := 0; i < 3; i++ {
+		if got := addrs(b.order()); got[0] != "primary" || got[1] != "secondary" {
+			t.Fatalf("order %v, want the listed one", got)
+		}
+	}
+	c, err := b.connect(pipeDial("primary"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.(*backendConn).be.addr; got != "secondary" {
+		t.Errorf("fell back to %s", got)
+	}
+	if got := addrs(b.order()); got[0] != "secondary" || got[1] != "tertiary" || got[2] != "primary" {
+		t.Errorf("order %v with the primary down", got)
+	}
+
+	// back to the primary once it answers again
+	b.backends[0].downUntil.Store(0)
+	if got := b.order()[0].addr; got != "primary" {
+		t.Errorf("started at %s with the primary up", got)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults of captures started without limits.
+const (
+	defaultCaptureBytes    = 10 << 20
+	defaultCaptureDuration = time.Minute
+)
+
+const (
+	pcapLinkRaw   = 101 // packets start with their IP header
+	maxCaptureSeg = 65000
+)
+
+// connCapture writes what a connection reads from the client and from the
+// destination to a pcap file, decrypted when the proxy terminates TLS. The
+// data is framed as TCP segments, or UDP datagrams, between the client and
+// destination addresses so tools can follow the stream.
+type connCapture struct {
+	mu      sync.Mutex
+	f       *os.File
+	path    string
+	written int64
+	max     int64
+	udp     bool
+	client  captureEnd
+	backend captureEnd
+	seq     [2]uint32 // next sequence number of the client and the destination
+	timer   *time.Timer
+	done    bool
+	lg      *slog.Logger
+}
+
+type captureEnd struct {
+	ip   net.IP
+	port uint16
+}
+
+// captureEndpoint makes an address fit in an IP header, addresses that
+// aren't IP ones like unix sockets get a loopback one.
+func captureEndpoint(addr string, fallback byte) captureEnd {
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			p, _ := strconv.ParseUint(port, 10, 16)
+			return captureEnd{ip: ip, port: uint16(p)}
+		}
+	}
+	return captureEnd{ip: net.IPv4(127, 0, 0, fallback), port: uint16(fallback)}
+}
+
+// startCapture starts capturing the connection to a file in dir, until
+// either limit is reached, the connection closes or it is stopped.
+func (lc *liveConn) startCapture(dir, profile string, maxBytes int64, d time.Duration) (string, error) {
+	name := strings.Map(func(r rune) rune {
+		if r == '$' || r == '#' || r == '/' || r == ':' {
+			return '_'
+		}
+		return r
+	}, lc.ident)
+	stamp := time.Now().UTC().Format("20060102T150405.000")
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.pcap", name, stamp))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	// a capture started again within the same millisecond gets a number
+	for i := 2; errors.Is(err, os.ErrExist) && i < 100; i++ {
+		path = filepath.Join(dir, fmt.Sprintf("%s-%s-%d.pcap", name, stamp, i))
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	if err != nil {
+		return "", err
+	}
+	cp := &connCapture{
+		f:       f,
+		path:    path,
+		max:     maxBytes,
+		udp:     lc.packet,
+		client:  captureEndpoint(lc.client, 1),
+		backend: captureEndpoint(lc.backend, 2),
+		lg:      slog.With("profile", profile, "conn", lc.ident, "file", path),
+	}
+	if err := cp.header(); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if !lc.capture.CompareAndSwap(nil, cp) {
+		f.Close()
+		os.Remove(path)
+		return "", errors.New("already capturing")
+	}
+	cp.mu.Lock()
+	cp.timer = time.AfterFunc(d, func() { lc.stopCapture(cp, "time limit") })
+	cp.mu.Unlock()
+	cp.lg.Info("capture started", "max_bytes", maxBytes, "duration", d)
+	return path, nil
+}
+
+// stopCapture stops the capture cp of the connection, or any when nil.
+func (lc *liveConn) stopCapture(cp *connCapture, reason string) bool {
+	if cp == nil {
+		cp = lc.capture.Load()
+	}
+	if cp == nil || !lc.capture.CompareAndSwap(cp, nil) {
+		return false
+	}
+	cp.close(reason)
+	return true
+}
+
+// captureRead writes what was read from the client or the destination.
+func (lc *liveConn) captureRead(fromClient bool, b []byte) {
+	cp := lc.capture.Load()
+	if cp == nil {
+		return
+	}
+	if !cp.write(fromClient, b) {
+		lc.stopCapture(cp, "size limit")
+	}
+}
+
+// header writes the pcap file header and, for TCP, a handshake so the stream
+// starts at sequence number 1.
+func (cp *connCapture) header() error {
+	var h [24]byte
+	binary.LittleEndian.PutUint32(h[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(h[4:], 2)
+	binary.LittleEndian.PutUint16(h[6:], 4)
+	binary.LittleEndian.PutUint32(h[16:], 262144)
+	binary.LittleEndian.PutUint32(h[20:], pcapLinkRaw)
+	if _, err := cp.f.Write(h[:]); err != nil {
+		return err
+	}
+	if cp.udp {
+		return nil
+	}
+	const syn, ack = 0x02, 0x10
+	now := time.Now()
+	for _, p := range []struct {
+		fromClient bool
+		flags      byte
+	}{{true, syn}, {false, syn | ack}, {true, ack}} {
+		if err := cp.packet(now, p.fromClient, p.flags, nil); err != nil {
+			return err
+		}
+		if p.flags&syn != 0 {
+			cp.seq[side(p.fromClient)]++
+		}
+	}
+	return nil
+}
+
+func side(fromClient bool) int {
+	if fromClient {
+		return 0
+	}
+	return 1
+}
+
+// write adds b to the capture, false once the size limit is reached.
+func (cp *connCapture) write(fromClient bool, b []byte) bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.done {
+		return true
+	}
+	now := time.Now()
+	for len(b) > 0 {
+		seg := b[:min(len(b), maxCaptureSeg)]
+		if cp.written+int64(len(seg)) > cp.max {
+			return false
+		}
+		const psh, ack = 0x08, 0x10
+		if err := cp.packet(now, fromClient, psh|ack, seg); err != nil {
+			cp.lg.Error("error writing capture", "err", err)
+			cp.done = true
+			return true
+		}
+		cp.written += int64(len(seg))
+		cp.seq[side(fromClient)] += uint32(len(seg))
+		b = b[len(seg):]
+	}
+	return true
+}
+
+// packet writes a pcap record with an IP packet carrying the payload.
+func (cp *connCapture) packet(at time.Time, fromClient bool, flags byte, payload []byte) error {
+	src, dst := cp.client, cp.backend
+	if !fromClient {
+		src, dst = dst, src
+	}
+	var l4 []byte
+	proto := byte(6)
+	if cp.udp {
+		proto = 17
+		l4 = make([]byte, 8, 8+len(payload))
+		binary.BigEndian.PutUint16(l4[0:], src.port)
+		binary.BigEndian.PutUint16(l4[2:], dst.port)
+		binary.BigEndian.PutUint16(l4[4:], uint16(8+len(payload)))
+	} else {
+		l4 = make([]byte, 20, 20+len(payload))
+		binary.BigEndian.PutUint16(l4[0:], src.port)
+		binary.BigEndian.PutUint16(l4[2:], dst.port)
+		binary.BigEndian.PutUint32(l4[4:], cp.seq[side(fromClient)])
+		if flags&0x10 != 0 {
+			binary.BigEndian.PutUint32(l4[8:], cp.seq[side(!fromClient)])
+		}
+		l4[12] = 5 << 4
+		l4[13] = flags
+		binary.BigEndian.PutUint16(l4[14:], 65535)
+	}
+	// checksums are left zero, they aren't checked by default
+	l4 = append(l4, payload...)
+
+	var ip []byte
+	if s4, d4 := src.ip.To4(), dst.ip.To4(); s4 != nil && d4 != nil {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(l4)))
+		ip[6] = 0x40 // don't fragment
+		ip[8] = 64
+		ip[9] = proto
+		copy(ip[12:], s4)
+		copy(ip[16:], d4)
+		binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip))
+	} else {
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(l4)))
+		ip[6] = proto
+		ip[7] = 64
+		copy(ip[8:], src.ip.To16())
+		copy(ip[24:], dst.ip.To16())
+	}
+
+	var rec [16]byte
+	binary.LittleEndian.PutUint32(rec[0:], uint32(at.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(at.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(ip)+len(l4)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(ip)+len(l4)))
+	if _, err := cp.f.Write(rec[:]); err != nil {
+		return err
+	}
+	if _, err := cp.f.Write(ip); err != nil {
+		return err
+	}
+	_, err := cp.f.Write(l4)
+	return err
+}
+
+func ipChecksum(h []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(h); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(h[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func (cp *connCapture) close(reason string) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.timer != nil {
+		cp.timer.Stop()
+	}
+	cp.done = true
+	if err := cp.f.Close(); err != nil {
+		cp.lg.Error("error closing capture", "err", err)
+	}
+	cp.lg.Info("capture finished", "bytes", cp.written, "reason", reason)
+}
+
+// CaptureConnection starts capturing a connection to a file in dir and
+// returns its path.
+func (inst *Instance) CaptureConnection(ident, dir string, maxBytes int64, d time.Duration) (string, error) {
+	inst.connsMu.Lock()
+	lc, ok := inst.conns[ident]
+	inst.connsMu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("no connection %s", ident)
+	}
+	return lc.startCapture(dir, inst.ident, maxBytes, d)
+}
+
+// StopCapture stops capturing a connection, false when it wasn't.
+func (inst *Instance) StopCapture(ident string) bool {
+	inst.connsMu.Lock()
+	lc, ok := inst.conns[ident]
+	inst.connsMu.Unlock()
+	return ok && lc.stopCapture(nil, "stopped through the admin server")
+}
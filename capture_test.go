@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// capturedSegment is a TCP segment read back from a capture.
+type capturedSegment struct {
+	srcPort uint16
+	payload string
+}
+
+func readCapture(t *testing.T, path string) []capturedSegment {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < 24 || binary.LittleEndian.Uint32(b) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(b[20:]) != pcapLinkRaw {
+		t.Fatalf("not a pcap file of raw IP packets: %x", b[:min(len(b), 24)])
+	}
+	var segs []capturedSegment
+	for b = b[24:]; len(b) >= 16; {
+		n := int(binary.LittleEndian.Uint32(b[8:]))
+		pkt := b[16 : 16+n]
+		b = b[16+n:]
+		if pkt[0] != 0x45 || pkt[9] != 6 {
+			t.Fatalf("not an IPv4 TCP packet: %x", pkt)
+		}
+		tcp := pkt[20:]
+		segs = append(segs, capturedSegment{srcPort: binary.BigEndian.Uint16(tcp), payload: string(tcp[20:])})
+	}
+	return segs
+}
+
+func TestInstanceCapture(t *testing.T) {
+	echo := testEcho(t)
+	inst := testInstance(t, &Profile{Proxy: echo})
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c) {
+		t.Fatal("no echo")
+	}
+	ident := inst.Connections()[0].ident
+	path := "/profiles/test/connections/" + ident + "/capture"
+
+	if w := adminDo(&Supervisor{c: &Configurations{}, insts: []*Instance{inst}}, http.MethodPost, path, ""); w.Code != http.StatusConflict {
+		t.Errorf("captured without a directory: %d", w.Code)
+	}
+	s := &Supervisor{c: &Configurations{CaptureDir: t.TempDir()}, insts: []*Instance{inst}}
+	w := adminDo(s, http.MethodPost, path, "")
+	var started map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &started); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	if w := adminDo(s, http.MethodPost, path, ""); w.Code != http.StatusConflict {
+		t.Errorf("second capture of the connection: %d", w.Code)
+	}
+	if !echoes(c) {
+		t.Fatal("no echo while capturing")
+	}
+	if w := adminDo(s, http.MethodDelete, path, ""); w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	echoes(c)
+
+	// after the handshake, what the client sent and what came back
+	segs := readCapture(t, started["file"])
+	clientPort := uint16(c.LocalAddr().(*net.TCPAddr).Port)
+	if len(segs) != 5 || segs[0].srcPort != clientPort || segs[3] != (capturedSegment{clientPort, "ping\n"}) || segs[4].srcPort == clientPort || segs[4].payload != "ping\n" {
+		t.Errorf("captured %+v", segs)
+	}
+
+	// over the size limit the capture stops by itself
+	w = adminDo(s, http.MethodPost, path, `{"max_bytes": 3}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &started); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("got %d %s", w.Code, w.Body)
+	}
+	echoes(c)
+	if w := adminDo(s, http.MethodDelete, path, ""); w.Code != http.StatusNotFound {
+		t.Errorf("capture over its limit still running: %d", w.Code)
+	}
+	if segs := readCapture(t, started["file"]); len(segs) != 3 {
+		t.Errorf("captured %+v over the limit", segs)
+	}
+
+	for _, body := range []string{`{"max_bytes": 0}`, `{"duration": "soon"}`, `{`} {
+		if w := adminDo(s, http.MethodPost, path, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d", body, w.Code)
+		}
+	}
+}
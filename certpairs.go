@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CertPair is an additional listen certificate, served to clients whose
+// server name (SNI) it matches.
+type CertPair struct {
+	CertPath    string
+	CertRaw     string
+	PrivatePath string
+	PrivateRaw  string
+}
+
+// parseCertPairs reads certificate pairs in the env format: cert=key,cert=key
+func parseCertPairs(s string) ([]*CertPair, error) {
+	var pairs []*CertPair
+	for _, x := range strings.Split(s, ",") {
+		x = strings.TrimSpace(x)
+		if len(x) < 1 {
+			continue
+		}
+		cert, key, ok := strings.Cut(x, "=")
+		if !ok || len(cert) < 1 || len(key) < 1 {
+			return nil, fmt.Errorf("invalid certificate pair %q, expected cert=key", x)
+		}
+		pairs = append(pairs, &CertPair{CertPath: cert, PrivatePath: key})
+	}
+	return pairs, nil
+}
+
+func copyCertPairs(pairs []*CertPair) []*CertPair {
+	if pairs == nil {
+		return nil
+	}
+	nu := make([]*CertPair, len(pairs))
+	for i, cp := range pairs {
+		c := *cp
+		nu[i] = &c
+	}
+	return nu
+}
+
+func certPairsEqual(a, b []*CertPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].CertRaw != b[i].CertRaw || a[i].PrivateRaw != b[i].PrivateRaw {
+			return false
+		}
+	}
+	return true
+}
+
+// resolve will load any files for the pair that are pending
+func (cp *CertPair) resolve() error {
+	if err := readPending(&cp.CertRaw, cp.CertPath); err != nil {
+		return err
+	}
+	if err := readPending(&cp.PrivateRaw, cp.PrivatePath); err != nil {
+		return err
+	}
+	if len(cp.CertRaw) < 1 || len(cp.PrivateRaw) < 1 {
+		return fmt.Errorf("a certificate and private key are required")
+	}
+	return nil
+}
+
+// selectCertificate returns a GetCertificate func serving the first
+// certificate the client supports, which checks the server name (SNI) against
+// the certificate's names. Until the overlap ends, previous certificates are
+// tried next. The first certificate is the fallback. When there are staplers,
+// they serve the certificates of the same index.
+func selectCertificate(certs []tls.Certificate, staplers []*ocspStapler, previous []tls.Certificate, until time.Time) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	serve := func(hello *tls.ClientHelloInfo, i int) (*tls.Certificate, error) {
+		if len(staplers) > 0 {
+			return staplers[i].getCertificate(hello)
+		}
+		return &certs[i], nil
+	}
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		for i := range certs {
+			if hello.SupportsCertificate(&certs[i]) == nil {
+				return serve(hello, i)
+			}
+		}
+		if time.Now().Before(until) {
+			for i := range previous {
+				if hello.SupportsCertificate(&previous[i]) == nil {
+					return &previous[i], nil
+				}
+			}
+		}
+		return serve(hello, 0)
+	}
+}
+
+// sameCertificates reports if both have the same leaf certificates.
+func sameCertificates(a, b []tls.Certificate) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i].Certificate) < 1 || len(b[i].Certificate) < 1 || !bytes.Equal(a[i].Certificate[0], b[i].Certificate[0]) {
+			return false
+		}
+	}
+	return true
+}
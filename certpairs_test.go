@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestParseCertPairs(t *testing.T) {
+	pairs, err := parseCertPairs(" a.pem=a.key, b.pem=b.key,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pairs) != 2 || pairs[0].CertPath != "a.pem" || pairs[1].PrivatePath != "b.key" {
+		t.Errorf("got %+v", pairs)
+	}
+	for _, s := range []string{"a.pem", "a.pem=", "=a.key"} {
+		if _, err := parseCertPairs(s); err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+}
+
+func TestListenCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	api, apiKey := ca.issueFor(t, "api", "api.example.test")
+	www, wwwKey := ca.issueFor(t, "www", "www.example.test")
+	p := &Profile{Proxy: testEcho(t), ListenCertificates: []*CertPair{{CertRaw: api, PrivateRaw: apiKey}, {CertRaw: www, PrivateRaw: wwwKey}}}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+
+	for _, c := range []struct{ name, want string }{
+		{"api.example.test", "api"},
+		{"www.example.test", "www"},
+		{"localhost", "proxy"},
+	} {
+		tlsconf := ca.clientConfig(t, "client")
+		tlsconf.ServerName = c.name
+		if got := servedCN(t, inst.ListenAddr(), tlsconf); got != c.want {
+			t.Errorf("%s was served %q, want %q", c.name, got, c.want)
+		}
+	}
+
+	// a client without SNI gets the first certificate
+	tlsconf := ca.clientConfig(t, "client")
+	tlsconf.ServerName, tlsconf.InsecureSkipVerify = "", true
+	if got := servedCN(t, inst.ListenAddr(), tlsconf); got != "proxy" {
+		t.Errorf("without a server name was served %q", got)
+	}
+
+	bad := &Profile{Name: "test", Listen: ":0", Proxy: "127.0.0.1:1", ListenCertificates: []*CertPair{{CertRaw: api}}}
+	if err := bad.Resolve(); err == nil {
+		t.Error("resolved a certificate without its key")
+	}
+}
+
+func testKeyPair(t *testing.T, ca *testCA, cn string, names ...string) tls.Certificate {
+	t.Helper()
+	certPEM, keyPEM := ca.issueFor(t, cn, names...)
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestSelectCertificateOverlap(t *testing.T) {
+	ca := newTestCA(t)
+	nu := []tls.Certificate{testKeyPair(t, ca, "new", "new.example.test")}
+	old := []tls.Certificate{testKeyPair(t, ca, "old", "old.example.test")}
+	hello := func(name string) *tls.ClientHelloInfo {
+		return &tls.ClientHelloInfo{ServerName: name, SupportedVersions: []uint16{tls.VersionTLS13}, SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256}}
+	}
+	for _, c := range []struct {
+		name  string
+		until time.Time
+		want  string
+	}{
+		{"new.example.test", time.Now().Add(time.Hour), "new"},
+		{"old.example.test", time.Now().Add(time.Hour), "old"},
+		{"old.example.test", time.Now().Add(-time.Second), "new"},
+		{"other.example.test", time.Now().Add(time.Hour), "new"},
+	} {
+		cert, err := selectCertificate(nu, nil, old, c.until)(hello(c.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cn := cert.Leaf.Subject.CommonName; cn != c.want {
+			t.Errorf("%s until %s was served %q, want %q", c.name, c.until.Format(time.TimeOnly), cn, c.want)
+		}
+	}
+}
+
+func TestRotateCerts(t *testing.T) {
+	ca := newTestCA(t)
+	a := []tls.Certificate{testKeyPair(t, ca, "a", "localhost")}
+	b := []tls.Certificate{testKeyPair(t, ca, "b", "localhost")}
+	inst := &Instance{}
+	inst.rotateCerts(a, time.Hour)
+	if len(inst.prevCerts) > 0 {
+		t.Error("previous certificates without a replacement")
+	}
+	inst.rotateCerts(a, time.Hour)
+	if len(inst.prevCerts) > 0 {
+		t.Error("the same certificates replaced themselves")
+	}
+	inst.rotateCerts(b, time.Hour)
+	if !sameCertificates(inst.prevCerts, a) || time.Until(inst.prevUntil) < 59*time.Minute {
+		t.Errorf("replaced certificates kept until %s", inst.prevUntil)
+	}
+	inst.rotateCerts(a, 0)
+	if len(inst.prevCerts) > 0 || !inst.prevUntil.IsZero() {
+		t.Error("previous certificates kept without an overlap")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// certDebounce is how long the watcher waits for writes to settle before
+// refreshing, cert rotation usually touches the cert and key separately.
+const certDebounce = 500 * time.Millisecond
+
+// certWatcher watches the directories holding the files of the running
+// profiles and reports batches of changed files. Directories are watched
+// instead of the files so atomic renames and Kubernetes style symlink swaps
+// (the "..data" link) are seen.
+type certWatcher struct {
+	w       *fsnotify.Watcher
+	changes chan map[string]bool
+	mu      sync.Mutex // guards paths and dirs
+	paths   map[string]bool
+	dirs    map[string]bool
+}
+
+func newCertWatcher() (*certWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	cw := &certWatcher{
+		w:       w,
+		changes: make(chan map[string]bool),
+		paths:   make(map[string]bool),
+		dirs:    make(map[string]bool),
+	}
+	go cw.run()
+	return cw, nil
+}
+
+// watch replaces the set of watched files.
+func (cw *certWatcher) watch(paths []string) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	cw.paths = make(map[string]bool, len(paths))
+	dirs := make(map[string]bool)
+	for _, p := range paths {
+		p = filepath.Clean(p)
+		cw.paths[p] = true
+		dirs[filepath.Dir(p)] = true
+	}
+
+	for d := range cw.dirs {
+		if !dirs[d] {
+			cw.w.Remove(d)
+			delete(cw.dirs, d)
+		}
+	}
+	for d := range dirs {
+		if cw.dirs[d] {
+			continue
+		}
+		if err := cw.w.Add(d); err != nil {
+			slog.Error("error watching directory", "dir", d, "err", err)
+			continue
+		}
+		cw.dirs[d] = true
+	}
+}
+
+func (cw *certWatcher) run() {
+	pending := make(map[string]bool)
+	timer := time.NewTimer(certDebounce)
+	timer.Stop()
+
+	for {
+		select {
+		case e, ok := <-cw.w.Events:
+			if !ok {
+				return
+			}
+			if matched := cw.match(e.Name); len(matched) > 0 {
+				for _, p := range matched {
+					pending[p] = true
+				}
+				timer.Reset(certDebounce)
+			}
+		case err, ok := <-cw.w.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("error watching files", "err", err)
+		case <-timer.C:
+			cw.changes <- pending
+			pending = make(map[string]bool)
+		}
+	}
+}
+
+// match returns the watched files affected by an event on name.
+func (cw *certWatcher) match(name string) []string {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if cw.paths[name] {
+		return []string{name}
+	}
+
+	// a swapped ..data symlink changes every file in the directory
+	if !strings.HasPrefix(filepath.Base(name), "..") {
+		return nil
+	}
+	var matched []string
+	dir := filepath.Dir(name)
+	for p := range cw.paths {
+		if filepath.Dir(p) == dir {
+			matched = append(matched, p)
+		}
+	}
+	return matched
+}
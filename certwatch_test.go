@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCertWatcherMatch(t *testing.T) {
+	cw := &certWatcher{paths: map[string]bool{"/d/cert.pem": true, "/d/key.pem": true, "/e/ca.pem": true}}
+	for _, c := range []struct {
+		name string
+		want []string
+	}{
+		{"/d/cert.pem", []string{"/d/cert.pem"}},
+		{"/d/./key.pem", []string{"/d/key.pem"}},
+		{"/d/..data", []string{"/d/cert.pem", "/d/key.pem"}},
+		{"/d/other.pem", nil},
+		{"/f/..data", nil},
+	} {
+		got := cw.match(c.name)
+		slices.Sort(got)
+		if !slices.Equal(got, c.want) {
+			t.Errorf("%s matched %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// nextChange waits for the watcher to report a batch, nil when none came.
+func nextChange(cw *certWatcher, wait time.Duration) map[string]bool {
+	select {
+	case changed := <-cw.changes:
+		return changed
+	case <-time.After(wait):
+		return nil
+	}
+}
+
+func TestCertWatcher(t *testing.T) {
+	cw, err := newCertWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cw.w.Close()
+	dir := t.TempDir()
+	cert, key := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for _, p := range []string{cert, key} {
+		if err := os.WriteFile(p, []byte("old"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cw.watch([]string{cert, key})
+
+	// both files written in a row come as one batch
+	os.WriteFile(cert, []byte("new"), 0600)
+	os.WriteFile(key, []byte("new"), 0600)
+	if changed := nextChange(cw, 5*time.Second); !changed[cert] || !changed[key] {
+		t.Errorf("got %v, want both files", changed)
+	}
+
+	os.WriteFile(filepath.Join(dir, "unrelated"), []byte("x"), 0600)
+	if changed := nextChange(cw, 2*certDebounce); changed != nil {
+		t.Errorf("unwatched file reported as %v", changed)
+	}
+
+	cw.watch([]string{key})
+	os.WriteFile(cert, []byte("newer"), 0600)
+	if changed := nextChange(cw, 2*certDebounce); changed != nil {
+		t.Errorf("file no longer watched reported as %v", changed)
+	}
+}
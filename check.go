@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// checkReport collects what `mtlsproxy check` finds, one line per check.
+type checkReport struct {
+	w        io.Writer
+	problems int
+	warnings int
+}
+
+func (r *checkReport) ok(format string, args ...any) {
+	fmt.Fprintf(r.w, "  ok    "+format+"\n", args...)
+}
+
+func (r *checkReport) warn(format string, args ...any) {
+	r.warnings++
+	fmt.Fprintf(r.w, "  warn  "+format+"\n", args...)
+}
+
+func (r *checkReport) fail(what string, err error) {
+	r.problems++
+	fmt.Fprintf(r.w, "  FAIL  %s: %v\n", what, err)
+}
+
+// checkedListen is where a profile would listen, to find profiles that can't
+// listen together.
+type checkedListen struct {
+	profile string
+	family  string // tcp, udp or unix
+	host    string // the socket path for unix
+	port    string
+}
+
+// conflicts reports if both can't be bound at the same time, a wildcard host
+// takes the port of every address.
+func (l checkedListen) conflicts(o checkedListen) bool {
+	if l.family != o.family {
+		return false
+	}
+	if l.family == "unix" {
+		return l.host == o.host
+	}
+	if l.port != o.port || l.port == "0" {
+		return false
+	}
+	return l.host == o.host || wildcardHost(l.host) || wildcardHost(o.host)
+}
+
+func wildcardHost(host string) bool {
+	if len(host) < 1 {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// runCheck loads the configuration the way starting would, reads every file
+// and parses the certificates and keys without binding any sockets. It writes
+// a report to w and returns the exit status.
+func runCheck(c *Configurations, w io.Writer) int {
+	layers, err := c.configLayers()
+	if err != nil {
+		fmt.Fprintf(w, "FAIL  reading configuration: %v\n", err)
+		return 1
+	}
+	r := &checkReport{w: w}
+	var header bool
+	for _, l := range layers {
+		if l.err == nil && len(l.unknown) < 1 {
+			continue
+		}
+		if !header {
+			fmt.Fprintln(w, "configuration files")
+			header = true
+		}
+		if l.err != nil {
+			r.fail(l.source, l.err)
+		}
+		for _, u := range l.unknown {
+			if c.Strict {
+				r.fail(u.where, errors.New(u.what))
+			} else {
+				r.warn("%s: %s", u.where, u.what)
+			}
+		}
+	}
+	profiles := mergeLayers(layers)
+	if len(profiles) < 1 {
+		fmt.Fprintln(w, "FAIL  nothing to run, no profiles are configured")
+		return 1
+	}
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+
+	var listens []checkedListen
+	for _, p := range profiles {
+		source := p.Source
+		if len(source) < 1 {
+			source = "environment"
+		}
+		if !p.enabled() {
+			source += ", disabled"
+		}
+		fmt.Fprintf(w, "profile %s (%s)\n", p.Name, source)
+
+		l, err := checkListen(p)
+		if err != nil {
+			r.fail("listen address", err)
+		} else {
+			r.ok("listen %s %s", p.listenNetwork(), p.Listen)
+			// a disabled profile may share its address with the one replacing it
+			if p.enabled() {
+				listens = append(listens, l)
+			}
+		}
+		r.destinations(p)
+
+		if err := p.Resolve(); err != nil {
+			r.fail("reading files and options", err)
+			continue
+		}
+		r.ok("files and options read")
+		r.certificates(p)
+	}
+
+	fmt.Fprintln(w, "listen addresses")
+	var dup bool
+	for i := range listens {
+		for _, o := range listens[i+1:] {
+			if listens[i].conflicts(o) {
+				dup = true
+				r.fail("profiles "+listens[i].profile+" and "+o.profile, errors.New("listen on the same address"))
+			}
+		}
+	}
+	if !dup {
+		r.ok("no profiles listen on the same address")
+	}
+
+	if r.problems > 0 {
+		fmt.Fprintf(w, "%d problems, %d warnings in %d profiles\n", r.problems, r.warnings, len(profiles))
+		return 1
+	}
+	fmt.Fprintf(w, "configuration ok, %d warnings in %d profiles\n", r.warnings, len(profiles))
+	return 0
+}
+
+// checkListen parses the listen address of the profile.
+func checkListen(p *Profile) (checkedListen, error) {
+	l := checkedListen{profile: p.Name}
+	if len(p.Listen) < 1 {
+		return l, errors.New("there is no listen address")
+	}
+	network := p.listenNetwork()
+	if isUnix(network) {
+		l.family, l.host = "unix", p.Listen
+		if !strings.HasPrefix(p.Listen, "@") {
+			l.host = filepath.Clean(p.Listen)
+		}
+		return l, nil
+	}
+
+	l.family = "tcp"
+	if isPacket(network) || isQUIC(network) {
+		l.family = "udp"
+	}
+	var err error
+	if l.host, l.port, err = net.SplitHostPort(p.Listen); err != nil {
+		return l, err
+	}
+	port, err := net.LookupPort(l.family, l.port)
+	if err != nil {
+		return l, err
+	}
+	l.port = fmt.Sprint(port)
+	return l, nil
+}
+
+// destinations parses the destination addresses of the profile and its
+// routes.
+func (r *checkReport) destinations(p *Profile) {
+	if isUnix(p.sendNetwork()) {
+		return
+	}
+	addrs := sendAddrs(p)
+	if len(addrs) < 1 && len(p.Routes) < 1 {
+		r.fail("destination", errors.New("there is no destination address"))
+		return
+	}
+	for _, a := range addrs {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			r.fail("destination "+a, err)
+			return
+		}
+	}
+	r.ok("destinations %s", strings.Join(addrs, ","))
+}
+
+// certificates parses the certificates, keys and authorities of a resolved
+// profile and checks that every key belongs to its certificate.
+func (r *checkReport) certificates(p *Profile) {
+	now := time.Now()
+	pair := func(use, certRaw, privateRaw string, signer crypto.Signer) {
+		if len(certRaw) < 1 {
+			return
+		}
+		if _, err := keyPair(certRaw, privateRaw, signer); err != nil {
+			r.fail(use+" certificate", err)
+			return
+		}
+		r.chain(use+" certificate", certRaw, now)
+	}
+	authority := func(use, raw string) {
+		if len(raw) < 1 {
+			return
+		}
+		r.chain(use+" authority", raw, now)
+	}
+
+	switch {
+	case p.ListenSPIFFE:
+		r.ok("listen certificate from SPIFFE, not checked")
+	case len(p.ListenACMEDomains) > 0:
+		r.ok("listen certificate from ACME, not checked")
+	}
+	pair("listen", p.ListenCertRaw, p.ListenPrivateRaw, p.listenSigner)
+	for i, cp := range p.ListenCertificates {
+		pair(fmt.Sprintf("listen %d", i+1), cp.CertRaw, cp.PrivateRaw, nil)
+	}
+	authority("listen", p.ListenAuthorityRaw)
+
+	if p.SendSPIFFE {
+		r.ok("send certificate from SPIFFE, not checked")
+	} else {
+		pair("send", p.SendCertRaw, p.SendPrivateRaw, p.sendSigner)
+		authority("send", p.SendAuthorityRaw)
+	}
+
+	names := make([]string, 0, len(p.Routes))
+	for name := range p.Routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rt := p.Routes[name]
+		pair("route "+name+" send", rt.SendCertRaw, rt.SendPrivateRaw, nil)
+		authority("route "+name+" send", rt.SendAuthorityRaw)
+	}
+}
+
+// chain parses every certificate in raw, the first one is reported.
+func (r *checkReport) chain(what, raw string, now time.Time) {
+	certs, err := parseCertificates(raw)
+	if err != nil {
+		r.fail(what, err)
+		return
+	}
+	if len(certs) < 1 {
+		r.fail(what, errors.New("no certificates found"))
+		return
+	}
+	leaf := certs[0]
+	switch {
+	case now.After(leaf.NotAfter):
+		r.warn("%s %q expired %s", what, leaf.Subject.String(), leaf.NotAfter.Format(time.RFC3339))
+	case now.Before(leaf.NotBefore):
+		r.warn("%s %q isn't valid before %s", what, leaf.Subject.String(), leaf.NotBefore.Format(time.RFC3339))
+	default:
+		r.ok("%s %q, %d certificates, expires %s", what, leaf.Subject.String(), len(certs), leaf.NotAfter.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckedListenConflicts(t *testing.T) {
+	for _, c := range []struct {
+		a, b checkedListen
+		want bool
+	}{
+		{checkedListen{family: "tcp", host: "127.0.0.1", port: "443"}, checkedListen{family: "tcp", host: "127.0.0.1", port: "443"}, true},
+		{checkedListen{family: "tcp", host: "127.0.0.1", port: "443"}, checkedListen{family: "tcp", host: "127.0.0.2", port: "443"}, false},
+		{checkedListen{family: "tcp", host: "", port: "443"}, checkedListen{family: "tcp", host: "127.0.0.1", port: "443"}, true},
+		{checkedListen{family: "tcp", host: "::", port: "443"}, checkedListen{family: "tcp", host: "127.0.0.1", port: "443"}, true},
+		{checkedListen{family: "tcp", host: "127.0.0.1", port: "443"}, checkedListen{family: "udp", host: "127.0.0.1", port: "443"}, false},
+		{checkedListen{family: "tcp", host: "127.0.0.1", port: "0"}, checkedListen{family: "tcp", host: "127.0.0.1", port: "0"}, false},
+		{checkedListen{family: "unix", host: "/run/a.sock"}, checkedListen{family: "unix", host: "/run/a.sock"}, true},
+	} {
+		if got := c.a.conflicts(c.b); got != c.want {
+			t.Errorf("%+v and %+v: got %v", c.a, c.b, got)
+		}
+	}
+}
+
+// check runs the check on c, returning its status and report.
+func check(c *Configurations) (int, string) {
+	var w strings.Builder
+	status := runCheck(c, &w)
+	return status, w.String()
+}
+
+func TestRunCheck(t *testing.T) {
+	ca := newTestCA(t)
+	a := &Profile{Name: "a", Listen: "127.0.0.1:8443", Proxy: "10.0.0.1:443"}
+	ca.listenTLS(t, a)
+	status, report := check(&Configurations{Profiles: []*Profile{a}})
+	if status != 0 || !strings.Contains(report, "profile a (environment)") || !strings.Contains(report, `listen certificate "CN=proxy"`) ||
+		!strings.Contains(report, "configuration ok, 0 warnings in 1 profiles") {
+		t.Errorf("got %d:\n%s", status, report)
+	}
+
+	b := &Profile{Name: "b", Listen: ":8443", Proxy: "10.0.0.2:443"}
+	ca.listenTLS(t, b)
+	_, b.ListenPrivateRaw = ca.issue(t, "other")
+	status, report = check(&Configurations{Profiles: []*Profile{a, b}})
+	if status != 1 || !strings.Contains(report, "FAIL  profiles a and b: listen on the same address") ||
+		!strings.Contains(report, "FAIL  listen certificate") || !strings.Contains(report, "2 problems, 0 warnings in 2 profiles") {
+		t.Errorf("got %d:\n%s", status, report)
+	}
+
+	// unknown keys are only problems when parsing strictly
+	path := writeConfig(t, t.TempDir(), "proxy.toml", "[a]\nListne = \"127.0.0.1:9443\"\n")
+	c := &Configurations{Profiles: []*Profile{a}, ConfigFiles: []string{path}}
+	if status, report = check(c); status != 0 || !strings.Contains(report, "  warn  ") || !strings.Contains(report, "1 warnings") {
+		t.Errorf("got %d:\n%s", status, report)
+	}
+	c.Strict = true
+	if status, report = check(c); status != 1 || !strings.Contains(report, "  FAIL  ") {
+		t.Errorf("got %d strictly:\n%s", status, report)
+	}
+
+	if status, report = check(&Configurations{}); status != 1 || !strings.Contains(report, "no profiles are configured") {
+		t.Errorf("got %d without profiles:\n%s", status, report)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// States of a circuit, the value of mtlsproxy_circuit_state.
+const (
+	circuitClosed   = 0 // connections dial the destination
+	circuitOpen     = 1 // connections are closed without dialing
+	circuitHalfOpen = 2 // one connection is probing the destination
+)
+
+var (
+	errCircuitOpen     = withCode(codeCircuitOpen, errors.New("circuit open, the destination kept failing"))
+	errDestinationDown = withCode(codeDestinationDown, errors.New("the destination is down"))
+)
+
+var circuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "mtlsproxy_circuit_state",
+	Help: "Circuit of each profile's destinations, 0 closed, 1 open or 2 half-open.",
+}, []string{"profile", "destination"})
+
+func init() {
+	prometheus.MustRegister(circuitState)
+}
+
+// circuitBreaker stops dialing a destination that failed threshold times in
+// a row, until the cooldown is over and a single connection got through.
+type circuitBreaker struct {
+	ident, addr string
+	threshold   int
+	cooldown    time.Duration
+
+	mu        sync.Mutex
+	state     int
+	failures  int
+	openUntil time.Time
+}
+
+func newCircuitBreaker(ident, addr string, threshold int, cooldown time.Duration) *circuitBreaker {
+	circuitState.WithLabelValues(ident, addr).Set(circuitClosed)
+	return &circuitBreaker{ident: ident, addr: addr, threshold: threshold, cooldown: cooldown}
+}
+
+// allow tells if a connection may dial the destination. Once the cooldown is
+// over the first connection probes it, the others are closed until it is
+// done.
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case circuitClosed:
+		return true
+	case circuitOpen:
+		if time.Now().Before(cb.openUntil) {
+			return false
+		}
+		cb.set(circuitHalfOpen)
+		slog.Info("circuit half-open, probing the destination", "profile", cb.ident, "destination", cb.addr)
+		return true
+	default:
+		return false
+	}
+}
+
+// isOpen tells if connections are closed without dialing the destination,
+// and the cooldown isn't over yet.
+func (cb *circuitBreaker) isOpen() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return cb.state == circuitOpen && time.Now().Before(cb.openUntil)
+}
+
+// done records how dialing the destination went.
+func (cb *circuitBreaker) done(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if err == nil {
+		if cb.state != circuitClosed {
+			slog.Info("circuit closed, the destination answers again", "profile", cb.ident, "destination", cb.addr)
+		}
+		cb.failures = 0
+		cb.set(circuitClosed)
+		return
+	}
+	cb.failures++
+	if cb.state == circuitHalfOpen || cb.failures >= cb.threshold {
+		cb.openUntil = time.Now().Add(cb.cooldown)
+		if cb.state != circuitOpen {
+			slog.Warn("circuit open, the destination keeps failing", "profile", cb.ident, "destination", cb.addr, "failures", cb.failures, "cooldown", cb.cooldown, "err", err)
+		}
+		cb.set(circuitOpen)
+	}
+}
+
+func (cb *circuitBreaker) set(state int) {
+	cb.state = state
+	circuitState.WithLabelValues(cb.ident, cb.addr).Set(float64(state))
+}
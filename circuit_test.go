@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingDialer fails the first fails dials and connects the rest.
+type failingDialer struct {
+	mu    sync.Mutex
+	fails int
+	dials int
+}
+
+func (d *failingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials++
+	fail := d.dials <= d.fails
+	d.mu.Unlock()
+	if fail {
+		return nil, errors.New("connection refused")
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, addr)
+}
+
+func (d *failingDialer) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.dials
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cb := newCircuitBreaker("test", "example.test:1", 2, 50*time.Millisecond)
+	failed := errors.New("refused")
+
+	cb.done(failed)
+	if !cb.allow() || cb.isOpen() {
+		t.Fatal("opened below the threshold")
+	}
+	cb.done(nil)
+	cb.done(failed)
+	if !cb.allow() {
+		t.Fatal("a success didn't reset the failures")
+	}
+	cb.done(failed)
+	if cb.allow() || !cb.isOpen() {
+		t.Fatal("still closed at the threshold")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if cb.isOpen() {
+		t.Error("open after the cooldown")
+	}
+	if !cb.allow() {
+		t.Fatal("no probe after the cooldown")
+	}
+	if cb.allow() {
+		t.Error("second connection let through while probing")
+	}
+	cb.done(failed)
+	if cb.allow() || !cb.isOpen() {
+		t.Fatal("a failed probe didn't open the circuit again")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !cb.allow() {
+		t.Fatal("no probe after the cooldown")
+	}
+	cb.done(nil)
+	if !cb.allow() || !cb.allow() {
+		t.Error("a good probe didn't close the circuit")
+	}
+}
+
+func TestCircuitBreakerConnect(t *testing.T) {
+	d := &failingDialer{fails: 2}
+	echo := testEcho(t)
+	info := socketInfo{net: "tcp", addr: echo, upstream: d}
+	info.breaker = newCircuitBreaker("test", echo, 2, 50*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if _, err := info.connect(); err == nil || errors.Is(err, errCircuitOpen) {
+			t.Fatalf("dial %d: got %v", i, err)
+		}
+	}
+	if _, err := info.connect(); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("got %v, want %v", err, errCircuitOpen)
+	}
+	if d.count() != 2 {
+		t.Errorf("dialed %d times with the circuit open", d.count())
+	}
+	if !info.down() {
+		t.Error("destination with an open circuit isn't down")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	c, err := info.connect()
+	if err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	c.Close()
+	if info.down() {
+		t.Error("destination still down after a good probe")
+	}
+}
@@ -1,75 +1,574 @@
 package main
 
 import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
-	"github.com/BurntSushi/toml"
 	"github.com/bryanaustin/yaarp"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
 	"io"
+	"log/slog"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Profile struct {
-	Name                string
-	Listen              string
-	Proxy               string //TODO: Rename to send
-	Protocol            string
-	ListenCertPath      string
-	ListenCertRaw       string
-	ListenPrivatePath   string
-	ListenPrivateRaw    string
-	ListenAuthorityPath string
-	ListenAuthorityRaw  string
-	SendCertPath        string
-	SendCertRaw         string
-	SendPrivatePath     string
-	SendPrivateRaw      string
-	SendAuthorityPath   string
-	SendAuthorityRaw    string
-	Source              string
+	Name                         string
+	Listen                       string
+	Proxy                        string //TODO: Rename to send
+	Protocol                     string
+	ListenCertPath               string
+	ListenCertRaw                string
+	ListenPrivatePath            string
+	ListenPrivateRaw             string
+	ListenAuthorityPath          string
+	ListenAuthorityRaw           string
+	SendCertPath                 string
+	SendCertRaw                  string
+	SendPrivatePath              string
+	SendPrivateRaw               string
+	SendAuthorityPath            string
+	SendAuthorityRaw             string
+	DNSCacheTTL                  string
+	DNSNegativeTTL               string
+	DNSServeStale                bool
+	Routes                       map[string]*Route
+	ListenCertificates           []*CertPair
+	MinTLSVersion                string
+	MaxTLSVersion                string
+	ListenMinTLSVersion          string
+	ListenMaxTLSVersion          string
+	SendMinTLSVersion            string
+	SendMaxTLSVersion            string
+	ListenCipherSuites           []string
+	SendCipherSuites             []string
+	ListenAllowedCNs             []string
+	ListenAllowedDNSNames        []string
+	ListenAllowedURIs            []string
+	ListenCRLPath                string
+	ListenCRLRaw                 string
+	ListenOCSPStapling           bool
+	ListenOCSPResponder          string
+	ListenOCSPRefresh            string
+	ListenACMEDomains            []string
+	ListenACMEEmail              string
+	ListenACMEDirectory          string
+	ListenACMECacheDir           string
+	SPIFFESocket                 string
+	ListenSPIFFE                 bool
+	ListenSPIFFEIDs              []string
+	SendSPIFFE                   bool
+	SendSPIFFEIDs                []string
+	ListenPrivatePassphrase      string
+	ListenPrivatePassphrasePath  string
+	SendPrivatePassphrase        string
+	SendPrivatePassphrasePath    string
+	ListenP12Path                string
+	ListenP12Passphrase          string
+	SendP12Path                  string
+	SendP12Passphrase            string
+	PKCS11Module                 string
+	PKCS11TokenLabel             string
+	PKCS11Slot                   string
+	PKCS11PIN                    string
+	ListenPKCS11KeyLabel         string
+	SendPKCS11KeyLabel           string
+	Mode                         string
+	ListenSessionTicketKeysPath  string
+	ListenSessionTicketKeysRaw   string
+	ListenSessionTicketRotation  string
+	ListenSessionTicketsDisabled bool
+	SendPinnedFingerprints       []string
+	AccessLog                    bool
+	ListenALPN                   []string
+	ListenALPNRequired           bool
+	SendALPN                     []string
+	SendALPNRequired             bool
+	ClientAuth                   string
+	SendServerName               string
+	SendInsecureSkipVerify       bool
+	SendUseSystemRoots           bool
+	SendRenegotiation            string
+	SendSessionResumption        bool
+	ListenCertOverlap            string
+	UDPIdleTimeout               string
+	ListenProtocol               string
+	SendProtocol                 string
+	ListenSocketMode             string
+	ListenSocketOwner            string
+	ListenSocketGroup            string
+	SendProxyProtocol            string
+	ListenAcceptProxyProtocol    bool
+	ListenProxyProtocolSources   []string
+	Balance                      string
+	HealthCheck                  string
+	HealthCheckInterval          string
+	HealthCheckTimeout           string
+	HealthCheckThreshold         int
+	DialTimeout                  string
+	IdleTimeout                  string
+	MaxConnectionAge             string
+	MaxConnections               int
+	ConnectionRate               string
+	ConnectionBurst              int
+	ConnectionBandwidth          string
+	ProfileBandwidth             string
+	DNSRefresh                   string
+	DNSPin                       []string
+	DNSPrefer                    string
+	DrainTimeout                 string
+	HTTPProxy                    string
+	SOCKSProxy                   string
+	HTTPClientCertHeader         string
+	HTTPClientCertFormat         string
+	StartTLS                     string
+	AccessLogFormat              string
+	LogLevel                     string
+	SendConnectionID             bool
+	HTTPConnectionIDHeader       string
+	AcceptConnectionID           bool
+	Enabled                      *bool // nil is enabled, a pointer so false takes precedence when merging
+	VaultAddress                 string
+	VaultMount                   string
+	VaultTokenPath               string
+	VaultAuthorityPath           string
+	VaultTTL                     string
+	ListenVaultRole              string
+	ListenVaultCommonName        string
+	ListenVaultAltNames          []string
+	SendVaultRole                string
+	SendVaultCommonName          string
+	AzureKeyVault                string
+	ListenAzureCertificate       string
+	SendAzureCertificate         string
+	AzureRemoteKeys              bool
+	ListenShards                 int
+	CircuitBreakerFailures       int
+	CircuitBreakerCooldown       string
+	DialRetries                  int
+	DialRetryBackoff             string
+	DialFailure                  string
+	Source                       string
+
+	dnsCacheTTL      time.Duration
+	dnsNegativeTTL   time.Duration
+	dnsRefresh       time.Duration
+	dnsPins          []*net.IPNet
+	proxySources     []*net.IPNet
+	unresolved       *Profile // as it was before Resolve, for reading the files again
+	listenMinTLS     uint16
+	listenMaxTLS     uint16
+	sendMinTLS       uint16
+	sendMaxTLS       uint16
+	listenCiphers    []uint16
+	sendCiphers      []uint16
+	listenCRLs       []*x509.RevocationList
+	ocspRefresh      time.Duration
+	listenSPIFFEIDs  []spiffeid.ID
+	sendSPIFFEIDs    []spiffeid.ID
+	listenSigner     crypto.Signer
+	ticketKeys       [][32]byte
+	sendPins         [][]byte
+	clientAuth       tls.ClientAuthType
+	renegotiation    tls.RenegotiationSupport
+	certOverlap      time.Duration
+	udpIdle          time.Duration
+	listenPerms      socketPerms
+	healthInterval   time.Duration
+	dialTimeout      time.Duration
+	circuitCooldown  time.Duration
+	dialBackoff      time.Duration
+	idleTimeout      time.Duration
+	maxAge           time.Duration
+	drainTimeout     time.Duration
+	httpProxy        *url.URL
+	socksProxy       *url.URL
+	connRate         float64
+	connBandwidth    int
+	profileBandwidth int
+	healthTimeout    time.Duration
+	ticketRotation   time.Duration
+	sendSigner       crypto.Signer
 }
 
+// defaultDialTimeout bounds connecting to a destination when DialTimeout isn't set.
+const defaultDialTimeout = 30 * time.Second
+
+// defaultDialBackoff is how long the first retry to connect to a destination
+// waits when DialRetryBackoff isn't set.
+const defaultDialBackoff = 100 * time.Millisecond
+
+// defaultCircuitCooldown is how long a circuit stays open when
+// CircuitBreakerCooldown isn't set.
+const defaultCircuitCooldown = 30 * time.Second
+
+// How a client's connection ends when its destination can't be reached.
+const (
+	DialFailureClose      = "close"
+	DialFailureReset      = "reset"
+	DialFailureRefuse     = "refuse"
+	DialFailureBadGateway = "bad-gateway"
+)
+
+const (
+	ModeTerminate   = "terminate"
+	ModePassthrough = "passthrough"
+	ModeHTTP        = "http"
+)
+
+const defaultCertExpiryWarning = 30 * 24 * time.Hour
+
+const defaultShutdownTimeout = 30 * time.Second
+
 type Configurations struct {
-	ConfigDir string
-	Profiles  []*Profile
+	ConfigDir           string
+	ConfigFiles         []string
+	ConfigURL           string
+	ConfigURLInterval   time.Duration
+	ConfigURLCert       string
+	ConfigURLKey        string
+	ConfigURLAuthority  string
+	remote              *remoteConfig // fetched from ConfigURL
+	KubernetesObjects   []string
+	KubernetesNamespace string
+	kube                *kubeConfig // watched through the Kubernetes API
+	EtcdEndpoints       []string
+	EtcdPrefix          string
+	EtcdCert            string
+	EtcdKey             string
+	EtcdAuthority       string
+	EtcdUsername        string
+	EtcdPassword        string
+	etcd                *etcdConfig // read from EtcdPrefix
+	AWSRefresh          time.Duration
+	AzureRefresh        time.Duration
+	stdinConfig         []byte // read once, for a config file named -
+	Profiles            []*Profile
+	jsonConfig          configLayer     // from MTLSPROXY_CONFIG_JSON, below Profiles
+	envDefaults         *Profile        // from the MTLSPROXY_DEFAULT_ variables
+	envUnknown          []unknownOption // MTLSPROXY_PROFILE_ and MTLSPROXY_DEFAULT_ variables without an option suffix
+	Overrides           []*Profile      // applied at runtime through the control server
+	ControlListen       string
+	ControlCertPath     string
+	ControlKeyPath      string
+	ControlAuthority    string
+	WatchCerts          bool
+	WatchConfig         bool
+	MetricsListen       string
+	KeyLogPath          string
+	keyLogAmbient       bool // KeyLogPath is from SSLKEYLOGFILE, not set for the proxy
+	InsecureDebugging   bool
+	CertExpiryWarning   time.Duration
+	ShutdownTimeout     time.Duration
+	LogFormat           string
+	LogOutput           string
+	LogLevel            string
+	LogRateLimit        string
+	OTLPEndpoint        string
+	DebugListen         string
+	AdminListen         string
+	ControlSocket       string
+	ShowVersion         bool
+	Strict              bool
+	strictSet           bool // Strict was given, check is strict by default
+	HealthListen        string
+	AuditLog            string
+	FlowCollector       string
+	CaptureDir          string
+	ReadyQuorum         string
 }
 
+// EnvConfigJSON holds profiles as a JSON object, the per profile variables
+// take precedence over it.
+const EnvConfigJSON = "MTLSPROXY_CONFIG_JSON"
+
+// EnvDefaultPrefix starts the variables of the defaults, followed by the
+// same suffixes as the options of profiles.
+const EnvDefaultPrefix = "MTLSPROXY_DEFAULT_"
+
 const (
-	EnvProfilePrefix         = "MTLSPROXY_PROFILE_"
-	EnvProtocolSuffix        = "_PROTOCOL"
-	EnvListenSuffix          = "_LISTEN"
-	EnvProxySuffix           = "_PROXY"
-	EnvListenCertSuffix      = "_CERT_LISTEN"
-	EnvSendCertSuffix        = "_CERT_SEND"
-	EnvListenPrivateSuffix   = "_PRIVATE_LISTEN"
-	EnvSendPrivateSuffix     = "_PRIVATE_SEND"
-	EnvAuthorityListenSuffix = "_AUTHORITY_LISTEN" //TODO: Rename _LISTEN_AUTHORITY
-	EnvAuthoritySendSuffix   = "_AUTHORITY_SEND"
+	EnvProfilePrefix                      = "MTLSPROXY_PROFILE_"
+	EnvProtocolSuffix                     = "_PROTOCOL"
+	EnvListenSuffix                       = "_LISTEN"
+	EnvProxySuffix                        = "_PROXY"
+	EnvListenCertSuffix                   = "_CERT_LISTEN"
+	EnvSendCertSuffix                     = "_CERT_SEND"
+	EnvListenPrivateSuffix                = "_PRIVATE_LISTEN"
+	EnvSendPrivateSuffix                  = "_PRIVATE_SEND"
+	EnvAuthorityListenSuffix              = "_AUTHORITY_LISTEN" //TODO: Rename _LISTEN_AUTHORITY
+	EnvAuthoritySendSuffix                = "_AUTHORITY_SEND"
+	EnvDNSCacheTTLSuffix                  = "_DNS_CACHE_TTL"
+	EnvDNSNegativeTTLSuffix               = "_DNS_NEGATIVE_TTL"
+	EnvDNSServeStaleSuffix                = "_DNS_SERVE_STALE"
+	EnvRoutesSuffix                       = "_ROUTES"
+	EnvListenCertificatesSuffix           = "_CERTS_LISTEN"
+	EnvMinTLSSuffix                       = "_MIN_TLS"
+	EnvMaxTLSSuffix                       = "_MAX_TLS"
+	EnvListenMinTLSSuffix                 = "_MIN_TLS_LISTEN"
+	EnvListenMaxTLSSuffix                 = "_MAX_TLS_LISTEN"
+	EnvSendMinTLSSuffix                   = "_MIN_TLS_SEND"
+	EnvSendMaxTLSSuffix                   = "_MAX_TLS_SEND"
+	EnvListenCiphersSuffix                = "_CIPHERS_LISTEN"
+	EnvSendCiphersSuffix                  = "_CIPHERS_SEND"
+	EnvListenAllowedCNsSuffix             = "_ALLOWED_CNS_LISTEN"
+	EnvListenAllowedDNSSuffix             = "_ALLOWED_DNS_LISTEN"
+	EnvListenAllowedURIsSuffix            = "_ALLOWED_URIS_LISTEN"
+	EnvListenCRLSuffix                    = "_CRL_LISTEN"
+	EnvListenOCSPStaplingSuffix           = "_OCSP_STAPLING_LISTEN"
+	EnvListenOCSPResponderSuffix          = "_OCSP_RESPONDER_LISTEN"
+	EnvListenOCSPRefreshSuffix            = "_OCSP_REFRESH_LISTEN"
+	EnvListenACMEDomainsSuffix            = "_ACME_DOMAINS_LISTEN"
+	EnvListenACMEEmailSuffix              = "_ACME_EMAIL_LISTEN"
+	EnvListenACMEDirectorySuffix          = "_ACME_DIRECTORY_LISTEN"
+	EnvListenACMECacheSuffix              = "_ACME_CACHE_LISTEN"
+	EnvSPIFFESocketSuffix                 = "_SPIFFE_SOCKET"
+	EnvListenSPIFFESuffix                 = "_SPIFFE_LISTEN"
+	EnvListenSPIFFEIDsSuffix              = "_SPIFFE_IDS_LISTEN"
+	EnvSendSPIFFESuffix                   = "_SPIFFE_SEND"
+	EnvSendSPIFFEIDsSuffix                = "_SPIFFE_IDS_SEND"
+	EnvListenPassphraseSuffix             = "_PASSPHRASE_LISTEN"
+	EnvListenPassphrasePathSuffix         = "_PASSPHRASE_PATH_LISTEN"
+	EnvSendPassphraseSuffix               = "_PASSPHRASE_SEND"
+	EnvSendPassphrasePathSuffix           = "_PASSPHRASE_PATH_SEND"
+	EnvListenP12Suffix                    = "_P12_LISTEN"
+	EnvListenP12PassphraseSuffix          = "_P12_PASSPHRASE_LISTEN"
+	EnvSendP12Suffix                      = "_P12_SEND"
+	EnvSendP12PassphraseSuffix            = "_P12_PASSPHRASE_SEND"
+	EnvPKCS11ModuleSuffix                 = "_PKCS11_MODULE"
+	EnvPKCS11TokenSuffix                  = "_PKCS11_TOKEN"
+	EnvPKCS11SlotSuffix                   = "_PKCS11_SLOT"
+	EnvPKCS11PINSuffix                    = "_PKCS11_PIN"
+	EnvListenPKCS11KeySuffix              = "_PKCS11_KEY_LISTEN"
+	EnvSendPKCS11KeySuffix                = "_PKCS11_KEY_SEND"
+	EnvModeSuffix                         = "_MODE"
+	EnvListenSessionTicketKeysSuffix      = "_SESSION_TICKET_KEYS_LISTEN"
+	EnvListenSessionTicketRotationSuffix  = "_SESSION_TICKET_ROTATION_LISTEN"
+	EnvListenSessionTicketsDisabledSuffix = "_SESSION_TICKETS_DISABLED_LISTEN"
+	EnvSendPinsSuffix                     = "_PINS_SEND"
+	EnvAccessLogSuffix                    = "_ACCESS_LOG"
+	EnvListenALPNSuffix                   = "_ALPN_LISTEN"
+	EnvListenALPNRequiredSuffix           = "_ALPN_REQUIRED_LISTEN"
+	EnvSendALPNSuffix                     = "_ALPN_SEND"
+	EnvSendALPNRequiredSuffix             = "_ALPN_REQUIRED_SEND"
+	EnvClientAuthSuffix                   = "_CLIENT_AUTH"
+	EnvSendServerNameSuffix               = "_SERVER_NAME_SEND"
+	EnvSendInsecureSkipVerifySuffix       = "_INSECURE_SKIP_VERIFY_SEND"
+	EnvSendSystemRootsSuffix              = "_SYSTEM_ROOTS_SEND"
+	EnvSendRenegotiationSuffix            = "_RENEGOTIATION_SEND"
+	EnvSendSessionResumptionSuffix        = "_SESSION_RESUMPTION_SEND"
+	EnvListenCertOverlapSuffix            = "_CERT_OVERLAP_LISTEN"
+	EnvUDPIdleTimeoutSuffix               = "_UDP_IDLE_TIMEOUT"
+	EnvListenProtocolSuffix               = "_PROTOCOL_LISTEN"
+	EnvSendProtocolSuffix                 = "_PROTOCOL_SEND"
+	EnvListenSocketModeSuffix             = "_SOCKET_MODE_LISTEN"
+	EnvListenSocketOwnerSuffix            = "_SOCKET_OWNER_LISTEN"
+	EnvListenSocketGroupSuffix            = "_SOCKET_GROUP_LISTEN"
+	EnvSendProxyProtocolSuffix            = "_PROXY_PROTOCOL_SEND"
+	EnvListenAcceptProxyProtocolSuffix    = "_ACCEPT_PROXY_PROTOCOL_LISTEN"
+	EnvListenProxyProtocolSourcesSuffix   = "_PROXY_PROTOCOL_SOURCES_LISTEN"
+	EnvBalanceSuffix                      = "_BALANCE"
+	EnvHealthCheckSuffix                  = "_HEALTH_CHECK"
+	EnvHealthCheckIntervalSuffix          = "_HEALTH_CHECK_INTERVAL"
+	EnvHealthCheckTimeoutSuffix           = "_HEALTH_CHECK_TIMEOUT"
+	EnvHealthCheckThresholdSuffix         = "_HEALTH_CHECK_THRESHOLD"
+	EnvDialTimeoutSuffix                  = "_DIAL_TIMEOUT"
+	EnvIdleTimeoutSuffix                  = "_IDLE_TIMEOUT"
+	EnvMaxConnectionAgeSuffix             = "_MAX_CONNECTION_AGE"
+	EnvMaxConnectionsSuffix               = "_MAX_CONNECTIONS"
+	EnvConnectionRateSuffix               = "_CONNECTION_RATE"
+	EnvConnectionBurstSuffix              = "_CONNECTION_BURST"
+	EnvConnectionBandwidthSuffix          = "_CONNECTION_BANDWIDTH"
+	EnvProfileBandwidthSuffix             = "_PROFILE_BANDWIDTH"
+	EnvDNSRefreshSuffix                   = "_DNS_REFRESH"
+	EnvDNSPinSuffix                       = "_DNS_PIN"
+	EnvDNSPreferSuffix                    = "_DNS_PREFER"
+	EnvDrainTimeoutSuffix                 = "_DRAIN_TIMEOUT"
+	EnvHTTPProxySuffix                    = "_HTTP_PROXY"
+	EnvSOCKSProxySuffix                   = "_SOCKS_PROXY"
+	EnvHTTPClientCertHeaderSuffix         = "_HTTP_CLIENT_CERT_HEADER"
+	EnvHTTPClientCertFormatSuffix         = "_HTTP_CLIENT_CERT_FORMAT"
+	EnvStartTLSSuffix                     = "_STARTTLS"
+	EnvAccessLogFormatSuffix              = "_ACCESS_LOG_FORMAT"
+	EnvLogLevelSuffix                     = "_LOG_LEVEL"
+	EnvSendConnectionIDSuffix             = "_CONNECTION_ID_SEND"
+	EnvHTTPConnectionIDHeaderSuffix       = "_HTTP_CONNECTION_ID_HEADER"
+	EnvAcceptConnectionIDSuffix           = "_CONNECTION_ID_ACCEPT"
+	EnvEnabledSuffix                      = "_ENABLED"
+	EnvVaultAddressSuffix                 = "_VAULT_ADDRESS"
+	EnvVaultMountSuffix                   = "_VAULT_MOUNT"
+	EnvVaultTokenPathSuffix               = "_VAULT_TOKEN_PATH"
+	EnvVaultAuthorityPathSuffix           = "_VAULT_AUTHORITY_PATH"
+	EnvVaultTTLSuffix                     = "_VAULT_TTL"
+	EnvListenVaultRoleSuffix              = "_VAULT_ROLE_LISTEN"
+	EnvListenVaultCommonNameSuffix        = "_VAULT_COMMON_NAME_LISTEN"
+	EnvListenVaultAltNamesSuffix          = "_VAULT_ALT_NAMES_LISTEN"
+	EnvSendVaultRoleSuffix                = "_VAULT_ROLE_SEND"
+	EnvSendVaultCommonNameSuffix          = "_VAULT_COMMON_NAME_SEND"
+	EnvAzureKeyVaultSuffix                = "_AZURE_KEY_VAULT"
+	EnvListenAzureCertificateSuffix       = "_AZURE_CERT_LISTEN"
+	EnvSendAzureCertificateSuffix         = "_AZURE_CERT_SEND"
+	EnvAzureRemoteKeysSuffix              = "_AZURE_REMOTE_KEYS"
+	EnvListenShardsSuffix                 = "_SHARDS_LISTEN"
+	EnvCircuitBreakerFailuresSuffix       = "_CIRCUIT_BREAKER_FAILURES"
+	EnvCircuitBreakerCooldownSuffix       = "_CIRCUIT_BREAKER_COOLDOWN"
+	EnvDialRetriesSuffix                  = "_DIAL_RETRIES"
+	EnvDialRetryBackoffSuffix             = "_DIAL_RETRY_BACKOFF"
+	EnvDialFailureSuffix                  = "_DIAL_FAILURE"
 )
 
 var (
 	Debug bool
 )
 
+// configLayer is the profiles from one source, getProfiles merges the layers
+// in order and the earlier ones take precedence.
+type configLayer struct {
+	source   string
+	profiles []*Profile
+	vars     map[string]string // the vars section of a config file
+	defaults *Profile          // merged into every profile, below all of them
+	expand   bool              // variables in the values are expanded
+	err      error             // a SOPS file that couldn't be decrypted, without profiles
+	unknown  []unknownOption   // keys and variables that aren't options
+}
+
 func (c Configurations) getProfiles() (nups []*Profile, err error) {
-	nups = make([]*Profile, len(c.Profiles))
-	for i := range nups {
-		nups[i] = c.Profiles[i].Copy()
+	layers, err := c.configLayers()
+	if err != nil {
+		return nil, err
+	}
+	logLayerErrors(layers)
+	ps := mergeLayers(layers)
+	if err := c.checkStrict(layers, ps); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// logLayerErrors logs the config files left out because they couldn't be
+// decrypted.
+func logLayerErrors(layers []configLayer) {
+	for _, l := range layers {
+		if l.err != nil {
+			slog.Error("error reading configuration, its profiles are left out", "file", l.source, "err", l.err)
+		}
 	}
+}
 
-	if len(c.ConfigDir) < 1 {
+// mergeLayers merges the profiles of the layers, then the defaults of the
+// layers into every profile.
+func mergeLayers(layers []configLayer) (ps []*Profile) {
+	var defaults *Profile
+	for _, l := range layers {
+		ps = mergeProfiles(ps, l.profiles...)
+		if l.defaults != nil {
+			defaults = mergeProfile(defaults, l.defaults.Copy())
+		}
+	}
+	if defaults == nil {
 		return
 	}
+	for i, p := range ps {
+		ps[i] = mergeProfile(p, defaults.Copy())
+	}
+	return
+}
+
+// configLayers reads the profiles of every source, from the highest
+// precedence to the lowest, with the variables of config files expanded.
+func (c Configurations) configLayers() ([]configLayer, error) {
+	layers, err := c.readConfigLayers()
+	if err != nil {
+		return nil, err
+	}
+	if err := expandLayers(layers); err != nil {
+		return nil, err
+	}
+	return layers, nil
+}
+
+func (c Configurations) readConfigLayers() (layers []configLayer, err error) {
+	copies := func(l configLayer, ps []*Profile) {
+		l.profiles = make([]*Profile, len(ps))
+		for i, p := range ps {
+			l.profiles[i] = p.Copy()
+		}
+		layers = append(layers, l)
+	}
+	copies(configLayer{source: "control"}, c.Overrides)
+	copies(configLayer{source: "environment", defaults: c.envDefaults, unknown: c.envUnknown}, c.Profiles)
+	copies(c.jsonConfig, c.jsonConfig.profiles)
+
+	// later files take precedence over earlier ones
+	for i := len(c.ConfigFiles) - 1; i >= 0; i-- {
+		path := c.ConfigFiles[i]
+		var l configLayer
+		if path == "-" {
+			l, err = parseConfig(c.stdinConfig, sniffFormat(c.stdinConfig), "stdin")
+		} else {
+			l, err = readConfigFile(path)
+		}
+		if err != nil {
+			err = fmt.Errorf("reading configuration %q: %w", path, err)
+			return
+		}
+		layers = append(layers, l)
+	}
+
+	if len(c.ConfigDir) > 0 {
+		var dl []configLayer
+		if dl, err = readConfigDir(c.ConfigDir); err != nil {
+			return
+		}
+		layers = append(layers, dl...)
+	}
+
+	if c.kube != nil {
+		var kl []configLayer
+		if kl, err = c.kube.layers(); err != nil {
+			return
+		}
+		layers = append(layers, kl...)
+	}
+
+	if c.remote != nil {
+		var l configLayer
+		if l, err = c.remote.layer(); err != nil {
+			err = fmt.Errorf("reading configuration %q: %w", c.remote.source, err)
+			return
+		}
+		layers = append(layers, l)
+	}
+
+	if c.etcd != nil {
+		var l configLayer
+		if l, err = c.etcd.layer(); err != nil {
+			err = fmt.Errorf("reading configuration %q: %w", c.etcd.source, err)
+			return
+		}
+		layers = append(layers, l)
+	}
+	return
+}
 
+// readConfigDir reads every config file in the directory.
+func readConfigDir(dir string) (layers []configLayer, err error) {
 	var cfd *os.File
-	cfd, err = os.Open(c.ConfigDir)
+	cfd, err = os.Open(dir)
 	if err != nil {
 		err = fmt.Errorf("opening config directory: %w", err)
 		return
 	}
+	defer cfd.Close()
 	var diritems []os.DirEntry
 	for {
 		diritems, err = cfd.ReadDir(16)
@@ -82,26 +581,24 @@ func (c Configurations) getProfiles() (nups []*Profile, err error) {
 			return
 		}
 		for _, item := range diritems {
+			path := filepath.Join(dir, item.Name())
 			if item.IsDir() {
 				continue
 			}
+			// like the ..data link of a Kubernetes ConfigMap
+			if item.Type()&os.ModeSymlink != 0 {
+				if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+					continue
+				}
+			}
 
-			var ps map[string]*Profile
-			path := filepath.Join(c.ConfigDir, item.Name())
-			_, err = toml.DecodeFile(path, &ps)
-			if err != nil {
+			var l configLayer
+			if l, err = readConfigFile(path); err != nil {
 				err = fmt.Errorf("reading configuration %q: %w", path, err)
 				return
 			}
 
-			pl := make([]*Profile, 0, len(ps))
-			for k := range ps {
-				ps[k].Name = k
-				ps[k].Source = path
-				pl = append(pl, ps[k])
-			}
-
-			nups = mergeProfiles(nups, pl...)
+			layers = append(layers, l)
 		}
 	}
 
@@ -111,8 +608,68 @@ func (c Configurations) getProfiles() (nups []*Profile, err error) {
 func getImmutableConfigs() (c *Configurations, err error) {
 	c = new(Configurations)
 	flag.BoolVar(&Debug, "debug", false, "enable debug logging")
+	flag.BoolVar(&c.ShowVersion, "version", false, "print the version, commit and features of the build and exit")
 	flag.StringVar(&c.ConfigDir, "configdir", "", "directory for config files")
+	flag.Func("config", "config file, YAML when it ends in .yaml or .yml, JSON when it ends in .json and TOML otherwise, - for stdin. Can be repeated", func(s string) error {
+		c.ConfigFiles = append(c.ConfigFiles, s)
+		return nil
+	})
+	flag.StringVar(&c.ConfigURL, "configurl", "", "https URL a TOML, YAML or JSON configuration is fetched from and polled")
+	var configURLInterval string
+	flag.StringVar(&configURLInterval, "configurlinterval", "", "how often the config URL is polled, defaults to 1m")
+	flag.StringVar(&c.ConfigURLCert, "configurlcert", "", "client certificate for the config URL")
+	flag.StringVar(&c.ConfigURLKey, "configurlkey", "", "private key of the config URL client certificate")
+	flag.StringVar(&c.ConfigURLAuthority, "configurlauthority", "", "certificate authority for the config URL server, defaults to the system roots")
+	var kubernetesObjects string
+	flag.StringVar(&kubernetesObjects, "kubernetes", "", "ConfigMaps and Secrets read through the Kubernetes API and watched, like configmap/NAME,secret/NAME")
+	flag.StringVar(&c.KubernetesNamespace, "kubernetesnamespace", "", "namespace of the ConfigMaps and Secrets, defaults to the namespace of the pod")
+	var etcdEndpoints string
+	flag.StringVar(&etcdEndpoints, "etcdendpoints", "", "etcd endpoints profiles are read from and watched, comma separated")
+	flag.StringVar(&c.EtcdPrefix, "etcdprefix", "", "etcd prefix of the profiles, defaults to "+defaultEtcdPrefix)
+	flag.StringVar(&c.EtcdCert, "etcdcert", "", "client certificate for etcd")
+	flag.StringVar(&c.EtcdKey, "etcdkey", "", "private key of the etcd client certificate")
+	flag.StringVar(&c.EtcdAuthority, "etcdauthority", "", "certificate authority for the etcd servers, etcd is connected to without TLS when it, the certificate and the key are unset")
+	flag.StringVar(&c.EtcdUsername, "etcdusername", "", "etcd user, the password is read from MTLSPROXY_ETCD_PASSWORD")
+	var awsRefresh string
+	flag.StringVar(&awsRefresh, "awsrefresh", "", "how often certificates and keys from aws-sm:// and ssm:// paths are read again, defaults to 5m")
+	var azureRefresh string
+	flag.StringVar(&azureRefresh, "azurerefresh", "", "how often certificates in Azure Key Vault are checked for new versions, defaults to 5m")
+	flag.BoolVar(&c.WatchCerts, "watchcerts", false, "reload profiles when their certificate files change")
+	flag.BoolVar(&c.WatchConfig, "watchconfig", false, "reload when the config directory or config files change")
+	flag.BoolFunc("strict", "reject unknown options and profiles without a listen or destination address, on by default for check", func(s string) error {
+		var err error
+		c.Strict, err = strconv.ParseBool(s)
+		c.strictSet = true
+		return err
+	})
+	flag.StringVar(&c.ControlListen, "controllisten", "", "address for the gRPC control server, disabled when empty")
+	flag.StringVar(&c.ControlCertPath, "controlcert", "", "certificate served by the gRPC control server")
+	flag.StringVar(&c.ControlKeyPath, "controlkey", "", "private key for the gRPC control server certificate")
+	flag.StringVar(&c.ControlAuthority, "controlauthority", "", "certificate authority for gRPC control server clients")
+	flag.StringVar(&c.CaptureDir, "capturedir", "", "directory captures of connections started through the admin server are written to, captures are disabled without it")
+	flag.StringVar(&c.FlowCollector, "flowcollector", "", "collector flow records are sent to as JSON lines, udp://host:port or tcp://host:port")
+	flag.StringVar(&c.AuditLog, "auditlog", "", "file every client certificate accepted or denied is appended to")
+	flag.StringVar(&c.HealthListen, "healthlisten", "", "address for the /healthz and /readyz server, disabled when empty")
+	flag.StringVar(&c.ReadyQuorum, "readyquorum", "", "profiles that need to be ready for /readyz, a count or percentage, defaults to all")
+	flag.StringVar(&c.AdminListen, "adminlisten", "", "address for the admin HTTP server, disabled when empty")
+	flag.StringVar(&c.ControlSocket, "controlsocket", "", "unix socket the admin API is served on for the reload, status and drain commands, disabled when empty")
+	flag.StringVar(&c.MetricsListen, "metricslisten", "", "address for the Prometheus metrics server, disabled when empty")
+	flag.StringVar(&c.KeyLogPath, "tlskeylog", "", "file to write TLS secrets to for decrypting captures, requires -insecuredebugging")
+	flag.StringVar(&c.DebugListen, "debuglisten", "", "loopback address for the pprof and expvar debug server, disabled when empty")
+	flag.BoolVar(&c.InsecureDebugging, "insecuredebugging", false, "allow debugging options that weaken security")
+	var expiryWarning string
+	flag.StringVar(&expiryWarning, "certexpirywarning", "", "warn about certificates expiring within this duration, defaults to 720h")
+	var shutdownTimeout string
+	flag.StringVar(&shutdownTimeout, "shutdowntimeout", "", "how long open connections get to finish on TERM or INT, defaults to 30s")
+	flag.StringVar(&c.LogFormat, "logformat", "", "log records as text or json, defaults to text")
+	flag.StringVar(&c.LogLevel, "loglevel", "", "log records from this level up: error, warn, info, debug or trace, defaults to info")
+	flag.StringVar(&c.LogRateLimit, "logratelimit", "", "records let through per interval, like 10/1s for warnings and errors or \"message=1/10s\" for a message, comma separated")
+	flag.StringVar(&c.LogOutput, "logoutput", "", "where log records go: stderr, syslog, syslog://host:port, syslog+tcp://host:port or journal, defaults to stderr")
+	flag.StringVar(&c.OTLPEndpoint, "otlpendpoint", "", "OTLP gRPC endpoint connection spans are exported to, like http://localhost:4317")
 	yaarp.Parse()
+	if c.ShowVersion {
+		return
+	}
 
 	if env := os.Getenv("MTLSPROXY_DEBUG"); !Debug && len(env) > 0 {
 		Debug, err = strconv.ParseBool(env)
@@ -125,11 +682,327 @@ func getImmutableConfigs() (c *Configurations, err error) {
 		c.ConfigDir = env
 	}
 
-	c.Profiles = profilesFromEnv()
+	if env := os.Getenv("MTLSPROXY_CONFIG"); len(c.ConfigFiles) < 1 && len(env) > 0 {
+		c.ConfigFiles = splitList(env)
+	}
+	for _, path := range c.ConfigFiles {
+		if path == "-" {
+			if c.stdinConfig, err = io.ReadAll(os.Stdin); err != nil {
+				err = fmt.Errorf("reading configuration from stdin: %w", err)
+				return
+			}
+			break
+		}
+	}
+
+	if env := os.Getenv("MTLSPROXY_CONFIG_URL"); len(c.ConfigURL) < 1 && len(env) > 0 {
+		c.ConfigURL = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_CONFIG_URL_INTERVAL"); len(configURLInterval) < 1 && len(env) > 0 {
+		configURLInterval = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_CONFIG_URL_CERT"); len(c.ConfigURLCert) < 1 && len(env) > 0 {
+		c.ConfigURLCert = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_CONFIG_URL_KEY"); len(c.ConfigURLKey) < 1 && len(env) > 0 {
+		c.ConfigURLKey = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_CONFIG_URL_AUTHORITY"); len(c.ConfigURLAuthority) < 1 && len(env) > 0 {
+		c.ConfigURLAuthority = env
+	}
+
+	c.ConfigURLInterval = defaultConfigURLInterval
+	if len(configURLInterval) > 0 {
+		c.ConfigURLInterval, err = time.ParseDuration(configURLInterval)
+		if err != nil {
+			return
+		}
+		if c.ConfigURLInterval <= 0 {
+			err = fmt.Errorf("config URL interval %q isn't positive", configURLInterval)
+			return
+		}
+	}
+
+	if env := os.Getenv("MTLSPROXY_KUBERNETES"); len(kubernetesObjects) < 1 && len(env) > 0 {
+		kubernetesObjects = env
+	}
+	c.KubernetesObjects = splitList(kubernetesObjects)
+
+	if env := os.Getenv("MTLSPROXY_KUBERNETES_NAMESPACE"); len(c.KubernetesNamespace) < 1 && len(env) > 0 {
+		c.KubernetesNamespace = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_ETCD_ENDPOINTS"); len(etcdEndpoints) < 1 && len(env) > 0 {
+		etcdEndpoints = env
+	}
+	c.EtcdEndpoints = splitList(etcdEndpoints)
+
+	if env := os.Getenv("MTLSPROXY_ETCD_PREFIX"); len(c.EtcdPrefix) < 1 && len(env) > 0 {
+		c.EtcdPrefix = env
+	}
+	if len(c.EtcdPrefix) < 1 {
+		c.EtcdPrefix = defaultEtcdPrefix
+	}
+
+	if env := os.Getenv("MTLSPROXY_ETCD_CERT"); len(c.EtcdCert) < 1 && len(env) > 0 {
+		c.EtcdCert = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_ETCD_KEY"); len(c.EtcdKey) < 1 && len(env) > 0 {
+		c.EtcdKey = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_ETCD_AUTHORITY"); len(c.EtcdAuthority) < 1 && len(env) > 0 {
+		c.EtcdAuthority = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_ETCD_USERNAME"); len(c.EtcdUsername) < 1 && len(env) > 0 {
+		c.EtcdUsername = env
+	}
+	c.EtcdPassword = os.Getenv("MTLSPROXY_ETCD_PASSWORD")
+
+	if env := os.Getenv("MTLSPROXY_AWS_REFRESH"); len(awsRefresh) < 1 && len(env) > 0 {
+		awsRefresh = env
+	}
+	c.AWSRefresh = defaultAWSRefresh
+	if len(awsRefresh) > 0 {
+		c.AWSRefresh, err = time.ParseDuration(awsRefresh)
+		if err != nil {
+			return
+		}
+		if c.AWSRefresh <= 0 {
+			err = fmt.Errorf("AWS refresh %q isn't positive", awsRefresh)
+			return
+		}
+	}
+
+	if env := os.Getenv("MTLSPROXY_AZURE_REFRESH"); len(azureRefresh) < 1 && len(env) > 0 {
+		azureRefresh = env
+	}
+	c.AzureRefresh = defaultAzureRefresh
+	if len(azureRefresh) > 0 {
+		c.AzureRefresh, err = time.ParseDuration(azureRefresh)
+		if err != nil {
+			return
+		}
+		if c.AzureRefresh <= 0 {
+			err = fmt.Errorf("Azure refresh %q isn't positive", azureRefresh)
+			return
+		}
+	}
+
+	if env := os.Getenv("MTLSPROXY_WATCH_CERTS"); !c.WatchCerts && len(env) > 0 {
+		c.WatchCerts, err = strconv.ParseBool(env)
+		if err != nil {
+			return
+		}
+	}
+
+	if env := os.Getenv("MTLSPROXY_WATCH_CONFIG"); !c.WatchConfig && len(env) > 0 {
+		c.WatchConfig, err = strconv.ParseBool(env)
+		if err != nil {
+			return
+		}
+	}
+
+	if env := os.Getenv("MTLSPROXY_STRICT"); !c.strictSet && len(env) > 0 {
+		c.Strict, err = strconv.ParseBool(env)
+		if err != nil {
+			return
+		}
+		c.strictSet = true
+	}
+
+	if env := os.Getenv("MTLSPROXY_CONTROL_LISTEN"); len(c.ControlListen) < 1 && len(env) > 0 {
+		c.ControlListen = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_CONTROL_CERT"); len(c.ControlCertPath) < 1 && len(env) > 0 {
+		c.ControlCertPath = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_CONTROL_KEY"); len(c.ControlKeyPath) < 1 && len(env) > 0 {
+		c.ControlKeyPath = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_CONTROL_AUTHORITY"); len(c.ControlAuthority) < 1 && len(env) > 0 {
+		c.ControlAuthority = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_CAPTURE_DIR"); len(c.CaptureDir) < 1 && len(env) > 0 {
+		c.CaptureDir = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_FLOW_COLLECTOR"); len(c.FlowCollector) < 1 && len(env) > 0 {
+		c.FlowCollector = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_AUDIT_LOG"); len(c.AuditLog) < 1 && len(env) > 0 {
+		c.AuditLog = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_HEALTH_LISTEN"); len(c.HealthListen) < 1 && len(env) > 0 {
+		c.HealthListen = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_READY_QUORUM"); len(c.ReadyQuorum) < 1 && len(env) > 0 {
+		c.ReadyQuorum = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_ADMIN_LISTEN"); len(c.AdminListen) < 1 && len(env) > 0 {
+		c.AdminListen = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_CONTROL_SOCKET"); len(c.ControlSocket) < 1 && len(env) > 0 {
+		c.ControlSocket = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_METRICS_LISTEN"); len(c.MetricsListen) < 1 && len(env) > 0 {
+		c.MetricsListen = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_CERT_EXPIRY_WARNING"); len(expiryWarning) < 1 && len(env) > 0 {
+		expiryWarning = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_TLS_KEYLOG"); len(c.KeyLogPath) < 1 && len(env) > 0 {
+		c.KeyLogPath = env
+	}
+
+	if env := os.Getenv("SSLKEYLOGFILE"); len(c.KeyLogPath) < 1 && len(env) > 0 {
+		c.KeyLogPath = env
+		c.keyLogAmbient = true
+	}
+
+	if env := os.Getenv("MTLSPROXY_DEBUG_LISTEN"); len(c.DebugListen) < 1 && len(env) > 0 {
+		c.DebugListen = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_INSECURE_DEBUGGING"); !c.InsecureDebugging && len(env) > 0 {
+		c.InsecureDebugging, err = strconv.ParseBool(env)
+		if err != nil {
+			return
+		}
+	}
+
+	c.CertExpiryWarning = defaultCertExpiryWarning
+	if len(expiryWarning) > 0 {
+		c.CertExpiryWarning, err = time.ParseDuration(expiryWarning)
+		if err != nil {
+			return
+		}
+	}
+
+	if env := os.Getenv("MTLSPROXY_SHUTDOWN_TIMEOUT"); len(shutdownTimeout) < 1 && len(env) > 0 {
+		shutdownTimeout = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_LOG_FORMAT"); len(c.LogFormat) < 1 && len(env) > 0 {
+		c.LogFormat = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_LOG_LEVEL"); len(c.LogLevel) < 1 && len(env) > 0 {
+		c.LogLevel = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_LOG_RATE_LIMIT"); len(c.LogRateLimit) < 1 && len(env) > 0 {
+		c.LogRateLimit = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_LOG_OUTPUT"); len(c.LogOutput) < 1 && len(env) > 0 {
+		c.LogOutput = env
+	}
+
+	if env := os.Getenv("MTLSPROXY_OTLP_ENDPOINT"); len(c.OTLPEndpoint) < 1 && len(env) > 0 {
+		c.OTLPEndpoint = env
+	}
+
+	c.ShutdownTimeout = defaultShutdownTimeout
+	if len(shutdownTimeout) > 0 {
+		c.ShutdownTimeout, err = time.ParseDuration(shutdownTimeout)
+		if err != nil {
+			return
+		}
+	}
+
 	return
 }
 
-func profilesFromEnv() (ps []*Profile) {
+// loadSources reads the profiles of the environment and fetches the config
+// URL, Kubernetes and etcd, which the commands talking to a running proxy
+// don't need.
+func (c *Configurations) loadSources() error {
+	var err error
+	var unknown []unknownOption
+	if c.Profiles, c.envUnknown, err = profilesFromEnv(); err != nil {
+		return err
+	}
+	if c.envDefaults, unknown, err = defaultsFromEnv(); err != nil {
+		return err
+	}
+	c.envUnknown = append(c.envUnknown, unknown...)
+	if c.jsonConfig, err = configFromJSONEnv(); err != nil {
+		return err
+	}
+
+	if len(c.ConfigURL) > 0 {
+		if c.remote, err = newRemoteConfig(c); err != nil {
+			return fmt.Errorf("config URL: %w", err)
+		}
+		if _, err := c.remote.fetch(); err != nil {
+			return fmt.Errorf("fetching configuration from %s: %w", c.remote.source, err)
+		}
+	}
+
+	if len(c.KubernetesObjects) > 0 {
+		if c.kube, err = newKubeConfig(c); err != nil {
+			return fmt.Errorf("kubernetes: %w", err)
+		}
+		if err := c.kube.load(); err != nil {
+			return fmt.Errorf("reading configuration from kubernetes: %w", err)
+		}
+	}
+
+	if len(c.EtcdEndpoints) > 0 {
+		if c.etcd, err = newEtcdConfig(c); err != nil {
+			return fmt.Errorf("etcd: %w", err)
+		}
+		if _, err := c.etcd.load(); err != nil {
+			return fmt.Errorf("reading configuration from %s: %w", c.etcd.source, err)
+		}
+	}
+	return nil
+}
+
+func profilesFromEnv() ([]*Profile, []unknownOption, error) {
+	return envProfiles(EnvProfilePrefix, EnvProfilePrefix)
+}
+
+// defaultsFromEnv reads the MTLSPROXY_DEFAULT_ variables, nil when there are
+// none.
+func defaultsFromEnv() (*Profile, []unknownOption, error) {
+	ps, unknown, err := envProfiles(EnvDefaultPrefix, "MTLSPROXY_")
+	if err != nil || len(ps) < 1 {
+		return nil, unknown, err
+	}
+	// everything after the prefix is a suffix, the profile is DEFAULT
+	for _, p := range ps {
+		if p.Name == "DEFAULT" {
+			p.Name = ""
+			return p, unknown, nil
+		}
+	}
+	return nil, unknown, nil
+}
+
+// envProfiles reads the profiles of the variables starting with match, the
+// names are what follows prefix. Variables without an option suffix are
+// returned as unknown.
+func envProfiles(match, prefix string) (ps []*Profile, unknown []unknownOption, err error) {
 	allenvs := os.Environ()
 	matchedPrefix := make([]string, 0, len(allenvs))
 
@@ -146,234 +1019,2235 @@ func profilesFromEnv() (ps []*Profile) {
 	}
 
 	for _, x := range allenvs {
-		if strings.HasPrefix(x, EnvProfilePrefix) {
-			matchedPrefix = append(matchedPrefix, x[len(EnvProfilePrefix):])
+		if strings.HasPrefix(x, match) {
+			// os.Environ gives key=value, only the key is matched against
+			if i := strings.IndexByte(x, '='); i > -1 {
+				x = x[:i]
+			}
+			matchedPrefix = append(matchedPrefix, x[len(prefix):])
 		}
 	}
 
 	for _, x := range matchedPrefix {
-		if r := profileSuffix(x, EnvListenSuffix); len(r) > 0 {
+		// checked before _PROXY, they also end with it
+		if r := profileSuffix(x, EnvHTTPProxySuffix); len(r) > 0 {
 			p := findoradd(r)
-			p.Listen = os.Getenv(EnvProfilePrefix + x)
+			p.HTTPProxy = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvSOCKSProxySuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SOCKSProxy = os.Getenv(prefix + x)
 			continue
 		}
 		if r := profileSuffix(x, EnvProxySuffix); len(r) > 0 {
 			p := findoradd(r)
-			p.Proxy = os.Getenv(EnvProfilePrefix + x)
+			p.Proxy = os.Getenv(prefix + x)
 			continue
 		}
 		if r := profileSuffix(x, EnvProtocolSuffix); len(r) > 0 {
 			p := findoradd(r)
-			p.Protocol = os.Getenv(EnvProfilePrefix + x)
+			p.Protocol = os.Getenv(prefix + x)
+			continue
+		}
+		// checked before _CERT_LISTEN and _CERT_SEND, they also end with them
+		if r := profileSuffix(x, EnvListenAzureCertificateSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenAzureCertificate = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvSendAzureCertificateSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendAzureCertificate = os.Getenv(prefix + x)
 			continue
 		}
 		if r := profileSuffix(x, EnvListenCertSuffix); len(r) > 0 {
 			p := findoradd(r)
-			p.ListenCertRaw = os.Getenv(EnvProfilePrefix + x)
+			p.ListenCertRaw = os.Getenv(prefix + x)
 			continue
 		}
 		if r := profileSuffix(x, EnvSendCertSuffix); len(r) > 0 {
 			p := findoradd(r)
-			p.SendCertRaw = os.Getenv(EnvProfilePrefix + x)
+			p.SendCertRaw = os.Getenv(prefix + x)
 			continue
 		}
 		if r := profileSuffix(x, EnvListenPrivateSuffix); len(r) > 0 {
 			p := findoradd(r)
-			p.ListenPrivateRaw = os.Getenv(EnvProfilePrefix + x)
+			p.ListenPrivateRaw = os.Getenv(prefix + x)
 			continue
 		}
 		if r := profileSuffix(x, EnvSendPrivateSuffix); len(r) > 0 {
 			p := findoradd(r)
-			p.SendPrivateRaw = os.Getenv(EnvProfilePrefix + x)
+			p.SendPrivateRaw = os.Getenv(prefix + x)
 			continue
 		}
 		if r := profileSuffix(x, EnvAuthorityListenSuffix); len(r) > 0 {
 			p := findoradd(r)
-			p.ListenAuthorityRaw = os.Getenv(EnvProfilePrefix + x)
+			p.ListenAuthorityRaw = os.Getenv(prefix + x)
 			continue
 		}
 		if r := profileSuffix(x, EnvAuthoritySendSuffix); len(r) > 0 {
 			p := findoradd(r)
-			p.SendAuthorityRaw = os.Getenv(EnvProfilePrefix + x)
+			p.SendAuthorityRaw = os.Getenv(prefix + x)
 			continue
 		}
-	}
-	return
-}
-
-func mergeProfiles(b []*Profile, n ...*Profile) []*Profile {
-	result := make([]*Profile, 0, len(b)+len(n))
-	result = append(result, b...)
-	for _, p := range n {
-		found := -1
-		for i := range result {
-			if result[i].Name == p.Name {
-				found = i
-				break
-			}
+		if r := profileSuffix(x, EnvDNSCacheTTLSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.DNSCacheTTL = os.Getenv(prefix + x)
+			continue
 		}
-
-		if found > -1 {
-			result[found] = mergeProfile(result[found], p)
-		} else {
-			result = append(result, p)
+		if r := profileSuffix(x, EnvDNSNegativeTTLSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.DNSNegativeTTL = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvDNSServeStaleSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.DNSServeStale, err = strconv.ParseBool(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvRoutesSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.Routes, err = parseRoutes(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvListenCertificatesSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.ListenCertificates, err = parseCertPairs(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvMinTLSSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.MinTLSVersion = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvMaxTLSSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.MaxTLSVersion = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenMinTLSSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenMinTLSVersion = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenMaxTLSSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenMaxTLSVersion = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvSendMinTLSSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendMinTLSVersion = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvSendMaxTLSSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendMaxTLSVersion = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenCiphersSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenCipherSuites = splitList(os.Getenv(prefix + x))
+			continue
+		}
+		if r := profileSuffix(x, EnvSendCiphersSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendCipherSuites = splitList(os.Getenv(prefix + x))
+			continue
+		}
+		if r := profileSuffix(x, EnvListenAllowedCNsSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenAllowedCNs = splitList(os.Getenv(prefix + x))
+			continue
+		}
+		if r := profileSuffix(x, EnvListenAllowedDNSSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenAllowedDNSNames = splitList(os.Getenv(prefix + x))
+			continue
+		}
+		if r := profileSuffix(x, EnvListenAllowedURIsSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenAllowedURIs = splitList(os.Getenv(prefix + x))
+			continue
+		}
+		if r := profileSuffix(x, EnvListenCRLSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenCRLRaw = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenOCSPStaplingSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.ListenOCSPStapling, err = strconv.ParseBool(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvListenOCSPResponderSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenOCSPResponder = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenOCSPRefreshSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenOCSPRefresh = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenACMEDomainsSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenACMEDomains = splitList(os.Getenv(prefix + x))
+			continue
+		}
+		if r := profileSuffix(x, EnvListenACMEEmailSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenACMEEmail = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenACMEDirectorySuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenACMEDirectory = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenACMECacheSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenACMECacheDir = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvSPIFFESocketSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SPIFFESocket = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenSPIFFESuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.ListenSPIFFE, err = strconv.ParseBool(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvListenSPIFFEIDsSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenSPIFFEIDs = splitList(os.Getenv(prefix + x))
+			continue
+		}
+		if r := profileSuffix(x, EnvSendSPIFFESuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.SendSPIFFE, err = strconv.ParseBool(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvSendSPIFFEIDsSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendSPIFFEIDs = splitList(os.Getenv(prefix + x))
+			continue
+		}
+		// checked before _PASSPHRASE_LISTEN and _PASSPHRASE_SEND, they also end
+		// with them
+		if r := profileSuffix(x, EnvListenP12PassphraseSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenP12Passphrase = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvSendP12PassphraseSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendP12Passphrase = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenPassphraseSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenPrivatePassphrase = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenPassphrasePathSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenPrivatePassphrasePath = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvSendPassphraseSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendPrivatePassphrase = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvSendPassphrasePathSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendPrivatePassphrasePath = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenP12Suffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenP12Path = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvSendP12Suffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendP12Path = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvPKCS11ModuleSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.PKCS11Module = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvPKCS11TokenSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.PKCS11TokenLabel = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvPKCS11SlotSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.PKCS11Slot = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvPKCS11PINSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.PKCS11PIN = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenPKCS11KeySuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenPKCS11KeyLabel = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvSendPKCS11KeySuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendPKCS11KeyLabel = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvModeSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.Mode = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenSessionTicketKeysSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenSessionTicketKeysPath = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenSessionTicketRotationSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenSessionTicketRotation = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenSessionTicketsDisabledSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.ListenSessionTicketsDisabled, err = strconv.ParseBool(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvSendPinsSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendPinnedFingerprints = splitList(os.Getenv(prefix + x))
+			continue
+		}
+		if r := profileSuffix(x, EnvAccessLogSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.AccessLog, err = strconv.ParseBool(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvListenALPNSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenALPN = splitList(os.Getenv(prefix + x))
+			continue
+		}
+		if r := profileSuffix(x, EnvListenALPNRequiredSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.ListenALPNRequired, err = strconv.ParseBool(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvSendALPNSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendALPN = splitList(os.Getenv(prefix + x))
+			continue
+		}
+		if r := profileSuffix(x, EnvSendALPNRequiredSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.SendALPNRequired, err = strconv.ParseBool(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvClientAuthSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ClientAuth = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvSendServerNameSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendServerName = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvSendInsecureSkipVerifySuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.SendInsecureSkipVerify, err = strconv.ParseBool(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvSendSystemRootsSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.SendUseSystemRoots, err = strconv.ParseBool(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvSendRenegotiationSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendRenegotiation = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvSendSessionResumptionSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.SendSessionResumption, err = strconv.ParseBool(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvListenCertOverlapSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenCertOverlap = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvUDPIdleTimeoutSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.UDPIdleTimeout = os.Getenv(prefix + x)
+			continue
+		}
+		// checked before _PROTOCOL_LISTEN and _PROTOCOL_SEND, they also end with
+		// them
+		if r := profileSuffix(x, EnvListenAcceptProxyProtocolSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.ListenAcceptProxyProtocol, err = strconv.ParseBool(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvSendProxyProtocolSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendProxyProtocol = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenProtocolSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenProtocol = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvSendProtocolSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendProtocol = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenSocketModeSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenSocketMode = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenSocketOwnerSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenSocketOwner = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenSocketGroupSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenSocketGroup = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenProxyProtocolSourcesSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenProxyProtocolSources = splitList(os.Getenv(prefix + x))
+			continue
+		}
+		if r := profileSuffix(x, EnvBalanceSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.Balance = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvHealthCheckSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.HealthCheck = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvHealthCheckIntervalSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.HealthCheckInterval = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvHealthCheckTimeoutSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.HealthCheckTimeout = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvHealthCheckThresholdSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.HealthCheckThreshold, err = strconv.Atoi(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvDialTimeoutSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.DialTimeout = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvIdleTimeoutSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.IdleTimeout = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvMaxConnectionAgeSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.MaxConnectionAge = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvMaxConnectionsSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.MaxConnections, err = strconv.Atoi(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvConnectionRateSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ConnectionRate = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvConnectionBurstSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.ConnectionBurst, err = strconv.Atoi(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvConnectionBandwidthSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ConnectionBandwidth = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvProfileBandwidthSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ProfileBandwidth = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvDNSRefreshSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.DNSRefresh = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvDNSPinSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.DNSPin = splitList(os.Getenv(prefix + x))
+			continue
+		}
+		if r := profileSuffix(x, EnvDNSPreferSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.DNSPrefer = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvDrainTimeoutSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.DrainTimeout = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvHTTPClientCertHeaderSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.HTTPClientCertHeader = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvHTTPClientCertFormatSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.HTTPClientCertFormat = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvStartTLSSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.StartTLS = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvAccessLogFormatSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.AccessLogFormat = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvLogLevelSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.LogLevel = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvSendConnectionIDSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.SendConnectionID, err = strconv.ParseBool(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvHTTPConnectionIDHeaderSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.HTTPConnectionIDHeader = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvAcceptConnectionIDSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.AcceptConnectionID, err = strconv.ParseBool(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvEnabledSuffix); len(r) > 0 {
+			p := findoradd(r)
+			enabled, perr := strconv.ParseBool(os.Getenv(prefix + x))
+			if perr != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, perr)
+				return
+			}
+			p.Enabled = &enabled
+			continue
+		}
+		if r := profileSuffix(x, EnvVaultAddressSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.VaultAddress = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvVaultMountSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.VaultMount = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvVaultTokenPathSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.VaultTokenPath = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvVaultAuthorityPathSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.VaultAuthorityPath = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvVaultTTLSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.VaultTTL = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenVaultRoleSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenVaultRole = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenVaultCommonNameSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenVaultCommonName = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvListenVaultAltNamesSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.ListenVaultAltNames = splitList(os.Getenv(prefix + x))
+			continue
+		}
+		if r := profileSuffix(x, EnvSendVaultRoleSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendVaultRole = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvSendVaultCommonNameSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.SendVaultCommonName = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvAzureKeyVaultSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.AzureKeyVault = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvAzureRemoteKeysSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.AzureRemoteKeys, err = strconv.ParseBool(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvListenShardsSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.ListenShards, err = strconv.Atoi(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvCircuitBreakerFailuresSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.CircuitBreakerFailures, err = strconv.Atoi(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvCircuitBreakerCooldownSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.CircuitBreakerCooldown = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvDialRetriesSuffix); len(r) > 0 {
+			p := findoradd(r)
+			if p.DialRetries, err = strconv.Atoi(os.Getenv(prefix + x)); err != nil {
+				err = fmt.Errorf("parsing %s: %w", prefix+x, err)
+				return
+			}
+			continue
+		}
+		if r := profileSuffix(x, EnvDialRetryBackoffSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.DialRetryBackoff = os.Getenv(prefix + x)
+			continue
+		}
+		if r := profileSuffix(x, EnvDialFailureSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.DialFailure = os.Getenv(prefix + x)
+			continue
+		}
+		// checked last, the other listen suffixes also end with it
+		if r := profileSuffix(x, EnvListenSuffix); len(r) > 0 {
+			p := findoradd(r)
+			p.Listen = os.Getenv(prefix + x)
+			continue
+		}
+		unknown = append(unknown, unknownOption{where: "environment", what: prefix + x + " doesn't end with an option suffix"})
+	}
+	return
+}
+
+func mergeProfiles(b []*Profile, n ...*Profile) []*Profile {
+	result := make([]*Profile, 0, len(b)+len(n))
+	result = append(result, b...)
+	for _, p := range n {
+		found := -1
+		for i := range result {
+			if result[i].Name == p.Name {
+				found = i
+				break
+			}
+		}
+
+		if found > -1 {
+			result[found] = mergeProfile(result[found], p)
+		} else {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// replaceProfiles returns b with any profiles of the same name swapped out for
+// those in n, unlike mergeProfiles the new profiles win outright.
+func replaceProfiles(b []*Profile, n ...*Profile) []*Profile {
+	result := make([]*Profile, 0, len(b)+len(n))
+	result = append(result, b...)
+	for _, p := range n {
+		found := -1
+		for i := range result {
+			if result[i].Name == p.Name {
+				found = i
+				break
+			}
+		}
+
+		if found > -1 {
+			result[found] = p
+		} else {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func mergeProfile(a, b *Profile) *Profile {
+	if a == nil {
+		if b != nil {
+			return b
+		}
+		a = new(Profile)
+	}
+	if b == nil {
+		return a
+	}
+
+	if len(a.Listen) < 1 {
+		a.Listen = b.Listen
+	}
+	if len(a.Proxy) < 1 {
+		a.Proxy = b.Proxy
+	}
+	if len(a.Protocol) < 1 {
+		a.Protocol = b.Protocol
+	}
+	if len(a.SendCertPath) < 1 {
+		a.SendCertPath = b.SendCertPath
+	}
+	if len(a.SendCertRaw) < 1 {
+		a.SendCertRaw = b.SendCertRaw
+	}
+	if len(a.ListenCertPath) < 1 {
+		a.ListenCertPath = b.ListenCertPath
+	}
+	if len(a.ListenCertRaw) < 1 {
+		a.ListenCertRaw = b.ListenCertRaw
+	}
+	if len(a.ListenPrivatePath) < 1 {
+		a.ListenPrivatePath = b.ListenPrivatePath
+	}
+	if len(a.ListenPrivateRaw) < 1 {
+		a.ListenPrivateRaw = b.ListenPrivateRaw
+	}
+	if len(a.SendPrivatePath) < 1 {
+		a.SendPrivatePath = b.SendPrivatePath
+	}
+	if len(a.SendPrivateRaw) < 1 {
+		a.SendPrivateRaw = b.SendPrivateRaw
+	}
+	if len(a.ListenAuthorityPath) < 1 {
+		a.ListenAuthorityPath = b.ListenAuthorityPath
+	}
+	if len(a.ListenAuthorityRaw) < 1 {
+		a.ListenAuthorityRaw = b.ListenAuthorityRaw
+	}
+	if len(a.SendAuthorityPath) < 1 {
+		a.SendAuthorityPath = b.SendAuthorityPath
+	}
+	if len(a.SendAuthorityRaw) < 1 {
+		a.SendAuthorityRaw = b.SendAuthorityRaw
+	}
+	if len(a.DNSCacheTTL) < 1 {
+		a.DNSCacheTTL = b.DNSCacheTTL
+	}
+	if len(a.DNSNegativeTTL) < 1 {
+		a.DNSNegativeTTL = b.DNSNegativeTTL
+	}
+	if !a.DNSServeStale {
+		a.DNSServeStale = b.DNSServeStale
+	}
+	if len(a.Routes) < 1 {
+		a.Routes = b.Routes
+	}
+	if len(a.ListenCertificates) < 1 {
+		a.ListenCertificates = b.ListenCertificates
+	}
+	if len(a.MinTLSVersion) < 1 {
+		a.MinTLSVersion = b.MinTLSVersion
+	}
+	if len(a.MaxTLSVersion) < 1 {
+		a.MaxTLSVersion = b.MaxTLSVersion
+	}
+	if len(a.ListenMinTLSVersion) < 1 {
+		a.ListenMinTLSVersion = b.ListenMinTLSVersion
+	}
+	if len(a.ListenMaxTLSVersion) < 1 {
+		a.ListenMaxTLSVersion = b.ListenMaxTLSVersion
+	}
+	if len(a.SendMinTLSVersion) < 1 {
+		a.SendMinTLSVersion = b.SendMinTLSVersion
+	}
+	if len(a.SendMaxTLSVersion) < 1 {
+		a.SendMaxTLSVersion = b.SendMaxTLSVersion
+	}
+	if len(a.ListenCipherSuites) < 1 {
+		a.ListenCipherSuites = b.ListenCipherSuites
+	}
+	if len(a.SendCipherSuites) < 1 {
+		a.SendCipherSuites = b.SendCipherSuites
+	}
+	if len(a.ListenAllowedCNs) < 1 {
+		a.ListenAllowedCNs = b.ListenAllowedCNs
+	}
+	if len(a.ListenAllowedDNSNames) < 1 {
+		a.ListenAllowedDNSNames = b.ListenAllowedDNSNames
+	}
+	if len(a.ListenAllowedURIs) < 1 {
+		a.ListenAllowedURIs = b.ListenAllowedURIs
+	}
+	if len(a.ListenCRLPath) < 1 {
+		a.ListenCRLPath = b.ListenCRLPath
+	}
+	if len(a.ListenCRLRaw) < 1 {
+		a.ListenCRLRaw = b.ListenCRLRaw
+	}
+	if !a.ListenOCSPStapling {
+		a.ListenOCSPStapling = b.ListenOCSPStapling
+	}
+	if len(a.ListenOCSPResponder) < 1 {
+		a.ListenOCSPResponder = b.ListenOCSPResponder
+	}
+	if len(a.ListenOCSPRefresh) < 1 {
+		a.ListenOCSPRefresh = b.ListenOCSPRefresh
+	}
+	if len(a.ListenACMEDomains) < 1 {
+		a.ListenACMEDomains = b.ListenACMEDomains
+	}
+	if len(a.ListenACMEEmail) < 1 {
+		a.ListenACMEEmail = b.ListenACMEEmail
+	}
+	if len(a.ListenACMEDirectory) < 1 {
+		a.ListenACMEDirectory = b.ListenACMEDirectory
+	}
+	if len(a.ListenACMECacheDir) < 1 {
+		a.ListenACMECacheDir = b.ListenACMECacheDir
+	}
+	if len(a.SPIFFESocket) < 1 {
+		a.SPIFFESocket = b.SPIFFESocket
+	}
+	if !a.ListenSPIFFE {
+		a.ListenSPIFFE = b.ListenSPIFFE
+	}
+	if len(a.ListenSPIFFEIDs) < 1 {
+		a.ListenSPIFFEIDs = b.ListenSPIFFEIDs
+	}
+	if !a.SendSPIFFE {
+		a.SendSPIFFE = b.SendSPIFFE
+	}
+	if len(a.SendSPIFFEIDs) < 1 {
+		a.SendSPIFFEIDs = b.SendSPIFFEIDs
+	}
+	if len(a.ListenPrivatePassphrase) < 1 {
+		a.ListenPrivatePassphrase = b.ListenPrivatePassphrase
+	}
+	if len(a.ListenPrivatePassphrasePath) < 1 {
+		a.ListenPrivatePassphrasePath = b.ListenPrivatePassphrasePath
+	}
+	if len(a.SendPrivatePassphrase) < 1 {
+		a.SendPrivatePassphrase = b.SendPrivatePassphrase
+	}
+	if len(a.SendPrivatePassphrasePath) < 1 {
+		a.SendPrivatePassphrasePath = b.SendPrivatePassphrasePath
+	}
+	if len(a.ListenP12Path) < 1 {
+		a.ListenP12Path = b.ListenP12Path
+	}
+	if len(a.ListenP12Passphrase) < 1 {
+		a.ListenP12Passphrase = b.ListenP12Passphrase
+	}
+	if len(a.SendP12Path) < 1 {
+		a.SendP12Path = b.SendP12Path
+	}
+	if len(a.SendP12Passphrase) < 1 {
+		a.SendP12Passphrase = b.SendP12Passphrase
+	}
+	if len(a.PKCS11Module) < 1 {
+		a.PKCS11Module = b.PKCS11Module
+	}
+	if len(a.PKCS11TokenLabel) < 1 {
+		a.PKCS11TokenLabel = b.PKCS11TokenLabel
+	}
+	if len(a.PKCS11Slot) < 1 {
+		a.PKCS11Slot = b.PKCS11Slot
+	}
+	if len(a.PKCS11PIN) < 1 {
+		a.PKCS11PIN = b.PKCS11PIN
+	}
+	if len(a.ListenPKCS11KeyLabel) < 1 {
+		a.ListenPKCS11KeyLabel = b.ListenPKCS11KeyLabel
+	}
+	if len(a.SendPKCS11KeyLabel) < 1 {
+		a.SendPKCS11KeyLabel = b.SendPKCS11KeyLabel
+	}
+	if len(a.Mode) < 1 {
+		a.Mode = b.Mode
+	}
+	if len(a.ListenSessionTicketKeysPath) < 1 {
+		a.ListenSessionTicketKeysPath = b.ListenSessionTicketKeysPath
+	}
+	if len(a.ListenSessionTicketKeysRaw) < 1 {
+		a.ListenSessionTicketKeysRaw = b.ListenSessionTicketKeysRaw
+	}
+	if len(a.ListenSessionTicketRotation) < 1 {
+		a.ListenSessionTicketRotation = b.ListenSessionTicketRotation
+	}
+	if !a.ListenSessionTicketsDisabled {
+		a.ListenSessionTicketsDisabled = b.ListenSessionTicketsDisabled
+	}
+	if len(a.SendPinnedFingerprints) < 1 {
+		a.SendPinnedFingerprints = b.SendPinnedFingerprints
+	}
+	if !a.AccessLog {
+		a.AccessLog = b.AccessLog
+	}
+	if len(a.ListenALPN) < 1 {
+		a.ListenALPN = b.ListenALPN
+	}
+	if !a.ListenALPNRequired {
+		a.ListenALPNRequired = b.ListenALPNRequired
+	}
+	if len(a.SendALPN) < 1 {
+		a.SendALPN = b.SendALPN
+	}
+	if !a.SendALPNRequired {
+		a.SendALPNRequired = b.SendALPNRequired
+	}
+	if len(a.ClientAuth) < 1 {
+		a.ClientAuth = b.ClientAuth
+	}
+	if len(a.SendServerName) < 1 {
+		a.SendServerName = b.SendServerName
+	}
+	if !a.SendInsecureSkipVerify {
+		a.SendInsecureSkipVerify = b.SendInsecureSkipVerify
+	}
+	if !a.SendUseSystemRoots {
+		a.SendUseSystemRoots = b.SendUseSystemRoots
+	}
+	if len(a.SendRenegotiation) < 1 {
+		a.SendRenegotiation = b.SendRenegotiation
+	}
+	if !a.SendSessionResumption {
+		a.SendSessionResumption = b.SendSessionResumption
+	}
+	if len(a.ListenCertOverlap) < 1 {
+		a.ListenCertOverlap = b.ListenCertOverlap
+	}
+	if len(a.UDPIdleTimeout) < 1 {
+		a.UDPIdleTimeout = b.UDPIdleTimeout
+	}
+	if len(a.ListenProtocol) < 1 {
+		a.ListenProtocol = b.ListenProtocol
+	}
+	if len(a.SendProtocol) < 1 {
+		a.SendProtocol = b.SendProtocol
+	}
+	if len(a.ListenSocketMode) < 1 {
+		a.ListenSocketMode = b.ListenSocketMode
+	}
+	if len(a.ListenSocketOwner) < 1 {
+		a.ListenSocketOwner = b.ListenSocketOwner
+	}
+	if len(a.ListenSocketGroup) < 1 {
+		a.ListenSocketGroup = b.ListenSocketGroup
+	}
+	if len(a.SendProxyProtocol) < 1 {
+		a.SendProxyProtocol = b.SendProxyProtocol
+	}
+	if !a.ListenAcceptProxyProtocol {
+		a.ListenAcceptProxyProtocol = b.ListenAcceptProxyProtocol
+	}
+	if len(a.ListenProxyProtocolSources) < 1 {
+		a.ListenProxyProtocolSources = b.ListenProxyProtocolSources
+	}
+	if len(a.Balance) < 1 {
+		a.Balance = b.Balance
+	}
+	if len(a.HealthCheck) < 1 {
+		a.HealthCheck = b.HealthCheck
+	}
+	if len(a.HealthCheckInterval) < 1 {
+		a.HealthCheckInterval = b.HealthCheckInterval
+	}
+	if len(a.HealthCheckTimeout) < 1 {
+		a.HealthCheckTimeout = b.HealthCheckTimeout
+	}
+	if a.HealthCheckThreshold == 0 {
+		a.HealthCheckThreshold = b.HealthCheckThreshold
+	}
+	if len(a.DialTimeout) < 1 {
+		a.DialTimeout = b.DialTimeout
+	}
+	if len(a.IdleTimeout) < 1 {
+		a.IdleTimeout = b.IdleTimeout
+	}
+	if len(a.MaxConnectionAge) < 1 {
+		a.MaxConnectionAge = b.MaxConnectionAge
+	}
+	if a.MaxConnections == 0 {
+		a.MaxConnections = b.MaxConnections
+	}
+	if len(a.ConnectionRate) < 1 {
+		a.ConnectionRate = b.ConnectionRate
+	}
+	if a.ConnectionBurst == 0 {
+		a.ConnectionBurst = b.ConnectionBurst
+	}
+	if len(a.ConnectionBandwidth) < 1 {
+		a.ConnectionBandwidth = b.ConnectionBandwidth
+	}
+	if len(a.ProfileBandwidth) < 1 {
+		a.ProfileBandwidth = b.ProfileBandwidth
+	}
+	if len(a.DNSRefresh) < 1 {
+		a.DNSRefresh = b.DNSRefresh
+	}
+	if len(a.DNSPin) < 1 {
+		a.DNSPin = b.DNSPin
+	}
+	if len(a.DNSPrefer) < 1 {
+		a.DNSPrefer = b.DNSPrefer
+	}
+	if len(a.DrainTimeout) < 1 {
+		a.DrainTimeout = b.DrainTimeout
+	}
+	if len(a.HTTPProxy) < 1 {
+		a.HTTPProxy = b.HTTPProxy
+	}
+	if len(a.SOCKSProxy) < 1 {
+		a.SOCKSProxy = b.SOCKSProxy
+	}
+	if len(a.HTTPClientCertHeader) < 1 {
+		a.HTTPClientCertHeader = b.HTTPClientCertHeader
+	}
+	if len(a.HTTPClientCertFormat) < 1 {
+		a.HTTPClientCertFormat = b.HTTPClientCertFormat
+	}
+	if len(a.StartTLS) < 1 {
+		a.StartTLS = b.StartTLS
+	}
+	if len(a.AccessLogFormat) < 1 {
+		a.AccessLogFormat = b.AccessLogFormat
+	}
+	if len(a.LogLevel) < 1 {
+		a.LogLevel = b.LogLevel
+	}
+	if !a.SendConnectionID {
+		a.SendConnectionID = b.SendConnectionID
+	}
+	if len(a.HTTPConnectionIDHeader) < 1 {
+		a.HTTPConnectionIDHeader = b.HTTPConnectionIDHeader
+	}
+	if !a.AcceptConnectionID {
+		a.AcceptConnectionID = b.AcceptConnectionID
+	}
+	if a.Enabled == nil {
+		a.Enabled = b.Enabled
+	}
+	if len(a.VaultAddress) < 1 {
+		a.VaultAddress = b.VaultAddress
+	}
+	if len(a.VaultMount) < 1 {
+		a.VaultMount = b.VaultMount
+	}
+	if len(a.VaultTokenPath) < 1 {
+		a.VaultTokenPath = b.VaultTokenPath
+	}
+	if len(a.VaultAuthorityPath) < 1 {
+		a.VaultAuthorityPath = b.VaultAuthorityPath
+	}
+	if len(a.VaultTTL) < 1 {
+		a.VaultTTL = b.VaultTTL
+	}
+	if len(a.ListenVaultRole) < 1 {
+		a.ListenVaultRole = b.ListenVaultRole
+	}
+	if len(a.ListenVaultCommonName) < 1 {
+		a.ListenVaultCommonName = b.ListenVaultCommonName
+	}
+	if len(a.ListenVaultAltNames) < 1 {
+		a.ListenVaultAltNames = b.ListenVaultAltNames
+	}
+	if len(a.SendVaultRole) < 1 {
+		a.SendVaultRole = b.SendVaultRole
+	}
+	if len(a.SendVaultCommonName) < 1 {
+		a.SendVaultCommonName = b.SendVaultCommonName
+	}
+	if len(a.AzureKeyVault) < 1 {
+		a.AzureKeyVault = b.AzureKeyVault
+	}
+	if len(a.ListenAzureCertificate) < 1 {
+		a.ListenAzureCertificate = b.ListenAzureCertificate
+	}
+	if len(a.SendAzureCertificate) < 1 {
+		a.SendAzureCertificate = b.SendAzureCertificate
+	}
+	if !a.AzureRemoteKeys {
+		a.AzureRemoteKeys = b.AzureRemoteKeys
+	}
+	if a.ListenShards == 0 {
+		a.ListenShards = b.ListenShards
+	}
+	if a.CircuitBreakerFailures == 0 {
+		a.CircuitBreakerFailures = b.CircuitBreakerFailures
+	}
+	if len(a.CircuitBreakerCooldown) < 1 {
+		a.CircuitBreakerCooldown = b.CircuitBreakerCooldown
+	}
+	if a.DialRetries == 0 {
+		a.DialRetries = b.DialRetries
+	}
+	if len(a.DialRetryBackoff) < 1 {
+		a.DialRetryBackoff = b.DialRetryBackoff
+	}
+	if len(a.DialFailure) < 1 {
+		a.DialFailure = b.DialFailure
+	}
+	return a
+}
+
+// splitList splits a comma separated env value, dropping empty items.
+// parseNets parses CIDRs, a lone IP is a network of its own.
+func parseNets(list []string) (nets []*net.IPNet, err error) {
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func splitList(s string) (l []string) {
+	for _, x := range strings.Split(s, ",") {
+		if x = strings.TrimSpace(x); len(x) > 0 {
+			l = append(l, x)
+		}
+	}
+	return
+}
+
+func profileSuffix(x, s string) string {
+	if strings.HasSuffix(x, s) {
+		index := len(x) - len(s)
+		return x[:index]
+	}
+	return ""
+}
+
+func (p Profile) Copy() (nu *Profile) {
+	nu = new(Profile)
+	nu.Name = p.Name
+	nu.Listen = p.Listen
+	nu.Proxy = p.Proxy
+	nu.Protocol = p.Protocol
+	nu.ListenCertPath = p.ListenCertPath
+	nu.ListenCertRaw = p.ListenCertRaw
+	nu.ListenPrivatePath = p.ListenPrivatePath
+	nu.ListenPrivateRaw = p.ListenPrivateRaw
+	nu.ListenAuthorityPath = p.ListenAuthorityPath
+	nu.ListenAuthorityRaw = p.ListenAuthorityRaw
+	nu.SendCertPath = p.SendCertPath
+	nu.SendCertRaw = p.SendCertRaw
+	nu.SendPrivatePath = p.SendPrivatePath
+	nu.SendPrivateRaw = p.SendPrivateRaw
+	nu.SendAuthorityPath = p.SendAuthorityPath
+	nu.SendAuthorityRaw = p.SendAuthorityRaw
+	nu.DNSCacheTTL = p.DNSCacheTTL
+	nu.DNSNegativeTTL = p.DNSNegativeTTL
+	nu.DNSServeStale = p.DNSServeStale
+	nu.Routes = copyRoutes(p.Routes)
+	nu.ListenCertificates = copyCertPairs(p.ListenCertificates)
+	nu.MinTLSVersion = p.MinTLSVersion
+	nu.MaxTLSVersion = p.MaxTLSVersion
+	nu.ListenMinTLSVersion = p.ListenMinTLSVersion
+	nu.ListenMaxTLSVersion = p.ListenMaxTLSVersion
+	nu.SendMinTLSVersion = p.SendMinTLSVersion
+	nu.SendMaxTLSVersion = p.SendMaxTLSVersion
+	nu.ListenCipherSuites = append([]string(nil), p.ListenCipherSuites...)
+	nu.SendCipherSuites = append([]string(nil), p.SendCipherSuites...)
+	nu.ListenAllowedCNs = append([]string(nil), p.ListenAllowedCNs...)
+	nu.ListenAllowedDNSNames = append([]string(nil), p.ListenAllowedDNSNames...)
+	nu.ListenAllowedURIs = append([]string(nil), p.ListenAllowedURIs...)
+	nu.ListenCRLPath = p.ListenCRLPath
+	nu.ListenCRLRaw = p.ListenCRLRaw
+	nu.ListenOCSPStapling = p.ListenOCSPStapling
+	nu.ListenOCSPResponder = p.ListenOCSPResponder
+	nu.ListenOCSPRefresh = p.ListenOCSPRefresh
+	nu.ListenACMEDomains = append([]string(nil), p.ListenACMEDomains...)
+	nu.ListenACMEEmail = p.ListenACMEEmail
+	nu.ListenACMEDirectory = p.ListenACMEDirectory
+	nu.ListenACMECacheDir = p.ListenACMECacheDir
+	nu.SPIFFESocket = p.SPIFFESocket
+	nu.ListenSPIFFE = p.ListenSPIFFE
+	nu.ListenSPIFFEIDs = append([]string(nil), p.ListenSPIFFEIDs...)
+	nu.SendSPIFFE = p.SendSPIFFE
+	nu.SendSPIFFEIDs = append([]string(nil), p.SendSPIFFEIDs...)
+	nu.ListenPrivatePassphrase = p.ListenPrivatePassphrase
+	nu.ListenPrivatePassphrasePath = p.ListenPrivatePassphrasePath
+	nu.SendPrivatePassphrase = p.SendPrivatePassphrase
+	nu.SendPrivatePassphrasePath = p.SendPrivatePassphrasePath
+	nu.ListenP12Path = p.ListenP12Path
+	nu.ListenP12Passphrase = p.ListenP12Passphrase
+	nu.SendP12Path = p.SendP12Path
+	nu.SendP12Passphrase = p.SendP12Passphrase
+	nu.PKCS11Module = p.PKCS11Module
+	nu.PKCS11TokenLabel = p.PKCS11TokenLabel
+	nu.PKCS11Slot = p.PKCS11Slot
+	nu.PKCS11PIN = p.PKCS11PIN
+	nu.ListenPKCS11KeyLabel = p.ListenPKCS11KeyLabel
+	nu.SendPKCS11KeyLabel = p.SendPKCS11KeyLabel
+	nu.Mode = p.Mode
+	nu.ListenSessionTicketKeysPath = p.ListenSessionTicketKeysPath
+	nu.ListenSessionTicketKeysRaw = p.ListenSessionTicketKeysRaw
+	nu.ListenSessionTicketRotation = p.ListenSessionTicketRotation
+	nu.ListenSessionTicketsDisabled = p.ListenSessionTicketsDisabled
+	nu.SendPinnedFingerprints = append([]string(nil), p.SendPinnedFingerprints...)
+	nu.AccessLog = p.AccessLog
+	nu.ListenALPN = append([]string(nil), p.ListenALPN...)
+	nu.ListenALPNRequired = p.ListenALPNRequired
+	nu.SendALPN = append([]string(nil), p.SendALPN...)
+	nu.SendALPNRequired = p.SendALPNRequired
+	nu.ClientAuth = p.ClientAuth
+	nu.SendServerName = p.SendServerName
+	nu.SendInsecureSkipVerify = p.SendInsecureSkipVerify
+	nu.SendUseSystemRoots = p.SendUseSystemRoots
+	nu.SendRenegotiation = p.SendRenegotiation
+	nu.SendSessionResumption = p.SendSessionResumption
+	nu.ListenCertOverlap = p.ListenCertOverlap
+	nu.UDPIdleTimeout = p.UDPIdleTimeout
+	nu.ListenProtocol = p.ListenProtocol
+	nu.SendProtocol = p.SendProtocol
+	nu.ListenSocketMode = p.ListenSocketMode
+	nu.ListenSocketOwner = p.ListenSocketOwner
+	nu.ListenSocketGroup = p.ListenSocketGroup
+	nu.SendProxyProtocol = p.SendProxyProtocol
+	nu.ListenAcceptProxyProtocol = p.ListenAcceptProxyProtocol
+	nu.ListenProxyProtocolSources = append([]string(nil), p.ListenProxyProtocolSources...)
+	nu.Balance = p.Balance
+	nu.HealthCheck = p.HealthCheck
+	nu.HealthCheckInterval = p.HealthCheckInterval
+	nu.HealthCheckTimeout = p.HealthCheckTimeout
+	nu.HealthCheckThreshold = p.HealthCheckThreshold
+	nu.DialTimeout = p.DialTimeout
+	nu.IdleTimeout = p.IdleTimeout
+	nu.MaxConnectionAge = p.MaxConnectionAge
+	nu.MaxConnections = p.MaxConnections
+	nu.ConnectionRate = p.ConnectionRate
+	nu.ConnectionBurst = p.ConnectionBurst
+	nu.ConnectionBandwidth = p.ConnectionBandwidth
+	nu.ProfileBandwidth = p.ProfileBandwidth
+	nu.DNSRefresh = p.DNSRefresh
+	nu.DNSPin = append([]string(nil), p.DNSPin...)
+	nu.DNSPrefer = p.DNSPrefer
+	nu.DrainTimeout = p.DrainTimeout
+	nu.HTTPProxy = p.HTTPProxy
+	nu.SOCKSProxy = p.SOCKSProxy
+	nu.HTTPClientCertHeader = p.HTTPClientCertHeader
+	nu.HTTPClientCertFormat = p.HTTPClientCertFormat
+	nu.StartTLS = p.StartTLS
+	nu.AccessLogFormat = p.AccessLogFormat
+	nu.LogLevel = p.LogLevel
+	nu.SendConnectionID = p.SendConnectionID
+	nu.HTTPConnectionIDHeader = p.HTTPConnectionIDHeader
+	nu.AcceptConnectionID = p.AcceptConnectionID
+	if p.Enabled != nil {
+		enabled := *p.Enabled
+		nu.Enabled = &enabled
+	}
+	nu.VaultAddress = p.VaultAddress
+	nu.VaultMount = p.VaultMount
+	nu.VaultTokenPath = p.VaultTokenPath
+	nu.VaultAuthorityPath = p.VaultAuthorityPath
+	nu.VaultTTL = p.VaultTTL
+	nu.ListenVaultRole = p.ListenVaultRole
+	nu.ListenVaultCommonName = p.ListenVaultCommonName
+	nu.ListenVaultAltNames = append([]string(nil), p.ListenVaultAltNames...)
+	nu.SendVaultRole = p.SendVaultRole
+	nu.SendVaultCommonName = p.SendVaultCommonName
+	nu.AzureKeyVault = p.AzureKeyVault
+	nu.ListenAzureCertificate = p.ListenAzureCertificate
+	nu.SendAzureCertificate = p.SendAzureCertificate
+	nu.AzureRemoteKeys = p.AzureRemoteKeys
+	nu.ListenShards = p.ListenShards
+	nu.CircuitBreakerFailures = p.CircuitBreakerFailures
+	nu.CircuitBreakerCooldown = p.CircuitBreakerCooldown
+	nu.DialRetries = p.DialRetries
+	nu.DialRetryBackoff = p.DialRetryBackoff
+	nu.DialFailure = p.DialFailure
+	nu.Source = p.Source
+	return
+}
+
+// resolve will load any files from the filesystem that are pending
+func (p *Profile) Resolve() error {
+	p.unresolved = p.Copy()
+	if err := p.resolveVault(); err != nil {
+		return err
+	}
+	if err := p.resolveAzure(); err != nil {
+		return err
+	}
+	if len(p.ListenCertRaw) < 1 && len(p.ListenCertPath) > 0 {
+		b, err := readFile(p.ListenCertPath)
+		if err != nil {
+			return fmt.Errorf("reading file %q: %w", p.ListenCertPath, err)
+		}
+		p.ListenCertRaw = string(b)
+	}
+	if len(p.SendCertRaw) < 1 && len(p.SendCertPath) > 0 {
+		b, err := readFile(p.SendCertPath)
+		if err != nil {
+			return fmt.Errorf("reading file %q: %w", p.SendCertPath, err)
+		}
+		p.SendCertRaw = string(b)
+	}
+	if len(p.ListenPrivateRaw) < 1 && len(p.ListenPrivatePath) > 0 {
+		b, err := readFile(p.ListenPrivatePath)
+		if err != nil {
+			return fmt.Errorf("reading file %q: %w", p.ListenPrivatePath, err)
+		}
+		p.ListenPrivateRaw = string(b)
+	}
+	if len(p.SendPrivateRaw) < 1 && len(p.SendPrivatePath) > 0 {
+		b, err := readFile(p.SendPrivatePath)
+		if err != nil {
+			return fmt.Errorf("reading file %q: %w", p.SendPrivatePath, err)
+		}
+		p.SendPrivateRaw = string(b)
+	}
+	if len(p.ListenAuthorityRaw) < 1 && len(p.ListenAuthorityPath) > 0 {
+		b, err := readFile(p.ListenAuthorityPath)
+		if err != nil {
+			return fmt.Errorf("reading file %q: %w", p.ListenAuthorityPath, err)
+		}
+		p.ListenAuthorityRaw = string(b)
+	}
+	if len(p.SendAuthorityRaw) < 1 && len(p.SendAuthorityPath) > 0 {
+		b, err := readFile(p.SendAuthorityPath)
+		if err != nil {
+			return fmt.Errorf("reading file %q: %w", p.SendAuthorityPath, err)
+		}
+		p.SendAuthorityRaw = string(b)
+	}
+	if len(p.DNSCacheTTL) > 0 {
+		d, err := time.ParseDuration(p.DNSCacheTTL)
+		if err != nil {
+			return fmt.Errorf("parsing DNSCacheTTL %q: %w", p.DNSCacheTTL, err)
+		}
+		p.dnsCacheTTL = d
+	}
+	if len(p.DNSNegativeTTL) > 0 {
+		d, err := time.ParseDuration(p.DNSNegativeTTL)
+		if err != nil {
+			return fmt.Errorf("parsing DNSNegativeTTL %q: %w", p.DNSNegativeTTL, err)
+		}
+		p.dnsNegativeTTL = d
+	}
+	if (len(p.DNSNegativeTTL) > 0 || p.DNSServeStale) && (len(p.DNSCacheTTL) < 1 || p.dnsCacheTTL <= 0) {
+		return errors.New("DNSNegativeTTL and DNSServeStale need a positive DNSCacheTTL")
+	}
+	if len(p.DNSRefresh) > 0 {
+		d, err := time.ParseDuration(p.DNSRefresh)
+		if err != nil {
+			return fmt.Errorf("parsing DNSRefresh %q: %w", p.DNSRefresh, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("DNSRefresh %q isn't positive", p.DNSRefresh)
+		}
+		p.dnsRefresh = d
+	}
+	p.dnsPins = nil
+	if len(p.DNSPin) > 0 {
+		pins, err := parseNets(p.DNSPin)
+		if err != nil {
+			return fmt.Errorf("DNSPin: %w", err)
+		}
+		p.dnsPins = pins
+	}
+	switch p.DNSPrefer {
+	case "", PreferIPv4, PreferIPv6:
+	default:
+		return fmt.Errorf("DNSPrefer %q isn't %q or %q", p.DNSPrefer, PreferIPv4, PreferIPv6)
+	}
+	p.httpProxy = nil
+	if len(p.HTTPProxy) > 0 {
+		u, err := parseHTTPProxy(p.HTTPProxy)
+		if err != nil {
+			return fmt.Errorf("HTTPProxy: %w", err)
+		}
+		if n := p.sendNetwork(); n != "tcp" && n != "tcp4" && n != "tcp6" {
+			return fmt.Errorf("HTTPProxy can't be used with %s destinations", n)
+		}
+		p.httpProxy = u
+	}
+	p.socksProxy = nil
+	if len(p.SOCKSProxy) > 0 {
+		if len(p.HTTPProxy) > 0 {
+			return errors.New("HTTPProxy and SOCKSProxy can't both be set")
+		}
+		u, err := parseSOCKSProxy(p.SOCKSProxy)
+		if err != nil {
+			return fmt.Errorf("SOCKSProxy: %w", err)
+		}
+		if n := p.sendNetwork(); n != "tcp" && n != "tcp4" && n != "tcp6" {
+			return fmt.Errorf("SOCKSProxy can't be used with %s destinations", n)
+		}
+		if _, err := socksDialer(u); err != nil {
+			return fmt.Errorf("SOCKSProxy: %w", err)
+		}
+		p.socksProxy = u
+	}
+	if err := readPending(&p.ListenCRLRaw, p.ListenCRLPath); err != nil {
+		return err
+	}
+	for i, cp := range p.ListenCertificates {
+		if err := cp.resolve(); err != nil {
+			return fmt.Errorf("listen certificate %d: %w", i+1, err)
+		}
+	}
+	if len(p.ListenP12Path) > 0 {
+		if len(p.ListenCertRaw) > 0 || len(p.ListenPrivateRaw) > 0 {
+			return errors.New("a listen PKCS#12 bundle can't be combined with a listen certificate or key")
+		}
+		var err error
+		if p.ListenCertRaw, p.ListenPrivateRaw, err = readP12(p.ListenP12Path, p.ListenP12Passphrase); err != nil {
+			return err
+		}
+	}
+	if len(p.SendP12Path) > 0 {
+		if len(p.SendCertRaw) > 0 || len(p.SendPrivateRaw) > 0 {
+			return errors.New("a send PKCS#12 bundle can't be combined with a send certificate or key")
+		}
+		var err error
+		if p.SendCertRaw, p.SendPrivateRaw, err = readP12(p.SendP12Path, p.SendP12Passphrase); err != nil {
+			return err
 		}
 	}
-	return result
+	if err := readPending(&p.ListenSessionTicketKeysRaw, p.ListenSessionTicketKeysPath); err != nil {
+		return err
+	}
+	if err := p.sessionTickets(); err != nil {
+		return err
+	}
+	p.dialTimeout = defaultDialTimeout
+	if len(p.DialTimeout) > 0 {
+		d, err := time.ParseDuration(p.DialTimeout)
+		if err != nil {
+			return fmt.Errorf("parsing DialTimeout %q: %w", p.DialTimeout, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("DialTimeout %q isn't positive", p.DialTimeout)
+		}
+		p.dialTimeout = d
+	}
+	if p.DialRetries < 0 {
+		return fmt.Errorf("DialRetries %d is negative", p.DialRetries)
+	}
+	p.dialBackoff = defaultDialBackoff
+	if len(p.DialRetryBackoff) > 0 {
+		d, err := time.ParseDuration(p.DialRetryBackoff)
+		if err != nil {
+			return fmt.Errorf("parsing DialRetryBackoff %q: %w", p.DialRetryBackoff, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("DialRetryBackoff %q isn't positive", p.DialRetryBackoff)
+		}
+		p.dialBackoff = d
+	}
+	if p.CircuitBreakerFailures < 0 {
+		return fmt.Errorf("CircuitBreakerFailures %d is negative", p.CircuitBreakerFailures)
+	}
+	p.circuitCooldown = defaultCircuitCooldown
+	if len(p.CircuitBreakerCooldown) > 0 {
+		d, err := time.ParseDuration(p.CircuitBreakerCooldown)
+		if err != nil {
+			return fmt.Errorf("parsing CircuitBreakerCooldown %q: %w", p.CircuitBreakerCooldown, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("CircuitBreakerCooldown %q isn't positive", p.CircuitBreakerCooldown)
+		}
+		p.circuitCooldown = d
+	}
+	if len(p.ConnectionRate) > 0 {
+		r, err := strconv.ParseFloat(p.ConnectionRate, 64)
+		if err != nil {
+			return fmt.Errorf("parsing ConnectionRate %q: %w", p.ConnectionRate, err)
+		}
+		if r <= 0 {
+			return fmt.Errorf("ConnectionRate %q isn't positive", p.ConnectionRate)
+		}
+		p.connRate = r
+	}
+	if p.ConnectionBurst < 0 {
+		return fmt.Errorf("ConnectionBurst %d is negative", p.ConnectionBurst)
+	}
+	if len(p.ConnectionBandwidth) > 0 {
+		n, err := parseByteRate(p.ConnectionBandwidth)
+		if err != nil {
+			return fmt.Errorf("ConnectionBandwidth: %w", err)
+		}
+		p.connBandwidth = n
+	}
+	if len(p.ProfileBandwidth) > 0 {
+		n, err := parseByteRate(p.ProfileBandwidth)
+		if err != nil {
+			return fmt.Errorf("ProfileBandwidth: %w", err)
+		}
+		p.profileBandwidth = n
+	}
+	if p.MaxConnections < 0 {
+		return fmt.Errorf("MaxConnections %d is negative", p.MaxConnections)
+	}
+	if len(p.IdleTimeout) > 0 {
+		d, err := time.ParseDuration(p.IdleTimeout)
+		if err != nil {
+			return fmt.Errorf("parsing IdleTimeout %q: %w", p.IdleTimeout, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("IdleTimeout %q isn't positive", p.IdleTimeout)
+		}
+		p.idleTimeout = d
+	}
+	if len(p.DrainTimeout) > 0 {
+		d, err := time.ParseDuration(p.DrainTimeout)
+		if err != nil {
+			return fmt.Errorf("parsing DrainTimeout %q: %w", p.DrainTimeout, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("DrainTimeout %q isn't positive", p.DrainTimeout)
+		}
+		p.drainTimeout = d
+	}
+	if len(p.MaxConnectionAge) > 0 {
+		d, err := time.ParseDuration(p.MaxConnectionAge)
+		if err != nil {
+			return fmt.Errorf("parsing MaxConnectionAge %q: %w", p.MaxConnectionAge, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("MaxConnectionAge %q isn't positive", p.MaxConnectionAge)
+		}
+		p.maxAge = d
+	}
+	p.udpIdle = defaultUDPIdleTimeout
+	if len(p.UDPIdleTimeout) > 0 {
+		d, err := time.ParseDuration(p.UDPIdleTimeout)
+		if err != nil {
+			return fmt.Errorf("parsing UDPIdleTimeout %q: %w", p.UDPIdleTimeout, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("UDPIdleTimeout %q isn't positive", p.UDPIdleTimeout)
+		}
+		p.udpIdle = d
+	}
+	if len(p.ListenCertOverlap) > 0 {
+		d, err := time.ParseDuration(p.ListenCertOverlap)
+		if err != nil {
+			return fmt.Errorf("parsing ListenCertOverlap %q: %w", p.ListenCertOverlap, err)
+		}
+		p.certOverlap = d
+	}
+	if len(p.ListenOCSPRefresh) > 0 {
+		d, err := time.ParseDuration(p.ListenOCSPRefresh)
+		if err != nil {
+			return fmt.Errorf("parsing ListenOCSPRefresh %q: %w", p.ListenOCSPRefresh, err)
+		}
+		p.ocspRefresh = d
+	}
+	var err error
+	if p.listenPerms, err = parseSocketPerms(p); err != nil {
+		return err
+	}
+	if p.listenPerms.set() && !isUnix(p.listenNetwork()) {
+		return errors.New("ListenSocket options require a unix or unixpacket listener")
+	}
+	if p.ListenShards < 0 {
+		return errors.New("ListenShards can't be negative")
+	}
+	if p.ListenShards > 0 {
+		if n := p.listenNetwork(); n != "tcp" && n != "tcp4" && n != "tcp6" {
+			return errors.New("ListenShards requires a tcp listener")
+		}
+		if !reusePortSupport {
+			return errors.New("ListenShards needs SO_REUSEPORT, which this platform doesn't have")
+		}
+	}
+	p.listenMinTLS, p.listenMaxTLS, err = tlsVersionRange(p.MinTLSVersion, p.MaxTLSVersion, p.ListenMinTLSVersion, p.ListenMaxTLSVersion)
+	if err != nil {
+		return fmt.Errorf("listen side: %w", err)
+	}
+	p.sendMinTLS, p.sendMaxTLS, err = tlsVersionRange(p.MinTLSVersion, p.MaxTLSVersion, p.SendMinTLSVersion, p.SendMaxTLSVersion)
+	if err != nil {
+		return fmt.Errorf("send side: %w", err)
+	}
+	if p.listenCiphers, err = parseCipherSuites(p.ListenCipherSuites); err != nil {
+		return fmt.Errorf("listen side: %w", err)
+	}
+	if p.sendCiphers, err = parseCipherSuites(p.SendCipherSuites); err != nil {
+		return fmt.Errorf("send side: %w", err)
+	}
+	if p.ListenSPIFFE && (len(p.ListenCertRaw) > 0 || len(p.ListenAuthorityRaw) > 0 || len(p.ListenACMEDomains) > 0) {
+		return errors.New("SPIFFE can't be combined with a listen certificate or authority")
+	}
+	if p.SendSPIFFE && (len(p.SendCertRaw) > 0 || len(p.SendAuthorityRaw) > 0) {
+		return errors.New("SPIFFE can't be combined with a send certificate or authority")
+	}
+	if p.listenSPIFFEIDs, err = parseSPIFFEIDs(p.ListenSPIFFEIDs); err != nil {
+		return err
+	}
+	if p.sendSPIFFEIDs, err = parseSPIFFEIDs(p.SendSPIFFEIDs); err != nil {
+		return err
+	}
+	if p.ListenALPNRequired && len(p.ListenALPN) < 1 {
+		return errors.New("ListenALPNRequired requires ListenALPN")
+	}
+	if p.SendALPNRequired && len(p.SendALPN) < 1 {
+		return errors.New("SendALPNRequired requires SendALPN")
+	}
+	if p.renegotiation, err = parseRenegotiation(p.SendRenegotiation); err != nil {
+		return err
+	}
+	if p.sendPins, err = parsePins(p.SendPinnedFingerprints); err != nil {
+		return err
+	}
+	if p.SendSPIFFE && (len(p.SendServerName) > 0 || p.SendInsecureSkipVerify || p.SendUseSystemRoots) {
+		return errors.New("SendServerName, SendInsecureSkipVerify and SendUseSystemRoots can't be used with SendSPIFFE")
+	}
+	if len(p.sendPins) > 0 && p.SendSPIFFE {
+		return errors.New("SendPinnedFingerprints can't be used with SendSPIFFE")
+	}
+	if len(p.ListenACMEDomains) > 0 && (len(p.ListenCertRaw) > 0 || len(p.ListenCertificates) > 0) {
+		return errors.New("a listen certificate can't be combined with ACME")
+	}
+	if p.clientAuth, err = parseClientAuth(p.ClientAuth, len(p.ListenAuthorityRaw) > 0); err != nil {
+		return err
+	}
+	if len(p.ClientAuth) > 0 {
+		if p.clientAuth != tls.NoClientCert && !p.listenCertificate() {
+			return errors.New("a client auth policy requires a listen certificate")
+		}
+		verifying := p.clientAuth == tls.VerifyClientCertIfGiven || p.clientAuth == tls.RequireAndVerifyClientCert
+		if (len(p.ListenCRLRaw) > 0 || p.hasClientAllowlist()) && !verifying {
+			return fmt.Errorf("allow lists and revocation lists can't be used with the client auth policy %q", p.ClientAuth)
+		}
+	}
+	if len(p.ListenCRLRaw) > 0 {
+		if len(p.ListenAuthorityRaw) < 1 {
+			return errors.New("a revocation list requires a listen authority")
+		}
+		if p.listenCRLs, err = parseCRLs(p.ListenCRLRaw, p.ListenAuthorityRaw); err != nil {
+			return withCode(codeCertParse, fmt.Errorf("listen revocation list: %w", err))
+		}
+	}
+	if p.hasClientAllowlist() && len(p.ListenAuthorityRaw) < 1 {
+		return errors.New("client certificate allow lists require a listen authority")
+	}
+	if err := p.checkQUIC(); err != nil {
+		return err
+	}
+	if err := p.checkStartTLS(); err != nil {
+		return err
+	}
+	if isPacket(p.listenNetwork()) || isPacket(p.sendNetwork()) {
+		if err := p.checkPacketOptions(); err != nil {
+			return err
+		}
+	}
+	switch p.Balance {
+	case "", BalanceRoundRobin, BalanceLeastConnections, BalanceRandom, BalanceFailover:
+	default:
+		return fmt.Errorf("Balance %q isn't %q, %q, %q or %q", p.Balance, BalanceRoundRobin, BalanceLeastConnections, BalanceRandom, BalanceFailover)
+	}
+	if err := p.healthCheck(); err != nil {
+		return err
+	}
+	switch p.DialFailure {
+	case "", DialFailureClose, DialFailureReset, DialFailureRefuse:
+	case DialFailureBadGateway:
+		if p.Mode != ModeHTTP {
+			return fmt.Errorf("DialFailure %q requires http mode", p.DialFailure)
+		}
+	default:
+		return fmt.Errorf("DialFailure %q isn't %q, %q, %q or %q", p.DialFailure, DialFailureClose, DialFailureReset, DialFailureRefuse, DialFailureBadGateway)
+	}
+	switch p.SendProxyProtocol {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+	default:
+		return fmt.Errorf("SendProxyProtocol %q isn't %q or %q", p.SendProxyProtocol, ProxyProtocolV1, ProxyProtocolV2)
+	}
+	if p.SendConnectionID && p.SendProxyProtocol != ProxyProtocolV2 {
+		return fmt.Errorf("SendConnectionID requires SendProxyProtocol %q", ProxyProtocolV2)
+	}
+	if p.AcceptConnectionID && !p.ListenAcceptProxyProtocol && len(p.HTTPConnectionIDHeader) < 1 {
+		return errors.New("AcceptConnectionID requires ListenAcceptProxyProtocol or HTTPConnectionIDHeader")
+	}
+	if p.ListenAcceptProxyProtocol && len(p.ListenProxyProtocolSources) < 1 && !isUnix(p.listenNetwork()) {
+		// anyone else could claim to be any client
+		return errors.New("ListenAcceptProxyProtocol requires ListenProxyProtocolSources")
+	}
+	if len(p.ListenProxyProtocolSources) > 0 && !p.ListenAcceptProxyProtocol {
+		return errors.New("ListenProxyProtocolSources requires ListenAcceptProxyProtocol")
+	}
+	if p.proxySources, err = parseNets(p.ListenProxyProtocolSources); err != nil {
+		return fmt.Errorf("ListenProxyProtocolSources: %w", err)
+	}
+	if len(p.LogLevel) > 0 {
+		if _, err := parseLevel(p.LogLevel); err != nil {
+			return fmt.Errorf("LogLevel: %w", err)
+		}
+	}
+	switch p.AccessLogFormat {
+	case "", AccessLogJSON, AccessLogCommon, AccessLogKV:
+	default:
+		return fmt.Errorf("AccessLogFormat %q isn't %q, %q or %q", p.AccessLogFormat, AccessLogJSON, AccessLogCommon, AccessLogKV)
+	}
+	switch p.Mode {
+	case "", ModeTerminate, ModeHTTP:
+	case ModePassthrough:
+		if len(p.ListenAuthorityRaw) > 0 || p.listenCertificate() {
+			return errors.New("listen TLS options can't be used in passthrough mode")
+		}
+		if len(p.SendAuthorityRaw) > 0 || len(p.SendCertRaw) > 0 || p.SendSPIFFE || len(p.sendPins) > 0 || len(p.SendServerName) > 0 || p.SendInsecureSkipVerify || p.SendUseSystemRoots {
+			return errors.New("send TLS options can't be used in passthrough mode")
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", p.Mode)
+	}
+	if err := p.checkHTTPMode(); err != nil {
+		return err
+	}
+	if len(p.Routes) > 0 {
+		if !p.listenCertificate() && !p.passthrough() {
+			return errors.New("routes require a listen certificate or passthrough mode to read the server name")
+		}
+		routes := make(map[string]*Route, len(p.Routes))
+		for name, r := range p.Routes {
+			if err := r.resolve(); err != nil {
+				return fmt.Errorf("route %q: %w", name, err)
+			}
+			if p.passthrough() && r.hasTLS() {
+				return fmt.Errorf("route %q: send TLS options can't be used in passthrough mode", name)
+			}
+			routes[strings.ToLower(name)] = r
+		}
+		p.Routes = routes
+	}
+	if err := p.decryptKeys(); err != nil {
+		return err
+	}
+	if err := p.pkcs11Keys(); err != nil {
+		return err
+	}
+	return nil
 }
 
-func mergeProfile(a, b *Profile) *Profile {
-	if a == nil {
-		if b != nil {
-			return b
+// pkcs11Keys finds the private keys held on a PKCS#11 token.
+func (p *Profile) pkcs11Keys() (err error) {
+	if len(p.ListenPKCS11KeyLabel) < 1 && len(p.SendPKCS11KeyLabel) < 1 {
+		return nil
+	}
+	if len(p.PKCS11Module) < 1 {
+		return errors.New("PKCS11Module is required for PKCS#11 keys")
+	}
+	if len(p.PKCS11TokenLabel) < 1 && len(p.PKCS11Slot) < 1 {
+		return errors.New("PKCS11TokenLabel or PKCS11Slot is required for PKCS#11 keys")
+	}
+
+	if len(p.ListenPKCS11KeyLabel) > 0 {
+		if len(p.ListenPrivateRaw) > 0 {
+			return errors.New("ListenPKCS11KeyLabel can't be used with a listen private key")
 		}
-		a = new(Profile)
+		if len(p.ListenCertRaw) < 1 {
+			return errors.New("ListenPKCS11KeyLabel requires a listen certificate")
+		}
+		if p.listenSigner, err = pkcs11Signer(p, p.ListenPKCS11KeyLabel); err != nil {
+			return fmt.Errorf("listen key: %w", err)
+		}
+	}
+	if len(p.SendPKCS11KeyLabel) > 0 {
+		if len(p.SendPrivateRaw) > 0 {
+			return errors.New("SendPKCS11KeyLabel can't be used with a send private key")
+		}
+		if len(p.SendCertRaw) < 1 {
+			return errors.New("SendPKCS11KeyLabel requires a send certificate")
+		}
+		if p.sendSigner, err = pkcs11Signer(p, p.SendPKCS11KeyLabel); err != nil {
+			return fmt.Errorf("send key: %w", err)
+		}
+	}
+	return nil
+}
+
+// decryptKeys decrypts any encrypted private keys with the passphrases.
+func (p *Profile) decryptKeys() (err error) {
+	if err = readPending(&p.ListenPrivatePassphrase, p.ListenPrivatePassphrasePath); err != nil {
+		return
+	}
+	if err = readPending(&p.SendPrivatePassphrase, p.SendPrivatePassphrasePath); err != nil {
+		return
+	}
+	listenPass := strings.TrimRight(p.ListenPrivatePassphrase, "\r\n")
+	sendPass := strings.TrimRight(p.SendPrivatePassphrase, "\r\n")
+
+	if p.ListenPrivateRaw, err = decryptPrivateKey(p.ListenPrivateRaw, listenPass); err != nil {
+		return fmt.Errorf("decrypting listen private key: %w", err)
+	}
+	if p.SendPrivateRaw, err = decryptPrivateKey(p.SendPrivateRaw, sendPass); err != nil {
+		return fmt.Errorf("decrypting send private key: %w", err)
+	}
+	for name, r := range p.Routes {
+		if r.SendPrivateRaw, err = decryptPrivateKey(r.SendPrivateRaw, sendPass); err != nil {
+			return fmt.Errorf("decrypting route %q private key: %w", name, err)
+		}
+	}
+	for i, cp := range p.ListenCertificates {
+		if cp.PrivateRaw, err = decryptPrivateKey(cp.PrivateRaw, listenPass); err != nil {
+			return fmt.Errorf("decrypting listen certificate %d private key: %w", i+1, err)
+		}
+	}
+	return
+}
+
+// sessionTickets parses the session ticket options.
+func (p *Profile) sessionTickets() (err error) {
+	if len(p.ListenSessionTicketKeysRaw) > 0 {
+		if p.ListenSessionTicketsDisabled {
+			return errors.New("session ticket keys can't be used with session tickets disabled")
+		}
+		if p.ticketKeys, err = parseTicketKeys(p.ListenSessionTicketKeysRaw); err != nil {
+			return fmt.Errorf("session ticket keys: %w", err)
+		}
+	}
+	if len(p.ListenSessionTicketRotation) > 0 {
+		if len(p.ticketKeys) < 1 {
+			return errors.New("ListenSessionTicketRotation requires session ticket keys")
+		}
+		if p.ticketRotation, err = time.ParseDuration(p.ListenSessionTicketRotation); err != nil {
+			return fmt.Errorf("parsing ListenSessionTicketRotation %q: %w", p.ListenSessionTicketRotation, err)
+		}
+		if p.ticketRotation < time.Minute {
+			return fmt.Errorf("ListenSessionTicketRotation %q is under a minute", p.ListenSessionTicketRotation)
+		}
+	}
+	return nil
+}
+
+// checkPacketOptions rejects the options that only work over streams.
+func (p *Profile) checkPacketOptions() error {
+	var unsupported []string
+	check := func(set bool, name string) {
+		if set {
+			unsupported = append(unsupported, name)
+		}
+	}
+	check(p.passthrough(), "passthrough mode")
+	check(p.Mode == ModeHTTP, "http mode")
+	check(len(p.Routes) > 0, "Routes")
+	check(len(p.ListenACMEDomains) > 0, "ListenACMEDomains")
+	check(p.ListenSPIFFE || p.SendSPIFFE, "SPIFFE")
+	check(p.ListenOCSPStapling, "ListenOCSPStapling")
+	check(len(p.ListenALPN) > 0 || len(p.SendALPN) > 0, "ALPN")
+	check(len(p.ListenSessionTicketKeysRaw) > 0, "session ticket keys")
+	check(len(p.SendProxyProtocol) > 0 || p.ListenAcceptProxyProtocol, "PROXY protocol")
+	check(len(p.HealthCheck) > 0, "HealthCheck")
+	check(len(p.DialFailure) > 0 && p.DialFailure != DialFailureClose, "DialFailure")
+	if len(unsupported) > 0 {
+		return fmt.Errorf("%s can't be used over UDP", strings.Join(unsupported, ", "))
+	}
+	return nil
+}
+
+// healthCheck checks and parses the HealthCheck options.
+func (p *Profile) healthCheck() error {
+	switch p.HealthCheck {
+	case "", HealthCheckTCP, HealthCheckTLS:
+	default:
+		return fmt.Errorf("HealthCheck %q isn't %q or %q", p.HealthCheck, HealthCheckTCP, HealthCheckTLS)
+	}
+	if p.HealthCheckThreshold < 0 {
+		return fmt.Errorf("HealthCheckThreshold %d is negative", p.HealthCheckThreshold)
+	}
+	p.healthInterval = defaultHealthInterval
+	if len(p.HealthCheckInterval) > 0 {
+		d, err := time.ParseDuration(p.HealthCheckInterval)
+		if err != nil {
+			return fmt.Errorf("parsing HealthCheckInterval %q: %w", p.HealthCheckInterval, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("HealthCheckInterval %q isn't positive", p.HealthCheckInterval)
+		}
+		p.healthInterval = d
+	}
+	p.healthTimeout = defaultHealthTimeout
+	if len(p.HealthCheckTimeout) > 0 {
+		d, err := time.ParseDuration(p.HealthCheckTimeout)
+		if err != nil {
+			return fmt.Errorf("parsing HealthCheckTimeout %q: %w", p.HealthCheckTimeout, err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("HealthCheckTimeout %q isn't positive", p.HealthCheckTimeout)
+		}
+		p.healthTimeout = d
+	}
+	return nil
+}
+
+// enabled reports if the profile is started, profiles are unless Enabled is
+// false.
+func (p *Profile) enabled() bool {
+	return p.Enabled == nil || *p.Enabled
+}
+
+// listenNetwork is the network the listener uses, ListenProtocol before
+// Protocol.
+func (p *Profile) listenNetwork() string {
+	if len(p.ListenProtocol) > 0 {
+		return p.ListenProtocol
+	}
+	if len(p.Protocol) > 0 {
+		return p.Protocol
+	}
+	return "tcp"
+}
+
+// sendNetwork is the network used to reach the destination, SendProtocol
+// before Protocol.
+func (p *Profile) sendNetwork() string {
+	if len(p.SendProtocol) > 0 {
+		return p.SendProtocol
+	}
+	if len(p.Protocol) > 0 {
+		return p.Protocol
+	}
+	return "tcp"
+}
+
+// passthrough reports if TLS is forwarded to the destination untouched.
+func (p *Profile) passthrough() bool {
+	return p.Mode == ModePassthrough
+}
+
+// listenCertificate reports if the listen side has a certificate to serve.
+func (p *Profile) listenCertificate() bool {
+	return len(p.ListenCertRaw) > 0 || len(p.ListenCertificates) > 0 || len(p.ListenACMEDomains) > 0 || p.ListenSPIFFE
+}
+
+func (p *Profile) hasClientAllowlist() bool {
+	return len(p.ListenAllowedCNs) > 0 || len(p.ListenAllowedDNSNames) > 0 || len(p.ListenAllowedURIs) > 0
+}
+
+// Reresolve returns a copy of the profile with its files read again.
+func (p *Profile) Reresolve() (*Profile, error) {
+	nu := p.unresolved.Copy()
+	if err := nu.Resolve(); err != nil {
+		return nil, err
+	}
+	return nu, nil
+}
+
+// filePaths lists every file the profile reads.
+func (p *Profile) filePaths() (paths []string) {
+	for _, path := range p.paths() {
+		if !isAWSSecret(path) {
+			paths = append(paths, path)
+		}
+	}
+	return
+}
+
+// usesAWSSecrets reports if the profile reads any path from AWS.
+func (p *Profile) usesAWSSecrets() bool {
+	for _, path := range p.paths() {
+		if isAWSSecret(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// paths lists every path the profile reads, files or secrets in AWS.
+func (p *Profile) paths() (paths []string) {
+	add := func(path string) {
+		if len(path) > 0 {
+			paths = append(paths, path)
+		}
+	}
+	add(p.ListenCertPath)
+	add(p.ListenPrivatePath)
+	add(p.ListenAuthorityPath)
+	add(p.ListenCRLPath)
+	add(p.ListenSessionTicketKeysPath)
+	add(p.ListenP12Path)
+	add(p.SendP12Path)
+	add(p.ListenPrivatePassphrasePath)
+	add(p.SendPrivatePassphrasePath)
+	add(p.SendCertPath)
+	add(p.SendPrivatePath)
+	add(p.SendAuthorityPath)
+	for _, r := range p.Routes {
+		add(r.SendCertPath)
+		add(r.SendPrivatePath)
+		add(r.SendAuthorityPath)
+	}
+	for _, cp := range p.ListenCertificates {
+		add(cp.CertPath)
+		add(cp.PrivatePath)
+	}
+	return
+}
+
+// ListenChanged will compare profiles to see if the listen side of the connection
+// needs to be changed.
+func (p *Profile) ListenChanged(q *Profile) bool {
+	if p.Listen != q.Listen {
+		return true
+	}
+	if p.Protocol != q.Protocol {
+		return true
+	}
+	if p.ListenAuthorityRaw != q.ListenAuthorityRaw {
+		return true
+	}
+	if p.ListenCertRaw != q.ListenCertRaw {
+		return true
+	}
+	if p.ListenPrivateRaw != q.ListenPrivateRaw {
+		return true
+	}
+	if p.MinTLSVersion != q.MinTLSVersion {
+		return true
+	}
+	if p.MaxTLSVersion != q.MaxTLSVersion {
+		return true
+	}
+	if p.ListenMinTLSVersion != q.ListenMinTLSVersion {
+		return true
+	}
+	if p.ListenMaxTLSVersion != q.ListenMaxTLSVersion {
+		return true
+	}
+	if !slices.Equal(p.ListenCipherSuites, q.ListenCipherSuites) {
+		return true
+	}
+	if !slices.Equal(p.ListenAllowedCNs, q.ListenAllowedCNs) {
+		return true
+	}
+	if !slices.Equal(p.ListenAllowedDNSNames, q.ListenAllowedDNSNames) {
+		return true
+	}
+	if !slices.Equal(p.ListenAllowedURIs, q.ListenAllowedURIs) {
+		return true
+	}
+	if p.ListenCRLRaw != q.ListenCRLRaw {
+		return true
+	}
+	if p.ListenOCSPStapling != q.ListenOCSPStapling {
+		return true
+	}
+	if p.ListenOCSPResponder != q.ListenOCSPResponder {
+		return true
+	}
+	if p.ListenOCSPRefresh != q.ListenOCSPRefresh {
+		return true
+	}
+	if !slices.Equal(p.ListenACMEDomains, q.ListenACMEDomains) {
+		return true
+	}
+	if p.ListenACMEEmail != q.ListenACMEEmail {
+		return true
 	}
-	if b == nil {
-		return a
+	if p.ListenACMEDirectory != q.ListenACMEDirectory {
+		return true
 	}
-
-	if len(a.Listen) < 1 {
-		a.Listen = b.Listen
+	if p.ListenACMECacheDir != q.ListenACMECacheDir {
+		return true
 	}
-	if len(a.Proxy) < 1 {
-		a.Proxy = b.Proxy
+	if p.SPIFFESocket != q.SPIFFESocket {
+		return true
 	}
-	if len(a.Protocol) < 1 {
-		a.Protocol = b.Protocol
+	if p.ListenSPIFFE != q.ListenSPIFFE {
+		return true
 	}
-	if len(a.SendCertPath) < 1 {
-		a.SendCertPath = b.SendCertPath
+	if !slices.Equal(p.ListenSPIFFEIDs, q.ListenSPIFFEIDs) {
+		return true
 	}
-	if len(a.SendCertRaw) < 1 {
-		a.SendCertRaw = b.SendCertRaw
+	if p.PKCS11Module != q.PKCS11Module {
+		return true
 	}
-	if len(a.ListenCertPath) < 1 {
-		a.ListenCertPath = b.ListenCertPath
+	if p.PKCS11TokenLabel != q.PKCS11TokenLabel {
+		return true
 	}
-	if len(a.ListenCertRaw) < 1 {
-		a.ListenCertRaw = b.ListenCertRaw
+	if p.PKCS11Slot != q.PKCS11Slot {
+		return true
 	}
-	if len(a.ListenPrivatePath) < 1 {
-		a.ListenPrivatePath = b.ListenPrivatePath
+	if p.PKCS11PIN != q.PKCS11PIN {
+		return true
 	}
-	if len(a.ListenPrivateRaw) < 1 {
-		a.ListenPrivateRaw = b.ListenPrivateRaw
+	if p.ListenPKCS11KeyLabel != q.ListenPKCS11KeyLabel {
+		return true
 	}
-	if len(a.SendPrivatePath) < 1 {
-		a.SendPrivatePath = b.SendPrivatePath
+	if p.Mode != q.Mode {
+		return true
 	}
-	if len(a.SendPrivateRaw) < 1 {
-		a.SendPrivateRaw = b.SendPrivateRaw
+	if p.ListenSessionTicketKeysRaw != q.ListenSessionTicketKeysRaw {
+		return true
 	}
-	if len(a.ListenAuthorityPath) < 1 {
-		a.ListenAuthorityPath = b.ListenAuthorityPath
+	if p.ListenSessionTicketRotation != q.ListenSessionTicketRotation {
+		return true
 	}
-	if len(a.ListenAuthorityRaw) < 1 {
-		a.ListenAuthorityRaw = b.ListenAuthorityRaw
+	if p.ListenSessionTicketsDisabled != q.ListenSessionTicketsDisabled {
+		return true
 	}
-	if len(a.SendAuthorityPath) < 1 {
-		a.SendAuthorityPath = b.SendAuthorityPath
+	if !slices.Equal(p.ListenALPN, q.ListenALPN) {
+		return true
 	}
-	if len(a.SendAuthorityRaw) < 1 {
-		a.SendAuthorityRaw = b.SendAuthorityRaw
+	if p.ListenALPNRequired != q.ListenALPNRequired {
+		return true
 	}
-	return a
-}
-
-func profileSuffix(x, s string) string {
-	if strings.HasSuffix(x, s) {
-		index := len(x) - len(s)
-		return x[index:]
+	if !certPairsEqual(p.ListenCertificates, q.ListenCertificates) {
+		return true
 	}
-	return ""
-}
-
-func (p Profile) Copy() (nu *Profile) {
-	nu = new(Profile)
-	nu.Name = p.Name
-	nu.Listen = p.Listen
-	nu.Proxy = p.Proxy
-	nu.Protocol = p.Protocol
-	nu.ListenCertPath = p.ListenCertPath
-	nu.ListenCertRaw = p.ListenCertRaw
-	nu.ListenPrivatePath = p.ListenPrivatePath
-	nu.ListenPrivateRaw = p.ListenPrivateRaw
-	nu.ListenAuthorityPath = p.ListenAuthorityPath
-	nu.ListenAuthorityRaw = p.ListenAuthorityRaw
-	nu.SendCertPath = p.SendCertPath
-	nu.SendCertRaw = p.SendCertRaw
-	nu.SendPrivatePath = p.SendPrivatePath
-	nu.SendPrivateRaw = p.SendPrivateRaw
-	nu.SendAuthorityPath = p.SendAuthorityPath
-	nu.SendAuthorityRaw = p.SendAuthorityRaw
-	nu.Source = p.Source
-	return
-}
-
-// resolve will load any files from the filesystem that are pending
-func (p *Profile) Resolve() error {
-	if len(p.ListenCertRaw) < 1 && len(p.ListenCertPath) > 0 {
-		b, err := os.ReadFile(p.ListenCertPath)
-		if err != nil {
-			return fmt.Errorf("reading file %q: %w", p.ListenCertPath, err)
-		}
-		p.ListenCertRaw = string(b)
+	if p.ClientAuth != q.ClientAuth {
+		return true
 	}
-	if len(p.SendCertRaw) < 1 && len(p.SendCertPath) > 0 {
-		b, err := os.ReadFile(p.SendCertPath)
-		if err != nil {
-			return fmt.Errorf("reading file %q: %w", p.SendCertPath, err)
-		}
-		p.SendCertRaw = string(b)
+	if p.ListenCertOverlap != q.ListenCertOverlap {
+		return true
 	}
-	if len(p.ListenPrivateRaw) < 1 && len(p.ListenPrivatePath) > 0 {
-		b, err := os.ReadFile(p.ListenPrivatePath)
-		if err != nil {
-			return fmt.Errorf("reading file %q: %w", p.ListenPrivatePath, err)
-		}
-		p.ListenPrivateRaw = string(b)
+	if p.UDPIdleTimeout != q.UDPIdleTimeout {
+		return true
 	}
-	if len(p.SendPrivateRaw) < 1 && len(p.SendPrivatePath) > 0 {
-		b, err := os.ReadFile(p.SendPrivatePath)
-		if err != nil {
-			return fmt.Errorf("reading file %q: %w", p.SendPrivatePath, err)
-		}
-		p.SendPrivateRaw = string(b)
+	if p.ListenProtocol != q.ListenProtocol {
+		return true
 	}
-	if len(p.ListenAuthorityRaw) < 1 && len(p.ListenAuthorityPath) > 0 {
-		b, err := os.ReadFile(p.ListenAuthorityPath)
-		if err != nil {
-			return fmt.Errorf("reading file %q: %w", p.ListenAuthorityPath, err)
-		}
-		p.ListenAuthorityRaw = string(b)
+	if p.ListenSocketMode != q.ListenSocketMode {
+		return true
 	}
-	if len(p.SendAuthorityRaw) < 1 && len(p.SendAuthorityPath) > 0 {
-		b, err := os.ReadFile(p.SendAuthorityPath)
-		if err != nil {
-			return fmt.Errorf("reading file %q: %w", p.SendAuthorityPath, err)
-		}
-		p.SendAuthorityRaw = string(b)
+	if p.ListenSocketOwner != q.ListenSocketOwner {
+		return true
 	}
-	return nil
-}
-
-// ListenChanged will compare profiles to see if the listen side of the connection
-// needs to be changed.
-func (p *Profile) ListenChanged(q *Profile) bool {
-	if p.Listen != q.Listen {
+	if p.ListenSocketGroup != q.ListenSocketGroup {
 		return true
 	}
-	if p.Protocol != q.Protocol {
+	if p.ListenAcceptProxyProtocol != q.ListenAcceptProxyProtocol {
 		return true
 	}
-	if p.ListenAuthorityRaw != q.ListenAuthorityRaw {
+	if !slices.Equal(p.ListenProxyProtocolSources, q.ListenProxyProtocolSources) {
 		return true
 	}
-	if p.ListenCertRaw != q.ListenCertRaw {
+	if p.StartTLS != q.StartTLS {
 		return true
 	}
-	if p.ListenPrivateRaw != q.ListenPrivateRaw {
+	if p.AzureRemoteKeys != q.AzureRemoteKeys {
+		return true
+	}
+	if p.ListenShards != q.ListenShards {
 		return true
 	}
 
@@ -398,6 +3272,194 @@ func (p *Profile) DestinationChanged(q *Profile) bool {
 	if p.SendPrivateRaw != q.SendPrivateRaw {
 		return true
 	}
+	if p.DNSCacheTTL != q.DNSCacheTTL {
+		return true
+	}
+	if p.DNSNegativeTTL != q.DNSNegativeTTL {
+		return true
+	}
+	if p.DNSServeStale != q.DNSServeStale {
+		return true
+	}
+	if !routesEqual(p.Routes, q.Routes) {
+		return true
+	}
+	if p.MinTLSVersion != q.MinTLSVersion {
+		return true
+	}
+	if p.MaxTLSVersion != q.MaxTLSVersion {
+		return true
+	}
+	if p.SendMinTLSVersion != q.SendMinTLSVersion {
+		return true
+	}
+	if p.SendMaxTLSVersion != q.SendMaxTLSVersion {
+		return true
+	}
+	if !slices.Equal(p.SendCipherSuites, q.SendCipherSuites) {
+		return true
+	}
+	if p.SPIFFESocket != q.SPIFFESocket {
+		return true
+	}
+	if p.SendSPIFFE != q.SendSPIFFE {
+		return true
+	}
+	if !slices.Equal(p.SendSPIFFEIDs, q.SendSPIFFEIDs) {
+		return true
+	}
+	if p.PKCS11Module != q.PKCS11Module {
+		return true
+	}
+	if p.PKCS11TokenLabel != q.PKCS11TokenLabel {
+		return true
+	}
+	if p.PKCS11Slot != q.PKCS11Slot {
+		return true
+	}
+	if p.PKCS11PIN != q.PKCS11PIN {
+		return true
+	}
+	if p.SendPKCS11KeyLabel != q.SendPKCS11KeyLabel {
+		return true
+	}
+	if p.Mode != q.Mode {
+		return true
+	}
+	if !slices.Equal(p.SendPinnedFingerprints, q.SendPinnedFingerprints) {
+		return true
+	}
+	if p.AccessLog != q.AccessLog {
+		return true
+	}
+	if !slices.Equal(p.SendALPN, q.SendALPN) {
+		return true
+	}
+	if p.SendALPNRequired != q.SendALPNRequired {
+		return true
+	}
+	if p.SendServerName != q.SendServerName {
+		return true
+	}
+	if p.SendInsecureSkipVerify != q.SendInsecureSkipVerify {
+		return true
+	}
+	if p.SendUseSystemRoots != q.SendUseSystemRoots {
+		return true
+	}
+	if p.SendRenegotiation != q.SendRenegotiation {
+		return true
+	}
+	if p.SendSessionResumption != q.SendSessionResumption {
+		return true
+	}
+	if p.SendProtocol != q.SendProtocol {
+		return true
+	}
+	if p.SendProxyProtocol != q.SendProxyProtocol {
+		return true
+	}
+	if p.Balance != q.Balance {
+		return true
+	}
+	if p.HealthCheck != q.HealthCheck {
+		return true
+	}
+	if p.HealthCheckInterval != q.HealthCheckInterval {
+		return true
+	}
+	if p.HealthCheckTimeout != q.HealthCheckTimeout {
+		return true
+	}
+	if p.HealthCheckThreshold != q.HealthCheckThreshold {
+		return true
+	}
+	if p.DialTimeout != q.DialTimeout {
+		return true
+	}
+	if p.IdleTimeout != q.IdleTimeout {
+		return true
+	}
+	if p.MaxConnectionAge != q.MaxConnectionAge {
+		return true
+	}
+	if p.MaxConnections != q.MaxConnections {
+		return true
+	}
+	if p.ConnectionRate != q.ConnectionRate {
+		return true
+	}
+	if p.ConnectionBurst != q.ConnectionBurst {
+		return true
+	}
+	if p.ConnectionBandwidth != q.ConnectionBandwidth {
+		return true
+	}
+	if p.ProfileBandwidth != q.ProfileBandwidth {
+		return true
+	}
+	if p.DNSRefresh != q.DNSRefresh {
+		return true
+	}
+	if !slices.Equal(p.DNSPin, q.DNSPin) {
+		return true
+	}
+	if p.DNSPrefer != q.DNSPrefer {
+		return true
+	}
+	if p.DrainTimeout != q.DrainTimeout {
+		return true
+	}
+	if p.HTTPProxy != q.HTTPProxy {
+		return true
+	}
+	if p.SOCKSProxy != q.SOCKSProxy {
+		return true
+	}
+	if p.StartTLS != q.StartTLS {
+		return true
+	}
+	if p.HTTPClientCertHeader != q.HTTPClientCertHeader {
+		return true
+	}
+	if p.HTTPClientCertFormat != q.HTTPClientCertFormat {
+		return true
+	}
+	// the http mode passes on client certificates by how the listen side
+	// verifies them
+	if p.Mode == ModeHTTP && p.verifiesClients() != q.verifiesClients() {
+		return true
+	}
+	if p.AccessLogFormat != q.AccessLogFormat {
+		return true
+	}
+	if p.SendConnectionID != q.SendConnectionID {
+		return true
+	}
+	if p.HTTPConnectionIDHeader != q.HTTPConnectionIDHeader {
+		return true
+	}
+	if p.AcceptConnectionID != q.AcceptConnectionID {
+		return true
+	}
+	if p.AzureRemoteKeys != q.AzureRemoteKeys {
+		return true
+	}
+	if p.CircuitBreakerFailures != q.CircuitBreakerFailures {
+		return true
+	}
+	if p.CircuitBreakerCooldown != q.CircuitBreakerCooldown {
+		return true
+	}
+	if p.DialRetries != q.DialRetries {
+		return true
+	}
+	if p.DialRetryBackoff != q.DialRetryBackoff {
+		return true
+	}
+	if p.DialFailure != q.DialFailure {
+		return true
+	}
 
 	return false
 }
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of config files.
+const (
+	ConfigTOML = "toml"
+	ConfigYAML = "yaml"
+	ConfigJSON = "json"
+)
+
+// configFormat tells the format of a config file by its extension, files
+// without a known one are TOML.
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return ConfigYAML
+	case ".json":
+		return ConfigJSON
+	}
+	return ConfigTOML
+}
+
+// sniffFormat tells the format of a config without a file name, JSON when it
+// is an object and TOML otherwise.
+func sniffFormat(b []byte) string {
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("{")) {
+		return ConfigJSON
+	}
+	return ConfigTOML
+}
+
+// Sections of config files that aren't profiles: variables for the values of
+// profiles and the defaults of every profile.
+const (
+	configVars     = "vars"
+	configDefaults = "defaults"
+)
+
+// readConfigFile reads the profiles and variables of a config file.
+func readConfigFile(path string) (configLayer, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return configLayer{}, err
+	}
+	b, format, err := decryptSOPSFile(path, b, configFormat(path))
+	if err != nil {
+		// reported on its own, the other files are still read
+		return configLayer{source: path, err: fmt.Errorf("decrypting: %w", err)}, nil
+	}
+	return parseConfig(b, format, path)
+}
+
+// parseConfig decodes profiles in the format, keyed by their name, and the
+// vars and defaults sections. Source is where they came from.
+func parseConfig(b []byte, format, source string) (configLayer, error) {
+	l := configLayer{source: source, expand: true}
+	var ps map[string]*Profile
+	var vars struct {
+		Vars map[string]string `toml:"vars" json:"vars"`
+	}
+	var err error
+	switch format {
+	case ConfigYAML:
+		if err = decodeYAML(b, &ps); err == nil {
+			err = decodeYAML(b, &vars)
+		}
+	case ConfigJSON:
+		if err = decodeJSON(b, &ps); err == nil {
+			err = decodeJSON(b, &vars)
+		}
+	default:
+		if _, err = toml.Decode(string(b), &ps); err == nil {
+			_, err = toml.Decode(string(b), &vars)
+		}
+	}
+	if err != nil {
+		return l, err
+	}
+	l.unknown = findUnknownOptions(b, format, source, "")
+	delete(ps, configVars)
+	l.vars = vars.Vars
+	if d, ok := ps[configDefaults]; ok {
+		if d != nil {
+			d.Source = source
+		}
+		l.defaults = d
+		delete(ps, configDefaults)
+	}
+
+	l.profiles = make([]*Profile, 0, len(ps))
+	for k, p := range ps {
+		if p == nil {
+			p = new(Profile)
+		}
+		p.Name = k
+		p.Source = source
+		l.profiles = append(l.profiles, p)
+	}
+	return l, nil
+}
+
+// decodeYAML decodes YAML into v by way of JSON, which like TOML matches keys
+// to field names regardless of case.
+func decodeYAML(b []byte, v any) error {
+	var doc map[string]any
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return err
+	}
+	j, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return decodeJSON(j, v)
+}
+
+func decodeJSON(b []byte, v any) error {
+	err := json.Unmarshal(b, v)
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		return fmt.Errorf("%s can't be a %s, it is a %s", strings.TrimPrefix(te.Field, "."), te.Value, te.Type)
+	}
+	return err
+}
+
+// configFromJSONEnv reads the profiles and variables of
+// MTLSPROXY_CONFIG_JSON, a JSON object like a JSON config file.
+func configFromJSONEnv() (configLayer, error) {
+	env := os.Getenv(EnvConfigJSON)
+	if len(env) < 1 {
+		return configLayer{source: EnvConfigJSON}, nil
+	}
+	l, err := parseConfig([]byte(env), ConfigJSON, EnvConfigJSON)
+	if err != nil {
+		return l, fmt.Errorf("parsing %s: %w", EnvConfigJSON, err)
+	}
+	return l, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeConfig writes a config file called name in dir.
+func writeConfig(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// profileNamed finds the profile called name, nil when there is none.
+func profileNamed(ps []*Profile, name string) *Profile {
+	for _, p := range ps {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func TestConfigFormat(t *testing.T) {
+	for path, want := range map[string]string{
+		"a.yaml":      ConfigYAML,
+		"a.YML":       ConfigYAML,
+		"a.json":      ConfigJSON,
+		"a.toml":      ConfigTOML,
+		"mtlsproxy":   ConfigTOML,
+		"a.yaml.toml": ConfigTOML,
+	} {
+		if got := configFormat(path); got != want {
+			t.Errorf("%s: got %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestReadYAMLConfig(t *testing.T) {
+	path := writeConfig(t, t.TempDir(), "proxy.yml", `
+web:
+  listen: 127.0.0.1:8443
+  Proxy: 10.0.0.1:443
+  listenallowedcns: [alice, bob]
+  maxconnections: 10
+  routes:
+    api.example.test:
+      proxy: 10.0.0.2:443
+`)
+	ps, err := Configurations{ConfigFiles: []string{path}}.getProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := profileNamed(ps, "web")
+	if len(ps) != 1 || p == nil {
+		t.Fatalf("got %v", ps)
+	}
+	if p.Listen != "127.0.0.1:8443" || p.Proxy != "10.0.0.1:443" || !slices.Equal(p.ListenAllowedCNs, []string{"alice", "bob"}) ||
+		p.MaxConnections != 10 || p.Routes["api.example.test"] == nil || p.Routes["api.example.test"].Proxy != "10.0.0.2:443" || p.Source != path {
+		t.Errorf("got %+v", p)
+	}
+
+	writeConfig(t, filepath.Dir(path), "proxy.yml", "web:\n  maxconnections: many\n")
+	if _, err := (Configurations{ConfigFiles: []string{path}}).getProfiles(); err == nil || !strings.Contains(err.Error(), "web.maxconnections") {
+		t.Errorf("got %v", err)
+	}
+	writeConfig(t, filepath.Dir(path), "proxy.yml", "web: [\n")
+	if _, err := (Configurations{ConfigFiles: []string{path}}).getProfiles(); err == nil {
+		t.Error("read a broken file")
+	}
+}
+
+func TestJSONConfig(t *testing.T) {
+	path := writeConfig(t, t.TempDir(), "proxy.json", `{
+		"web": {"Listen": "127.0.0.1:8443", "proxy": "10.0.0.1:443", "MaxConnections": 10},
+		"api": {"Listen": "127.0.0.1:9443", "Proxy": "10.0.0.3:443"}
+	}`)
+	t.Setenv(EnvConfigJSON, `{"web": {"Proxy": "10.0.0.2:443"}}`)
+	l, err := configFromJSONEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the variable takes precedence over files
+	ps, err := Configurations{jsonConfig: l, ConfigFiles: []string{path}}.getProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, api := profileNamed(ps, "web"), profileNamed(ps, "api")
+	if len(ps) != 2 || web == nil || api == nil {
+		t.Fatalf("got %v", ps)
+	}
+	if web.Proxy != "10.0.0.2:443" || web.Listen != "127.0.0.1:8443" || web.MaxConnections != 10 || api.Proxy != "10.0.0.3:443" {
+		t.Errorf("got web %+v, api %+v", web, api)
+	}
+
+	t.Setenv(EnvConfigJSON, `["web"]`)
+	if _, err := configFromJSONEnv(); err == nil || !strings.Contains(err.Error(), EnvConfigJSON) {
+		t.Errorf("got %v", err)
+	}
+	t.Setenv(EnvConfigJSON, "")
+	if l, err := configFromJSONEnv(); err != nil || len(l.profiles) > 0 {
+		t.Errorf("got %v, %v without the variable", l.profiles, err)
+	}
+}
+
+func TestSniffFormat(t *testing.T) {
+	for in, want := range map[string]string{
+		` {"web": {}}`:       ConfigJSON,
+		"[web]\nProxy = 'a'": ConfigTOML,
+		"":                   ConfigTOML,
+	} {
+		if got := sniffFormat([]byte(in)); got != want {
+			t.Errorf("%q: got %s, want %s", in, got, want)
+		}
+	}
+}
+
+func TestRepeatedConfig(t *testing.T) {
+	dir := t.TempDir()
+	base := writeConfig(t, dir, "base.toml", "[web]\nListen = \"127.0.0.1:8443\"\nProxy = \"10.0.0.1:443\"\nMaxConnections = 10\n")
+	local := writeConfig(t, dir, "local.toml", "[web]\nProxy = \"10.0.0.2:443\"\n")
+	stdin := []byte(`{"web": {"MaxConnections": 20}, "api": {"Listen": "127.0.0.1:9443", "Proxy": "10.0.0.3:443"}}`)
+
+	// later files take precedence over earlier ones
+	ps, err := Configurations{ConfigFiles: []string{base, local, "-"}, stdinConfig: stdin}.getProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, api := profileNamed(ps, "web"), profileNamed(ps, "api")
+	if len(ps) != 2 || web == nil || api == nil {
+		t.Fatalf("got %v", ps)
+	}
+	if web.Listen != "127.0.0.1:8443" || web.Proxy != "10.0.0.2:443" || web.MaxConnections != 20 || api.Proxy != "10.0.0.3:443" {
+		t.Errorf("got web %+v, api %+v", web, api)
+	}
+
+	if _, err := (Configurations{ConfigFiles: []string{base, "-"}, stdinConfig: []byte("[web")}).getProfiles(); err == nil || !strings.Contains(err.Error(), `"-"`) {
+		t.Errorf("got %v for broken stdin", err)
+	}
+	if _, err := (Configurations{ConfigFiles: []string{base, filepath.Join(dir, "missing.toml")}}).getProfiles(); err == nil || !strings.Contains(err.Error(), "missing.toml") {
+		t.Errorf("got %v for a missing file", err)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	path := writeConfig(t, t.TempDir(), "proxy.toml", `[defaults]
+MaxConnections = 10
+DNSCacheTTL = "1m"
+Proxy = "10.0.0.9:443"
+
+[web]
+Listen = "127.0.0.1:8443"
+Proxy = "10.0.0.1:443"
+
+[api]
+Listen = "127.0.0.1:9443"
+MaxConnections = 5
+`)
+	t.Setenv(EnvDefaultPrefix+"DNS_CACHE_TTL", "5m")
+	t.Setenv(EnvDefaultPrefix+"MAX_CONNECTIONS", "20")
+	defaults, _, err := defaultsFromEnv()
+	if err != nil || defaults == nil {
+		t.Fatalf("got %v, %v", defaults, err)
+	}
+
+	// the variables are above the file, every profile is above both
+	ps, err := Configurations{envDefaults: defaults, ConfigFiles: []string{path}}.getProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, api := profileNamed(ps, "web"), profileNamed(ps, "api")
+	if len(ps) != 2 || web == nil || api == nil {
+		t.Fatalf("got %v", ps)
+	}
+	if web.Proxy != "10.0.0.1:443" || web.MaxConnections != 20 || web.DNSCacheTTL != "5m" {
+		t.Errorf("got web %+v", web)
+	}
+	if api.Proxy != "10.0.0.9:443" || api.MaxConnections != 5 || api.DNSCacheTTL != "5m" {
+		t.Errorf("got api %+v", api)
+	}
+
+	t.Setenv(EnvDefaultPrefix+"MAX_CONNECTIONS", "many")
+	if _, _, err := defaultsFromEnv(); err == nil {
+		t.Error("parsed a bad default")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configDebounce is how long the watcher waits for changes to the
+// configuration to settle, editors and ConfigMap updates touch several files.
+const configDebounce = time.Second
+
+// configWatcher reports changes to the config directory and config files, for
+// reloading without HUP. Like the certificate watcher it watches directories so
+// atomic renames and Kubernetes style symlink swaps are seen.
+type configWatcher struct {
+	w       *fsnotify.Watcher
+	dir     string          // the config directory, empty when there is none
+	files   map[string]bool // config files outside of it
+	changes chan struct{}
+}
+
+func newConfigWatcher(c *Configurations) (*configWatcher, error) {
+	cw := &configWatcher{files: make(map[string]bool), changes: make(chan struct{})}
+	dirs := make(map[string]bool)
+	if len(c.ConfigDir) > 0 {
+		cw.dir = filepath.Clean(c.ConfigDir)
+		dirs[cw.dir] = true
+	}
+	for _, path := range c.ConfigFiles {
+		if path == "-" {
+			continue
+		}
+		path = filepath.Clean(path)
+		cw.files[path] = true
+		dirs[filepath.Dir(path)] = true
+	}
+	if len(dirs) < 1 {
+		return nil, errors.New("there is no config directory or config file to watch")
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for d := range dirs {
+		if err := w.Add(d); err != nil {
+			w.Close()
+			return nil, fmt.Errorf("watching %q: %w", d, err)
+		}
+	}
+	cw.w = w
+	go cw.run()
+	return cw, nil
+}
+
+func (cw *configWatcher) run() {
+	timer := time.NewTimer(configDebounce)
+	timer.Stop()
+
+	for {
+		select {
+		case e, ok := <-cw.w.Events:
+			if !ok {
+				return
+			}
+			if e.Op != fsnotify.Chmod && cw.match(e.Name) {
+				timer.Reset(configDebounce)
+			}
+		case err, ok := <-cw.w.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("error watching configuration", "err", err)
+		case <-timer.C:
+			cw.changes <- struct{}{}
+		}
+	}
+}
+
+// match reports if an event on name changes the configuration.
+func (cw *configWatcher) match(name string) bool {
+	name = filepath.Clean(name)
+	dir := filepath.Dir(name)
+	if len(cw.dir) > 0 && dir == cw.dir {
+		return true
+	}
+	if cw.files[name] {
+		return true
+	}
+
+	// a swapped ..data symlink changes every file in the directory
+	if !strings.HasPrefix(filepath.Base(name), "..") {
+		return false
+	}
+	for path := range cw.files {
+		if filepath.Dir(path) == dir {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigWatcherMatch(t *testing.T) {
+	cw := &configWatcher{dir: "/etc/mtlsproxy.d", files: map[string]bool{"/etc/proxy/main.toml": true}}
+	for name, want := range map[string]bool{
+		"/etc/mtlsproxy.d/web.toml":     true,
+		"/etc/mtlsproxy.d/./api.toml":   true,
+		"/etc/proxy/main.toml":          true,
+		"/etc/proxy/..data":             true,
+		"/etc/proxy/other.toml":         false,
+		"/etc/other/..data":             false,
+		"/etc/mtlsproxy.d/sub/web.toml": false,
+	} {
+		if got := cw.match(name); got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+// configChanged waits for the watcher to report a change.
+func configChanged(cw *configWatcher, wait time.Duration) bool {
+	select {
+	case <-cw.changes:
+		return true
+	case <-time.After(wait):
+		return false
+	}
+}
+
+func TestConfigWatcher(t *testing.T) {
+	if _, err := newConfigWatcher(&Configurations{ConfigFiles: []string{"-"}}); err == nil {
+		t.Error("watching without anything to watch")
+	}
+
+	dir, other := t.TempDir(), t.TempDir()
+	path := writeConfig(t, other, "main.toml", "[web]\n")
+	cw, err := newConfigWatcher(&Configurations{ConfigDir: dir, ConfigFiles: []string{path, "-"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cw.w.Close()
+
+	// changes in a row come as one
+	writeConfig(t, dir, "a.toml", "[a]\n")
+	writeConfig(t, dir, "b.toml", "[b]\n")
+	if !configChanged(cw, 5*time.Second) {
+		t.Fatal("change to the config directory not reported")
+	}
+	if configChanged(cw, 2*configDebounce) {
+		t.Error("changes reported more than once")
+	}
+
+	writeConfig(t, other, "unrelated.toml", "")
+	if configChanged(cw, 2*configDebounce) {
+		t.Error("unrelated file reported")
+	}
+
+	// editors often write a new file and rename it over the old one
+	tmp := writeConfig(t, other, "main.toml.tmp", "[web]\nProxy = \"10.0.0.1:443\"\n")
+	if err := os.Rename(tmp, filepath.Join(other, "main.toml")); err != nil {
+		t.Fatal(err)
+	}
+	if !configChanged(cw, 5*time.Second) {
+		t.Error("config file replaced by a rename not reported")
+	}
+}
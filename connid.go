@@ -0,0 +1,32 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// maxConnID is the longest connection ID taken from the proxy in front, the
+// limit of PP2_TYPE_UNIQUE_ID.
+const maxConnID = 128
+
+// newConnID makes the ID of a connection. Unlike its ident it stays unique
+// across restarts and proxies, so it can be looked up along a chain of them.
+func newConnID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validConnID tells if an ID received from a client or proxy can be used, it
+// ends up in logs and headers so only printable ASCII is.
+func validConnID(id string) bool {
+	if len(id) < 1 || len(id) > maxConnID {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestConnIDs(t *testing.T) {
+	a, b := newConnID(), newConnID()
+	if len(a) != 32 || a == b || !validConnID(a) {
+		t.Errorf("got %q and %q", a, b)
+	}
+	for _, id := range []string{"", "has space", "tab\t", "nul\x00", "café", strings.Repeat("x", maxConnID+1)} {
+		if validConnID(id) {
+			t.Errorf("%q is valid", id)
+		}
+	}
+	if !validConnID("req-1/2:3") {
+		t.Error("printable ID isn't valid")
+	}
+}
+
+func TestProxyHeaderConnectionID(t *testing.T) {
+	src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+	dst := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 443}
+	for _, id := range []string{"abc", ""} {
+		hdr := proxyHeader(ProxyProtocolV2, src, dst, nil, id)
+		gotSrc, _, gotID, err := readProxyHeader(bufio.NewReader(bytes.NewReader(hdr)))
+		if err != nil || gotSrc.String() != src.String() || gotID != id {
+			t.Errorf("%q: read %v, %q, %v", id, gotSrc, gotID, err)
+		}
+	}
+	if tlvValue([]byte{pp2TypeUniqueID, 0, 9, 'a'}, pp2TypeUniqueID) != "" {
+		t.Error("value of a TLV cut short")
+	}
+}
+
+func TestInstanceConnectionID(t *testing.T) {
+	back := testInstance(t, &Profile{Name: "back", Proxy: testEcho(t), ListenAcceptProxyProtocol: true, ListenProxyProtocolSources: []string{"127.0.0.1"}, AcceptConnectionID: true})
+	front := testInstance(t, &Profile{Name: "front", Proxy: back.ListenAddr(), SendProxyProtocol: ProxyProtocolV2, SendConnectionID: true})
+	c, err := net.Dial("tcp", front.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c) {
+		t.Fatal("no echo")
+	}
+	fronts, backs := front.Connections(), back.Connections()
+	if len(fronts) != 1 || len(backs) != 1 || fronts[0].id != backs[0].id {
+		t.Errorf("the connection ID wasn't passed along")
+	}
+
+	for _, p := range []Profile{
+		{SendConnectionID: true, SendProxyProtocol: ProxyProtocolV1},
+		{AcceptConnectionID: true},
+	} {
+		p.Name, p.Listen, p.Proxy = "test", "127.0.0.1:0", "127.0.0.1:1"
+		if err := p.Resolve(); err == nil || !strings.Contains(err.Error(), "ConnectionID") {
+			t.Errorf("%+v: got %v", p, err)
+		}
+	}
+}
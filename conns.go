@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// liveConn is a connection being proxied, as the admin server shows it.
+type liveConn struct {
+	ident   string
+	id      string
+	client  string
+	backend string
+	start   time.Time
+	up      atomic.Int64 // bytes read from the client so far
+	down    atomic.Int64 // bytes read from the destination so far
+	// reads from each side, which are datagrams for packet networks
+	upReads   atomic.Int64
+	downReads atomic.Int64
+	close     func(reason string)
+	packet    bool // on a packet network, captured as UDP
+	capture   atomic.Pointer[connCapture]
+}
+
+// countedConn counts what is read from it, for the connection and the
+// profile's totals.
+type countedConn struct {
+	net.Conn
+	counts []*atomic.Int64
+	reads  *atomic.Int64
+	metric prometheus.Counter
+	lc     *liveConn // for captures
+	client bool      // it is the client side
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		for _, count := range c.counts {
+			count.Add(int64(n))
+		}
+		c.reads.Add(1)
+		c.metric.Add(float64(n))
+		c.lc.captureRead(c.client, b[:n])
+	}
+	return n, err
+}
+
+// Bytes are what the instance read from clients and from destinations,
+// including connections still open.
+func (inst *Instance) Bytes() (up, down int64) {
+	return inst.bytesUp.Load(), inst.bytesDown.Load()
+}
+
+// OpenBytes are what the connections still open read so far.
+func (inst *Instance) OpenBytes() (up, down int64) {
+	for _, lc := range inst.Connections() {
+		up += lc.up.Load()
+		down += lc.down.Load()
+	}
+	return
+}
+
+func (inst *Instance) track(lc *liveConn) {
+	inst.connsMu.Lock()
+	defer inst.connsMu.Unlock()
+	if inst.conns == nil {
+		inst.conns = make(map[string]*liveConn)
+	}
+	inst.conns[lc.ident] = lc
+}
+
+func (inst *Instance) untrack(ident string) {
+	inst.connsMu.Lock()
+	delete(inst.conns, ident)
+	inst.connsMu.Unlock()
+}
+
+// Connections are the connections being proxied, oldest first.
+func (inst *Instance) Connections() []*liveConn {
+	inst.connsMu.Lock()
+	lcs := make([]*liveConn, 0, len(inst.conns))
+	for _, lc := range inst.conns {
+		lcs = append(lcs, lc)
+	}
+	inst.connsMu.Unlock()
+	sort.Slice(lcs, func(i, j int) bool { return lcs[i].start.Before(lcs[j].start) })
+	return lcs
+}
+
+// CloseConnection closes both sides of a connection, false when there is no
+// connection with the ident.
+func (inst *Instance) CloseConnection(ident string) bool {
+	inst.connsMu.Lock()
+	lc, ok := inst.conns[ident]
+	inst.connsMu.Unlock()
+	if ok {
+		lc.close("closed through the admin server")
+	}
+	return ok
+}
+
+// CloseConnections closes both sides of every connection, for why, and returns
+// how many there were.
+func (inst *Instance) CloseConnections(why string) int {
+	lcs := inst.Connections()
+	for _, lc := range lcs {
+		lc.close(why)
+	}
+	return len(lcs)
+}
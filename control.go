@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+
+	"github.com/BurntSushi/toml"
+	"github.com/bryanaustin/mtlsproxy/controlpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// controlServer implements the gRPC control-plane API on top of a Supervisor.
+type controlServer struct {
+	controlpb.UnimplementedControlServer
+	s *Supervisor
+}
+
+// startControlServer starts the gRPC control server when an address is
+// configured. The server always requires mTLS.
+func startControlServer(c *Configurations, s *Supervisor) error {
+	if len(c.ControlListen) < 1 {
+		return nil
+	}
+
+	tlsconf, err := controlTLSConfig(c)
+	if err != nil {
+		return err
+	}
+
+	l, err := listenSocket("tcp", c.ControlListen)
+	if err != nil {
+		return err
+	}
+
+	gs := grpc.NewServer(grpc.Creds(credentials.NewTLS(tlsconf)))
+	controlpb.RegisterControlServer(gs, &controlServer{s: s})
+	go func() {
+		if err := gs.Serve(l); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("control server stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// controlTLSConfig requires clients of the control and admin servers to have
+// a certificate from the control authority.
+func controlTLSConfig(c *Configurations) (*tls.Config, error) {
+	if len(c.ControlCertPath) < 1 || len(c.ControlKeyPath) < 1 || len(c.ControlAuthority) < 1 {
+		return nil, errors.New("the control and admin servers require a certificate, key and authority")
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.ControlCertPath, c.ControlKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading cert/key pair: %w", err)
+	}
+
+	ca, err := os.ReadFile(c.ControlAuthority)
+	if err != nil {
+		return nil, fmt.Errorf("reading file %q: %w", c.ControlAuthority, err)
+	}
+	capool := x509.NewCertPool()
+	if ok := capool.AppendCertsFromPEM(ca); !ok {
+		return nil, errors.New("no certs found for the control authority")
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    capool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, nil
+}
+
+func (cs *controlServer) ListProfiles(ctx context.Context, req *controlpb.ListProfilesRequest) (*controlpb.ListProfilesResponse, error) {
+	insts := cs.s.Instances()
+	resp := &controlpb.ListProfilesResponse{Profiles: make([]*controlpb.Profile, 0, len(insts))}
+	for _, inst := range insts {
+		p := inst.Profile()
+		resp.Profiles = append(resp.Profiles, &controlpb.Profile{
+			Name:     p.Name,
+			Listen:   p.Listen,
+			Proxy:    p.Proxy,
+			Protocol: p.Protocol,
+			Source:   p.Source,
+		})
+	}
+	return resp, nil
+}
+
+func (cs *controlServer) ApplyProfiles(ctx context.Context, req *controlpb.ApplyProfilesRequest) (*controlpb.ApplyProfilesResponse, error) {
+	var ps map[string]*Profile
+	if _, err := toml.Decode(req.Toml, &ps); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "decoding profiles: %s", err)
+	}
+	if len(ps) < 1 {
+		return nil, status.Error(codes.InvalidArgument, "no profiles given")
+	}
+
+	pl := make([]*Profile, 0, len(ps))
+	for k := range ps {
+		ps[k].Name = k
+		ps[k].Source = "control"
+		pl = append(pl, ps[k])
+	}
+
+	if err := cs.s.Apply(pl); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "applying profiles: %s", err)
+	}
+	return &controlpb.ApplyProfilesResponse{}, nil
+}
+
+func (cs *controlServer) Reload(ctx context.Context, req *controlpb.ReloadRequest) (*controlpb.ReloadResponse, error) {
+	if err := cs.s.Reload(); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "reloading: %s", err)
+	}
+	return &controlpb.ReloadResponse{}, nil
+}
+
+func (cs *controlServer) WatchConnections(req *controlpb.WatchConnectionsRequest, stream controlpb.Control_WatchConnectionsServer) error {
+	events := connEvents.subscribe()
+	defer connEvents.unsubscribe(events)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e := <-events:
+			if len(req.Profile) > 0 && req.Profile != e.profile {
+				continue
+			}
+
+			ce := &controlpb.ConnectionEvent{
+				Profile:    e.profile,
+				Ident:      e.ident,
+				RemoteAddr: e.remote,
+				Bytes:      e.xfer,
+				Time:       timestamppb.New(e.time),
+			}
+			switch e.kind {
+			case connOpened:
+				ce.Kind = controlpb.ConnectionEvent_KIND_OPENED
+			case connClosed:
+				ce.Kind = controlpb.ConnectionEvent_KIND_CLOSED
+			}
+			if e.err != nil {
+				ce.Error = e.err.Error()
+			}
+
+			if err := stream.Send(ce); err != nil {
+				return err
+			}
+		}
+	}
+}
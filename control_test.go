@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/bryanaustin/mtlsproxy/controlpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// serveReloads answers one reload request like the main loop.
+func serveReloads(s *Supervisor) {
+	s.reloads = make(chan reloadRequest)
+	go func() {
+		r := <-s.reloads
+		r.result <- s.applyAndReload(r.apply)
+	}()
+}
+
+func TestApplyProfilesDiscardsFailed(t *testing.T) {
+	echo := testEcho(t)
+	inst := testInstance(t, &Profile{Name: "a", Proxy: echo})
+	s := &Supervisor{c: &Configurations{Profiles: []*Profile{{Name: "a", Listen: "127.0.0.1:0", Proxy: echo, MaxConnections: 3}}}, insts: []*Instance{inst}}
+	serveReloads(s)
+
+	cs := &controlServer{s: s}
+	_, err := cs.ApplyProfiles(context.Background(), &controlpb.ApplyProfilesRequest{Toml: fmt.Sprintf(`
+[a]
+MaxConnections = 5
+
+[b]
+Listen = "127.0.0.1:0"
+Proxy = %q
+SendAuthorityPath = "/nonexistent/ca.pem"
+`, echo)})
+	if status.Code(err) != codes.FailedPrecondition || !strings.Contains(err.Error(), `"b"`) {
+		t.Fatalf("got %v, want profile b named in the error", err)
+	}
+
+	// options left out of the override keep the configured values
+	if p := inst.Profile(); p.MaxConnections != 5 || p.Proxy != echo {
+		t.Errorf("profile a runs with MaxConnections %d, Proxy %q", p.MaxConnections, p.Proxy)
+	}
+	if len(s.c.Overrides) != 1 || s.c.Overrides[0].Name != "a" {
+		t.Errorf("overrides %v, want only profile a kept", s.c.Overrides)
+	}
+	if len(s.Degraded()) > 0 {
+		t.Error("discarded profile is still retried")
+	}
+}
+
+func TestApplyProfilesNothingApplied(t *testing.T) {
+	echo := testEcho(t)
+	inst := testInstance(t, &Profile{Name: "a", Proxy: echo})
+	s := &Supervisor{c: &Configurations{Profiles: []*Profile{{Name: "a", Listen: "127.0.0.1:0", Proxy: echo}}}, insts: []*Instance{inst}}
+	serveReloads(s)
+
+	cs := &controlServer{s: s}
+	_, err := cs.ApplyProfiles(context.Background(), &controlpb.ApplyProfilesRequest{Toml: `
+[a]
+SendAuthorityPath = "/nonexistent/ca.pem"
+`})
+	if err == nil {
+		t.Fatal("broken profile was applied")
+	}
+	if len(s.c.Overrides) > 0 {
+		t.Error("override of a profile that wasn't applied was kept")
+	}
+	if inst.Profile().SendAuthorityPath != "" {
+		t.Error("running profile changed")
+	}
+}
+
+func TestApplyProfilesInvalid(t *testing.T) {
+	cs := &controlServer{s: &Supervisor{}}
+	for _, doc := range []string{"not toml [", ""} {
+		if _, err := cs.ApplyProfiles(context.Background(), &controlpb.ApplyProfilesRequest{Toml: doc}); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("%q: got %v", doc, err)
+		}
+	}
+}
@@ -0,0 +1,4 @@
+// Package controlpb holds the generated types for the gRPC control-plane API.
+package controlpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative control.proto
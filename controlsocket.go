@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// drainPoll is how often the drain command looks at the connections left.
+const drainPoll = 500 * time.Millisecond
+
+// startControlSocket serves the admin API on a unix socket for the reload,
+// status and drain commands. There is no TLS on it, only the user of the
+// process can connect. The returned func removes the socket.
+func startControlSocket(c *Configurations, s *Supervisor) (func(), error) {
+	if len(c.ControlSocket) < 1 {
+		return func() {}, nil
+	}
+	l, err := listenSocket("unix", c.ControlSocket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(c.ControlSocket, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	mux := newAdminMux(s)
+	go func() {
+		if err := http.Serve(l, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("control socket stopped", "err", err)
+		}
+	}()
+	return func() { l.Close() }, nil
+}
+
+// controlClient talks to the admin API on the control socket of a running
+// proxy.
+type controlClient struct {
+	http.Client
+}
+
+func newControlClient(path string) *controlClient {
+	return &controlClient{http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}}
+}
+
+// do makes a request and decodes the JSON response into out, responses that
+// aren't successful are returned as errors.
+func (cc *controlClient) do(method, path string, out any) error {
+	req, err := http.NewRequest(method, "http://mtlsproxy"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := cc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body := io.LimitReader(resp.Body, 1<<20)
+	if resp.StatusCode/100 != 2 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(body).Decode(&e); err != nil || len(e.Error) < 1 {
+			return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return errors.New(e.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(body).Decode(out)
+}
+
+// runControl runs a command against the control socket of a running proxy.
+func runControl(c *Configurations, command, profile string, out io.Writer) error {
+	if len(c.ControlSocket) < 1 {
+		return errors.New("there is no control socket, set -controlsocket or MTLSPROXY_CONTROL_SOCKET like for the proxy")
+	}
+	cc := newControlClient(c.ControlSocket)
+	switch command {
+	case "reload":
+		return controlReload(cc, out)
+	case "status":
+		return controlStatus(cc, out)
+	case "drain":
+		if len(profile) < 1 {
+			return errors.New("drain needs the name of a profile: mtlsproxy drain NAME")
+		}
+		return controlDrain(cc, profile, out)
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
+
+// controlReload reloads like HUP and prints what changed.
+func controlReload(cc *controlClient, out io.Writer) error {
+	reloadErr := cc.do(http.MethodPost, "/reload", nil)
+	var st reloadStatus
+	if err := cc.do(http.MethodGet, "/reload", &st); err != nil {
+		if reloadErr != nil {
+			return reloadErr
+		}
+		return err
+	}
+	for _, change := range []struct {
+		name     string
+		profiles []string
+	}{{"added", st.Added}, {"modified", st.Modified}, {"removed", st.Removed}} {
+		if len(change.profiles) > 0 {
+			fmt.Fprintf(out, "%s: %s\n", change.name, strings.Join(change.profiles, ", "))
+		}
+	}
+	names := make([]string, 0, len(st.Errors))
+	for name := range st.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "failed %s: %s\n", name, st.Errors[name])
+	}
+	if reloadErr != nil {
+		return reloadErr
+	}
+	fmt.Fprintln(out, "reloaded")
+	return nil
+}
+
+// controlStatus prints a line for every profile.
+func controlStatus(cc *controlClient, out io.Writer) error {
+	var ps []profileStatus
+	if err := cc.do(http.MethodGet, "/profiles", &ps); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROFILE\tSTATE\tLISTEN\tPROXY\tACTIVE\tERROR")
+	for _, st := range ps {
+		state, errText := "listening", st.LastError
+		switch {
+		case st.Draining:
+			state = "draining"
+		case st.Stopped:
+			state = "stopped"
+		case st.Disabled:
+			state = "disabled"
+		case st.Degraded:
+			state, errText = "degraded", st.StartError
+		case !st.Listening:
+			state, errText = "not listening", st.ListenError
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", st.Name, state, st.Listen, st.Proxy, st.Active, errText)
+	}
+	return tw.Flush()
+}
+
+// controlDrain stops the profile from accepting connections and waits until
+// its open ones are closed, or the shutdown timeout of the proxy closed them.
+func controlDrain(cc *controlClient, profile string, out io.Writer) error {
+	path := "/profiles/" + url.PathEscape(profile)
+	if err := cc.do(http.MethodPost, path+"/stop", nil); err != nil {
+		return err
+	}
+	last := int64(-1)
+	for {
+		var st profileStatus
+		if err := cc.do(http.MethodGet, path, &st); err != nil {
+			return err
+		}
+		if !st.Draining {
+			break
+		}
+		if st.Active != last {
+			fmt.Fprintf(out, "draining %s, %d connections open\n", profile, st.Active)
+			last = st.Active
+		}
+		time.Sleep(drainPoll)
+	}
+	fmt.Fprintf(out, "drained %s\n", profile)
+	return nil
+}
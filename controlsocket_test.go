@@ -0,0 +1,95 @@
+//go:build unix
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlSocket(t *testing.T) {
+	echo, dest := testEcho(t), testBanner(t, "dest")
+	inst := testInstance(t, &Profile{Name: "a", Proxy: dest})
+	path := filepath.Join(t.TempDir(), "control.sock")
+	c := &Configurations{ControlSocket: path, ShutdownTimeout: 5 * time.Second, Profiles: []*Profile{
+		{Name: "a", Listen: inst.ListenAddr(), Proxy: dest},
+		{Name: "b", Listen: "127.0.0.1:0", Proxy: echo},
+	}}
+	s := &Supervisor{c: c, insts: []*Instance{inst}}
+	t.Cleanup(func() {
+		for _, inst := range s.Instances() {
+			inst.Stop()
+		}
+	})
+	closeSocket, err := startControlSocket(c, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeSocket()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket is %v, %v", fi.Mode(), err)
+	}
+
+	var out strings.Builder
+	if err := runControl(c, "status", "", &out); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(out.String(), "\n"); !strings.HasPrefix(lines[0], "PROFILE") || !strings.HasPrefix(lines[1], "a ") || !strings.Contains(lines[1], "listening") {
+		t.Errorf("status:\n%s", out.String())
+	}
+
+	serveReloads(s)
+	out.Reset()
+	if err := runControl(c, "reload", "", &out); err != nil || !strings.HasPrefix(out.String(), "added: b\n") || !strings.HasSuffix(out.String(), "reloaded\n") {
+		t.Errorf("reload: %v\n%s", err, out.String())
+	}
+
+	// drain waits for the connections of the profile to be closed
+	for _, i := range s.Instances() {
+		if i.Profile().Name == "a" {
+			inst = i
+		}
+	}
+	conn, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the destination is done, the connection lasts until the client is too
+	if line, _ := bufio.NewReader(conn).ReadString('\n'); line != "dest\n" {
+		t.Fatalf("got %q", line)
+	}
+	drained := make(chan error, 1)
+	drainOut := &logBuffer{}
+	go func() { drained <- runControl(c, "drain", "a", drainOut) }()
+	waitFor(t, "draining", func() bool { return strings.Contains(drainOut.String(), "draining a, 1 connections open\n") })
+	conn.Close()
+	select {
+	case err := <-drained:
+		if err != nil || !strings.HasSuffix(drainOut.String(), "drained a\n") {
+			t.Errorf("drain: %v\n%s", err, drainOut.String())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain didn't return once the connection was closed")
+	}
+
+	for _, c := range []struct {
+		c                *Configurations
+		command, profile string
+		want             string
+	}{
+		{&Configurations{}, "status", "", "there is no control socket"},
+		{c, "drain", "", "needs the name of a profile"},
+		{c, "drain", "missing", `no running profile "missing"`},
+		{c, "restart", "", "unknown command"},
+	} {
+		if err := runControl(c.c, c.command, c.profile, &out); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s %s: got %v, want %q", c.command, c.profile, err, c.want)
+		}
+	}
+}
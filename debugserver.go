@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// connectionsTotal counts the connections each profile accepted, for expvar.
+var connectionsTotal = expvar.NewMap("connections_total")
+
+// startDebugServer serves net/http/pprof under /debug/pprof/ and the expvar
+// counters at /debug/vars. Profiles reveal a lot about the process, so it only
+// listens on loopback addresses unless insecure debugging is allowed.
+func startDebugServer(c *Configurations, s *Supervisor) error {
+	if len(c.DebugListen) < 1 {
+		return nil
+	}
+	if !c.InsecureDebugging && !isLoopback(c.DebugListen) {
+		return errors.New("the debug server only listens on loopback addresses without -insecuredebugging")
+	}
+
+	l, err := listenSocket("tcp", c.DebugListen)
+	if err != nil {
+		return err
+	}
+
+	expvar.Publish("connections_active", expvar.Func(func() any {
+		active := make(map[string]int64)
+		for _, inst := range s.Instances() {
+			active[inst.ident] = inst.Active()
+		}
+		return active
+	}))
+
+	expvar.Publish("bytes_total", expvar.Func(func() any {
+		return instanceBytes(s, (*Instance).Bytes)
+	}))
+	expvar.Publish("bytes_open", expvar.Func(func() any {
+		return instanceBytes(s, (*Instance).OpenBytes)
+	}))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		if err := http.Serve(l, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("debug server stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// instanceBytes has the up and down bytes of each profile.
+func instanceBytes(s *Supervisor, bytes func(*Instance) (int64, int64)) map[string]map[string]int64 {
+	m := make(map[string]map[string]int64)
+	for _, inst := range s.Instances() {
+		up, down := bytes(inst)
+		m[inst.ident] = map[string]int64{"up": up, "down": down}
+	}
+	return m
+}
+
+// isLoopback tells if the listen address can only be reached from the host.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
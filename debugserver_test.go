@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsLoopback(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:6060": true,
+		"[::1]:6060":     true,
+		"localhost:6060": true,
+		":6060":          false,
+		"0.0.0.0:6060":   false,
+		"10.0.0.1:6060":  false,
+		"127.0.0.1":      false,
+	} {
+		if got := isLoopback(addr); got != want {
+			t.Errorf("%s: got %v", addr, got)
+		}
+	}
+}
+
+func TestDebugServer(t *testing.T) {
+	if err := startDebugServer(&Configurations{DebugListen: ":0"}, &Supervisor{}); err == nil {
+		t.Error("listening on every address without -insecuredebugging")
+	}
+
+	inst := testInstance(t, &Profile{Proxy: testEcho(t)})
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c) {
+		t.Fatal("no echo")
+	}
+	// the counters are published once per process, so the server can only
+	// be started once
+	addr := freeAddr(t)
+	if err := startDebugServer(&Configurations{DebugListen: addr}, &Supervisor{insts: []*Instance{inst}}); err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	res, err := client.Get("http://" + addr + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vars struct {
+		Active map[string]int64            `json:"connections_active"`
+		Total  map[string]int64            `json:"connections_total"`
+		Bytes  map[string]map[string]int64 `json:"bytes_open"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&vars)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars.Active[inst.ident] != 1 || vars.Total[inst.ident] < 1 || vars.Bytes[inst.ident]["up"] != 5 {
+		t.Errorf("got %+v", vars)
+	}
+
+	res, err = client.Get("http://" + addr + "/debug/pprof/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if !strings.Contains(string(b), "goroutine") {
+		t.Errorf("pprof index is %q", b)
+	}
+}
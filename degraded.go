@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A profile that fails to start, like when a file it reads isn't there yet,
+// is degraded: the others run and it is retried after profileRetryMin,
+// doubling up to profileRetryMax, until it starts or the configuration no
+// longer has it.
+const (
+	profileRetryMin  = 5 * time.Second
+	profileRetryMax  = 5 * time.Minute
+	profileRetryPoll = time.Second
+)
+
+var profileDegraded = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "mtlsproxy_profile_degraded",
+	Help: "Whether each profile failed to start and is retried in the background.",
+}, []string{"profile"})
+
+func init() {
+	prometheus.MustRegister(profileDegraded)
+}
+
+// degradedProfile is a profile that failed to start.
+type degradedProfile struct {
+	p        *Profile
+	err      error
+	since    time.Time
+	attempts int
+	backoff  time.Duration
+	retryAt  time.Time
+}
+
+// degrade records that p failed to start with err, so it is retried later. A
+// profile that is already degraded keeps its schedule, only what is retried is
+// updated. s.mu must be held.
+func (s *Supervisor) degrade(p *Profile, err error) {
+	if d := s.degraded[p.Name]; d != nil {
+		d.p, d.err = p, err
+		slog.Warn("degraded profile still fails to start", "profile", p.Name, "retry_in", time.Until(d.retryAt).Round(time.Second), "err", err)
+		return
+	}
+	if s.degraded == nil {
+		s.degraded = make(map[string]*degradedProfile)
+	}
+	d := &degradedProfile{since: time.Now()}
+	s.degraded[p.Name] = d
+	profileDegraded.WithLabelValues(p.Name).Set(1)
+	d.failed(p, err)
+}
+
+// failed records another failed attempt and backs off the next one.
+func (d *degradedProfile) failed(p *Profile, err error) {
+	d.p, d.err = p, err
+	d.attempts++
+	d.backoff = min(max(2*d.backoff, profileRetryMin), profileRetryMax)
+	d.retryAt = time.Now().Add(d.backoff)
+	slog.Error("profile failed to start, retrying in the background", "profile", p.Name, "code", countError(p.Name, err), "attempts", d.attempts, "retry_in", d.backoff, "err", err)
+}
+
+// undegrade forgets a degraded profile that started or is gone. s.mu must be
+// held.
+func (s *Supervisor) undegrade(name string) {
+	if _, ok := s.degraded[name]; !ok {
+		return
+	}
+	delete(s.degraded, name)
+	profileDegraded.WithLabelValues(name).Set(0)
+}
+
+// retryDegraded starts the degraded profiles that are due for another try,
+// and tells if any did.
+func (s *Supervisor) retryDegraded() (started bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for name, d := range s.degraded {
+		if now.Before(d.retryAt) {
+			continue
+		}
+		p, err := d.p.Reresolve()
+		if err != nil {
+			d.failed(d.p, fmt.Errorf("reading files: %w", err))
+			continue
+		}
+		inst, err := NewInstance(p)
+		if err != nil {
+			d.failed(d.p, err)
+			continue
+		}
+		slog.Info("profile started after retrying", "profile", name, "attempts", d.attempts, "degraded_for", now.Sub(d.since).Round(time.Second))
+		s.insts = append(s.insts, inst)
+		s.undegrade(name)
+		started = true
+	}
+	return started
+}
+
+// Degraded returns the profiles that failed to start and why.
+func (s *Supervisor) Degraded() []degradedProfile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ds := make([]degradedProfile, 0, len(s.degraded))
+	for _, d := range s.degraded {
+		ds = append(ds, *d)
+	}
+	return ds
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// testBroken is a profile that fails to resolve, its authority doesn't exist.
+func testBroken(name string) *Profile {
+	return &Profile{Name: name, Listen: "127.0.0.1:0", Proxy: "127.0.0.1:1", SendAuthorityPath: "/nonexistent/ca.pem"}
+}
+
+func TestDegradeBacksOff(t *testing.T) {
+	s := &Supervisor{}
+	p := testBroken("a")
+	s.degrade(p, errors.New("first"))
+	d := s.degraded["a"]
+	if d.attempts != 1 || d.backoff != profileRetryMin {
+		t.Fatalf("got %d attempts, backoff %s", d.attempts, d.backoff)
+	}
+
+	d.failed(p, errors.New("retried"))
+	if d.attempts != 2 || d.backoff != 2*profileRetryMin {
+		t.Errorf("got %d attempts, backoff %s after a failed retry", d.attempts, d.backoff)
+	}
+	for i := 0; i < 20; i++ {
+		d.failed(p, errors.New("retried"))
+	}
+	if d.backoff != profileRetryMax {
+		t.Errorf("backoff %s, want it capped at %s", d.backoff, profileRetryMax)
+	}
+
+	s.undegrade("a")
+	if len(s.Degraded()) > 0 {
+		t.Error("profile still degraded")
+	}
+}
+
+func TestDegradeAgainKeepsSchedule(t *testing.T) {
+	s := &Supervisor{}
+	s.degrade(testBroken("a"), errors.New("first"))
+	d := s.degraded["a"]
+	retryAt := d.retryAt
+
+	q := testBroken("a")
+	s.degrade(q, errors.New("again"))
+	if d.attempts != 1 || d.backoff != profileRetryMin || !d.retryAt.Equal(retryAt) {
+		t.Errorf("degrading again changed the schedule: %d attempts, backoff %s", d.attempts, d.backoff)
+	}
+	if d.p != q || d.err.Error() != "again" {
+		t.Error("degrading again didn't update the profile retried")
+	}
+}
+
+func TestReloadDegradesNewProfile(t *testing.T) {
+	running := &Profile{Name: "a", Proxy: testEcho(t)}
+	inst := testInstance(t, running)
+	s := &Supervisor{c: &Configurations{Profiles: []*Profile{{Name: "a", Listen: "127.0.0.1:0", Proxy: running.Proxy}, testBroken("b")}}, insts: []*Instance{inst}}
+
+	for i := 0; i < 3; i++ {
+		applied, degraded, err := s.reload()
+		if !applied || err != nil {
+			t.Fatalf("reload %d: applied %t, %v", i, applied, err)
+		}
+		if degraded == nil {
+			t.Fatalf("reload %d: profile b didn't fail", i)
+		}
+	}
+	ds := s.Degraded()
+	if len(ds) != 1 || ds[0].p.Name != "b" {
+		t.Fatalf("degraded: %v", ds)
+	}
+	if ds[0].attempts != 1 {
+		t.Errorf("reloads made %d attempts, want them left to the retries", ds[0].attempts)
+	}
+	if len(s.Instances()) != 1 {
+		t.Error("running profile was stopped")
+	}
+
+	// gone from the configuration, it isn't retried
+	s.c.Profiles = s.c.Profiles[:1]
+	if _, degraded, err := s.reload(); degraded != nil || err != nil {
+		t.Fatal(degraded, err)
+	}
+	if len(s.Degraded()) > 0 {
+		t.Error("profile no longer configured is still degraded")
+	}
+}
+
+func TestReloadFailsForRunningProfile(t *testing.T) {
+	inst := testInstance(t, &Profile{Name: "a", Proxy: testEcho(t)})
+	s := &Supervisor{c: &Configurations{Profiles: []*Profile{testBroken("a"), testBroken("b")}}, insts: []*Instance{inst}}
+	applied, degraded, err := s.reload()
+	if applied || err == nil {
+		t.Fatalf("applied %t, %v", applied, err)
+	}
+	if degraded != nil || len(s.Degraded()) > 0 {
+		t.Error("a reload that changed nothing degraded a profile")
+	}
+}
+
+func TestApplyKeepsAppliedProfiles(t *testing.T) {
+	echo := testEcho(t)
+	inst := testInstance(t, &Profile{Name: "a", Proxy: echo})
+	s := &Supervisor{c: &Configurations{Profiles: []*Profile{{Name: "a", Listen: "127.0.0.1:0", Proxy: echo}}}, insts: []*Instance{inst}}
+
+	err := s.applyAndReload([]*Profile{{Name: "a", Listen: "127.0.0.1:0", Proxy: echo, MaxConnections: 5}, testBroken("b")})
+	if err == nil {
+		t.Fatal("profile b didn't fail")
+	}
+	if inst.Profile().MaxConnections != 5 {
+		t.Error("profile a wasn't applied")
+	}
+	var kept bool
+	for _, p := range s.c.Overrides {
+		kept = kept || p.Name == "a"
+	}
+	if !kept {
+		t.Error("override of the applied profile was rolled back")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	PreferIPv4 = "ipv4"
+	PreferIPv6 = "ipv6"
+)
+
+// resolverCache caches destination host lookups for a single profile. The Go
+// resolver doesn't expose record TTLs, so entries live for the configured ttl.
+type resolverCache struct {
+	ident    string
+	ttl      time.Duration
+	negative time.Duration
+	stale    bool
+	pins     []*net.IPNet // answers outside these are dropped, when set
+	prefer   string       // address family tried first
+	mu       sync.Mutex
+	entries  map[string]*resolverEntry
+	stop     chan struct{}
+
+	lookupHost func(ctx context.Context, host string) ([]string, error)
+}
+
+type resolverEntry struct {
+	addrs   []string
+	err     error
+	expires time.Time
+	retry   time.Time // while stale, when resolving is tried again
+}
+
+func newResolverCache(ident string, ttl, negative time.Duration, stale bool) *resolverCache {
+	return &resolverCache{
+		ident:    ident,
+		ttl:      ttl,
+		negative: negative,
+		stale:    stale,
+		entries:  make(map[string]*resolverEntry),
+
+		lookupHost: net.DefaultResolver.LookupHost,
+	}
+}
+
+// lookup returns the addresses for host, from the cache when the entry is still
+// fresh. When serving stale is enabled, the last good answer is returned if the
+// lookup fails.
+func (rc *resolverCache) lookup(ctx context.Context, host string) ([]string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{host}, nil
+	}
+
+	now := time.Now()
+	rc.mu.Lock()
+	e := rc.entries[host]
+	var retry time.Time
+	if e != nil {
+		retry = e.retry
+	}
+	rc.mu.Unlock()
+	if e != nil && (now.Before(e.expires) || now.Before(retry)) {
+		return e.addrs, e.err
+	}
+
+	return rc.resolve(ctx, host, e)
+}
+
+// resolve looks host up, e is the current entry if there is one.
+func (rc *resolverCache) resolve(ctx context.Context, host string, e *resolverEntry) ([]string, error) {
+	now := time.Now()
+	addrs, err := rc.lookupHost(ctx, host)
+	if err == nil {
+		if addrs = rc.filter(addrs); len(addrs) < 1 {
+			err = errors.New("no address allowed by DNSPin")
+		}
+	}
+	if err != nil {
+		if rc.stale && e != nil && e.err == nil {
+			// the stale entry stays until a lookup succeeds, only the next
+			// attempt is held off like a negative answer
+			slog.Warn("resolving failed, serving stale answer", "profile", rc.ident, "host", host, "stale", now.Sub(e.expires), "err", err)
+			rc.mu.Lock()
+			e.retry = now.Add(rc.negative)
+			rc.mu.Unlock()
+			return e.addrs, nil
+		}
+		if rc.negative > 0 {
+			rc.store(host, &resolverEntry{err: err, expires: now.Add(rc.negative)})
+		}
+		return nil, err
+	}
+
+	if e != nil && e.err == nil && !sameAddrs(e.addrs, addrs) {
+		slog.Info("resolved to new addresses", "profile", rc.ident, "host", host, "addrs", addrs, "was", e.addrs)
+	} else if e == nil || e.err != nil {
+		slog.Debug("resolved", "profile", rc.ident, "host", host, "addrs", addrs)
+	}
+	rc.store(host, &resolverEntry{addrs: addrs, expires: now.Add(rc.ttl)})
+	return addrs, nil
+}
+
+// sameAddrs compares answers ignoring order, DNS servers often rotate them.
+func sameAddrs(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// filter drops the addresses outside the pins and puts the preferred family
+// first.
+func (rc *resolverCache) filter(addrs []string) []string {
+	var kept []string
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			continue
+		}
+		if len(rc.pins) > 0 && !slices.ContainsFunc(rc.pins, func(n *net.IPNet) bool { return n.Contains(ip) }) {
+			continue
+		}
+		kept = append(kept, a)
+	}
+	if len(rc.prefer) > 0 {
+		v4 := rc.prefer == PreferIPv4
+		sort.SliceStable(kept, func(i, j int) bool {
+			return (net.ParseIP(kept[i]).To4() != nil) == v4 && (net.ParseIP(kept[j]).To4() != nil) != v4
+		})
+	}
+	return kept
+}
+
+// refresh resolves hosts right away and every host looked up so far on the
+// interval, so dials use a current answer without waiting on DNS.
+func (rc *resolverCache) refresh(interval time.Duration, hosts []string) {
+	rc.stop = make(chan struct{})
+	if rc.ttl < interval*2 {
+		rc.ttl = interval * 2 // fresh until the refresh after next
+	}
+	go func() {
+		for _, host := range hosts {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			if _, err := rc.lookup(ctx, host); err != nil {
+				slog.Warn("error resolving", "profile", rc.ident, "host", host, "err", err)
+			}
+			cancel()
+		}
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-rc.stop:
+				return
+			case <-t.C:
+			}
+			rc.mu.Lock()
+			current := make(map[string]*resolverEntry, len(rc.entries))
+			for host, e := range rc.entries {
+				current[host] = e
+			}
+			rc.mu.Unlock()
+			for host, e := range current {
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				if _, err := rc.resolve(ctx, host, e); err != nil {
+					slog.Warn("error refreshing", "profile", rc.ident, "host", host, "err", err)
+				}
+				cancel()
+			}
+		}
+	}()
+}
+
+func (rc *resolverCache) close() {
+	if rc != nil && rc.stop != nil {
+		close(rc.stop)
+	}
+}
+
+func (rc *resolverCache) store(host string, e *resolverEntry) {
+	rc.mu.Lock()
+	rc.entries[host] = e
+	rc.mu.Unlock()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLookup answers with addrs or err and counts the calls.
+type fakeLookup struct {
+	addrs []string
+	err   error
+	calls int
+}
+
+func (f *fakeLookup) lookup(ctx context.Context, host string) ([]string, error) {
+	f.calls++
+	return f.addrs, f.err
+}
+
+func testResolver(ttl, negative time.Duration, stale bool) (*resolverCache, *fakeLookup) {
+	f := &fakeLookup{addrs: []string{"192.0.2.1"}}
+	rc := newResolverCache("test", ttl, negative, stale)
+	rc.lookupHost = f.lookup
+	return rc, f
+}
+
+func TestResolverCacheHit(t *testing.T) {
+	rc, f := testResolver(time.Minute, 0, false)
+	for i := 0; i < 3; i++ {
+		addrs, err := rc.lookup(context.Background(), "example.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(addrs, []string{"192.0.2.1"}) {
+			t.Fatalf("got %v", addrs)
+		}
+	}
+	if f.calls != 1 {
+		t.Errorf("resolved %d times, want 1", f.calls)
+	}
+}
+
+func TestResolverCacheExpires(t *testing.T) {
+	rc, f := testResolver(time.Minute, 0, false)
+	rc.lookup(context.Background(), "example.test")
+	rc.entries["example.test"].expires = time.Now().Add(-time.Second)
+	f.addrs = []string{"192.0.2.2"}
+	addrs, err := rc.lookup(context.Background(), "example.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(addrs, []string{"192.0.2.2"}) || f.calls != 2 {
+		t.Errorf("got %v after %d lookups", addrs, f.calls)
+	}
+}
+
+func TestResolverCacheIPLiteral(t *testing.T) {
+	rc, f := testResolver(time.Minute, 0, false)
+	addrs, err := rc.lookup(context.Background(), "2001:db8::1")
+	if err != nil || !slices.Equal(addrs, []string{"2001:db8::1"}) || f.calls != 0 {
+		t.Errorf("got %v, %v after %d lookups", addrs, err, f.calls)
+	}
+}
+
+func TestResolverCacheNegative(t *testing.T) {
+	rc, f := testResolver(time.Minute, time.Minute, false)
+	f.err = errors.New("no such host")
+	for i := 0; i < 2; i++ {
+		if _, err := rc.lookup(context.Background(), "example.test"); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	if f.calls != 1 {
+		t.Errorf("resolved %d times, want the failure cached", f.calls)
+	}
+
+	rc, f = testResolver(time.Minute, 0, false)
+	f.err = errors.New("no such host")
+	rc.lookup(context.Background(), "example.test")
+	rc.lookup(context.Background(), "example.test")
+	if f.calls != 2 {
+		t.Errorf("resolved %d times, want failures not cached", f.calls)
+	}
+}
+
+func TestResolverCacheServeStale(t *testing.T) {
+	rc, f := testResolver(time.Minute, time.Minute, true)
+	rc.lookup(context.Background(), "example.test")
+	expired := time.Now().Add(-time.Second)
+	rc.entries["example.test"].expires = expired
+
+	f.err = errors.New("timeout")
+	for i := 0; i < 2; i++ {
+		addrs, err := rc.lookup(context.Background(), "example.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(addrs, []string{"192.0.2.1"}) {
+			t.Fatalf("got %v, want the stale answer", addrs)
+		}
+	}
+	if f.calls != 2 {
+		t.Errorf("resolved %d times, want retries held off", f.calls)
+	}
+	e := rc.entries["example.test"]
+	if !e.expires.Equal(expired) {
+		t.Error("stale entry was stored as fresh")
+	}
+
+	// the stale entry is only replaced by a successful lookup
+	e.retry = time.Time{}
+	f.err, f.addrs = nil, []string{"192.0.2.3"}
+	addrs, err := rc.lookup(context.Background(), "example.test")
+	if err != nil || !slices.Equal(addrs, []string{"192.0.2.3"}) {
+		t.Fatalf("got %v, %v", addrs, err)
+	}
+	if e := rc.entries["example.test"]; !e.expires.After(time.Now()) || !e.retry.IsZero() {
+		t.Error("successful lookup didn't replace the stale entry")
+	}
+}
+
+func TestResolverCachePrefer(t *testing.T) {
+	rc := newResolverCache("test", 0, 0, false)
+	rc.prefer = PreferIPv6
+	got := rc.filter([]string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2"})
+	want := []string{"2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	_, pin, _ := net.ParseCIDR("192.0.2.0/24")
+	rc.pins = []*net.IPNet{pin}
+	got = rc.filter([]string{"198.51.100.1", "192.0.2.1", "2001:db8::1"})
+	if !slices.Equal(got, []string{"192.0.2.1"}) {
+		t.Errorf("got %v, want only the pinned address", got)
+	}
+}
+
+func TestResolveDNSNeedsCacheTTL(t *testing.T) {
+	for _, p := range []*Profile{
+		{Name: "a", Listen: ":0", Proxy: "example.test:1", DNSNegativeTTL: "5s"},
+		{Name: "b", Listen: ":0", Proxy: "example.test:1", DNSServeStale: true},
+		{Name: "c", Listen: ":0", Proxy: "example.test:1", DNSServeStale: true, DNSCacheTTL: "0s"},
+	} {
+		if err := p.Resolve(); err == nil {
+			t.Errorf("profile %s resolved without DNSCacheTTL", p.Name)
+		}
+	}
+	p := &Profile{Name: "d", Listen: ":0", Proxy: "example.test:1", DNSServeStale: true, DNSNegativeTTL: "5s", DNSCacheTTL: "1m"}
+	if err := p.Resolve(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResolverCacheRefresh(t *testing.T) {
+	var mu sync.Mutex
+	answer, calls := []string{"192.0.2.1"}, 0
+	rc := newResolverCache("test", time.Millisecond, 0, false)
+	rc.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		return answer, nil
+	}
+	rc.refresh(20*time.Millisecond, []string{"example.test"})
+	defer rc.close()
+	if rc.ttl < 40*time.Millisecond {
+		t.Errorf("TTL %s expires before the refresh after next", rc.ttl)
+	}
+	waitFor(t, "first lookup", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls > 0
+	})
+
+	mu.Lock()
+	answer = []string{"192.0.2.2"}
+	mu.Unlock()
+	waitFor(t, "refreshed answer", func() bool {
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		e := rc.entries["example.test"]
+		return e != nil && slices.Equal(e.addrs, []string{"192.0.2.2"})
+	})
+	mu.Lock()
+	before := calls
+	mu.Unlock()
+	if addrs, err := rc.lookup(context.Background(), "example.test"); err != nil || !slices.Equal(addrs, []string{"192.0.2.2"}) {
+		t.Errorf("got %v, %v", addrs, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != before {
+		t.Error("dial waited on DNS with a refreshed answer")
+	}
+}
+
+func TestResolverCachePinnedOut(t *testing.T) {
+	rc, _ := testResolver(time.Minute, 0, false)
+	_, pin, _ := net.ParseCIDR("198.51.100.0/24")
+	rc.pins = []*net.IPNet{pin}
+	if _, err := rc.lookup(context.Background(), "example.test"); err == nil {
+		t.Error("answer outside the pins used")
+	}
+}
+
+func TestSameAddrs(t *testing.T) {
+	if !sameAddrs([]string{"192.0.2.1", "192.0.2.2"}, []string{"192.0.2.2", "192.0.2.1"}) {
+		t.Error("rotated answer reported as changed")
+	}
+	if sameAddrs([]string{"192.0.2.1"}, []string{"192.0.2.1", "192.0.2.2"}) {
+		t.Error("grown answer reported as the same")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dumpLookupTimeout bounds resolving destinations for a state dump, DNS may
+// be part of the incident.
+const dumpLookupTimeout = 2 * time.Second
+
+// dumpState logs a snapshot of every profile, for when the admin server
+// can't be reached.
+func (s *Supervisor) dumpState() {
+	insts := s.Instances()
+	stopped := s.Stopped()
+	disabled := s.Disabled()
+	degraded := s.Degraded()
+	slog.Info("state dump", "profiles", len(insts), "stopped", len(stopped), "disabled", len(disabled), "degraded", len(degraded), "goroutines", runtime.NumGoroutine())
+
+	now := time.Now()
+	for _, inst := range insts {
+		p := inst.Profile()
+		listening, listenErr := inst.ListenStatus()
+		attrs := []any{"profile", p.Name, "listen", p.Listen, "bound", inst.ListenAddr(), "listening", listening}
+		if listenErr != nil {
+			attrs = append(attrs, "listen_error", listenErr, "listen_error_code", errorCode(listenErr))
+		}
+		send := sendAddrs(p)
+		attrs = append(attrs, "send", strings.Join(send, ","), "resolved", strings.Join(inst.resolveAll(send), ","), "active", inst.Active())
+		if msg, code, at := inst.LastError(); len(msg) > 0 {
+			attrs = append(attrs, "last_error", msg, "last_error_code", code, "last_error_at", at.Format(time.RFC3339))
+		}
+		slog.Info("profile state", attrs...)
+
+		for _, lc := range profileCerts(p) {
+			slog.Info("certificate state", "profile", p.Name, "use", lc.use, "subject", lc.cert.Subject.String(), "serial", lc.cert.SerialNumber.String(),
+				"expiry", lc.cert.NotAfter.Format(time.RFC3339), "left", lc.cert.NotAfter.Sub(now).Round(time.Minute))
+		}
+	}
+	for _, p := range stopped {
+		slog.Info("profile state", "profile", p.Name, "listen", p.Listen, "send", strings.Join(sendAddrs(p), ","), "stopped", true)
+	}
+	for _, p := range disabled {
+		slog.Info("profile state", "profile", p.Name, "listen", p.Listen, "send", strings.Join(sendAddrs(p), ","), "disabled", true)
+	}
+	for _, d := range degraded {
+		slog.Info("profile state", "profile", d.p.Name, "listen", d.p.Listen, "send", strings.Join(sendAddrs(d.p), ","), "degraded", true,
+			"start_error", d.err, "start_error_code", errorCode(d.err), "attempts", d.attempts, "since", d.since.Format(time.RFC3339), "retry_at", d.retryAt.Format(time.RFC3339))
+	}
+	if st, err := s.LastReload(); err == nil {
+		attrs := []any{"at", st.Time.Format(time.RFC3339), "success", st.Success, "added", len(st.Added), "modified", len(st.Modified), "removed", len(st.Removed), "failed", len(st.Errors)}
+		if !st.Success {
+			attrs = append(attrs, "code", st.Code, "err", st.Error)
+		}
+		slog.Info("last reload", attrs...)
+	}
+	slog.Info("end of state dump")
+}
+
+// sendAddrs are the destination addresses of the profile and its routes.
+func sendAddrs(p *Profile) []string {
+	addrs := splitList(p.Proxy)
+	names := make([]string, 0, len(p.Routes))
+	for name := range p.Routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		addrs = append(addrs, splitList(p.Routes[name].Proxy)...)
+	}
+	return addrs
+}
+
+// resolveAll looks up the host names of the addresses the way connections
+// would, through the profile's DNS cache when it has one.
+func (inst *Instance) resolveAll(addrs []string) []string {
+	inst.change.Lock()
+	rc := inst.resolver
+	inst.change.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), dumpLookupTimeout)
+	defer cancel()
+	var resolved []string
+	for _, a := range addrs {
+		host, port, err := net.SplitHostPort(a)
+		if err != nil || net.ParseIP(host) != nil {
+			resolved = append(resolved, a)
+			continue
+		}
+		var ips []string
+		if rc != nil {
+			ips, err = rc.lookup(ctx, host)
+		} else {
+			ips, err = net.DefaultResolver.LookupHost(ctx, host)
+		}
+		if err != nil {
+			resolved = append(resolved, a+" ("+err.Error()+")")
+			continue
+		}
+		for _, ip := range ips {
+			resolved = append(resolved, net.JoinHostPort(ip, port))
+		}
+	}
+	return resolved
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSendAddrs(t *testing.T) {
+	p := &Profile{Proxy: "10.0.0.1:443,10.0.0.2:443", Routes: map[string]*Route{
+		"b.example.test": {Proxy: "10.0.0.4:443"},
+		"a.example.test": {Proxy: "10.0.0.3:443"},
+	}}
+	want := []string{"10.0.0.1:443", "10.0.0.2:443", "10.0.0.3:443", "10.0.0.4:443"}
+	if got := sendAddrs(p); !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestResolveAll(t *testing.T) {
+	inst := &Instance{}
+	got := inst.resolveAll([]string{"192.0.2.1:443", "localhost:8443", "nonsense"})
+	if len(got) < 3 || got[0] != "192.0.2.1:443" || got[len(got)-1] != "nonsense" || !slices.Contains(got, "127.0.0.1:8443") {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestDumpState(t *testing.T) {
+	ca := newTestCA(t)
+	p := &Profile{Proxy: testEcho(t)}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+	s := &Supervisor{insts: []*Instance{inst}, stopped: map[string]*Profile{"old": {Name: "old", Listen: "127.0.0.1:1", Proxy: "127.0.0.1:2"}}}
+	lb := captureLog(t)
+	s.dumpState()
+
+	out := lb.String()
+	for _, want := range []string{
+		`msg="state dump" profiles=1 stopped=1 disabled=0 degraded=0`,
+		`msg="profile state" profile=test listen=127.0.0.1:0 bound=` + inst.ListenAddr() + ` listening=true send=` + p.Proxy + ` resolved=` + p.Proxy + ` active=0`,
+		`msg="certificate state" profile=test use=listen subject="CN=proxy"`,
+		`msg="profile state" profile=old listen=127.0.0.1:1 send=127.0.0.1:2 stopped=true`,
+		`msg="end of state dump"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("no %s in\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "last reload") {
+		t.Error("last reload logged without any")
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// dumpSignals make the state be dumped to the log, there is no SIGUSR1 here.
+var dumpSignals []os.Signal
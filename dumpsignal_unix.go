@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// dumpSignals make the state be dumped to the log.
+var dumpSignals = []os.Signal{syscall.SIGUSR1}
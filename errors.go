@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Codes of operational failures, shown as the code of log records, the code
+// label of mtlsproxy_errors_total and in the admin API.
+const (
+	codeBindFailure      = "bind_failure"       // the listener couldn't be opened
+	codeCertParse        = "cert_parse_failure" // a certificate, key or authority couldn't be loaded
+	codeCAMismatch       = "ca_mismatch"        // the peer's certificate isn't from a trusted authority
+	codeHandshakeFailure = "handshake_failure"  // any other TLS handshake failure
+	codeDialTimeout      = "dial_timeout"       // the destination didn't answer in time
+	codeDialRefused      = "dial_refused"       // the destination refused the connection
+	codeDialFailure      = "dial_failure"       // any other failure connecting to the destination
+	codeCircuitOpen      = "circuit_open"       // the destination kept failing, it wasn't dialed
+	codeDestinationDown  = "destination_down"   // the client was refused while the destination is down
+	codePeerReset        = "peer_reset"         // the client or destination reset the connection
+	codeDrainTimeout     = "drain_timeout"      // connections were still open when their time was up
+	codePanic            = "panic"              // a goroutine of the connection panicked
+	codeOther            = "other"
+)
+
+var errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mtlsproxy_errors_total",
+	Help: "Operational failures of each profile by code.",
+}, []string{"profile", "code"})
+
+func init() {
+	prometheus.MustRegister(errorsTotal)
+}
+
+// codedError gives an error the code of the failure it caused.
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string { return e.err.Error() }
+func (e *codedError) Unwrap() error { return e.err }
+
+func withCode(code string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &codedError{code: code, err: err}
+}
+
+// errorCode is the code err was given, or one told from the kind of error.
+func errorCode(err error) string {
+	var ce *codedError
+	if errors.As(err, &ce) {
+		return ce.code
+	}
+	var ua x509.UnknownAuthorityError
+	if errors.As(err, &ua) {
+		return codeCAMismatch
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return codePeerReset
+	}
+	return codeOther
+}
+
+// countError counts the failure of a profile and returns its code.
+func countError(profile string, err error) string {
+	code := errorCode(err)
+	errorsTotal.WithLabelValues(profile, code).Inc()
+	return code
+}
+
+// dialFailure gives an error connecting to the destination its code.
+func dialFailure(err error) error {
+	var ne net.Error
+	switch code := errorCode(err); {
+	case code != codeOther:
+		return err
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return withCode(codeDialTimeout, err)
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return withCode(codeDialRefused, err)
+	}
+	return withCode(codeDialFailure, err)
+}
+
+// handshakeCode is the code of a handshake failure with the reason.
+func handshakeCode(reason string, err error) string {
+	if reason == "unknown_ca" {
+		return codeCAMismatch
+	}
+	if code := errorCode(err); code != codeOther {
+		return code
+	}
+	return codeHandshakeFailure
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestErrorCode(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want string
+	}{
+		{withCode(codeBindFailure, errors.New("address in use")), codeBindFailure},
+		{fmt.Errorf("starting: %w", withCode(codeCertParse, errors.New("bad PEM"))), codeCertParse},
+		{&tlsVerifyError{x509.UnknownAuthorityError{}}, codeCAMismatch},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, codePeerReset},
+		{errors.New("something"), codeOther},
+	} {
+		if got := errorCode(c.err); got != c.want {
+			t.Errorf("%v: got %s, want %s", c.err, got, c.want)
+		}
+	}
+	if withCode(codeOther, nil) != nil {
+		t.Error("no error given a code")
+	}
+	if handshakeCode("unknown_ca", errors.New("x")) != codeCAMismatch || handshakeCode("not_tls", errors.New("x")) != codeHandshakeFailure {
+		t.Error("wrong handshake codes")
+	}
+}
+
+// tlsVerifyError wraps an error like crypto/tls does with verification
+// failures.
+type tlsVerifyError struct{ err error }
+
+func (e *tlsVerifyError) Error() string { return "tls: " + e.err.Error() }
+func (e *tlsVerifyError) Unwrap() error { return e.err }
+
+func TestDialFailureCode(t *testing.T) {
+	var d net.Dialer
+	_, err := d.Dial("tcp", closedAddr(t))
+	if got := errorCode(dialFailure(err)); got != codeDialRefused {
+		t.Errorf("refused dial has code %s", got)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	_, err = d.DialContext(ctx, "tcp", testEcho(t))
+	if got := errorCode(dialFailure(err)); got != codeDialTimeout {
+		t.Errorf("dial out of time has code %s", got)
+	}
+	if got := errorCode(dialFailure(withCode(codeCircuitOpen, errCircuitOpen))); got != codeCircuitOpen {
+		t.Errorf("code replaced with %s", got)
+	}
+	if got := errorCode(dialFailure(errors.New("no route"))); got != codeDialFailure {
+		t.Errorf("other failure has code %s", got)
+	}
+}
+
+func TestInstanceErrorCodes(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: closedAddr(t)})
+	refused := errorsTotal.WithLabelValues(inst.ident, codeDialRefused)
+	before := testutil.ToFloat64(refused)
+	readsBanner(t, inst.ListenAddr())
+	waitFor(t, "the failure to be counted", func() bool { return testutil.ToFloat64(refused) == before+1 })
+	if msg, code, _ := inst.LastError(); code != codeDialRefused || len(msg) < 1 {
+		t.Errorf("last error %q with code %s", msg, code)
+	}
+	w := adminDo(&Supervisor{insts: []*Instance{inst}}, http.MethodGet, "/profiles/test", "")
+	if !strings.Contains(w.Body.String(), `"last_error_code":"dial_refused"`) {
+		t.Errorf("admin server shows %s", w.Body)
+	}
+}
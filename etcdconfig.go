@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultEtcdPrefix = "/mtlsproxy/"
+	// etcdTimeout bounds connecting to etcd and reading the prefix.
+	etcdTimeout = 10 * time.Second
+	// etcdRetry is how long the watch waits before starting again after etcd
+	// ended it.
+	etcdRetry = 5 * time.Second
+)
+
+// etcdConfig is a configuration kept under a prefix in etcd, every key is a
+// profile named after the rest of the key with its options in JSON or Toml.
+// Like in config files the keys vars and defaults are the variables and the
+// defaults of the profiles.
+type etcdConfig struct {
+	client *clientv3.Client
+	prefix string
+	source string
+	mu     sync.Mutex // guards what follows
+	rev    int64
+	kvs    map[string][]byte
+}
+
+func newEtcdConfig(c *Configurations) (*etcdConfig, error) {
+	conf := clientv3.Config{
+		Endpoints:   c.EtcdEndpoints,
+		DialTimeout: etcdTimeout,
+		Username:    c.EtcdUsername,
+		Password:    c.EtcdPassword,
+		Logger:      zap.NewNop(),
+	}
+	if len(c.EtcdAuthority) > 0 || len(c.EtcdCert) > 0 || len(c.EtcdKey) > 0 {
+		tlsconf := &tls.Config{}
+		if len(c.EtcdAuthority) > 0 {
+			ca, err := os.ReadFile(c.EtcdAuthority)
+			if err != nil {
+				return nil, fmt.Errorf("reading file %q: %w", c.EtcdAuthority, err)
+			}
+			capool := x509.NewCertPool()
+			if ok := capool.AppendCertsFromPEM(ca); !ok {
+				return nil, errors.New("no certs found for the etcd authority")
+			}
+			tlsconf.RootCAs = capool
+		}
+		if len(c.EtcdCert) > 0 || len(c.EtcdKey) > 0 {
+			cert, err := tls.LoadX509KeyPair(c.EtcdCert, c.EtcdKey)
+			if err != nil {
+				return nil, fmt.Errorf("loading cert/key pair: %w", err)
+			}
+			tlsconf.Certificates = []tls.Certificate{cert}
+		}
+		conf.TLS = tlsconf
+	}
+
+	client, err := clientv3.New(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdConfig{
+		client: client,
+		prefix: c.EtcdPrefix,
+		source: "etcd " + c.EtcdPrefix,
+	}, nil
+}
+
+// load reads every key under the prefix, and reports if any changed since the
+// last load.
+func (ec *etcdConfig) load() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	resp, err := ec.client.Get(ctx, ec.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return false, err
+	}
+
+	kvs := make(map[string][]byte, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs[string(kv.Key)] = kv.Value
+	}
+
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	changed := len(kvs) != len(ec.kvs)
+	for k, v := range kvs {
+		if old, ok := ec.kvs[k]; !ok || string(old) != string(v) {
+			changed = true
+		}
+	}
+	ec.kvs, ec.rev = kvs, resp.Header.Revision
+	return changed, nil
+}
+
+// layer is the profiles of the keys as they were last seen.
+func (ec *etcdConfig) layer() (configLayer, error) {
+	l := configLayer{source: ec.source, expand: true}
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	for k, v := range ec.kvs {
+		name := strings.TrimPrefix(k, ec.prefix)
+		if name == configVars {
+			if err := decodeValue(v, &l.vars); err != nil {
+				return l, fmt.Errorf("%s: %w", k, err)
+			}
+			continue
+		}
+
+		p := new(Profile)
+		if err := decodeValue(v, p); err != nil {
+			return l, fmt.Errorf("%s: %w", k, err)
+		}
+		l.unknown = append(l.unknown, findUnknownOptions(v, sniffFormat(v), k, name)...)
+		p.Source = ec.source
+		if name == configDefaults {
+			l.defaults = p
+			continue
+		}
+		p.Name = name
+		l.profiles = append(l.profiles, p)
+	}
+	return l, nil
+}
+
+// decodeValue decodes the value of a key, JSON when it is an object and Toml
+// otherwise.
+func decodeValue(b []byte, v any) error {
+	if sniffFormat(b) == ConfigJSON {
+		return decodeJSON(b, v)
+	}
+	_, err := toml.Decode(string(b), v)
+	return err
+}
+
+// watch sends on the returned channel when keys under the prefix are put or
+// deleted. When etcd ends the watch, like after a compaction, the prefix is
+// read again and the watch starts over from there.
+func (ec *etcdConfig) watch() <-chan struct{} {
+	changes := make(chan struct{})
+	go func() {
+		for {
+			ec.mu.Lock()
+			rev := ec.rev
+			ec.mu.Unlock()
+
+			ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(context.Background()))
+			for resp := range ec.client.Watch(ctx, ec.prefix, clientv3.WithPrefix(), clientv3.WithRev(rev+1)) {
+				if err := resp.Err(); err != nil {
+					slog.Error("error watching etcd", "prefix", ec.prefix, "err", err)
+					break
+				}
+				if len(resp.Events) < 1 {
+					continue
+				}
+				ec.apply(resp)
+				changes <- struct{}{}
+			}
+			cancel()
+
+			time.Sleep(etcdRetry)
+			changed, err := ec.load()
+			if err != nil {
+				slog.Error("error reading etcd", "prefix", ec.prefix, "err", err)
+				continue
+			}
+			if changed {
+				changes <- struct{}{}
+			}
+		}
+	}()
+	return changes
+}
+
+func (ec *etcdConfig) apply(resp clientv3.WatchResponse) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	for _, e := range resp.Events {
+		if e.Type == clientv3.EventTypeDelete {
+			delete(ec.kvs, string(e.Kv.Key))
+		} else {
+			ec.kvs[string(e.Kv.Key)] = e.Kv.Value
+		}
+	}
+	ec.rev = resp.Header.Revision
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEtcdConfigLayer(t *testing.T) {
+	ec := &etcdConfig{prefix: defaultEtcdPrefix, source: "etcd " + defaultEtcdPrefix, kvs: map[string][]byte{
+		"/mtlsproxy/vars":     []byte(`{"port": "443"}`),
+		"/mtlsproxy/defaults": []byte("MaxConnections = 10\n"),
+		"/mtlsproxy/web":      []byte(`{"Listen": "127.0.0.1:8443", "Proxy": "10.0.0.1:${port}"}`),
+		"/mtlsproxy/api":      []byte("Listen = \"127.0.0.1:9443\"\nProxy = \"10.0.0.2:443\"\nMaxConnections = 5\nProxi = \"typo\"\n"),
+	}}
+	l, err := ec.layer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l.unknown) != 1 || !strings.Contains(l.unknown[0].where, "/mtlsproxy/api") {
+		t.Errorf("unknown options %+v", l.unknown)
+	}
+
+	ps, err := Configurations{etcd: ec}.getProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, api := profileNamed(ps, "web"), profileNamed(ps, "api")
+	if len(ps) != 2 || web == nil || api == nil {
+		t.Fatalf("got %v", ps)
+	}
+	if web.Proxy != "10.0.0.1:443" || web.MaxConnections != 10 || web.Source != ec.source || api.MaxConnections != 5 {
+		t.Errorf("got web %+v, api %+v", web, api)
+	}
+
+	ec.kvs["/mtlsproxy/web"] = []byte(`{"MaxConnections": "many"}`)
+	if _, err := ec.layer(); err == nil || !strings.Contains(err.Error(), "/mtlsproxy/web") {
+		t.Errorf("got %v", err)
+	}
+}
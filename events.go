@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type connEventKind int
+
+const (
+	connOpened connEventKind = iota
+	connClosed
+)
+
+// connEvent describes a connection opening or closing on an instance.
+type connEvent struct {
+	kind    connEventKind
+	profile string
+	ident   string
+	remote  string
+	xfer    int64
+	err     error
+	time    time.Time
+}
+
+// eventHub fans connection events out to any subscribers. Subscribers that
+// can't keep up miss events rather than slowing down connections.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan connEvent]struct{}
+}
+
+var connEvents = &eventHub{subs: make(map[chan connEvent]struct{})}
+
+func (h *eventHub) subscribe() chan connEvent {
+	ch := make(chan connEvent, 64)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan connEvent) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+func (h *eventHub) publish(e connEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
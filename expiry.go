@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/x509"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	expiryCheckInterval = time.Hour
+	expiryWarnInterval  = 24 * time.Hour // how often the same certificate is warned about
+)
+
+var certExpiryDays = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "mtlsproxy_certificate_expiry_days",
+	Help: "Days until a loaded certificate expires, negative once it has.",
+}, []string{"profile", "use", "subject", "serial"})
+
+func init() {
+	prometheus.MustRegister(certExpiryDays)
+}
+
+// expiryMonitor warns about certificates of the running profiles nearing their
+// NotAfter and keeps the expiry metric current.
+type expiryMonitor struct {
+	window time.Duration
+	mu     sync.Mutex // guards warned
+	warned map[string]time.Time
+}
+
+func newExpiryMonitor(window time.Duration) *expiryMonitor {
+	return &expiryMonitor{window: window, warned: make(map[string]time.Time)}
+}
+
+type loadedCert struct {
+	profile, use string
+	cert         *x509.Certificate
+}
+
+// profileCerts lists the certificates loaded from files or config, ACME,
+// SPIFFE and Vault certificates renew themselves and aren't included.
+func profileCerts(p *Profile) (certs []loadedCert) {
+	add := func(use, raw string) {
+		parsed, err := parseCertificates(raw)
+		if err != nil {
+			return
+		}
+		for _, c := range parsed {
+			certs = append(certs, loadedCert{profile: p.Name, use: use, cert: c})
+		}
+	}
+	if len(p.ListenVaultRole) < 1 {
+		add("listen", p.ListenCertRaw)
+	}
+	for _, cp := range p.ListenCertificates {
+		add("listen", cp.CertRaw)
+	}
+	add("listen_authority", p.ListenAuthorityRaw)
+	if len(p.SendVaultRole) < 1 {
+		add("send", p.SendCertRaw)
+	}
+	add("send_authority", p.SendAuthorityRaw)
+
+	names := make([]string, 0, len(p.Routes))
+	for name := range p.Routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		r := p.Routes[name]
+		add("route_send:"+name, r.SendCertRaw)
+		add("route_send_authority:"+name, r.SendAuthorityRaw)
+	}
+	return
+}
+
+func (m *expiryMonitor) check(profiles []*Profile) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	certExpiryDays.Reset()
+	for _, p := range profiles {
+		for _, lc := range profileCerts(p) {
+			left := lc.cert.NotAfter.Sub(now)
+			serial := lc.cert.SerialNumber.String()
+			certExpiryDays.WithLabelValues(lc.profile, lc.use, lc.cert.Subject.String(), serial).Set(left.Hours() / 24)
+
+			if left > m.window {
+				continue
+			}
+			key := strings.Join([]string{lc.profile, lc.use, serial}, "\x00")
+			seen[key] = true
+			if last, ok := m.warned[key]; ok && now.Sub(last) < expiryWarnInterval {
+				continue
+			}
+			m.warned[key] = now
+
+			at := lc.cert.NotAfter.Format(time.RFC3339)
+			if left <= 0 {
+				slog.Warn("certificate expired", "profile", lc.profile, "use", lc.use, "subject", lc.cert.Subject.String(), "serial", serial, "expiry", at)
+			} else {
+				slog.Warn("certificate expires soon", "profile", lc.profile, "use", lc.use, "subject", lc.cert.Subject.String(), "serial", serial, "left", left.Round(time.Minute), "expiry", at)
+			}
+		}
+	}
+
+	for key := range m.warned {
+		if !seen[key] {
+			delete(m.warned, key)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProfileCerts(t *testing.T) {
+	ca := newTestCA(t)
+	listen, _ := ca.issue(t, "proxy")
+	route, _ := ca.issue(t, "route")
+	p := &Profile{Name: "test", ListenCertRaw: listen + ca.pem, SendAuthorityRaw: ca.pem, Routes: map[string]*Route{"a.example.test": {SendCertRaw: route}}}
+	var uses []string
+	for _, lc := range profileCerts(p) {
+		uses = append(uses, lc.use+"="+lc.cert.Subject.CommonName)
+	}
+	want := "listen=proxy listen=test ca send_authority=test ca route_send:a.example.test=route"
+	if got := strings.Join(uses, " "); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestExpiryMonitor(t *testing.T) {
+	ca := newTestCA(t)
+	cert, _ := ca.issue(t, "proxy")
+	p := &Profile{Name: "expiry", ListenCertRaw: cert}
+	lc := profileCerts(p)[0]
+	lb := captureLog(t)
+
+	// issued for an hour, outside a half hour window
+	newExpiryMonitor(30 * time.Minute).check([]*Profile{p})
+	if strings.Contains(lb.String(), "expires soon") {
+		t.Errorf("warned outside the window: %s", lb)
+	}
+	days := testutil.ToFloat64(certExpiryDays.WithLabelValues("expiry", "listen", lc.cert.Subject.String(), lc.cert.SerialNumber.String()))
+	if days <= 0 || days > 1.0/24 {
+		t.Errorf("expiry in %v days, want about an hour", days)
+	}
+
+	m := newExpiryMonitor(2 * time.Hour)
+	m.check([]*Profile{p})
+	m.check([]*Profile{p})
+	if n := strings.Count(lb.String(), "expires soon"); n != 1 {
+		t.Errorf("warned %d times, want once a day", n)
+	}
+	m.check(nil)
+	if len(m.warned) > 0 {
+		t.Error("certificate no longer loaded still remembered")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	flowQueue        = 1024 // records waiting to be sent, more are dropped
+	flowDialTimeout  = 5 * time.Second
+	flowRetryBackoff = 5 * time.Second
+)
+
+var flowsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "mtlsproxy_flow_records_dropped_total",
+	Help: "Flow records that couldn't be sent to the collector.",
+})
+
+func init() {
+	prometheus.MustRegister(flowsDropped)
+}
+
+// flows receives the flow records for the collector, nil without one.
+var flows chan *flowRecord
+
+// flowRecord is one proxied connection, the client's side and the
+// destination's side, for network accounting.
+type flowRecord struct {
+	Start        time.Time `json:"start"`
+	End          time.Time `json:"end"`
+	DurationMs   int64     `json:"duration_ms"`
+	Profile      string    `json:"profile"`
+	Conn         string    `json:"conn"`
+	ConnID       string    `json:"conn_id"`
+	Protocol     string    `json:"protocol"`
+	BackendProto string    `json:"backend_protocol"`
+	ClientAddr   string    `json:"client_addr"`
+	ClientPort   int       `json:"client_port"`
+	ListenAddr   string    `json:"listen_addr"`
+	ListenPort   int       `json:"listen_port"`
+	SourceAddr   string    `json:"source_addr"` // of the connection to the destination
+	SourcePort   int       `json:"source_port"`
+	BackendAddr  string    `json:"backend_addr"`
+	BackendPort  int       `json:"backend_port"`
+	BytesUp      int64     `json:"bytes_up"`
+	BytesDown    int64     `json:"bytes_down"`
+	PacketsUp    int64     `json:"packets_up,omitempty"` // for datagrams
+	PacketsDown  int64     `json:"packets_down,omitempty"`
+}
+
+// startFlowExport sends flow records as JSON lines to the collector, over UDP
+// one per datagram or over TCP.
+func startFlowExport(c *Configurations) error {
+	if len(c.FlowCollector) < 1 {
+		return nil
+	}
+	u, err := url.Parse(c.FlowCollector)
+	if err != nil {
+		return fmt.Errorf("parsing flow collector: %w", err)
+	}
+	if (u.Scheme != "udp" && u.Scheme != "tcp") || len(u.Port()) < 1 {
+		return fmt.Errorf("flow collector %q isn't udp://host:port or tcp://host:port", c.FlowCollector)
+	}
+
+	flows = make(chan *flowRecord, flowQueue)
+	go func() {
+		var conn net.Conn
+		var retryAt time.Time
+		for fr := range flows {
+			line, err := json.Marshal(fr)
+			if err != nil {
+				continue
+			}
+			line = append(line, '\n')
+			if conn == nil && time.Now().After(retryAt) {
+				if conn, err = net.DialTimeout(u.Scheme, u.Host, flowDialTimeout); err != nil {
+					slog.Warn("error connecting to flow collector", "collector", u.Host, "err", err)
+					conn, retryAt = nil, time.Now().Add(flowRetryBackoff)
+				}
+			}
+			if conn == nil {
+				flowsDropped.Inc()
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(flowDialTimeout))
+			if _, err := conn.Write(line); err != nil {
+				slog.Warn("error sending flow record", "collector", u.Host, "err", err)
+				flowsDropped.Inc()
+				conn.Close()
+				conn = nil
+			}
+		}
+	}()
+	return nil
+}
+
+// exportFlow queues the record of a connection that ended.
+func exportFlow(fr *flowRecord) {
+	if flows == nil {
+		return
+	}
+	select {
+	case flows <- fr:
+	default:
+		flowsDropped.Inc()
+	}
+}
+
+// newFlowRecord has both sides of a connection, l to the client and c to the
+// destination.
+func newFlowRecord(profile string, lc *liveConn, l, c net.Conn) *flowRecord {
+	fr := &flowRecord{
+		Start:        lc.start,
+		End:          time.Now(),
+		Profile:      profile,
+		Conn:         lc.ident,
+		ConnID:       lc.id,
+		Protocol:     l.LocalAddr().Network(),
+		BackendProto: c.RemoteAddr().Network(),
+		BytesUp:      lc.up.Load(),
+		BytesDown:    lc.down.Load(),
+	}
+	fr.DurationMs = fr.End.Sub(fr.Start).Milliseconds()
+	fr.ClientAddr, fr.ClientPort = splitAddr(l.RemoteAddr())
+	fr.ListenAddr, fr.ListenPort = splitAddr(l.LocalAddr())
+	fr.SourceAddr, fr.SourcePort = splitAddr(c.LocalAddr())
+	fr.BackendAddr, fr.BackendPort = splitAddr(c.RemoteAddr())
+	if isPacket(fr.Protocol) {
+		fr.PacketsUp = lc.upReads.Load()
+	}
+	if isPacket(fr.BackendProto) {
+		fr.PacketsDown = lc.downReads.Load()
+	}
+	return fr
+}
+
+// splitAddr separates the port from an address, unix sockets have none.
+func splitAddr(a net.Addr) (string, int) {
+	if a == nil {
+		return "", 0
+	}
+	host, port, err := net.SplitHostPort(a.String())
+	if err != nil {
+		return a.String(), 0
+	}
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
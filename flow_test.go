@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+)
+
+func TestSplitAddr(t *testing.T) {
+	for _, c := range []struct {
+		addr net.Addr
+		host string
+		port int
+	}{
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}, "192.0.2.1", 443},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, "2001:db8::1", 53},
+		{&net.UnixAddr{Name: "/run/proxy.sock", Net: "unix"}, "/run/proxy.sock", 0},
+		{nil, "", 0},
+	} {
+		if host, port := splitAddr(c.addr); host != c.host || port != c.port {
+			t.Errorf("%v: got %s, %d", c.addr, host, port)
+		}
+	}
+}
+
+func TestFlowExport(t *testing.T) {
+	for _, collector := range []string{"http://127.0.0.1:9000", "udp://127.0.0.1", "unix:///run/flows.sock"} {
+		if err := startFlowExport(&Configurations{FlowCollector: collector}); err == nil {
+			t.Errorf("%s accepted", collector)
+		}
+	}
+
+	pc, addr := testSyslogUDP(t)
+	if err := startFlowExport(&Configurations{FlowCollector: "udp://" + addr}); err != nil {
+		t.Fatal(err)
+	}
+	// connections of later tests don't queue records
+	t.Cleanup(func() { flows = nil })
+
+	dest := testBanner(t, "dest")
+	inst := testInstance(t, &Profile{Proxy: dest})
+	if got := readsBanner(t, inst.ListenAddr()); got != "dest\n" {
+		t.Fatalf("got %q", got)
+	}
+	var fr flowRecord
+	if err := json.Unmarshal([]byte(readDatagram(t, pc)), &fr); err != nil {
+		t.Fatal(err)
+	}
+	_, destPort, _ := net.SplitHostPort(dest)
+	_, listenPort, _ := net.SplitHostPort(inst.ListenAddr())
+	if fr.Profile != inst.ident || fr.Protocol != "tcp" || fr.BytesDown != 5 || fr.BytesUp != 0 || len(fr.ConnID) < 1 ||
+		strconv.Itoa(fr.BackendPort) != destPort || strconv.Itoa(fr.ListenPort) != listenPort || fr.ClientAddr != "127.0.0.1" || fr.End.Before(fr.Start) {
+		t.Errorf("got %+v", fr)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var handshakeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mtlsproxy_handshake_failures_total",
+	Help: "Failed TLS handshakes with clients by cause.",
+}, []string{"profile", "reason"})
+
+func init() {
+	prometheus.MustRegister(handshakeFailures)
+}
+
+// handshakeFailure names why a handshake with a client failed, counts it and
+// audits the client certificate that was denied.
+func (inst *Instance) handshakeFailure(ident string, client net.Addr, err error) string {
+	reason := classifyHandshake(err)
+	handshakeFailures.WithLabelValues(inst.ident, reason).Inc()
+	if cert := deniedCert(err); cert != nil {
+		audit(inst.ident, ident, client.String(), cert, "denied", reason)
+	}
+	return reason
+}
+
+// classifyHandshake tells handshake errors apart, crypto/tls only has types
+// for some of them and the others are told apart by their message.
+func classifyHandshake(err error) string {
+	var denied *deniedCertError
+	var unknownCA x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var verification *tls.CertificateVerificationError
+	var header tls.RecordHeaderError
+	var ne net.Error
+	switch {
+	case errors.As(err, &denied):
+		return denied.reason
+	case errors.As(err, &unknownCA):
+		return "unknown_ca"
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return "expired_cert"
+	case errors.As(err, &verification):
+		return "bad_client_cert"
+	case errors.As(err, &header):
+		return "not_tls"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, syscall.ECONNRESET):
+		return "client_closed"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	}
+
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "didn't provide a certificate"):
+		return "no_client_cert"
+	case strings.Contains(msg, "unsupported versions"), strings.Contains(msg, "protocol version not supported"):
+		return "protocol_version"
+	case strings.Contains(msg, "no cipher suite"), strings.Contains(msg, "application protocol"):
+		return "no_common_parameters"
+	case strings.Contains(msg, "remote error: tls: bad certificate"), strings.Contains(msg, "remote error: tls: unknown certificate"),
+		strings.Contains(msg, "remote error: tls: certificate"), strings.Contains(msg, "remote error: tls: unsupported certificate"):
+		// the client doesn't trust the listen certificate
+		return "client_rejected_cert"
+	case strings.Contains(msg, "remote error:"):
+		return "client_alert"
+	}
+	return "other"
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClassifyHandshake(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want string
+	}{
+		{&deniedCertError{reason: "not_allowed"}, "not_allowed"},
+		{tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, "not_tls"},
+		{io.EOF, "client_closed"},
+		{errors.New("tls: client didn't provide a certificate"), "no_client_cert"},
+		{errors.New("tls: client offered only unsupported versions: [301]"), "protocol_version"},
+		{errors.New("tls: no cipher suite supported by both client and server"), "no_common_parameters"},
+		{errors.New("remote error: tls: bad certificate"), "client_rejected_cert"},
+		{errors.New("remote error: tls: internal error"), "client_alert"},
+		{errors.New("something else"), "other"},
+	} {
+		if got := classifyHandshake(c.err); got != c.want {
+			t.Errorf("%v: got %s, want %s", c.err, got, c.want)
+		}
+	}
+}
+
+func TestInstanceHandshakeFailures(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	p := &Profile{Proxy: testEcho(t)}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+	noCert := ca.clientConfig(t, "client")
+	noCert.Certificates = nil
+	untrusting := ca.clientConfig(t, "client")
+	untrusting.RootCAs = other.clientConfig(t, "client").RootCAs
+	unknown := ca.clientConfig(t, "client")
+	unknown.Certificates = other.clientConfig(t, "client").Certificates
+
+	for _, c := range []struct {
+		reason string
+		client func(net.Conn)
+	}{
+		{"not_tls", func(c net.Conn) { io.WriteString(c, "GET / HTTP/1.0\r\n\r\n") }},
+		{"client_closed", func(c net.Conn) {}},
+		{"no_client_cert", func(c net.Conn) { tls.Client(c, noCert).Handshake() }},
+		{"unknown_ca", func(c net.Conn) { tls.Client(c, unknown).Handshake() }},
+		{"client_rejected_cert", func(c net.Conn) { tls.Client(c, untrusting).Handshake() }},
+	} {
+		failures := handshakeFailures.WithLabelValues(inst.ident, c.reason)
+		before := testutil.ToFloat64(failures)
+		conn, err := net.Dial("tcp", inst.ListenAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.client(conn)
+		conn.Close()
+		waitFor(t, c.reason, func() bool { return testutil.ToFloat64(failures) == before+1 })
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	HealthCheckTCP = "tcp"
+	HealthCheckTLS = "tls"
+
+	defaultHealthInterval  = 10 * time.Second
+	defaultHealthTimeout   = 5 * time.Second
+	defaultHealthThreshold = 3
+)
+
+var backendUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "mtlsproxy_backend_up",
+	Help: "Whether the last health checks of a destination address passed.",
+}, []string{"profile", "backend"})
+
+func init() {
+	prometheus.MustRegister(backendUp)
+}
+
+// healthChecker probes the destinations of a profile in the background and
+// takes the ones failing threshold checks in a row out of rotation until a
+// check passes again.
+type healthChecker struct {
+	ident     string
+	kind      string
+	interval  time.Duration
+	timeout   time.Duration
+	threshold int
+	targets   []healthTarget
+	stop      chan struct{}
+}
+
+type healthTarget struct {
+	info *socketInfo
+	be   *backend
+}
+
+func newHealthChecker(p *Profile, dests []*socketInfo) *healthChecker {
+	hc := &healthChecker{
+		ident:     p.Name,
+		kind:      p.HealthCheck,
+		interval:  p.healthInterval,
+		timeout:   p.healthTimeout,
+		threshold: p.HealthCheckThreshold,
+		stop:      make(chan struct{}),
+	}
+	if hc.threshold < 1 {
+		hc.threshold = defaultHealthThreshold
+	}
+	seen := make(map[*balancer]bool)
+	for _, info := range dests {
+		if info.balancer == nil || seen[info.balancer] {
+			continue
+		}
+		seen[info.balancer] = true
+		for _, be := range info.balancer.backends {
+			hc.targets = append(hc.targets, healthTarget{info: info, be: be})
+			backendUp.WithLabelValues(hc.ident, be.addr).Set(1)
+		}
+	}
+	go hc.run()
+	return hc
+}
+
+func (hc *healthChecker) close() {
+	close(hc.stop)
+}
+
+func (hc *healthChecker) run() {
+	failures := make([]int, len(hc.targets))
+	t := time.NewTicker(hc.interval)
+	defer t.Stop()
+	for {
+		var wg sync.WaitGroup
+		errs := make([]error, len(hc.targets))
+		for i, target := range hc.targets {
+			wg.Add(1)
+			go func(i int, target healthTarget) {
+				defer wg.Done()
+				errs[i] = hc.probe(target)
+			}(i, target)
+		}
+		wg.Wait()
+
+		for i, target := range hc.targets {
+			be := target.be
+			if errs[i] == nil {
+				failures[i] = 0
+				if be.unhealthy.Swap(false) {
+					backendUp.WithLabelValues(hc.ident, be.addr).Set(1)
+					slog.Info("destination is healthy again", "profile", hc.ident, "destination", be.addr)
+				}
+				continue
+			}
+			failures[i]++
+			slog.Debug("health check failed", "profile", hc.ident, "destination", be.addr, "err", errs[i])
+			if failures[i] >= hc.threshold && !be.unhealthy.Swap(true) {
+				backendUp.WithLabelValues(hc.ident, be.addr).Set(0)
+				slog.Warn("destination is unhealthy", "profile", hc.ident, "destination", be.addr, "failures", failures[i], "err", errs[i])
+			}
+		}
+
+		select {
+		case <-hc.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// probe connects to the destination, completing the TLS handshake for the tls
+// kind when the destination uses TLS.
+func (hc *healthChecker) probe(target healthTarget) error {
+	var dialer contextDialer = &net.Dialer{}
+	if target.info.upstream != nil {
+		dialer = target.info.upstream
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hc.timeout)
+	defer cancel()
+	c, err := dialer.DialContext(ctx, target.info.net, target.be.addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if hc.kind != HealthCheckTLS || target.info.tlsconf == nil {
+		return nil
+	}
+
+	tlsconf := target.info.tlsconf
+	if len(tlsconf.ServerName) < 1 {
+		tlsconf = tlsconf.Clone()
+		tlsconf.ServerName, _, _ = net.SplitHostPort(target.be.addr)
+	}
+	tc := tls.Client(c, tlsconf)
+	tc.SetDeadline(time.Now().Add(hc.timeout))
+	return tc.Handshake()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+)
+
+// testHealth checks the addresses every few milliseconds, taking them out
+// after two failures.
+func testHealth(t *testing.T, kind string, tlsconf *tls.Config, addrs ...string) *balancer {
+	t.Helper()
+	info := &socketInfo{net: "tcp", tlsconf: tlsconf, balancer: newBalancer("test", BalanceRoundRobin, addrs)}
+	p := &Profile{Name: "test", HealthCheck: kind, HealthCheckThreshold: 2, healthInterval: 10 * time.Millisecond, healthTimeout: time.Second}
+	hc := newHealthChecker(p, []*socketInfo{info})
+	t.Cleanup(hc.close)
+	return info.balancer
+}
+
+func TestHealthChecker(t *testing.T) {
+	up, gone := testEcho(t), closedAddr(t)
+	b := testHealth(t, HealthCheckTCP, nil, up, gone)
+	waitFor(t, "unhealthy", func() bool { return b.backends[1].unhealthy.Load() })
+	if b.backends[0].unhealthy.Load() {
+		t.Error("reachable destination unhealthy")
+	}
+	if got := addrs(b.order()); got[0] != up {
+		t.Errorf("unhealthy destination not tried last: %v", got)
+	}
+
+	l, err := net.Listen("tcp", gone)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	waitFor(t, "healthy again", func() bool { return !b.backends[1].unhealthy.Load() })
+}
+
+func TestHealthCheckTLS(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(ca.pem))
+	tlsconf := &tls.Config{RootCAs: pool}
+	good, bad := testTLSBanner(t, ca, "good", "127.0.0.1"), testTLSBanner(t, other, "bad", "127.0.0.1")
+
+	b := testHealth(t, HealthCheckTLS, tlsconf, good, bad)
+	waitFor(t, "unhealthy", func() bool { return b.backends[1].unhealthy.Load() })
+	if b.backends[0].unhealthy.Load() {
+		t.Error("destination with a trusted certificate unhealthy")
+	}
+
+	// connecting is all the tcp kind asks for
+	b = testHealth(t, HealthCheckTCP, tlsconf, bad)
+	time.Sleep(50 * time.Millisecond)
+	if b.backends[0].unhealthy.Load() {
+		t.Error("tcp check failed on the certificate")
+	}
+}
+
+func TestResolveHealthCheck(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		p    Profile
+		ok   bool
+	}{
+		{"defaults", Profile{HealthCheck: HealthCheckTCP}, true},
+		{"unknown", Profile{HealthCheck: "http"}, false},
+		{"negative threshold", Profile{HealthCheck: HealthCheckTCP, HealthCheckThreshold: -1}, false},
+		{"zero interval", Profile{HealthCheck: HealthCheckTCP, HealthCheckInterval: "0s"}, false},
+		{"bad timeout", Profile{HealthCheck: HealthCheckTCP, HealthCheckTimeout: "soon"}, false},
+	} {
+		p := c.p
+		if err := p.healthCheck(); (err == nil) != c.ok {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+	}
+	p := &Profile{HealthCheck: HealthCheckTLS}
+	if err := p.healthCheck(); err != nil || p.healthInterval != defaultHealthInterval || p.healthTimeout != defaultHealthTimeout {
+		t.Errorf("defaults: %v, %s, %s", err, p.healthInterval, p.healthTimeout)
+	}
+}
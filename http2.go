@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync/atomic"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/time/rate"
+)
+
+// isHTTP2 tells if the client negotiated HTTP/2 in http mode, its streams are
+// relayed over an HTTP/2 connection to the destination.
+func (info socketInfo) isHTTP2(cs *tls.ConnectionState) bool {
+	return info.http != nil && cs != nil && cs.NegotiatedProtocol == http2.NextProtoTLS
+}
+
+// transferHTTP2 serves the client's HTTP/2 connection, each request goes to
+// the destination as a stream of the one connection to it, h2 over TLS or
+// h2c with prior knowledge.
+func (inst *Instance) transferHTTP2(ctx context.Context, ident string, l, c net.Conn, e chan<- conConculsion, config socketInfo, cs *tls.ConnectionState, connUp, connDown *rate.Limiter, id string) {
+	defer inst.recoverTransfer(e, ident+":ltd", ident+":dtl")
+	lm := &meteredConn{Conn: l, r: throttle(l, connUp, config.profileUp)}
+	cm := &meteredConn{Conn: c, r: throttle(c, connDown, config.profileDown)}
+	cc, err := (&http2.Transport{AllowHTTP: true}).NewClientConn(cm)
+	if err != nil {
+		conclude(ident+":ltd", 0, nil, e)
+		conclude(ident+":dtl", 0, err, e)
+		return
+	}
+	defer cc.Close()
+
+	scheme := "http"
+	if config.tlsconf != nil {
+		scheme = "https"
+	}
+	remote := l.RemoteAddr()
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = scheme
+			pr.Out.URL.Host = pr.In.Host
+			pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+			config.http.setHeaders(pr.Out, remote, cs, id)
+			propagate(ctx, pr.Out.Header)
+		},
+		Transport:     cc,
+		FlushInterval: -1, // streaming, like gRPC
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if r.Context().Err() == nil {
+				slog.Warn("error relaying request", "profile", inst.ident, "conn", ident, "method", r.Method, "path", r.URL.Path, "err", err)
+			}
+			w.WriteHeader(http.StatusBadGateway)
+			if !cc.CanTakeNewRequest() {
+				// the destination is gone, so is the client
+				l.Close()
+			}
+		},
+	}
+	var srv http2.Server
+	srv.ServeConn(lm, &http2.ServeConnOpts{Handler: rp, BaseConfig: &http.Server{}})
+	conclude(ident+":ltd", lm.n.Load(), nil, e)
+	conclude(ident+":dtl", cm.n.Load(), nil, e)
+}
+
+// meteredConn counts what is read through its reader.
+type meteredConn struct {
+	net.Conn
+	r io.Reader
+	n atomic.Int64
+}
+
+func (m *meteredConn) Read(b []byte) (int, error) {
+	n, err := m.r.Read(b)
+	m.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	CertHeaderPEM     = "pem"
+	CertHeaderSubject = "subject"
+)
+
+// httpOptions are the headers set on requests in the http mode.
+type httpOptions struct {
+	certHeader string // carries the client certificate, empty for none
+	certFormat string
+	verified   bool   // the listen side verifies client certificates
+	idHeader   string // carries the connection ID, empty for none
+	acceptID   bool   // an ID the client sent in idHeader is kept
+}
+
+func (p *Profile) httpOptions() *httpOptions {
+	if p.Mode != ModeHTTP {
+		return nil
+	}
+	h := &httpOptions{
+		certHeader: http.CanonicalHeaderKey(p.HTTPClientCertHeader),
+		certFormat: p.HTTPClientCertFormat,
+		verified:   p.verifiesClients(),
+		idHeader:   http.CanonicalHeaderKey(p.HTTPConnectionIDHeader),
+		acceptID:   p.AcceptConnectionID,
+	}
+	if len(h.certFormat) < 1 {
+		h.certFormat = CertHeaderPEM
+	}
+	return h
+}
+
+// verifiesClients tells if the listen side verifies the certificates clients
+// send, only those are passed on in the http mode.
+func (p *Profile) verifiesClients() bool {
+	return p.ListenSPIFFE || p.clientAuth == tls.VerifyClientCertIfGiven || p.clientAuth == tls.RequireAndVerifyClientCert
+}
+
+// checkHTTPMode checks the options of the http mode.
+func (p *Profile) checkHTTPMode() error {
+	if p.Mode != ModeHTTP {
+		if len(p.HTTPClientCertHeader) > 0 || len(p.HTTPClientCertFormat) > 0 || len(p.HTTPConnectionIDHeader) > 0 {
+			return errors.New("HTTPClientCertHeader, HTTPClientCertFormat and HTTPConnectionIDHeader are only used in http mode")
+		}
+		return nil
+	}
+	switch p.HTTPClientCertFormat {
+	case "", CertHeaderPEM, CertHeaderSubject:
+	default:
+		return fmt.Errorf("HTTPClientCertFormat %q isn't %q or %q", p.HTTPClientCertFormat, CertHeaderPEM, CertHeaderSubject)
+	}
+	return nil
+}
+
+// httpExchange pairs the requests written to the destination with its
+// responses, so an upgraded connection switches to streaming in both
+// directions only once the destination agreed with 101 Switching Protocols.
+type httpExchange struct {
+	pending chan pendingRequest // written, waiting on their response
+	done    chan struct{}       // responses are no longer followed
+}
+
+type pendingRequest struct {
+	method  string
+	upgrade chan bool // for upgrade requests, whether the destination switched
+}
+
+// maxPipelined is how many requests can wait on their responses.
+const maxPipelined = 64
+
+// badGatewayTimeout bounds reading the client's request and answering it
+// when the destination couldn't be reached.
+const badGatewayTimeout = 5 * time.Second
+
+func newHTTPExchange() *httpExchange {
+	return &httpExchange{pending: make(chan pendingRequest, maxPipelined), done: make(chan struct{})}
+}
+
+// transferHTTP copies the HTTP/1.1 requests read from r to w with the
+// forwarding headers set, until r ends.
+func (inst *Instance) transferHTTP(ctx context.Context, ident string, r io.Reader, w io.Writer, e chan<- conConculsion, x *httpExchange, h *httpOptions, remote net.Addr, cs *tls.ConnectionState, id string) {
+	defer inst.recoverTransfer(e, ident)
+	cw := &countWriter{w: w}
+	err := h.rewrite(ctx, r, cw, x, remote, cs, id)
+	close(x.pending)
+	conclude(ident, cw.n, err, e)
+}
+
+// transferResponses copies the destination's responses from r to w as they
+// come, reading along to tell when an upgrade is accepted.
+func (inst *Instance) transferResponses(ident string, r io.Reader, w io.Writer, e chan<- conConculsion, x *httpExchange, bufSize int) {
+	defer inst.recoverTransfer(e, ident)
+	cw := &countWriter{w: w}
+	stream, err := x.follow(r, cw)
+	close(x.done)
+	if stream {
+		// upgraded, or the responses stopped making sense
+		_, err = io.CopyBuffer(cw, r, make([]byte, bufSize))
+	}
+	conclude(ident, cw.n, err, e)
+}
+
+// badGateway answers the client's request with a 502 when the destination
+// couldn't be reached. Over HTTP/2 every request gets one until the client
+// hangs up or the time is up.
+func badGateway(l net.Conn, h2 bool) {
+	l.SetDeadline(time.Now().Add(badGatewayTimeout))
+	if h2 {
+		var srv http2.Server
+		srv.ServeConn(l, &http2.ServeConnOpts{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}), BaseConfig: &http.Server{}})
+		return
+	}
+	// the request is read first, a close with it unread could reset the
+	// connection before the client reads the response
+	req, err := http.ReadRequest(bufio.NewReader(l))
+	if err != nil {
+		return
+	}
+	io.Copy(io.Discard, io.LimitReader(req.Body, 64<<10))
+	res := &http.Response{StatusCode: http.StatusBadGateway, ProtoMajor: 1, ProtoMinor: 1, Request: req, Close: true}
+	res.Write(l)
+}
+
+func conclude(ident string, count int64, err error, e chan<- conConculsion) {
+	if err != nil {
+		werr := fmt.Errorf("error after transferring %d bytes: %w", count, err)
+		e <- conConculsion{ident: ident, err: werr, xfer: count}
+	} else {
+		e <- conConculsion{ident: ident, xfer: count}
+	}
+}
+
+func (h *httpOptions) rewrite(ctx context.Context, r io.Reader, w io.Writer, x *httpExchange, remote net.Addr, cs *tls.ConnectionState, id string) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		h.setHeaders(req, remote, cs, id)
+		propagate(ctx, req.Header)
+		if _, ok := req.Header["User-Agent"]; !ok {
+			// keeps Write from adding its own
+			req.Header["User-Agent"] = []string{""}
+		}
+		if req.Body != http.NoBody {
+			req.Body = flushingBody{ReadCloser: req.Body, w: bw}
+		}
+		pr := pendingRequest{method: req.Method}
+		if isUpgrade(req.Header) {
+			pr.upgrade = make(chan bool, 1)
+		}
+		select {
+		case x.pending <- pr:
+		case <-x.done:
+		}
+		if err := req.Write(bw); err != nil {
+			return err
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if pr.upgrade == nil {
+			continue
+		}
+		select {
+		case ok := <-pr.upgrade:
+			if !ok {
+				continue
+			}
+		case <-x.done:
+			continue
+		}
+		// the rest belongs to the upgraded protocol
+		_, err = io.Copy(w, br)
+		return err
+	}
+}
+
+// follow reads the responses passing through until one switches protocols,
+// which the waiting request hears about, and the rest is to be streamed.
+func (x *httpExchange) follow(r io.Reader, w io.Writer) (stream bool, err error) {
+	br := bufio.NewReader(io.TeeReader(r, w))
+	for {
+		if _, err := br.Peek(1); err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			return false, err
+		}
+		var pr pendingRequest
+		select {
+		case pr = <-x.pending:
+		default:
+			// sent without a request, like a 408 before closing
+		}
+		req := &http.Request{Method: pr.method}
+		if len(req.Method) < 1 {
+			req.Method = http.MethodGet
+		}
+		for {
+			resp, err := http.ReadResponse(br, req)
+			if err != nil {
+				if pr.upgrade != nil {
+					pr.upgrade <- false
+				}
+				return true, nil
+			}
+			if resp.StatusCode == http.StatusSwitchingProtocols {
+				if pr.upgrade != nil {
+					pr.upgrade <- true
+				}
+				return true, nil
+			}
+			if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+				return false, err
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 200 {
+				break
+			}
+			// informational, the final response is still to come
+		}
+		if pr.upgrade != nil {
+			pr.upgrade <- false
+		}
+	}
+}
+
+// isUpgrade tells if the request asks to switch protocols, like to WebSocket.
+func isUpgrade(hdr http.Header) bool {
+	if len(hdr.Get("Upgrade")) < 1 {
+		return false
+	}
+	for _, v := range hdr.Values("Connection") {
+		for _, tok := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(tok), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setHeaders replaces whatever the client sent in the forwarding headers, and
+// in the connection ID header unless its ID is accepted.
+func (h *httpOptions) setHeaders(req *http.Request, remote net.Addr, cs *tls.ConnectionState, id string) {
+	ip := remote.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		ip = strings.Join(prior, ", ") + ", " + ip
+	}
+	req.Header.Set("X-Forwarded-For", ip)
+	if cs != nil {
+		req.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		req.Header.Set("X-Forwarded-Proto", "http")
+	}
+	if len(h.idHeader) > 0 && (!h.acceptID || !validConnID(req.Header.Get(h.idHeader))) {
+		req.Header.Set(h.idHeader, id)
+	}
+
+	if len(h.certHeader) < 1 {
+		return
+	}
+	req.Header.Del(h.certHeader)
+	if cs == nil || !h.verified || len(cs.PeerCertificates) < 1 {
+		return
+	}
+	leaf := cs.PeerCertificates[0]
+	switch h.certFormat {
+	case CertHeaderSubject:
+		req.Header.Set(h.certHeader, leaf.Subject.String())
+	default:
+		block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})
+		req.Header.Set(h.certHeader, strings.ReplaceAll(url.QueryEscape(string(block)), "+", "%20"))
+	}
+}
+
+// flushingBody sends what is buffered for the destination before waiting on
+// more of the request body, for clients streaming it or expecting 100 Continue.
+type flushingBody struct {
+	io.ReadCloser
+	w *bufio.Writer
+}
+
+func (b flushingBody) Read(p []byte) (int, error) {
+	if err := b.w.Flush(); err != nil {
+		return 0, err
+	}
+	return b.ReadCloser.Read(p)
+}
+
+// countWriter counts the bytes written through it.
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
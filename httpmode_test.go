@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+var testRemote = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 40000}
+
+const upgradeRequest = "GET /ws HTTP/1.1\r\nHost: example.test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+
+// answerUpgrades plays the side following the responses, telling every
+// upgrade request whether it was switched.
+func answerUpgrades(x *httpExchange, switched ...bool) {
+	for pr := range x.pending {
+		if pr.upgrade == nil {
+			continue
+		}
+		pr.upgrade <- len(switched) > 0 && switched[0]
+		if len(switched) > 0 {
+			switched = switched[1:]
+		}
+	}
+}
+
+func TestHTTPRewriteUpgrade(t *testing.T) {
+	x := newHTTPExchange()
+	go answerUpgrades(x, true)
+	var w bytes.Buffer
+	h := &httpOptions{}
+	if err := h.rewrite(context.Background(), strings.NewReader(upgradeRequest+"\x81\x05hello"), &w, x, testRemote, nil, "id"); err != nil {
+		t.Fatal(err)
+	}
+	close(x.pending)
+	written := w.String()
+	req, err := http.ReadRequest(bufio.NewReader(&w))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := req.Header.Get("X-Forwarded-For"); got != "192.0.2.1" {
+		t.Errorf("X-Forwarded-For %q", got)
+	}
+	if !strings.HasSuffix(written, "\r\n\r\n\x81\x05hello") {
+		t.Errorf("upgraded stream not passed through as is: %q", written)
+	}
+}
+
+func TestHTTPRewriteUpgradeRefused(t *testing.T) {
+	x := newHTTPExchange()
+	go answerUpgrades(x, false)
+	var w bytes.Buffer
+	h := &httpOptions{}
+	in := upgradeRequest + "GET /next HTTP/1.1\r\nHost: example.test\r\nX-Forwarded-For: 10.0.0.1\r\n\r\n"
+	if err := h.rewrite(context.Background(), strings.NewReader(in), &w, x, testRemote, nil, "id"); err != nil {
+		t.Fatal(err)
+	}
+	close(x.pending)
+	br := bufio.NewReader(&w)
+	for _, want := range []struct{ path, xff string }{{"/ws", "192.0.2.1"}, {"/next", "10.0.0.1, 192.0.2.1"}} {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			t.Fatalf("%s: %v", want.path, err)
+		}
+		if req.URL.Path != want.path || req.Header.Get("X-Forwarded-For") != want.xff {
+			t.Errorf("got %s with X-Forwarded-For %q, want %s with %q", req.URL.Path, req.Header.Get("X-Forwarded-For"), want.path, want.xff)
+		}
+	}
+}
+
+func TestHTTPFollow(t *testing.T) {
+	x := newHTTPExchange()
+	head := pendingRequest{method: http.MethodHead}
+	get := pendingRequest{method: http.MethodGet}
+	up := pendingRequest{method: http.MethodGet, upgrade: make(chan bool, 1)}
+	refused := pendingRequest{method: http.MethodGet, upgrade: make(chan bool, 1)}
+	for _, pr := range []pendingRequest{head, get, refused, up} {
+		x.pending <- pr
+	}
+	responses := "HTTP/1.1 200 OK\r\nContent-Length: 10\r\n\r\n" + // HEAD, there is no body
+		"HTTP/1.1 103 Early Hints\r\nLink: </a.css>\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok" +
+		"HTTP/1.1 426 Upgrade Required\r\nContent-Length: 0\r\n\r\n" +
+		"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+	var w bytes.Buffer
+	r := strings.NewReader(responses + "\x81\x05hello")
+	stream, err := x.follow(r, &w)
+	if err != nil || !stream {
+		t.Fatalf("got %v, %v, want to stream", stream, err)
+	}
+	if ok := <-refused.upgrade; ok {
+		t.Error("refused upgrade was switched")
+	}
+	if ok := <-up.upgrade; !ok {
+		t.Error("upgrade wasn't switched")
+	}
+	// what was read ahead is already passed on, the rest is streamed after
+	rest, _ := io.ReadAll(r)
+	if got := w.String() + string(rest); got != responses+"\x81\x05hello" {
+		t.Errorf("responses weren't passed on as read: %q", got)
+	}
+}
+
+func TestHTTPFollowNonsense(t *testing.T) {
+	x := newHTTPExchange()
+	up := pendingRequest{method: http.MethodGet, upgrade: make(chan bool, 1)}
+	x.pending <- up
+	stream, err := x.follow(strings.NewReader("SSH-2.0-OpenSSH\r\n"), io.Discard)
+	if err != nil || !stream {
+		t.Errorf("got %v, %v, want to stream what isn't HTTP", stream, err)
+	}
+	if <-up.upgrade {
+		t.Error("upgrade switched on a response that isn't one")
+	}
+
+	x = newHTTPExchange()
+	if stream, err := x.follow(strings.NewReader(""), io.Discard); stream || err != nil {
+		t.Errorf("got %v, %v at the end of the responses", stream, err)
+	}
+}
+
+// testUpgradeServer answers upgrade requests with 101 and echoes what
+// follows, other requests get their X-Forwarded-For back.
+func testUpgradeServer(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					if isUpgrade(req.Header) {
+						io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+						io.Copy(c, br)
+						return
+					}
+					xff := req.Header.Get("X-Forwarded-For")
+					io.WriteString(c, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(xff))+"\r\n\r\n"+xff)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestInstanceHTTPUpgrade(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: testUpgradeServer(t), Mode: ModeHTTP})
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: example.test\r\nX-Forwarded-For: 10.0.0.1\r\n\r\n")
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(res.Body)
+	if string(b) != "10.0.0.1, 127.0.0.1" {
+		t.Errorf("destination got X-Forwarded-For %q", b)
+	}
+
+	io.WriteString(c, upgradeRequest)
+	if res, err = http.ReadResponse(br, nil); err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %v, %v", res, err)
+	}
+	// not HTTP anymore, it must come back untouched
+	io.WriteString(c, "GET / HTTP/1.1\r\n\r\n")
+	b = make([]byte, len("GET / HTTP/1.1\r\n\r\n"))
+	if _, err := io.ReadFull(br, b); err != nil || string(b) != "GET / HTTP/1.1\r\n\r\n" {
+		t.Errorf("got %q, %v after the upgrade", b, err)
+	}
+}
+
+func TestInstanceHTTPClientCertHeader(t *testing.T) {
+	got := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header
+	}))
+	defer srv.Close()
+	ca := newTestCA(t)
+	p := &Profile{Proxy: strings.TrimPrefix(srv.URL, "http://"), Mode: ModeHTTP, HTTPClientCertHeader: "X-Client-Cert", HTTPClientCertFormat: CertHeaderSubject, HTTPConnectionIDHeader: "X-Request-Id"}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: ca.clientConfig(t, "client")}, Timeout: 5 * time.Second}
+	req, _ := http.NewRequest(http.MethodGet, "https://"+inst.ListenAddr()+"/", nil)
+	req.Header.Set("X-Client-Cert", "CN=spoofed")
+	req.Header.Set("X-Request-Id", "spoofed")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	hdr := <-got
+	if hdr.Get("X-Client-Cert") != "CN=client" {
+		t.Errorf("X-Client-Cert %q", hdr.Get("X-Client-Cert"))
+	}
+	if id := hdr.Get("X-Request-Id"); len(id) < 1 || id == "spoofed" {
+		t.Errorf("X-Request-Id %q", id)
+	}
+	if hdr.Get("X-Forwarded-Proto") != "https" {
+		t.Errorf("X-Forwarded-Proto %q", hdr.Get("X-Forwarded-Proto"))
+	}
+}
+
+func TestInstanceHTTP2(t *testing.T) {
+	dest := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto+" "+r.Header.Get("X-Forwarded-For"))
+	}), &http2.Server{}))
+	defer dest.Close()
+	ca := newTestCA(t)
+	p := &Profile{Proxy: strings.TrimPrefix(dest.URL, "http://"), Mode: ModeHTTP, ListenALPN: []string{"h2", "http/1.1"}}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: ca.clientConfig(t, "client"), ForceAttemptHTTP2: true}, Timeout: 5 * time.Second}
+	for i := 0; i < 2; i++ {
+		res, err := client.Get("https://" + inst.ListenAddr() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.ProtoMajor != 2 || string(b) != "HTTP/2.0 127.0.0.1" {
+			t.Errorf("client got %s, destination saw %q", res.Proto, b)
+		}
+	}
+}
+
+func TestReloadHTTPClientCertHeader(t *testing.T) {
+	got := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- r.Header
+	}))
+	defer srv.Close()
+	ca := newTestCA(t)
+	p := &Profile{Proxy: strings.TrimPrefix(srv.URL, "http://"), Mode: ModeHTTP, HTTPClientCertHeader: "X-Client-Cert", HTTPClientCertFormat: CertHeaderSubject}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+	headers := func() http.Header {
+		t.Helper()
+		// a new client each time, so the request comes on a new connection
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: ca.clientConfig(t, "client")}, Timeout: 5 * time.Second}
+		defer client.CloseIdleConnections()
+		res, err := client.Get("https://" + inst.ListenAddr() + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return <-got
+	}
+
+	adapted(t, inst, func(p *Profile) { p.HTTPClientCertHeader, p.HTTPClientCertFormat = "X-Peer-Cert", CertHeaderPEM })
+	if hdr := headers(); len(hdr.Get("X-Client-Cert")) > 0 || !strings.HasPrefix(hdr.Get("X-Peer-Cert"), "-----BEGIN%20CERTIFICATE-----") {
+		t.Errorf("got X-Client-Cert %q, X-Peer-Cert %q after the reload", hdr.Get("X-Client-Cert"), hdr.Get("X-Peer-Cert"))
+	}
+
+	// certificates that aren't verified anymore aren't passed on
+	adapted(t, inst, func(p *Profile) { p.ClientAuth = "require" })
+	if hdr := headers(); len(hdr.Get("X-Peer-Cert")) > 0 {
+		t.Errorf("unverified certificate passed on as %q", hdr.Get("X-Peer-Cert"))
+	}
+}
@@ -1,26 +1,60 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/http2"
+	"golang.org/x/time/rate"
 )
 
 type Instance struct {
 	ident string
 	p     *Profile
 	// l net.Listener // Interface
-	newCon  chan newConnection
-	newDest chan *socketInfo
-	newList chan *socketInfo
-	fin     chan struct{}
-	change  sync.Mutex
-	closed  bool
+	newCon   chan newConnection
+	newDest  chan *socketInfo
+	newList  chan *socketInfo
+	fin      chan struct{}
+	change   sync.Mutex
+	closed   bool
+	staplers []*ocspStapler
+	tickets  *ticketRotator
+	health   *healthChecker
+	resolver *resolverCache // refreshing in the background with DNSRefresh
+	active   atomic.Int64   // connections being proxied
+	// bytes read from clients and destinations
+	bytesUp   atomic.Int64
+	bytesDown atomic.Int64
+	// state of the listener and errors, for the admin server and state dumps
+	statusMu   sync.Mutex
+	listening  bool
+	listenAddr string // where the listener is bound
+	listenErr  error  // why the last listener failed
+	lastErr    string // what ended the last failed connection
+	lastCode   string // and its code
+	lastErrAt  time.Time
+	connsMu    sync.Mutex
+	conns      map[string]*liveConn // by ident
+	// listen certificates, the previous ones are served until prevUntil
+	certs     []tls.Certificate
+	prevCerts []tls.Certificate
+	prevUntil time.Time
 }
 
 type newConnection struct {
@@ -29,8 +63,37 @@ type newConnection struct {
 }
 
 type socketInfo struct {
-	tlsconf   *tls.Config
-	net, addr string
+	tlsconf     *tls.Config
+	net, addr   string
+	resolver    *resolverCache
+	balancer    *balancer              // when addr lists several destinations
+	breaker     *circuitBreaker        // with CircuitBreakerFailures
+	routes      map[string]*socketInfo // by server name
+	passthrough bool                   // TLS from the client is forwarded untouched
+	accessLog   bool
+	idle        time.Duration // for packet listeners, or streams with IdleTimeout
+	proxyProto  string        // PROXY protocol version written to the destination
+	sendID      bool          // the PROXY protocol header carries the connection ID
+	acceptID    bool          // the connection ID in the PROXY protocol header from the client is used
+	dialTimeout time.Duration
+	dialRetries int           // connecting again after the first attempt failed
+	dialBackoff time.Duration // before the first retry, doubling for each one
+	dialFailure string        // how the client's connection ends when the destination can't be reached
+	maxAge      time.Duration
+	maxConns    int64         // 0 for no limit
+	drain       time.Duration // open connections are closed this long after the destination changes
+	rateLimit   *ipRateLimiter
+	connBytes   int           // per connection bytes per second limit, each way
+	profileUp   *rate.Limiter // shared by the profile's connections, client to destination
+	profileDown *rate.Limiter // and destination to client
+	perms       socketPerms   // for unix listeners
+	acceptProxy bool          // connections start with a PROXY protocol header
+	proxyFrom   []*net.IPNet  // peers the PROXY protocol header is taken from
+	upstream    contextDialer // forward proxy the destination is reached through
+	http        *httpOptions  // requests are read and given forwarding headers
+	startTLS    string        // protocol upgrading to TLS after a plaintext start
+	summary     string        // access log format, a record is written for every connection when set
+	shards      int           // listeners sharing the address with SO_REUSEPORT
 }
 
 type conConculsion struct {
@@ -39,6 +102,21 @@ type conConculsion struct {
 	xfer  int64
 }
 
+// A listener that fails to open, like when its address is still in use or its
+// interface isn't up yet, is retried after bindRetryMin, doubling up to
+// bindRetryMax.
+const (
+	bindRetryMin = time.Second
+	bindRetryMax = time.Minute
+)
+
+// A failed accept, like when the process is out of descriptors, is retried
+// after acceptRetryMin, doubling up to acceptRetryMax while it keeps failing.
+const (
+	acceptRetryMin = 5 * time.Millisecond
+	acceptRetryMax = time.Second
+)
+
 func NewInstance(p *Profile) (inst *Instance, err error) {
 	inst = &Instance{
 		p:       p,
@@ -81,6 +159,13 @@ func (inst *Instance) AdaptTo(p *Profile) error {
 	return nil
 }
 
+// Profile returns the profile the instance is currently running.
+func (inst *Instance) Profile() *Profile {
+	inst.change.Lock()
+	defer inst.change.Unlock()
+	return inst.p
+}
+
 func (inst *Instance) Stop() {
 	inst.change.Lock()
 	defer inst.change.Unlock()
@@ -91,75 +176,391 @@ func (inst *Instance) Stop() {
 
 	inst.newDest <- nil
 	inst.newList <- nil
+	inst.replaceStaplers(nil)
+	inst.replaceTickets(nil)
+	inst.replaceHealth(nil)
+	inst.replaceResolver(nil)
 	inst.closed = true
 	close(inst.fin)
 }
 
+// StopListening closes the listener, open connections carry on.
+func (inst *Instance) StopListening() {
+	inst.change.Lock()
+	defer inst.change.Unlock()
+
+	if inst.closed {
+		return
+	}
+	inst.newList <- nil
+}
+
+// ResumeListening opens the listener again after StopListening.
+func (inst *Instance) ResumeListening() error {
+	inst.change.Lock()
+	defer inst.change.Unlock()
+
+	if inst.closed {
+		return nil
+	}
+	return inst.changeListener(inst.p)
+}
+
+// ListenStatus tells if the instance is accepting connections, or why its
+// listener failed.
+func (inst *Instance) ListenStatus() (bool, error) {
+	inst.statusMu.Lock()
+	defer inst.statusMu.Unlock()
+	return inst.listening, inst.listenErr
+}
+
+func (inst *Instance) setListenStatus(l net.Listener, err error) {
+	inst.statusMu.Lock()
+	inst.listening, inst.listenErr = l != nil, err
+	inst.listenAddr = ""
+	up := 0.0
+	if l != nil {
+		inst.listenAddr = l.Addr().String()
+		up = 1
+	}
+	inst.statusMu.Unlock()
+	listenerUp.WithLabelValues(inst.ident).Set(up)
+}
+
+// ListenAddr is the address the listener is bound to, empty when not
+// listening.
+func (inst *Instance) ListenAddr() string {
+	inst.statusMu.Lock()
+	defer inst.statusMu.Unlock()
+	return inst.listenAddr
+}
+
+// LastError is why the last connection failed, the code of the failure and
+// when, empty if none did.
+func (inst *Instance) LastError() (string, string, time.Time) {
+	inst.statusMu.Lock()
+	defer inst.statusMu.Unlock()
+	return inst.lastErr, inst.lastCode, inst.lastErrAt
+}
+
+func (inst *Instance) setLastError(reason, code string) {
+	inst.statusMu.Lock()
+	inst.lastErr, inst.lastCode, inst.lastErrAt = reason, code, time.Now()
+	inst.statusMu.Unlock()
+}
+
+// Active is the number of connections being proxied.
+func (inst *Instance) Active() int64 {
+	return inst.active.Load()
+}
+
 func (inst *Instance) changeListener(p *Profile) error {
-	proto := p.Protocol
-	if len(proto) < 1 {
-		proto = "tcp"
+	proto := p.listenNetwork()
+
+	if p.ListenSPIFFE {
+		tlsconf, err := spiffeServerConfig(p)
+		if err != nil {
+			return fmt.Errorf("SPIFFE: %w", err)
+		}
+		tlsconf.KeyLogWriter = keyLog
+		inst.replaceStaplers(nil)
+		inst.replaceTickets(nil)
+		inst.rotateCerts(nil, 0)
+		inst.newList <- &socketInfo{tlsconf: tlsconf, net: proto, addr: p.Listen, idle: p.udpIdle, perms: p.listenPerms, acceptProxy: p.ListenAcceptProxyProtocol, proxyFrom: p.proxySources, shards: p.ListenShards, startTLS: p.StartTLS}
+		return nil
 	}
 
-	if len(p.ListenAuthorityRaw) < 1 && len(p.ListenCertRaw) < 1 {
-		inst.newList <- &socketInfo{tlsconf: nil, net: proto, addr: p.Listen}
+	if len(p.ListenAuthorityRaw) < 1 && !p.listenCertificate() {
+		inst.replaceStaplers(nil)
+		inst.replaceTickets(nil)
+		inst.rotateCerts(nil, 0)
+		inst.newList <- &socketInfo{tlsconf: nil, net: proto, addr: p.Listen, idle: p.udpIdle, perms: p.listenPerms, acceptProxy: p.ListenAcceptProxyProtocol, proxyFrom: p.proxySources, shards: p.ListenShards}
 		return nil
 	}
 
-	tlsconf := new(tls.Config)
+	tlsconf := &tls.Config{
+		MinVersion:   p.listenMinTLS,
+		MaxVersion:   p.listenMaxTLS,
+		CipherSuites: p.listenCiphers,
+		KeyLogWriter: keyLog,
+	}
+	if len(p.ListenALPN) > 0 {
+		tlsconf.NextProtos = append([]string(nil), p.ListenALPN...)
+		tlsconf.VerifyConnection = alpnCheck(p.Name, "listen", p.ListenALPN, p.ListenALPNRequired)
+	}
 
 	if len(p.ListenAuthorityRaw) > 0 {
 		capool := x509.NewCertPool()
 		if ok := capool.AppendCertsFromPEM([]byte(p.ListenAuthorityRaw)); !ok {
-			return errors.New("no certs found for the listen authority")
+			return withCode(codeCertParse, errors.New("no certs found for the listen authority"))
 		}
 		tlsconf.ClientCAs = capool
-		tlsconf.ClientAuth = tls.RequireAndVerifyClientCert
+
+		var checks []func([][]byte, [][]*x509.Certificate) error
+		if len(p.listenCRLs) > 0 {
+			checks = append(checks, revocationCheck(p.Name, p.listenCRLs))
+		}
+		if p.hasClientAllowlist() {
+			checks = append(checks, clientAllowlist(p.Name, p.ListenAllowedCNs, p.ListenAllowedDNSNames, p.ListenAllowedURIs))
+		}
+		tlsconf.VerifyPeerCertificate = verifyAll(checks...)
+		if p.clientAuth == tls.VerifyClientCertIfGiven && tlsconf.VerifyPeerCertificate != nil {
+			tlsconf.VerifyPeerCertificate = optionalCert(tlsconf.VerifyPeerCertificate)
+		}
 	}
+	tlsconf.ClientAuth = p.clientAuth
 
 	if len(p.ListenCertRaw) > 0 {
-		cert, err := tls.X509KeyPair([]byte(p.ListenCertRaw), []byte(p.ListenPrivateRaw))
+		cert, err := keyPair(p.ListenCertRaw, p.ListenPrivateRaw, p.listenSigner)
 		if err != nil {
-			return errors.New("loading cert/key pair: " + err.Error())
+			return withCode(codeCertParse, errors.New("loading cert/key pair: "+err.Error()))
 		}
 		tlsconf.Certificates = []tls.Certificate{cert}
 	}
+	for i, cp := range p.ListenCertificates {
+		cert, err := tls.X509KeyPair([]byte(cp.CertRaw), []byte(cp.PrivateRaw))
+		if err != nil {
+			return withCode(codeCertParse, fmt.Errorf("loading listen certificate %d: %w", i+1, err))
+		}
+		tlsconf.Certificates = append(tlsconf.Certificates, cert)
+	}
+
+	if len(p.ListenACMEDomains) > 0 {
+		m, err := acmeManager(p)
+		if err != nil {
+			return fmt.Errorf("ACME: %w", err)
+		}
+		tlsconf.GetCertificate = m.GetCertificate
+		tlsconf.NextProtos = append(tlsconf.NextProtos, acme.ALPNProto)
 
-	inst.newList <- &socketInfo{tlsconf: tlsconf, net: proto, addr: p.Listen}
+		// the CA's challenge handshake doesn't come with a client certificate
+		base := tlsconf
+		tlsconf.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			for _, proto := range hello.SupportedProtos {
+				if proto == acme.ALPNProto {
+					challenge := base.Clone()
+					challenge.ClientAuth = tls.NoClientCert
+					challenge.VerifyPeerCertificate = nil
+					challenge.VerifyConnection = nil
+					challenge.GetConfigForClient = nil
+					return challenge, nil
+				}
+			}
+			return nil, nil
+		}
+	}
+
+	var staplers []*ocspStapler
+	if p.ListenOCSPStapling && len(tlsconf.Certificates) > 0 {
+		for _, cert := range tlsconf.Certificates {
+			stapler, err := newOCSPStapler(p.Name, cert, p.ListenOCSPResponder, p.ocspRefresh)
+			if err != nil {
+				for _, st := range staplers {
+					st.close()
+				}
+				return fmt.Errorf("OCSP stapling: %w", err)
+			}
+			staplers = append(staplers, stapler)
+		}
+	}
+	inst.rotateCerts(tlsconf.Certificates, p.certOverlap)
+	var previous []tls.Certificate
+	if time.Now().Before(inst.prevUntil) {
+		previous = inst.prevCerts
+	}
+	if len(tlsconf.Certificates) > 0 && !isPacket(proto) && (len(staplers) > 0 || len(tlsconf.Certificates) > 1 || len(previous) > 0) {
+		tlsconf.GetCertificate = selectCertificate(tlsconf.Certificates, staplers, previous, inst.prevUntil)
+		tlsconf.Certificates = nil
+	}
+	inst.replaceStaplers(staplers)
+
+	var tickets *ticketRotator
+	if p.ListenSessionTicketsDisabled {
+		tlsconf.SessionTicketsDisabled = true
+	} else if p.ticketRotation > 0 {
+		tickets = newTicketRotator(tlsconf, p.ticketKeys[0], p.ticketRotation)
+	} else if len(p.ticketKeys) > 0 {
+		tlsconf.SetSessionTicketKeys(p.ticketKeys)
+	}
+	inst.replaceTickets(tickets)
+
+	inst.newList <- &socketInfo{tlsconf: tlsconf, net: proto, addr: p.Listen, idle: p.udpIdle, perms: p.listenPerms, acceptProxy: p.ListenAcceptProxyProtocol, proxyFrom: p.proxySources, shards: p.ListenShards, startTLS: p.StartTLS}
 	return nil
 }
 
+func (inst *Instance) replaceStaplers(sts []*ocspStapler) {
+	for _, st := range inst.staplers {
+		st.close()
+	}
+	inst.staplers = sts
+}
+
+// rotateCerts records the listen certificates, keeping the replaced ones for
+// the overlap when they changed.
+func (inst *Instance) rotateCerts(certs []tls.Certificate, overlap time.Duration) {
+	if overlap > 0 && len(inst.certs) > 0 && !sameCertificates(inst.certs, certs) {
+		inst.prevCerts = inst.certs
+		inst.prevUntil = time.Now().Add(overlap)
+	} else if overlap < 1 {
+		inst.prevCerts = nil
+		inst.prevUntil = time.Time{}
+	}
+	inst.certs = certs
+}
+
+func (inst *Instance) replaceTickets(tr *ticketRotator) {
+	if inst.tickets != nil {
+		inst.tickets.close()
+	}
+	inst.tickets = tr
+}
+
 func (inst *Instance) changeDesination(p *Profile) error {
-	proto := p.Protocol
-	if len(proto) < 1 {
-		proto = "tcp"
+	proto := p.sendNetwork()
+
+	var resolver *resolverCache
+	if len(p.DNSCacheTTL) > 0 || p.dnsRefresh > 0 || len(p.dnsPins) > 0 || len(p.DNSPrefer) > 0 {
+		resolver = newResolverCache(p.Name, p.dnsCacheTTL, p.dnsNegativeTTL, p.DNSServeStale)
+		resolver.pins, resolver.prefer = p.dnsPins, p.DNSPrefer
 	}
 
-	if len(p.SendAuthorityRaw) < 1 && len(p.SendCertRaw) < 1 {
-		inst.newDest <- &socketInfo{tlsconf: nil, net: proto, addr: p.Proxy}
-		return nil
+	tlsconf, err := sendTLSConfig(p, p.SendCertRaw, p.SendPrivateRaw, p.SendAuthorityRaw, p.sendSigner)
+	if err != nil {
+		return err
+	}
+	if p.SendInsecureSkipVerify {
+		slog.Warn("destination certificates aren't verified", "profile", p.Name)
+	}
+	dest := &socketInfo{tlsconf: tlsconf, net: proto, addr: p.Proxy, resolver: resolver, passthrough: p.passthrough(), accessLog: p.AccessLog, summary: p.AccessLogFormat, proxyProto: p.SendProxyProtocol, sendID: p.SendConnectionID, acceptID: p.AcceptConnectionID, dialTimeout: p.dialTimeout, dialRetries: p.DialRetries, dialBackoff: p.dialBackoff, dialFailure: p.DialFailure, idle: p.idleTimeout, maxAge: p.maxAge, maxConns: int64(p.MaxConnections), connBytes: p.connBandwidth, drain: p.drainTimeout, upstream: p.upstream(), http: p.httpOptions(), startTLS: p.StartTLS}
+	dest.balance(p)
+	dest.circuit(p)
+	if p.profileBandwidth > 0 {
+		dest.profileUp, dest.profileDown = newByteLimiter(p.profileBandwidth), newByteLimiter(p.profileBandwidth)
+	}
+	if p.connRate > 0 {
+		dest.rateLimit = newIPRateLimiter(p.Name, p.connRate, p.ConnectionBurst)
+	}
+
+	if len(p.Routes) > 0 {
+		dest.routes = make(map[string]*socketInfo, len(p.Routes))
+		for name, r := range p.Routes {
+			// a routed connection carries on with the route, everything but
+			// where it goes is the profile's
+			route := *dest
+			ri := &route
+			ri.addr, ri.routes, ri.balancer, ri.breaker = r.Proxy, nil, nil, nil
+			if r.hasTLS() {
+				ri.tlsconf, err = sendTLSConfig(p, r.SendCertRaw, r.SendPrivateRaw, r.SendAuthorityRaw, nil)
+				if err != nil {
+					return fmt.Errorf("route %q: %w", name, err)
+				}
+			}
+			ri.balance(p)
+			ri.circuit(p)
+			dest.routes[name] = ri
+		}
 	}
 
-	tlsconf := new(tls.Config)
+	var health *healthChecker
+	if len(p.HealthCheck) > 0 {
+		dests := []*socketInfo{dest}
+		for _, ri := range dest.routes {
+			dests = append(dests, ri)
+		}
+		health = newHealthChecker(p, dests)
+	}
+	inst.replaceHealth(health)
+	if resolver != nil && p.dnsRefresh > 0 {
+		addrs := splitList(dest.addr)
+		for _, ri := range dest.routes {
+			addrs = append(addrs, splitList(ri.addr)...)
+		}
+		var hosts []string
+		for _, a := range addrs {
+			if host, _, err := net.SplitHostPort(a); err == nil && net.ParseIP(host) == nil {
+				hosts = append(hosts, host)
+			}
+		}
+		resolver.refresh(p.dnsRefresh, hosts)
+	}
+	inst.replaceResolver(resolver)
 
-	if len(p.SendAuthorityRaw) > 0 {
+	inst.newDest <- dest
+	return nil
+}
+
+func (inst *Instance) replaceResolver(rc *resolverCache) {
+	inst.resolver.close()
+	inst.resolver = rc
+}
+
+func (inst *Instance) replaceHealth(hc *healthChecker) {
+	if inst.health != nil {
+		inst.health.close()
+	}
+	inst.health = hc
+}
+
+// sendTLSConfig builds the tls.Config for dialing the destination, nil when the
+// destination isn't TLS. The certificates may come from a route, the remaining
+// settings always come from the profile.
+func sendTLSConfig(p *Profile, certRaw, privateRaw, authorityRaw string, signer crypto.Signer) (*tls.Config, error) {
+	if p.SendSPIFFE {
+		tlsconf, err := spiffeClientConfig(p)
+		if err != nil {
+			return nil, err
+		}
+		tlsconf.KeyLogWriter = keyLog
+		return tlsconf, nil
+	}
+
+	if len(authorityRaw) < 1 && len(certRaw) < 1 && len(p.sendPins) < 1 && len(p.SendServerName) < 1 && !p.SendInsecureSkipVerify && !p.SendUseSystemRoots {
+		return nil, nil
+	}
+
+	tlsconf := &tls.Config{
+		MinVersion:         p.sendMinTLS,
+		MaxVersion:         p.sendMaxTLS,
+		CipherSuites:       p.sendCiphers,
+		ServerName:         p.SendServerName,
+		InsecureSkipVerify: p.SendInsecureSkipVerify,
+		KeyLogWriter:       keyLog,
+		Renegotiation:      p.renegotiation,
+	}
+	if p.SendSessionResumption {
+		tlsconf.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	if len(p.sendPins) > 0 {
+		tlsconf.VerifyPeerCertificate = pinCheck(p.sendPins)
+	}
+	if len(p.SendALPN) > 0 {
+		tlsconf.NextProtos = append([]string(nil), p.SendALPN...)
+		tlsconf.VerifyConnection = alpnCheck(p.Name, "send", p.SendALPN, p.SendALPNRequired)
+	}
+
+	if len(authorityRaw) > 0 {
 		capool := x509.NewCertPool()
-		if ok := capool.AppendCertsFromPEM([]byte(p.SendAuthorityRaw)); !ok {
-			return errors.New("no certs found for the listen authority")
+		if p.SendUseSystemRoots {
+			var err error
+			if capool, err = x509.SystemCertPool(); err != nil {
+				return nil, fmt.Errorf("loading system roots: %w", err)
+			}
+		}
+		if ok := capool.AppendCertsFromPEM([]byte(authorityRaw)); !ok {
+			return nil, withCode(codeCertParse, errors.New("no certs found for the send authority"))
 		}
 		tlsconf.RootCAs = capool
 	}
 
-	if len(p.SendCertRaw) > 0 {
-		cert, err := tls.X509KeyPair([]byte(p.SendCertRaw), []byte(p.SendPrivateRaw))
+	if len(certRaw) > 0 {
+		cert, err := keyPair(certRaw, privateRaw, signer)
 		if err != nil {
-			return errors.New("loading cert/key pair: " + err.Error())
+			return nil, withCode(codeCertParse, errors.New("loading cert/key pair: "+err.Error()))
 		}
 		tlsconf.Certificates = []tls.Certificate{cert}
 	}
 
-	inst.newDest <- &socketInfo{tlsconf: tlsconf, net: proto, addr: p.Proxy}
-	return nil
+	return tlsconf, nil
 }
 
 func (inst *Instance) changeEverything(p *Profile) error {
@@ -173,6 +574,15 @@ func (inst *Instance) changeEverything(p *Profile) error {
 
 func (inst *Instance) run() {
 	var listener net.Listener
+	var list *socketInfo    // what listener was opened with
+	var switcher *tlsSwitch // of listener, nil when it can't change its TLS settings
+	var listIdent string
+	// a listener that failed to open is retried with backoff
+	var pending *socketInfo
+	var pendingIdent string
+	var backoff time.Duration
+	var retryTimer *time.Timer
+	var retry <-chan time.Time
 	var conCloser chan struct{}
 	var dest *socketInfo
 	var count uint64
@@ -181,12 +591,22 @@ func (inst *Instance) run() {
 	for {
 		select {
 		case con := <-inst.newCon:
-			if dest != nil {
+			if dest == nil {
+				con.conn.Close()
+			} else if dest.maxConns > 0 && inst.active.Load() >= dest.maxConns {
+				connectionsRejected.WithLabelValues(inst.ident).Inc()
+				if dest.accessLog || debugging(inst.ident) {
+					slog.Info("rejected, at the connection limit", "profile", inst.ident, "conn", con.ident, "limit", dest.maxConns)
+				}
+				con.conn.Close()
+			} else {
 				newident := fmt.Sprintf("%s$%d#%d", inst.ident, rev, count)
 				count++
+				connectionsTotal.Add(inst.ident, 1)
+				connectionsAccepted.WithLabelValues(inst.ident).Inc()
+				connectionsOpen.WithLabelValues(inst.ident).Inc()
+				inst.active.Add(1)
 				go inst.connection(newident, con.conn, *dest, conCloser)
-			} else {
-				con.conn.Close()
 			}
 		case x := <-inst.newDest:
 			rev++
@@ -199,77 +619,465 @@ func (inst *Instance) run() {
 				conCloser = make(chan struct{})
 			}
 		case x := <-inst.newList:
-			//TODO: if new and old don't have the same address, change the order to open, close for high availability
-			if listener != nil {
+			if retryTimer != nil {
+				// a new listener replaces the one being retried
+				retryTimer.Stop()
+				retryTimer, retry, pending = nil, nil, nil
+			}
+			if x != nil && listener != nil && switcher != nil && x.tlsconf != nil && x.sameSocket(list) {
+				// only the TLS settings changed, handshakes from now on use them
+				switcher.set(x.tlsconf)
+				list = x
+				continue
+			}
+			closeOld := func() {
+				if listener == nil {
+					return
+				}
 				if err := listener.Close(); err != nil {
-					ident := fmt.Sprintf("%s$%d", inst.ident, rev)
-					log.Println(fmt.Sprintf("%s: error closing old listener: %s", ident, err.Error()))
+					slog.Error("error closing old listener", "profile", inst.ident, "listener", listIdent, "err", err)
 				}
+				listener, switcher, list = nil, nil, nil
 			}
 			ident := fmt.Sprintf("%s$%d", inst.ident, rev)
 			rev++
 			if x == nil {
-				listener = nil
+				closeOld()
+				inst.setListenStatus(nil, nil)
 				continue
 			}
-			l, err := x.listen()
+			// a new address is bound before the old one is closed, so clients
+			// are never refused, the same address has to be closed first unless
+			// both share it with SO_REUSEPORT
+			if list != nil && (list.net != x.net || list.addr != x.addr || list.shards > 0 && x.shards > 0) {
+				l, sw, err := x.listen()
+				if err == nil {
+					closeOld()
+					listener, switcher, list, listIdent = l, sw, x, ident
+					inst.setListenStatus(l, nil)
+					inst.startAccepting(ident, l)
+					continue
+				}
+				// the old address can overlap the new one, like a wildcard
+				slog.Debug("binding before closing the old listener failed", "profile", inst.ident, "listener", ident, "err", err)
+			}
+			closeOld()
+			l, sw, err := x.listen()
 			if err != nil {
-				log.Println(fmt.Sprintf("%s: error opening new listener: %s", ident, err.Error()))
+				err = withCode(codeBindFailure, err)
+				slog.Error("error opening new listener, retrying", "profile", inst.ident, "listener", ident, "code", countError(inst.ident, err), "retry_in", bindRetryMin, "err", err)
+				inst.setListenStatus(nil, err)
+				pending, pendingIdent, backoff = x, ident, bindRetryMin
+				retryTimer = time.NewTimer(backoff)
+				retry = retryTimer.C
 			} else {
-				// list = &x
-				listener = l
-				go inst.acceptance(ident, l)
+				listener, switcher, list, listIdent = l, sw, x, ident
+				inst.setListenStatus(l, nil)
+				inst.startAccepting(ident, l)
+			}
+		case <-retry:
+			l, sw, err := pending.listen()
+			if err != nil {
+				backoff = min(backoff*2, bindRetryMax)
+				err = withCode(codeBindFailure, err)
+				slog.Warn("error opening new listener, retrying", "profile", inst.ident, "listener", pendingIdent, "code", countError(inst.ident, err), "retry_in", backoff, "err", err)
+				inst.setListenStatus(nil, err)
+				retryTimer.Reset(backoff)
+				continue
 			}
+			slog.Info("opened listener after retrying", "profile", inst.ident, "listener", pendingIdent)
+			listener, switcher, list, listIdent = l, sw, pending, pendingIdent
+			inst.setListenStatus(l, nil)
+			inst.startAccepting(pendingIdent, l)
+			retryTimer, retry, pending = nil, nil, nil
 		case <-inst.fin:
+			if retryTimer != nil {
+				retryTimer.Stop()
+			}
 			return
 		}
 	}
 }
 
+// startAccepting runs an acceptance loop for l, or one for each of its shards
+// so they accept in parallel. They number the connections together.
+func (inst *Instance) startAccepting(ident string, l net.Listener) {
+	count := new(atomic.Uint64)
+	if sl, ok := l.(*shardListener); ok {
+		for _, shard := range sl.shards {
+			go inst.acceptance(ident, shard, count)
+		}
+		return
+	}
+	go inst.acceptance(ident, l, count)
+}
+
 // acceptance runs in it's own Go routine for handling new connection
-func (inst *Instance) acceptance(ident string, l net.Listener) {
-	var count uint64
+func (inst *Instance) acceptance(ident string, l net.Listener, count *atomic.Uint64) {
+	for inst.accept(ident, l, count) {
+		time.Sleep(acceptRestart)
+	}
+}
+
+// accept hands the connections of l to the instance until l is closed, it
+// tells to accept again when it recovered from a panic. Other errors are
+// retried with a backoff, those that aren't transient mark the listener down
+// until it accepts again.
+func (inst *Instance) accept(ident string, l net.Listener, count *atomic.Uint64) (again bool) {
+	defer func() {
+		if p := recover(); p != nil {
+			inst.recovered("acceptance", p, "listener", ident)
+			again = true
+		}
+	}()
+	var delay time.Duration
+	var down bool
+	defer acceptBackoff.WithLabelValues(inst.ident).Set(0)
 	for {
 		c, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			slog.Debug("listener closed, stopped accepting", "profile", inst.ident, "listener", ident)
+			return false
+		}
 		if err != nil {
-			log.Println(fmt.Sprintf("%s: error accepting new connections: %s", ident, err.Error()))
-			// Are there any errors here that are recoverable?
-			return
+			delay = min(max(2*delay, acceptRetryMin), acceptRetryMax)
+			acceptBackoff.WithLabelValues(inst.ident).Set(delay.Seconds())
+			if transientAcceptError(err) {
+				acceptErrors.WithLabelValues(inst.ident, "transient").Inc()
+				slog.Warn("temporary error accepting new connections, retrying", "profile", inst.ident, "listener", ident, "retry_in", delay, "err", err)
+			} else {
+				acceptErrors.WithLabelValues(inst.ident, "other").Inc()
+				slog.Error("error accepting new connections, retrying", "profile", inst.ident, "listener", ident, "retry_in", delay, "err", err)
+				if !down {
+					inst.setListenStatus(nil, err)
+					down = true
+				}
+			}
+			time.Sleep(delay)
+			continue
+		}
+		if delay > 0 {
+			delay = 0
+			acceptBackoff.WithLabelValues(inst.ident).Set(0)
+			if down {
+				inst.setListenStatus(l, nil)
+				down = false
+			}
+			slog.Info("accepting new connections again", "profile", inst.ident, "listener", ident)
 		}
-		inst.newCon <- newConnection{ident: fmt.Sprintf("%s#%d", ident, count), conn: c}
-		// verbose logging of the new connection
-		count++
+		inst.newCon <- newConnection{ident: fmt.Sprintf("%s#%d", ident, count.Add(1)-1), conn: c}
 	}
 }
 
+// transientAcceptError tells if err is one accept recovers from on its own,
+// like running out of descriptors or a client aborting before it was
+// accepted.
+func transientAcceptError(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EINTR, syscall.EAGAIN, syscall.EPROTO, syscall.EPERM} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
 // connection runs in it's own Go routine and manages the connection to dest as well as the read/write go routines.
 func (inst *Instance) connection(ident string, l net.Conn, config socketInfo, done <-chan struct{}) {
+	defer inst.active.Add(-1)
+	defer connectionsOpen.WithLabelValues(inst.ident).Dec()
 	defer l.Close()
-	c, err := config.connect()
+	id := newConnID()
+	if pc, ok := l.(*proxyConn); ok && config.acceptID && validConnID(pc.ConnectionID()) {
+		id = pc.ConnectionID()
+	}
+	lg := slog.With("profile", inst.ident, "conn", ident, "conn_id", id, "peer", l.RemoteAddr().String())
+	rec := &accessRecord{Start: time.Now(), Profile: inst.ident, Conn: ident, ID: id, Client: l.RemoteAddr().String(), Destination: config.addr}
+	if format := config.summary; len(format) > 0 {
+		defer func() {
+			rec.End = time.Now()
+			rec.write(format)
+		}()
+	}
+	ctx, span := startSpan(inst.ident, ident, id, l.RemoteAddr())
+	defer endSpan(span, rec)
+	defer func() {
+		if rec.err != nil {
+			inst.setLastError(rec.Reason, countError(inst.ident, rec.err))
+		}
+	}()
+	defer func() {
+		if p := recover(); p != nil {
+			rec.fail("panic", inst.recovered("connection", p, "conn", ident))
+		}
+	}()
+	if config.rateLimit != nil && !config.rateLimit.allow(l.RemoteAddr()) {
+		rec.fail("over the connection rate limit", nil)
+		return
+	}
+	if config.dialFailure == DialFailureRefuse && config.down() {
+		resetConn(l)
+		lg.Warn("refused, the destination is down", "destination", config.addr, "code", codeDestinationDown)
+		rec.fail("destination down", errDestinationDown)
+		return
+	}
+	var cs *tls.ConnectionState
+	if pc, ok := l.(*proxyConn); ok {
+		if err := pc.header(); err != nil {
+			lg.Warn("error reading PROXY protocol header", "err", err)
+			rec.fail("error reading PROXY protocol header", err)
+			return
+		}
+	}
+	var upgraded bool
+	if sc, ok := l.(*startTLSConn); ok && sc.proto != StartTLSMySQL {
+		tc, err := sc.upgrade()
+		if err != nil {
+			lg.Warn("error upgrading to TLS", "err", err)
+			rec.fail("error upgrading to TLS", err)
+			return
+		}
+		l, upgraded = tc, true
+	}
+	if config.passthrough {
+		sni, pc, err := peekServerName(l)
+		if err != nil {
+			lg.Warn("error reading client hello", "err", err)
+			rec.fail("error reading client hello", err)
+			return
+		}
+		l = pc
+		rec.ServerName = sni
+		if len(config.routes) > 0 {
+			config = *config.route(sni)
+		}
+		if config.accessLog || debugging(inst.ident) {
+			lg.Info("accepted, passthrough", "server_name", sni, "destination", config.addr)
+		}
+	} else if tc, ok := l.(*tls.Conn); ok {
+		// handshaking here rather than on the first read tells why it failed
+		if err := traced(ctx, "handshake", tc.Handshake); err != nil {
+			reason := inst.handshakeFailure(ident, l.RemoteAddr(), err)
+			err = withCode(handshakeCode(reason, err), err)
+			lg.Warn("handshake error", "reason", reason, "code", errorCode(err), "err", err)
+			rec.fail("handshake error ("+reason+")", err)
+			return
+		}
+		state := tc.ConnectionState()
+		cs = &state
+		if config.accessLog || debugging(inst.ident) {
+			lg.Info("accepted", "tls", describeTLS(state))
+		}
+		if len(config.routes) > 0 {
+			config = *config.route(state.ServerName)
+			lg.Debug("routed", "server_name", state.ServerName, "destination", config.addr)
+		}
+	} else if qs, ok := l.(*quicStream); ok {
+		state := qs.ConnectionState()
+		cs = &state
+		if config.accessLog || debugging(inst.ident) {
+			lg.Info("accepted", "quic_stream", int64(qs.StreamID()), "tls", describeTLS(state))
+		}
+		if len(config.routes) > 0 {
+			config = *config.route(state.ServerName)
+		}
+	} else if ic, ok := l.(*idleConn); ok && ic.isDTLS() {
+		if err := traced(ctx, "handshake", ic.handshake); err != nil {
+			reason := inst.handshakeFailure(ident, l.RemoteAddr(), err)
+			err = withCode(handshakeCode(reason, err), err)
+			lg.Warn("handshake error", "reason", reason, "code", errorCode(err), "err", err)
+			rec.fail("handshake error ("+reason+")", err)
+			return
+		}
+		if config.accessLog || debugging(inst.ident) {
+			lg.Info("accepted", "tls", "DTLS")
+		}
+	} else if config.accessLog {
+		lg.Info("accepted")
+	}
+	if cs != nil {
+		rec.setTLS(cs)
+		auditAccepted(inst.ident, ident, l.RemoteAddr().String(), cs)
+	}
+	rec.Destination = config.addr
+	if len(config.addr) < 1 {
+		lg.Warn("no destination for connection")
+		rec.fail("no destination for connection", nil)
+		return
+	}
+	if config.isHTTP2(cs) && config.tlsconf != nil && len(config.tlsconf.NextProtos) < 1 {
+		config.tlsconf = config.tlsconf.Clone()
+		config.tlsconf.NextProtos = []string{http2.NextProtoTLS}
+	}
+	var c net.Conn
+	err := traced(ctx, "dial", func() (err error) {
+		c, err = inst.dial(config, lg)
+		return err
+	})
+	if errors.Is(err, errCircuitOpen) {
+		lg.Warn("closing, the destination's circuit is open", "destination", config.addr, "code", codeCircuitOpen)
+		rec.fail("destination circuit open", err)
+		config.failClient(l, cs)
+		return
+	}
 	if err != nil {
-		log.Println(fmt.Sprintf("%s: error connecting to destination: %s", ident, err.Error()))
+		err = dialFailure(err)
+		lg.Error("error connecting to destination", "code", errorCode(err), "err", err)
+		rec.fail("error connecting to destination", err)
+		config.failClient(l, cs)
 		//TODO: consider upstream effects
 		//TODO: close parent socket?
 		return
 	}
 	defer c.Close()
-	ec := make(chan conConculsion)
-	defer close(ec)
-	go inst.transfer(ident+":ltd", l, c, ec)
-	go inst.transfer(ident+":dtl", c, l, ec)
+	rec.setDestination(c, config.addr)
+	if len(config.proxyProto) > 0 {
+		var sendID string
+		if config.sendID {
+			sendID = id
+		}
+		if _, err := c.Write(proxyHeader(config.proxyProto, l.RemoteAddr(), l.LocalAddr(), cs, sendID)); err != nil {
+			lg.Warn("error writing PROXY protocol header", "err", err)
+			rec.fail("error writing PROXY protocol header", err)
+			return
+		}
+	}
+	if config.startTLS == StartTLSMySQL {
+		// the server speaks first, the client upgrades once it was greeted
+		var ml, mc net.Conn
+		var state *tls.ConnectionState
+		err := traced(ctx, "handshake", func() (err error) {
+			ml, mc, state, err = mysqlStartTLS(l, c, config.tlsconf != nil)
+			return err
+		})
+		if err != nil {
+			lg.Warn("error upgrading to TLS", "err", err)
+			rec.fail("error upgrading to TLS", err)
+			return
+		}
+		l, c = ml, mc
+		if state != nil {
+			cs = state
+			rec.setTLS(cs)
+			auditAccepted(inst.ident, ident, l.RemoteAddr().String(), cs)
+			if config.accessLog || debugging(inst.ident) {
+				lg.Info("accepted", "tls", describeTLS(*state))
+			}
+		}
+	} else if len(config.startTLS) > 0 {
+		if err := alignStartTLS(config.startTLS, upgraded, config.tlsconf != nil, l, c); err != nil {
+			lg.Warn("error aligning STARTTLS", "err", err)
+			rec.fail("error aligning STARTTLS", err)
+			return
+		}
+	}
+	connEvents.publish(connEvent{kind: connOpened, profile: inst.ident, ident: ident, remote: l.RemoteAddr().String(), time: time.Now()})
+	if config.idle > 0 && !isPacket(config.net) {
+		l, c = newIdleConn(l, config.idle), newIdleConn(c, config.idle)
+	}
+	var reaped atomic.Value // why the proxy closed the connection
+	if config.maxAge > 0 {
+		reap := time.AfterFunc(config.maxAge, func() {
+			reaped.Store("maximum connection age")
+			lg.Info("closing after reaching the maximum connection age", "max_age", config.maxAge)
+			l.Close()
+			c.Close()
+		})
+		defer reap.Stop()
+	}
+	if config.drain > 0 {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			// the destination changed or the profile is gone, the connection
+			// gets the drain timeout to finish on its own
+			select {
+			case <-done:
+			case <-finished:
+				return
+			}
+			t := time.NewTimer(config.drain)
+			defer t.Stop()
+			select {
+			case <-t.C:
+				reaped.Store("drain timeout")
+				errorsTotal.WithLabelValues(inst.ident, codeDrainTimeout).Inc()
+				lg.Info("closing, still open after its profile changed", "drain", config.drain, "code", codeDrainTimeout)
+				l.Close()
+				c.Close()
+			case <-finished:
+			}
+		}()
+	}
+	lc := &liveConn{ident: ident, id: id, client: l.RemoteAddr().String(), backend: rec.Destination, start: rec.Start, packet: isPacket(config.net)}
+	lc.close = func(why string) {
+		reaped.Store(why)
+		lg.Info("closing", "why", why)
+		l.Close()
+		c.Close()
+	}
+	inst.track(lc)
+	defer inst.untrack(ident)
+	defer lc.stopCapture(nil, "connection closed")
+	l = &countedConn{Conn: l, counts: []*atomic.Int64{&lc.up, &inst.bytesUp}, reads: &lc.upReads, metric: bytesTotal.WithLabelValues(inst.ident, rec.Destination, "up"), lc: lc, client: true}
+	c = &countedConn{Conn: c, counts: []*atomic.Int64{&lc.down, &inst.bytesDown}, reads: &lc.downReads, metric: bytesTotal.WithLabelValues(inst.ident, rec.Destination, "down"), lc: lc}
+	// buffered for both directions, so they can end after a panic here
+	ec := make(chan conConculsion, 2)
+	bufSize := 32 << 10
+	if isPacket(config.net) {
+		bufSize = maxDatagram
+	}
+	throttled := throttle
+	if isPacket(config.net) {
+		throttled = throttleDatagrams
+	}
+	var connUp, connDown *rate.Limiter
+	if config.connBytes > 0 {
+		connUp, connDown = newByteLimiter(config.connBytes), newByteLimiter(config.connBytes)
+	}
+	if config.isHTTP2(cs) {
+		go inst.transferHTTP2(ctx, ident, l, c, ec, config, cs, connUp, connDown, id)
+	} else if config.http != nil {
+		x := newHTTPExchange()
+		go inst.transferHTTP(ctx, ident+":ltd", throttle(l, connUp, config.profileUp), c, ec, x, config.http, l.RemoteAddr(), cs, id)
+		go inst.transferResponses(ident+":dtl", throttle(c, connDown, config.profileDown), l, ec, x, bufSize)
+	} else {
+		go inst.transfer(ident+":ltd", throttled(l, connUp, config.profileUp), c, ec, bufSize)
+		go inst.transfer(ident+":dtl", throttled(c, connDown, config.profileDown), l, ec, bufSize)
+	}
 	var result conConculsion
+	var total int64
+	var firstErr error
 	open := 2
 
-	select {
-	case result = <-ec:
-		open--
-		if result.err != nil {
-			log.Println(fmt.Sprintf("%s: socket error after xfer:%d: %s", ident, result.xfer, result.err.Error()))
-		} else if Debug {
-			log.Println(fmt.Sprintf("%s: closed after xfer:%d", ident, result.xfer))
-		}
-	case <-done:
-		//TODO: Add grace period
+	result = <-ec
+	open--
+	total += result.xfer
+	firstErr = result.err
+	rec.add(result)
+	if why, ok := reaped.Load().(string); ok {
+		rec.Reason = why
+	} else if result.err != nil {
+		rec.fail("socket error", result.err)
+	} else if strings.HasSuffix(result.ident, ":ltd") {
+		rec.Reason = "client closed"
+	} else {
+		rec.Reason = "destination closed"
+	}
+	if result.err != nil && reaped.Load() == nil {
+		lg.Warn("socket error", "stream", result.ident, "bytes", result.xfer, "code", errorCode(result.err), "err", result.err)
+	} else {
+		lg.Log(ctx, LevelTrace, "closed", "stream", result.ident, "bytes", result.xfer)
+	}
+
+	if isPacket(config.net) || errorCode(result.err) == codePanic {
+		// datagram peers never hang up, and a direction that panicked
+		// won't carry on, end the other direction too
+		l.Close()
+		c.Close()
 	}
 
 	// Close never needs checked form the connection level right? io channels will always indicate?
@@ -277,33 +1085,310 @@ func (inst *Instance) connection(ident string, l net.Conn, config socketInfo, do
 	// drain both channels
 	for ; open > 0; open-- {
 		result = <-ec
-		if Debug {
-			log.Println(fmt.Sprintf("%s: closed after xfer:%d", ident, result.xfer))
-		}
+		total += result.xfer
+		rec.add(result)
+		lg.Log(ctx, LevelTrace, "closed", "stream", result.ident, "bytes", result.xfer)
 	}
+	connEvents.publish(connEvent{kind: connClosed, profile: inst.ident, ident: ident, remote: l.RemoteAddr().String(), xfer: total, err: firstErr, time: time.Now()})
+	exportFlow(newFlowRecord(inst.ident, lc, l, c))
 }
 
-func (inst *Instance) transfer(ident string, r io.Reader, w io.Writer, e chan<- conConculsion) {
-	count, err := io.Copy(w, r)
+func (inst *Instance) transfer(ident string, r io.Reader, w io.Writer, e chan<- conConculsion, bufSize int) {
+	defer inst.recoverTransfer(e, ident)
+	count, err := io.CopyBuffer(w, r, make([]byte, bufSize))
 	if err != nil {
-		werr := fmt.Errorf("%s: error after transferring %d bytes: %w", ident, count, err)
+		werr := fmt.Errorf("error after transferring %d bytes: %w", count, err)
 		e <- conConculsion{ident: ident, err: werr, xfer: count}
 	} else {
 		e <- conConculsion{ident: ident, xfer: count}
 	}
 }
 
+// balance sets up load balancing when the address lists several destinations,
+// or health checks need to track a single one.
+func (info *socketInfo) balance(p *Profile) {
+	if addrs := splitList(info.addr); len(addrs) > 1 || (len(addrs) > 0 && len(p.HealthCheck) > 0) {
+		info.balancer = newBalancer(p.Name, p.Balance, addrs)
+	}
+}
+
+// dial connects to the destination of config, retrying with a backoff when
+// DialRetries is set. It doesn't retry while the circuit is open.
+func (inst *Instance) dial(config socketInfo, lg *slog.Logger) (net.Conn, error) {
+	backoff := config.dialBackoff
+	for retry := 1; ; retry++ {
+		c, err := config.connect()
+		if err == nil || retry > config.dialRetries || errors.Is(err, errCircuitOpen) {
+			return c, err
+		}
+		dialRetriesTotal.WithLabelValues(inst.ident).Inc()
+		lg.Warn("error connecting to destination, retrying", "retry", retry, "retries", config.dialRetries, "retry_in", backoff, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// down tells if the destination is known to be unreachable, its circuit is
+// open or all its addresses are down.
+func (info socketInfo) down() bool {
+	return (info.breaker != nil && info.breaker.isOpen()) || (info.balancer != nil && info.balancer.down())
+}
+
+// failClient ends the client's connection after the destination couldn't be
+// reached, the way DialFailure says.
+func (info socketInfo) failClient(l net.Conn, cs *tls.ConnectionState) {
+	switch info.dialFailure {
+	case DialFailureReset, DialFailureRefuse:
+		resetConn(l)
+	case DialFailureBadGateway:
+		badGateway(l, info.isHTTP2(cs))
+	}
+}
+
+// resetConn closes c with a TCP reset rather than ending it in order, when it
+// is a TCP connection.
+func resetConn(c net.Conn) {
+	for {
+		switch x := c.(type) {
+		case *net.TCPConn:
+			x.SetLinger(0)
+			x.Close()
+			return
+		case *tls.Conn:
+			c = x.NetConn()
+		case *proxyConn:
+			c = x.Conn
+		case *startTLSConn:
+			c = x.Conn
+		case *replayConn:
+			c = x.Conn
+		case *idleConn:
+			c = x.Conn
+		default:
+			return
+		}
+	}
+}
+
+// circuit sets up the circuit breaker when CircuitBreakerFailures is set.
+func (info *socketInfo) circuit(p *Profile) {
+	if p.CircuitBreakerFailures > 0 && len(info.addr) > 0 {
+		info.breaker = newCircuitBreaker(p.Name, info.addr, p.CircuitBreakerFailures, p.circuitCooldown)
+	}
+}
+
 func (info socketInfo) connect() (net.Conn, error) {
-	if info.tlsconf == nil {
-		return net.Dial(info.net, info.addr)
-		//TODO: implement DialTimeout
+	if info.breaker == nil {
+		return info.connectBackends()
+	}
+	if !info.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+	c, err := info.connectBackends()
+	info.breaker.done(err)
+	return c, err
+}
+
+func (info socketInfo) connectBackends() (net.Conn, error) {
+	if info.balancer != nil {
+		return info.balancer.connect(info.connectAddr)
 	}
-	return tls.Dial(info.net, info.addr, info.tlsconf)
+	return info.connectAddr(info.addr)
 }
 
-func (info socketInfo) listen() (net.Listener, error) {
-	if info.tlsconf == nil {
-		return net.Listen(info.net, info.addr)
+// connectAddr connects to a single destination address, giving up after the
+// dial timeout.
+func (info socketInfo) connectAddr(addr string) (net.Conn, error) {
+	ctx := context.Background()
+	if info.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, info.dialTimeout)
+		defer cancel()
+	}
+
+	if info.resolver == nil || info.upstream != nil {
+		// the forward proxy resolves the name itself
+		return info.dial(ctx, addr, info.tlsconf)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// not a host:port address (unix socket, etc), nothing to resolve
+		return info.dial(ctx, addr, info.tlsconf)
+	}
+
+	addrs, err := info.resolver.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsconf := info.tlsconf
+	if tlsconf != nil && len(tlsconf.ServerName) < 1 {
+		// dialing the resolved IP, verify against the configured name
+		tlsconf = tlsconf.Clone()
+		tlsconf.ServerName = host
+	}
+
+	var c net.Conn
+	for _, a := range addrs {
+		c, err = info.dial(ctx, net.JoinHostPort(a, port), tlsconf)
+		if err == nil {
+			return c, nil
+		}
+	}
+	return nil, err
+}
+
+func (info socketInfo) dial(ctx context.Context, addr string, tlsconf *tls.Config) (net.Conn, error) {
+	if tlsconf != nil && isPacket(info.net) {
+		return dialDTLS(ctx, info.net, addr, tlsconf)
+	}
+	if info.upstream == nil && len(info.startTLS) < 1 {
+		if tlsconf == nil {
+			var d net.Dialer
+			return d.DialContext(ctx, info.net, addr)
+		}
+		d := &tls.Dialer{Config: tlsconf}
+		return d.DialContext(ctx, info.net, addr)
+	}
+
+	var dialer contextDialer = &net.Dialer{}
+	if info.upstream != nil {
+		dialer = info.upstream
+	}
+	c, err := dialer.DialContext(ctx, info.net, addr)
+	if err != nil || tlsconf == nil {
+		return c, err
+	}
+	var greeting []byte
+	if len(info.startTLS) > 0 {
+		if greeting, err = clientStartTLS(ctx, c, info.startTLS); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if len(tlsconf.ServerName) < 1 {
+		tlsconf = tlsconf.Clone()
+		tlsconf.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tc := tls.Client(c, tlsconf)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if len(greeting) > 0 {
+		// read by the proxy before the upgrade, the client still needs it
+		return &replayConn{Conn: tc, r: io.MultiReader(bytes.NewReader(greeting), tc)}, nil
+	}
+	return tc, nil
+}
+
+// sameSocket tells if o is listening the way info would, only the TLS
+// settings can differ.
+func (info *socketInfo) sameSocket(o *socketInfo) bool {
+	return o != nil && info.net == o.net && info.addr == o.addr && info.idle == o.idle && info.perms == o.perms &&
+		info.acceptProxy == o.acceptProxy && info.startTLS == o.startTLS && info.shards == o.shards &&
+		slices.EqualFunc(info.proxyFrom, o.proxyFrom, func(a, b *net.IPNet) bool { return a.String() == b.String() })
+}
+
+// tlsSwitch lets a TLS listener change its settings without being bound
+// again. Handshakes use the config it was last set to.
+type tlsSwitch struct {
+	conf    atomic.Pointer[tls.Config]
+	tlsconf *tls.Config // the listener is made with
+}
+
+func newTLSSwitch(tlsconf *tls.Config) *tlsSwitch {
+	sw := &tlsSwitch{}
+	sw.conf.Store(tlsconf)
+	sw.tlsconf = &tls.Config{GetConfigForClient: sw.configForClient}
+	return sw
+}
+
+func (sw *tlsSwitch) set(tlsconf *tls.Config) {
+	sw.conf.Store(tlsconf)
+}
+
+func (sw *tlsSwitch) configForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	tlsconf := sw.conf.Load()
+	// it isn't called for the config returned, like for ACME challenges
+	if tlsconf.GetConfigForClient != nil {
+		if c, err := tlsconf.GetConfigForClient(hello); c != nil || err != nil {
+			return c, err
+		}
+	}
+	return tlsconf, nil
+}
+
+// listen opens the listener, with the switch for its TLS settings when they
+// can be changed while it is open.
+func (info socketInfo) listen() (net.Listener, *tlsSwitch, error) {
+	if isPacket(info.net) {
+		var l net.Listener
+		var err error
+		if info.tlsconf == nil {
+			l, err = listenUDP(info.net, info.addr)
+		} else {
+			l, err = listenDTLS(info.net, info.addr, info.tlsconf)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		return &idleListener{Listener: l, idle: info.idle}, nil, nil
+	}
+	if isQUIC(info.net) {
+		l, err := listenQUIC(info.addr, info.tlsconf)
+		return l, nil, err
+	}
+	var l net.Listener
+	listen := func() (err error) {
+		if info.shards > 0 {
+			l, err = listenShards(info.net, info.addr, info.shards)
+		} else {
+			l, err = listenSocket(info.net, info.addr)
+		}
+		return err
+	}
+	var err error
+	if isUnix(info.net) && info.perms.set() {
+		// owner only until the configured ownership and mode are applied, so
+		// nothing connects in between
+		err = withUmask(0o177, listen)
+	} else {
+		err = listen()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if isUnix(info.net) && info.perms.set() {
+		if err := info.perms.apply(info.addr); err != nil {
+			l.Close()
+			return nil, nil, fmt.Errorf("setting socket permissions: %w", err)
+		}
+	}
+	var sw *tlsSwitch
+	if info.tlsconf != nil {
+		sw = newTLSSwitch(info.tlsconf)
+	}
+	wrap := func(l net.Listener) net.Listener {
+		if info.acceptProxy {
+			l = &proxyListener{Listener: l, from: info.proxyFrom}
+		}
+		switch {
+		case sw == nil:
+			return l
+		case len(info.startTLS) > 0:
+			return &startTLSListener{Listener: l, proto: info.startTLS, tlsconf: sw.tlsconf}
+		default:
+			return tls.NewListener(l, sw.tlsconf)
+		}
+	}
+	if sl, ok := l.(*shardListener); ok {
+		// each shard is accepted from on its own
+		for i := range sl.shards {
+			sl.shards[i] = wrap(sl.shards[i])
+		}
+		return sl, sw, nil
 	}
-	return tls.Listen(info.net, info.addr, info.tlsconf)
+	return wrap(l), sw, nil
 }
@@ -0,0 +1,626 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// testEcho listens on a loopback port and writes back what it reads, closed
+// with the test.
+func testEcho(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// testInstance resolves p and runs it, stopped with the test. It returns once
+// the instance is listening.
+func testInstance(t *testing.T, p *Profile) *Instance {
+	t.Helper()
+	if len(p.Name) < 1 {
+		p.Name = "test"
+	}
+	if len(p.Listen) < 1 {
+		p.Listen = "127.0.0.1:0"
+	}
+	if err := p.Resolve(); err != nil {
+		t.Fatal(err)
+	}
+	inst, err := NewInstance(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(inst.Stop)
+	waitFor(t, "listening", func() bool { return len(inst.ListenAddr()) > 0 })
+	return inst
+}
+
+// waitFor polls cond for up to five seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// echoes sends a line through c and tells if it came back.
+func echoes(c net.Conn) bool {
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	defer c.SetDeadline(time.Time{})
+	if _, err := io.WriteString(c, "ping\n"); err != nil {
+		return false
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	return err == nil && line == "ping\n"
+}
+
+// closed tells if the peer closed c within a couple of seconds.
+func closed(c net.Conn) bool {
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer c.SetReadDeadline(time.Time{})
+	_, err := c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+func TestInstanceProxies(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: testEcho(t)})
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c) {
+		t.Fatal("nothing came back through the proxy")
+	}
+	waitFor(t, "the connection to be tracked", func() bool { return inst.Active() == 1 })
+}
+
+func TestInstanceConnectionLimit(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: testEcho(t), MaxConnections: 1})
+	first, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	if !echoes(first) {
+		t.Fatal("first connection wasn't proxied")
+	}
+
+	second, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if !closed(second) {
+		t.Error("connection over the limit wasn't closed")
+	}
+	if !echoes(first) {
+		t.Error("first connection stopped working")
+	}
+}
+
+func TestCloseConnections(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: testEcho(t)})
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echoes(c)
+	if n := inst.CloseConnections("test"); n != 1 {
+		t.Fatalf("closed %d connections, want 1", n)
+	}
+	if !closed(c) {
+		t.Error("connection is still open")
+	}
+	waitFor(t, "the connection to finish", func() bool { return inst.Active() == 0 })
+}
+
+func TestDialRetries(t *testing.T) {
+	inst := &Instance{ident: "test"}
+	lg := slog.Default()
+	echo := testEcho(t)
+
+	d := &failingDialer{fails: 2}
+	info := socketInfo{net: "tcp", addr: echo, upstream: d, dialRetries: 2, dialBackoff: 10 * time.Millisecond}
+	c, err := inst.dial(info, lg)
+	if err != nil {
+		t.Fatalf("gave up after %d dials: %v", d.count(), err)
+	}
+	c.Close()
+	if d.count() != 3 {
+		t.Errorf("dialed %d times, want 3", d.count())
+	}
+
+	d = &failingDialer{fails: 3}
+	info.upstream = d
+	start := time.Now()
+	if _, err := inst.dial(info, lg); err == nil {
+		t.Fatal("dial succeeded past the retries")
+	}
+	if d.count() != 3 {
+		t.Errorf("dialed %d times, want 3", d.count())
+	}
+	if waited := time.Since(start); waited < 30*time.Millisecond {
+		t.Errorf("retried after %v, want the backoff doubling from 10ms", waited)
+	}
+
+	// an open circuit isn't retried
+	d = &failingDialer{fails: 10}
+	info.upstream = d
+	info.breaker = newCircuitBreaker("test", echo, 1, time.Hour)
+	if _, err := inst.dial(info, lg); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("got %v, want %v", err, errCircuitOpen)
+	}
+	if d.count() != 1 {
+		t.Errorf("dialed %d times with the circuit open", d.count())
+	}
+}
+
+// closedAddr is a loopback address nothing listens on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// readErr is what reading c ends with.
+func readErr(c net.Conn) error {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.ReadAll(c)
+	return err
+}
+
+func TestDialFailure(t *testing.T) {
+	for _, c := range []struct {
+		policy string
+		reset  bool
+	}{
+		{DialFailureClose, false},
+		{DialFailureReset, true},
+	} {
+		inst := testInstance(t, &Profile{Name: c.policy, Proxy: closedAddr(t), DialFailure: c.policy})
+		conn, err := net.Dial("tcp", inst.ListenAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := readErr(conn); errors.Is(err, syscall.ECONNRESET) != c.reset {
+			t.Errorf("%s: client got %v", c.policy, err)
+		}
+	}
+}
+
+func TestDialFailureRefuse(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: closedAddr(t), DialFailure: DialFailureRefuse, CircuitBreakerFailures: 1, CircuitBreakerCooldown: "1h"})
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", inst.ListenAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := readErr(conn); !errors.Is(err, syscall.ECONNRESET) {
+			t.Errorf("connection %d: client got %v", i, err)
+		}
+	}
+	// the second never got to dial, the circuit was open by then
+	waitFor(t, "the refusal", func() bool {
+		_, code, _ := inst.LastError()
+		return code == codeDestinationDown
+	})
+}
+
+func TestDialFailureBadGateway(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: closedAddr(t), Mode: ModeHTTP, DialFailure: DialFailureBadGateway})
+	conn, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.test\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("got %s, want 502", res.Status)
+	}
+}
+
+// scriptedListener plays its steps one per Accept, then is closed.
+type scriptedListener struct {
+	steps []func() (net.Conn, error)
+}
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	if len(l.steps) < 1 {
+		return nil, net.ErrClosed
+	}
+	step := l.steps[0]
+	l.steps = l.steps[1:]
+	return step()
+}
+
+func (l *scriptedListener) Close() error { return nil }
+
+func (l *scriptedListener) Addr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1} }
+
+func TestTransientAcceptError(t *testing.T) {
+	for _, c := range []struct {
+		err       error
+		transient bool
+	}{
+		{&net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)}, true},
+		{&net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.ECONNABORTED)}, true},
+		{os.ErrDeadlineExceeded, true},
+		{&net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EBADF)}, false},
+		{errors.New("listener broke"), false},
+	} {
+		if got := transientAcceptError(c.err); got != c.transient {
+			t.Errorf("%v: got %v, want %v", c.err, got, c.transient)
+		}
+	}
+}
+
+func TestAcceptRetries(t *testing.T) {
+	inst := &Instance{ident: "test", newCon: make(chan newConnection, 2)}
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	var downWhile error
+	l := &scriptedListener{steps: []func() (net.Conn, error){
+		func() (net.Conn, error) { return nil, os.NewSyscallError("accept4", syscall.EMFILE) },
+		func() (net.Conn, error) {
+			if _, err := inst.ListenStatus(); err != nil {
+				t.Error("a transient error marked the listener down")
+			}
+			return nil, errors.New("listener broke")
+		},
+		func() (net.Conn, error) {
+			_, downWhile = inst.ListenStatus()
+			return a, nil
+		},
+	}}
+	count := new(atomic.Uint64)
+	if inst.accept("test", l, count) {
+		t.Error("accepting again after the listener closed")
+	}
+	if downWhile == nil {
+		t.Error("listener wasn't down after an error that isn't transient")
+	}
+	if up, err := inst.ListenStatus(); !up || err != nil {
+		t.Errorf("listener status %v, %v once accepting again", up, err)
+	}
+	if nc := <-inst.newCon; nc.conn != a || nc.ident != "test#0" {
+		t.Errorf("got connection %s", nc.ident)
+	}
+}
+
+// testSilent accepts connections and never answers on them.
+func testSilent(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestDialTimeout(t *testing.T) {
+	info := socketInfo{net: "tcp", addr: testSilent(t), tlsconf: &tls.Config{ServerName: "localhost"}, dialTimeout: 100 * time.Millisecond}
+	start := time.Now()
+	if _, err := info.connect(); err == nil {
+		t.Fatal("connected without a handshake")
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("gave up on the handshake after %s", took)
+	}
+
+	for _, d := range []string{"0s", "-1s", "soon"} {
+		p := &Profile{Name: "test", Listen: ":0", Proxy: "127.0.0.1:1", DialTimeout: d}
+		if err := p.Resolve(); err == nil {
+			t.Errorf("resolved DialTimeout %q", d)
+		}
+	}
+	p := &Profile{Name: "test", Listen: ":0", Proxy: "127.0.0.1:1"}
+	if err := p.Resolve(); err != nil || p.dialTimeout != defaultDialTimeout {
+		t.Errorf("default dial timeout %s, %v", p.dialTimeout, err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: testEcho(t), IdleTimeout: "300ms"})
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// activity keeps it open past the timeout
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if !echoes(c) {
+			t.Fatalf("closed while active, after %d echoes", i)
+		}
+	}
+	if !closed(c) {
+		t.Error("idle connection kept open")
+	}
+}
+
+func TestMaxConnectionAge(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: testEcho(t), MaxConnectionAge: "200ms"})
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	for echoes(c) {
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("active connection kept past its maximum age")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if took := time.Since(start); took < 150*time.Millisecond {
+		t.Errorf("closed after %s", took)
+	}
+
+	for _, p := range []*Profile{{IdleTimeout: "0s"}, {MaxConnectionAge: "forever"}} {
+		p.Name, p.Listen, p.Proxy = "test", ":0", "127.0.0.1:1"
+		if err := p.Resolve(); err == nil {
+			t.Errorf("resolved %q %q", p.IdleTimeout, p.MaxConnectionAge)
+		}
+	}
+}
+
+// adapted resolves a copy of inst's profile changed by change and adapts inst
+// to it.
+func adapted(t *testing.T, inst *Instance, change func(*Profile)) {
+	t.Helper()
+	p := inst.Profile().Copy()
+	change(p)
+	if err := p.Resolve(); err != nil {
+		t.Fatal(err)
+	}
+	if err := inst.AdaptTo(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: testEcho(t), DrainTimeout: "300ms"})
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c) {
+		t.Fatal("connection wasn't proxied")
+	}
+
+	adapted(t, inst, func(p *Profile) { p.Proxy = testEcho(t) })
+	if !echoes(c) {
+		t.Error("connection closed as soon as the destination changed")
+	}
+	if !closed(c) {
+		t.Error("connection still open after draining")
+	}
+}
+
+func TestNoDrainTimeout(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: testEcho(t)})
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echoes(c)
+
+	adapted(t, inst, func(p *Profile) { p.Proxy = testEcho(t) })
+	time.Sleep(100 * time.Millisecond)
+	if !echoes(c) {
+		t.Error("connection closed without a drain timeout")
+	}
+}
+
+func TestSameSocket(t *testing.T) {
+	info := &socketInfo{net: "tcp", addr: "127.0.0.1:8443", tlsconf: &tls.Config{}}
+	for _, c := range []struct {
+		name string
+		o    *socketInfo
+		want bool
+	}{
+		{"other TLS settings", &socketInfo{net: "tcp", addr: "127.0.0.1:8443", tlsconf: &tls.Config{MinVersion: tls.VersionTLS13}}, true},
+		{"other address", &socketInfo{net: "tcp", addr: "127.0.0.1:9443"}, false},
+		{"other network", &socketInfo{net: "tcp4", addr: "127.0.0.1:8443"}, false},
+		{"PROXY protocol", &socketInfo{net: "tcp", addr: "127.0.0.1:8443", acceptProxy: true}, false},
+		{"STARTTLS", &socketInfo{net: "tcp", addr: "127.0.0.1:8443", startTLS: StartTLSSMTP}, false},
+		{"nothing", nil, false},
+	} {
+		if got := info.sameSocket(c.o); got != c.want {
+			t.Errorf("%s: got %v", c.name, got)
+		}
+	}
+}
+
+func TestListenerSwap(t *testing.T) {
+	ca := newTestCA(t)
+	p := &Profile{Proxy: testEcho(t)}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+	addr := inst.ListenAddr()
+	c, err := tls.Dial("tcp", addr, ca.clientConfig(t, "client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c) {
+		t.Fatal("connection wasn't proxied")
+	}
+
+	// a new certificate is served on the listener that is open
+	adapted(t, inst, func(p *Profile) { p.ListenCertRaw, p.ListenPrivateRaw = ca.issue(t, "renewed") })
+	waitFor(t, "the new certificate", func() bool { return servedCN(t, addr, ca.clientConfig(t, "client")) == "renewed" })
+	if got := inst.ListenAddr(); got != addr {
+		t.Errorf("listening on %s after a certificate change, was %s", got, addr)
+	}
+	if !echoes(c) {
+		t.Error("connection closed by the certificate change")
+	}
+
+	// a new address is listened on and the old one closed
+	moved := closedAddr(t)
+	adapted(t, inst, func(p *Profile) { p.Listen = moved })
+	waitFor(t, "the new address", func() bool { return inst.ListenAddr() == moved })
+	if servedCN(t, moved, ca.clientConfig(t, "client")) != "renewed" {
+		t.Error("the new address doesn't serve the certificate")
+	}
+	if old, err := net.Dial("tcp", addr); err == nil {
+		old.Close()
+		t.Error("the old address is still listened on")
+	}
+	if !echoes(c) {
+		t.Error("connection closed by the address change")
+	}
+
+	// the wildcard can't be bound while the loopback one is, it is closed first
+	_, port, _ := net.SplitHostPort(moved)
+	adapted(t, inst, func(p *Profile) { p.Listen = "0.0.0.0:" + port })
+	waitFor(t, "the wildcard address", func() bool {
+		host, _, _ := net.SplitHostPort(inst.ListenAddr())
+		return net.ParseIP(host).IsUnspecified()
+	})
+	if servedCN(t, moved, ca.clientConfig(t, "client")) != "renewed" {
+		t.Error("the wildcard address doesn't serve the certificate")
+	}
+
+	// an address in use fails, with nothing listening
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	adapted(t, inst, func(p *Profile) { p.Listen = taken.Addr().String() })
+	waitFor(t, "the bind to fail", func() bool {
+		ok, err := inst.ListenStatus()
+		return !ok && err != nil
+	})
+}
+
+func TestBindRetry(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	addr := taken.Addr().String()
+	p := &Profile{Name: "bindretry", Listen: addr, Proxy: testEcho(t)}
+	if err := p.Resolve(); err != nil {
+		t.Fatal(err)
+	}
+	inst, err := NewInstance(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inst.Stop()
+	up := listenerUp.WithLabelValues(inst.ident)
+	waitFor(t, "the bind to fail", func() bool {
+		ok, err := inst.ListenStatus()
+		return !ok && err != nil
+	})
+	if testutil.ToFloat64(up) != 0 {
+		t.Error("listener up while the address is in use")
+	}
+
+	// it is bound once the address is free
+	taken.Close()
+	waitFor(t, "the bind to be retried", func() bool { return inst.ListenAddr() == addr })
+	if testutil.ToFloat64(up) != 1 {
+		t.Error("listener not up once bound")
+	}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c) {
+		t.Error("connection wasn't proxied after retrying")
+	}
+
+	// a listener being retried is given up for the next one
+	if taken, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	busy := taken.Addr().String()
+	adapted(t, inst, func(p *Profile) { p.Listen = busy })
+	waitFor(t, "the bind to fail", func() bool {
+		ok, _ := inst.ListenStatus()
+		return !ok
+	})
+	moved := closedAddr(t)
+	adapted(t, inst, func(p *Profile) { p.Listen = moved })
+	waitFor(t, "the next address", func() bool { return inst.ListenAddr() == moved })
+	taken.Close()
+	time.Sleep(bindRetryMin + 500*time.Millisecond)
+	if got := inst.ListenAddr(); got != moved {
+		t.Errorf("listening on %s, the retried address took over", got)
+	}
+	if c, err := net.Dial("tcp", busy); err == nil {
+		c.Close()
+		t.Error("the address given up was bound")
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/coreos/go-systemd/v22/journal"
+)
+
+// journalSender writes records to the systemd journal with their priority.
+func journalSender() (func(slog.Level, string) error, error) {
+	if !journal.Enabled() {
+		return nil, errors.New("the systemd journal isn't available")
+	}
+	vars := map[string]string{"SYSLOG_IDENTIFIER": "mtlsproxy"}
+	return func(level slog.Level, msg string) error {
+		return journal.Send(msg, journal.Priority(severity(level)), vars)
+	}, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// keyLog receives the TLS secrets of every listen and send session in the NSS
+// key log format when set, so captures can be decrypted with Wireshark.
+var keyLog io.Writer
+
+func openKeyLog(c *Configurations) error {
+	if len(c.KeyLogPath) < 1 {
+		return nil
+	}
+	if !c.InsecureDebugging {
+		if c.keyLogAmbient {
+			// often left set in a shell for other programs, not a reason to
+			// refuse to start
+			slog.Warn("ignoring SSLKEYLOGFILE, writing a TLS key log requires -insecuredebugging", "path", c.KeyLogPath)
+			return nil
+		}
+		return errors.New("writing a TLS key log requires -insecuredebugging")
+	}
+
+	f, err := os.OpenFile(c.KeyLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	slog.Warn("writing TLS secrets, every session can be decrypted", "path", c.KeyLogPath)
+	keyLog = f
+	return nil
+}
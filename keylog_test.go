@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenKeyLog(t *testing.T) {
+	defer func() {
+		if f, ok := keyLog.(*os.File); ok {
+			f.Close()
+		}
+		keyLog = nil
+	}()
+	path := filepath.Join(t.TempDir(), "keys.log")
+
+	if err := openKeyLog(&Configurations{KeyLogPath: path}); err == nil {
+		t.Error("opened a key log set for the proxy without insecure debugging")
+	}
+
+	if err := openKeyLog(&Configurations{KeyLogPath: path, keyLogAmbient: true}); err != nil {
+		t.Errorf("SSLKEYLOGFILE stopped startup: %v", err)
+	}
+	if keyLog != nil {
+		t.Error("SSLKEYLOGFILE wasn't ignored")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("ignored key log was created")
+	}
+
+	if err := openKeyLog(&Configurations{KeyLogPath: path, keyLogAmbient: true, InsecureDebugging: true}); err != nil {
+		t.Fatal(err)
+	}
+	if keyLog == nil {
+		t.Error("SSLKEYLOGFILE wasn't used with insecure debugging")
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("key log: %v, %v", fi, err)
+	}
+}
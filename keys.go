@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// decryptPrivateKey returns raw with an encrypted private key swapped for the
+// decrypted key, so the plaintext key only ever lives in memory. Unencrypted
+// keys are returned untouched.
+func decryptPrivateKey(raw, passphrase string) (string, error) {
+	var out strings.Builder
+	var decrypted bool
+	rest := []byte(raw)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		//lint:ignore SA1019 legacy PEM encryption is still handed out by some PKIs
+		legacy := x509.IsEncryptedPEMBlock(block)
+		if block.Type != "ENCRYPTED PRIVATE KEY" && !legacy {
+			pem.Encode(&out, block)
+			continue
+		}
+		if len(passphrase) < 1 {
+			return "", errors.New("the private key is encrypted but no passphrase was given")
+		}
+
+		if legacy {
+			der, err := x509.DecryptPEMBlock(block, []byte(passphrase))
+			if err != nil {
+				return "", err
+			}
+			pem.Encode(&out, &pem.Block{Type: block.Type, Bytes: der})
+		} else {
+			key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(passphrase))
+			if err != nil {
+				return "", err
+			}
+			der, err := x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				return "", err
+			}
+			pem.Encode(&out, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		}
+		decrypted = true
+	}
+
+	if !decrypted {
+		return raw, nil
+	}
+	return out.String(), nil
+}
+
+// readP12 reads a PKCS#12 bundle and returns the certificate chain and private
+// key in PEM format.
+func readP12(path, passphrase string) (certRaw, privateRaw string, err error) {
+	b, err := readFile(path)
+	if err != nil {
+		return "", "", fmt.Errorf("reading file %q: %w", path, err)
+	}
+	if certRaw, privateRaw, err = decodeP12(b, passphrase); err != nil {
+		return "", "", fmt.Errorf("decoding %q: %w", path, err)
+	}
+	return
+}
+
+// decodeP12 returns the certificate chain and private key of a PKCS#12 bundle
+// in PEM format.
+func decodeP12(b []byte, passphrase string) (certRaw, privateRaw string, err error) {
+	key, cert, chain, err := pkcs12.DecodeChain(b, passphrase)
+	if err != nil {
+		return "", "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+
+	var certs strings.Builder
+	pem.Encode(&certs, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	for _, c := range chain {
+		pem.Encode(&certs, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+	}
+	return certs.String(), string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// encryptKey encrypts the PEM private key with the passphrase, legacy uses
+// the old PEM header encryption instead of PKCS#8.
+func encryptKey(t *testing.T, raw, passphrase string, legacy bool) string {
+	t.Helper()
+	block, _ := pem.Decode([]byte(raw))
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacy {
+		der, err := x509.MarshalECPrivateKey(key.(*ecdsa.PrivateKey))
+		if err != nil {
+			t.Fatal(err)
+		}
+		//lint:ignore SA1019 the legacy format is what is tested
+		eb, err := x509.EncryptPEMBlock(rand.Reader, "EC PRIVATE KEY", der, []byte(passphrase), x509.PEMCipherAES256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(eb))
+	}
+	der, err := pkcs8.MarshalPrivateKey(key, []byte(passphrase), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}))
+}
+
+func TestDecryptPrivateKey(t *testing.T) {
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, "server")
+	for _, legacy := range []bool{false, true} {
+		enc := encryptKey(t, key, "secret", legacy)
+		dec, err := decryptPrivateKey(enc, "secret")
+		if err != nil {
+			t.Fatalf("legacy %v: %v", legacy, err)
+		}
+		if _, err := tls.X509KeyPair([]byte(cert), []byte(dec)); err != nil {
+			t.Errorf("legacy %v: decrypted key doesn't match: %v", legacy, err)
+		}
+		if _, err := decryptPrivateKey(enc, "wrong"); err == nil {
+			t.Errorf("legacy %v: decrypted with the wrong passphrase", legacy)
+		}
+		if _, err := decryptPrivateKey(enc, ""); err == nil {
+			t.Errorf("legacy %v: decrypted without a passphrase", legacy)
+		}
+	}
+	if got, err := decryptPrivateKey(key, "secret"); err != nil || got != key {
+		t.Errorf("unencrypted key changed: %v", err)
+	}
+}
+
+func TestDecryptKeysPassphraseFile(t *testing.T) {
+	ca := newTestCA(t)
+	cert, key := ca.issue(t, "server")
+	path := filepath.Join(t.TempDir(), "passphrase")
+	if err := os.WriteFile(path, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := &Profile{ListenCertRaw: cert, ListenPrivateRaw: encryptKey(t, key, "secret", false), ListenPrivatePassphrasePath: path}
+	if err := p.decryptKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tls.X509KeyPair([]byte(cert), []byte(p.ListenPrivateRaw)); err != nil {
+		t.Error(err)
+	}
+}
+
+// writeP12 writes a PKCS#12 bundle of the certificate and key issued by ca
+// for cn, with the authority in the chain.
+func writeP12(t *testing.T, ca *testCA, cn, passphrase string) string {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, cn)
+	pair, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := pkcs12.Modern.Encode(pair.PrivateKey, pair.Leaf, []*x509.Certificate{ca.cert}, passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), cn+".p12")
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadP12(t *testing.T) {
+	ca := newTestCA(t)
+	path := writeP12(t, ca, "server", "secret")
+	certRaw, privateRaw, err := readP12(path, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.X509KeyPair([]byte(certRaw), []byte(privateRaw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pair.Certificate) != 2 || pair.Leaf.Subject.CommonName != "server" {
+		t.Errorf("got %d certificates for %s, want the leaf and the authority", len(pair.Certificate), pair.Leaf.Subject)
+	}
+	if _, _, err := readP12(path, "wrong"); err == nil {
+		t.Error("read with the wrong passphrase")
+	}
+}
+
+func TestListenP12(t *testing.T) {
+	ca := newTestCA(t)
+	p := &Profile{Proxy: testEcho(t), ListenP12Path: writeP12(t, ca, "proxy", "secret"), ListenP12Passphrase: "secret", ListenAuthorityRaw: ca.pem}
+	inst := testInstance(t, p)
+	if _, err := tlsEchoes(inst.ListenAddr(), ca.clientConfig(t, "client")); err != nil {
+		t.Error(err)
+	}
+
+	p = &Profile{Name: "test", Listen: ":0", Proxy: "127.0.0.1:1", ListenP12Path: p.ListenP12Path, ListenCertRaw: "cert"}
+	if err := p.Resolve(); err == nil {
+		t.Error("resolved a PKCS#12 bundle with a listen certificate")
+	}
+}
+
+func TestP12FromEnvironment(t *testing.T) {
+	t.Setenv(EnvProfilePrefix+"WEB"+EnvListenP12Suffix, "/etc/web.p12")
+	t.Setenv(EnvProfilePrefix+"WEB"+EnvListenP12PassphraseSuffix, "listen secret")
+	t.Setenv(EnvProfilePrefix+"WEB"+EnvSendP12PassphraseSuffix, "send secret")
+	p := envProfile(t, "WEB")
+	if p.ListenP12Passphrase != "listen secret" || p.SendP12Passphrase != "send secret" || len(p.ListenPrivatePassphrase) > 0 || len(p.SendPrivatePassphrase) > 0 {
+		t.Errorf("got %q and %q, key passphrases %q and %q", p.ListenP12Passphrase, p.SendP12Passphrase, p.ListenPrivatePassphrase, p.SendPrivatePassphrase)
+	}
+}
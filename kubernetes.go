@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// kubeServiceAccount is where Kubernetes mounts the token, the authority of
+	// the API server and the namespace of the pod.
+	kubeServiceAccount = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// kubeTimeout bounds requests to the API server other than watches.
+	kubeTimeout = 30 * time.Second
+	// kubeWatchTimeout is how long the API server keeps a watch open, it is
+	// started again after.
+	kubeWatchTimeout = 5 * time.Minute
+	// kubeRetry is how long a failed watch waits before starting again.
+	kubeRetry = 5 * time.Second
+)
+
+// errKubeGone is returned by a watch when the API server no longer has the
+// resource version it started from, the object is listed again.
+var errKubeGone = errors.New("resource version too old")
+
+// kubeConfig reads profiles and certificates from ConfigMaps and Secrets
+// through the Kubernetes API and watches them, without mounting them.
+type kubeConfig struct {
+	client    *http.Client
+	host      string
+	namespace string
+	objects   []*kubeObject
+}
+
+// kubeObject is a watched ConfigMap or Secret. Its keys ending in .toml, .yaml,
+// .yml or .json are config files, the others variables named kind/name/key.
+type kubeObject struct {
+	kind     string // configmap or secret
+	name     string
+	resource string
+	mu       sync.Mutex // guards what follows
+	version  string
+	data     map[string][]byte // nil when the object doesn't exist
+}
+
+type kubeResource struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Data       map[string]string `json:"data"`
+	BinaryData map[string][]byte `json:"binaryData"`
+}
+
+func newKubeConfig(c *Configurations) (*kubeConfig, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if len(host) < 1 || len(port) < 1 {
+		return nil, errors.New("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT aren't set, not running in a cluster")
+	}
+	ca, err := os.ReadFile(filepath.Join(kubeServiceAccount, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("reading API server authority: %w", err)
+	}
+	capool := x509.NewCertPool()
+	if ok := capool.AppendCertsFromPEM(ca); !ok {
+		return nil, errors.New("no certs found for the API server authority")
+	}
+
+	namespace := c.KubernetesNamespace
+	if len(namespace) < 1 {
+		b, err := os.ReadFile(filepath.Join(kubeServiceAccount, "namespace"))
+		if err != nil {
+			return nil, fmt.Errorf("reading namespace: %w", err)
+		}
+		namespace = strings.TrimSpace(string(b))
+	}
+
+	kc := &kubeConfig{
+		client: &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: capool}},
+		},
+		host:      net.JoinHostPort(host, port),
+		namespace: namespace,
+	}
+	for _, s := range c.KubernetesObjects {
+		kind, name, _ := strings.Cut(s, "/")
+		o := &kubeObject{kind: strings.ToLower(kind), name: name}
+		switch o.kind {
+		case "configmap":
+			o.resource = "configmaps"
+		case "secret":
+			o.resource = "secrets"
+		default:
+			return nil, fmt.Errorf("%q isn't configmap/NAME or secret/NAME", s)
+		}
+		if len(name) < 1 {
+			return nil, fmt.Errorf("%q has no name", s)
+		}
+		kc.objects = append(kc.objects, o)
+	}
+	return kc, nil
+}
+
+// get requests the resource of the object with only the object selected, so
+// RBAC can limit list and watch to the names in resourceNames.
+func (kc *kubeConfig) get(ctx context.Context, o *kubeObject, query url.Values) (*http.Response, error) {
+	// bound service account tokens are rotated, read it every time
+	token, err := os.ReadFile(filepath.Join(kubeServiceAccount, "token"))
+	if err != nil {
+		return nil, fmt.Errorf("reading service account token: %w", err)
+	}
+	query.Set("fieldSelector", "metadata.name="+o.name)
+	u := url.URL{
+		Scheme:   "https",
+		Host:     kc.host,
+		Path:     "/api/v1/namespaces/" + kc.namespace + "/" + o.resource,
+		RawQuery: query.Encode(),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := kc.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s/%s: unexpected status %s: %s", o.kind, kc.namespace, o.name, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// load lists every object, for starting.
+func (kc *kubeConfig) load() error {
+	for _, o := range kc.objects {
+		if _, err := kc.list(o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list reads the object, and reports if it changed.
+func (kc *kubeConfig) list(o *kubeObject) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), kubeTimeout)
+	defer cancel()
+	resp, err := kc.get(ctx, o, url.Values{})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []kubeResource `json:"items"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return false, fmt.Errorf("%s %s/%s: %w", o.kind, kc.namespace, o.name, err)
+	}
+	var data map[string][]byte
+	if len(list.Items) > 0 {
+		if data, err = o.decode(list.Items[0]); err != nil {
+			return false, err
+		}
+	}
+	return o.set(list.Metadata.ResourceVersion, data), nil
+}
+
+// decode is the data of the object, Secrets are base64 encoded.
+func (o *kubeObject) decode(r kubeResource) (map[string][]byte, error) {
+	data := make(map[string][]byte, len(r.Data)+len(r.BinaryData))
+	for k, v := range r.BinaryData {
+		data[k] = v
+	}
+	for k, v := range r.Data {
+		if o.kind != "secret" {
+			data[k] = []byte(v)
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: key %s: %w", o.kind, o.name, k, err)
+		}
+		data[k] = b
+	}
+	return data, nil
+}
+
+// set stores the version and the data of the object, nil when it doesn't
+// exist, and reports if the data changed.
+func (o *kubeObject) set(version string, data map[string][]byte) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.version = version
+	changed := (data == nil) != (o.data == nil) || len(data) != len(o.data)
+	for k, v := range data {
+		if old, ok := o.data[k]; !ok || string(old) != string(v) {
+			changed = true
+		}
+	}
+	o.data = data
+	return changed
+}
+
+// watch sends on the returned channel when a watched object is created,
+// changed or deleted. Watches that end are started again, after listing the
+// object again when the API server lost track of it.
+func (kc *kubeConfig) watch() <-chan struct{} {
+	changes := make(chan struct{})
+	for _, o := range kc.objects {
+		go func(o *kubeObject) {
+			for {
+				err := kc.watchObject(o, changes)
+				if err == nil {
+					continue
+				}
+				if !errors.Is(err, errKubeGone) {
+					slog.Error("error watching kubernetes object", "object", o.kind+"/"+o.name, "err", err)
+					time.Sleep(kubeRetry)
+				}
+				changed, err := kc.list(o)
+				if err != nil {
+					slog.Error("error reading kubernetes object", "object", o.kind+"/"+o.name, "err", err)
+					continue
+				}
+				if changed {
+					changes <- struct{}{}
+				}
+			}
+		}(o)
+	}
+	return changes
+}
+
+// watchObject watches the object from the last version seen until the API
+// server ends the watch.
+func (kc *kubeConfig) watchObject(o *kubeObject, changes chan<- struct{}) error {
+	o.mu.Lock()
+	version := o.version
+	o.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), kubeWatchTimeout+kubeTimeout)
+	defer cancel()
+	resp, err := kc.get(ctx, o, url.Values{
+		"watch":               {"1"},
+		"resourceVersion":     {version},
+		"allowWatchBookmarks": {"true"},
+		"timeoutSeconds":      {fmt.Sprint(int(kubeWatchTimeout.Seconds()))},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e struct {
+			Type   string          `json:"type"`
+			Object json.RawMessage `json:"object"`
+		}
+		if err := dec.Decode(&e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if e.Type == "ERROR" {
+			var status struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			if err := json.Unmarshal(e.Object, &status); err != nil {
+				return err
+			}
+			if status.Code == http.StatusGone {
+				return errKubeGone
+			}
+			return errors.New(status.Message)
+		}
+
+		var r kubeResource
+		if err := json.Unmarshal(e.Object, &r); err != nil {
+			return err
+		}
+		switch e.Type {
+		case "BOOKMARK":
+			o.mu.Lock()
+			o.version = r.Metadata.ResourceVersion
+			o.mu.Unlock()
+		case "ADDED", "MODIFIED":
+			data, err := o.decode(r)
+			if err != nil {
+				return err
+			}
+			if o.set(r.Metadata.ResourceVersion, data) {
+				changes <- struct{}{}
+			}
+		case "DELETED":
+			if o.set(r.Metadata.ResourceVersion, nil) {
+				changes <- struct{}{}
+			}
+		}
+	}
+}
+
+// layers are the config files and variables of the objects, objects given
+// later take precedence like config files.
+func (kc *kubeConfig) layers() (layers []configLayer, err error) {
+	for i := len(kc.objects) - 1; i >= 0; i-- {
+		o := kc.objects[i]
+		o.mu.Lock()
+		data := o.data
+		o.mu.Unlock()
+
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		object := o.kind + "/" + o.name
+		vars := make(map[string]string)
+		for _, k := range keys {
+			switch strings.ToLower(path.Ext(k)) {
+			case ".toml", ".yaml", ".yml", ".json":
+				var l configLayer
+				if l, err = parseConfig(data[k], configFormat(k), object+"/"+k); err != nil {
+					err = fmt.Errorf("reading configuration %q: %w", object+"/"+k, err)
+					return
+				}
+				layers = append(layers, l)
+			default:
+				vars[object+"/"+k] = string(data[k])
+			}
+		}
+		if len(vars) > 0 {
+			layers = append(layers, configLayer{source: object, vars: vars})
+		}
+	}
+	return
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestKubeObjectDecode(t *testing.T) {
+	r := kubeResource{
+		Data:       map[string]string{"proxy.toml": base64.StdEncoding.EncodeToString([]byte("[web]\n"))},
+		BinaryData: map[string][]byte{"ca.der": {0x30, 0x82}},
+	}
+	secret := &kubeObject{kind: "secret", name: "certs"}
+	data, err := secret.decode(r)
+	if err != nil || string(data["proxy.toml"]) != "[web]\n" || len(data["ca.der"]) != 2 {
+		t.Errorf("got %q, %v", data, err)
+	}
+	// only Secrets are base64 encoded
+	cm := &kubeObject{kind: "configmap", name: "proxy"}
+	if data, err = cm.decode(kubeResource{Data: map[string]string{"proxy.toml": "[web]\n"}}); err != nil || string(data["proxy.toml"]) != "[web]\n" {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if _, err := secret.decode(kubeResource{Data: map[string]string{"tls.key": "not base64!"}}); err == nil {
+		t.Error("decoded a Secret that isn't base64")
+	}
+}
+
+func TestKubeObjectSet(t *testing.T) {
+	o := &kubeObject{kind: "configmap", name: "proxy"}
+	for _, c := range []struct {
+		data    map[string][]byte
+		changed bool
+	}{
+		{map[string][]byte{}, true}, // created empty
+		{map[string][]byte{}, false},
+		{map[string][]byte{"a": []byte("1")}, true},
+		{map[string][]byte{"a": []byte("1")}, false},
+		{map[string][]byte{"a": []byte("2")}, true},
+		{nil, true}, // deleted
+		{nil, false},
+	} {
+		if got := o.set("1", c.data); got != c.changed {
+			t.Errorf("setting %q: got %v", c.data, got)
+		}
+	}
+}
+
+func TestKubeLayers(t *testing.T) {
+	cm := &kubeObject{kind: "configmap", name: "proxy", data: map[string][]byte{
+		"proxy.toml": []byte("[web]\nListen = \"127.0.0.1:8443\"\nProxy = \"10.0.0.1:443\"\nListenCertRaw = \"${secret/certs/tls.crt}\"\n"),
+		"README":     []byte("not a config file"),
+	}}
+	secret := &kubeObject{kind: "secret", name: "certs", data: map[string][]byte{
+		"tls.crt":    []byte("cert with ${literal}"),
+		"extra.yaml": []byte("web:\n  proxy: 10.0.0.2:443\n"),
+	}}
+	c := Configurations{kube: &kubeConfig{objects: []*kubeObject{cm, secret}}}
+	ps, err := c.getProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// objects given later take precedence, the values of Secrets aren't expanded
+	web := profileNamed(ps, "web")
+	if len(ps) != 1 || web == nil {
+		t.Fatalf("got %v", ps)
+	}
+	if web.Proxy != "10.0.0.2:443" || web.Listen != "127.0.0.1:8443" || web.ListenCertRaw != "cert with ${literal}" {
+		t.Errorf("got %+v", web)
+	}
+
+	// a deleted object takes its variables along
+	secret.set("2", nil)
+	if _, err := c.getProfiles(); err == nil || !strings.Contains(err.Error(), "secret/certs/tls.crt") {
+		t.Errorf("got %v once the Secret is deleted", err)
+	}
+	cm.set("2", map[string][]byte{"proxy.toml": []byte("[web")})
+	if _, err := c.getProfiles(); err == nil {
+		t.Error("read a broken config file")
+	}
+}
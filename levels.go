@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// LevelTrace is below debug, for records about every read and write.
+const LevelTrace = slog.Level(-8)
+
+// levels decides which records are logged: the global level, unless the
+// profile of a record has a level of its own.
+var levels logLevels
+
+type logLevels struct {
+	global     slog.LevelVar
+	mu         sync.RWMutex
+	configured map[string]slog.Level // LogLevel of the profiles
+	overrides  map[string]slog.Level // set through the admin server, until restarted
+	lowest     atomic.Int64          // of the profile levels
+}
+
+// parseLevel reads error, warn, info, debug or trace.
+func parseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "error":
+		return slog.LevelError, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "trace":
+		return LevelTrace, nil
+	}
+	return 0, fmt.Errorf("log level %q isn't error, warn, info, debug or trace", s)
+}
+
+func levelName(l slog.Level) string {
+	if l == LevelTrace {
+		return "TRACE"
+	}
+	return l.String()
+}
+
+// configure replaces the levels of the profiles from their config.
+func (ll *logLevels) configure(profiles map[string]slog.Level) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	ll.configured = profiles
+	ll.update()
+}
+
+// configureLevels takes the LogLevel of the profiles, they were validated by
+// Resolve.
+func configureLevels(profiles []*Profile) {
+	m := make(map[string]slog.Level)
+	for _, p := range profiles {
+		if l, err := parseLevel(p.LogLevel); len(p.LogLevel) > 0 && err == nil {
+			m[p.Name] = l
+		}
+	}
+	levels.configure(m)
+}
+
+// override sets the level of a profile until the process restarts, nil
+// removes the override.
+func (ll *logLevels) override(profile string, l *slog.Level) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	if l == nil {
+		delete(ll.overrides, profile)
+	} else {
+		if ll.overrides == nil {
+			ll.overrides = make(map[string]slog.Level)
+		}
+		ll.overrides[profile] = *l
+	}
+	ll.update()
+}
+
+// update finds the lowest profile level, holding mu.
+func (ll *logLevels) update() {
+	lowest := slog.LevelError + 1
+	for _, m := range []map[string]slog.Level{ll.configured, ll.overrides} {
+		for _, l := range m {
+			lowest = min(lowest, l)
+		}
+	}
+	ll.lowest.Store(int64(lowest))
+}
+
+// of is the level records about the profile are logged at.
+func (ll *logLevels) of(profile string) slog.Level {
+	if len(profile) > 0 {
+		ll.mu.RLock()
+		defer ll.mu.RUnlock()
+		if l, ok := ll.overrides[profile]; ok {
+			return l
+		}
+		if l, ok := ll.configured[profile]; ok {
+			return l
+		}
+	}
+	return ll.global.Level()
+}
+
+// debugging reports if debug records about the profile are logged.
+func debugging(profile string) bool {
+	return levels.of(profile) <= slog.LevelDebug
+}
+
+// levelHandler drops records below the level of their profile, which comes
+// from the logger's attributes or the record's.
+type levelHandler struct {
+	slog.Handler
+	profile string
+}
+
+func (h *levelHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= min(levels.global.Level(), slog.Level(levels.lowest.Load()))
+}
+
+func (h *levelHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < levels.of(recordProfile(h.profile, r)) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithAttrs(attrs), profile: attrsProfile(h.profile, attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithGroup(name), profile: h.profile}
+}
+
+// recordProfile is the profile a record is about, from the logger it was
+// made with or its own attributes.
+func recordProfile(profile string, r slog.Record) string {
+	if len(profile) < 1 {
+		r.Attrs(func(a slog.Attr) bool {
+			if a.Key == "profile" {
+				profile = a.Value.String()
+				return false
+			}
+			return true
+		})
+	}
+	return profile
+}
+
+// attrsProfile is the profile of a logger given the attributes.
+func attrsProfile(profile string, attrs []slog.Attr) string {
+	for _, a := range attrs {
+		if a.Key == "profile" {
+			profile = a.Value.String()
+		}
+	}
+	return profile
+}
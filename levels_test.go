@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// resetLevels puts the log levels back as they were once the test is over.
+func resetLevels(t *testing.T) {
+	prev := levels.global.Level()
+	t.Cleanup(func() {
+		levels.global.Set(prev)
+		levels.mu.Lock()
+		levels.overrides = nil
+		levels.mu.Unlock()
+		levels.configure(nil)
+	})
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]slog.Level{"error": slog.LevelError, "Warning": slog.LevelWarn, "info": slog.LevelInfo, "DEBUG": slog.LevelDebug, "trace": LevelTrace} {
+		if l, err := parseLevel(s); err != nil || l != want {
+			t.Errorf("%s: got %v, %v", s, l, err)
+		}
+	}
+	if _, err := parseLevel("verbose"); err == nil {
+		t.Error("parsed verbose")
+	}
+	if levelName(LevelTrace) != "TRACE" || levelName(slog.LevelWarn) != "WARN" {
+		t.Error("wrong level names")
+	}
+}
+
+func TestLevelHandler(t *testing.T) {
+	resetLevels(t)
+	levels.global.Set(slog.LevelInfo)
+	configureLevels([]*Profile{{Name: "web", LogLevel: "debug"}, {Name: "api"}})
+	lb := &logBuffer{}
+	logger := slog.New(&levelHandler{Handler: slog.NewTextHandler(lb, &slog.HandlerOptions{Level: LevelTrace})})
+
+	logger.Debug("web debug", "profile", "web")
+	logger.Debug("api debug", "profile", "api")
+	logger.With("profile", "web").Debug("web logger debug")
+	logger.Log(context.Background(), LevelTrace, "web trace", "profile", "web")
+	logger.Info("global info")
+	out := lb.String()
+	for msg, want := range map[string]bool{"web debug": true, "api debug": false, "web logger debug": true, "web trace": false, "global info": true} {
+		if got := strings.Contains(out, `msg="`+msg+`"`); got != want {
+			t.Errorf("%s logged: %v, want %v", msg, got, want)
+		}
+	}
+	if !debugging("web") || debugging("api") {
+		t.Error("wrong profiles debugging")
+	}
+
+	trace := LevelTrace
+	levels.override("api", &trace)
+	if levels.of("api") != LevelTrace || !logger.Enabled(context.Background(), LevelTrace) {
+		t.Error("override not taken")
+	}
+	levels.override("api", nil)
+	if levels.of("api") != slog.LevelInfo || logger.Enabled(context.Background(), LevelTrace) {
+		t.Error("override not removed")
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	resetLevels(t)
+	levels.global.Set(slog.LevelInfo)
+	configureLevels([]*Profile{{Name: "web", LogLevel: "warn"}})
+	s := &Supervisor{}
+	for _, r := range []struct {
+		method, path, body string
+		code               int
+		want               string
+	}{
+		{http.MethodGet, "/loglevel", "", http.StatusOK, `"level":"info"`},
+		{http.MethodPut, "/loglevel", `{"level":"debug"}`, http.StatusOK, `"level":"debug"`},
+		{http.MethodPut, "/loglevel", `{"level":"loud"}`, http.StatusBadRequest, "loud"},
+		{http.MethodPut, "/profiles/web/loglevel", `{"level":"trace"}`, http.StatusOK, `"level":"trace"`},
+		{http.MethodDelete, "/profiles/web/loglevel", "", http.StatusOK, `"level":"warn"`},
+		{http.MethodPost, "/profiles/web/loglevel", "", http.StatusMethodNotAllowed, ""},
+	} {
+		w := adminDo(s, r.method, r.path, r.body)
+		if w.Code != r.code || !strings.Contains(w.Body.String(), r.want) {
+			t.Errorf("%s %s %s: got %d %s", r.method, r.path, r.body, w.Code, w.Body)
+		}
+	}
+	if levels.global.Level() != slog.LevelDebug {
+		t.Errorf("global level is %v", levels.global.Level())
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	LogOutputStderr  = "stderr"
+	LogOutputSyslog  = "syslog" // the local syslog daemon, or syslog://host:port and syslog+tcp://host:port
+	LogOutputJournal = "journal"
+)
+
+// setupLogging replaces the default logger with one writing records in the
+// format to the output. Records below the level are dropped, it defaults to
+// info or debug with -debug, and so are records over their rate limit.
+func setupLogging(c *Configurations) error {
+	format, output := c.LogFormat, c.LogOutput
+	switch {
+	case len(c.LogLevel) > 0:
+		l, err := parseLevel(c.LogLevel)
+		if err != nil {
+			return err
+		}
+		levels.global.Set(l)
+	case Debug:
+		levels.global.Set(slog.LevelDebug)
+	}
+	// levelHandler does the filtering
+	opts := &slog.HandlerOptions{Level: LevelTrace, ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+		if l, ok := a.Value.Any().(slog.Level); ok && len(groups) < 1 && a.Key == slog.LevelKey {
+			a.Value = slog.StringValue(levelName(l))
+		}
+		return a
+	}}
+
+	var send func(slog.Level, string) error
+	switch {
+	case len(output) < 1 || output == LogOutputStderr:
+	case output == LogOutputJournal:
+		var err error
+		if send, err = journalSender(); err != nil {
+			return err
+		}
+	case output == LogOutputSyslog || strings.HasPrefix(output, LogOutputSyslog+":") || strings.HasPrefix(output, LogOutputSyslog+"+"):
+		s, err := newSyslogSender(output)
+		if err != nil {
+			return err
+		}
+		send = s.send
+	default:
+		return fmt.Errorf("log output %q isn't %q, %q or %q", output, LogOutputStderr, LogOutputSyslog, LogOutputJournal)
+	}
+
+	var out *sink
+	var w io.Writer = os.Stderr
+	if send != nil {
+		// the destination keeps its own time
+		named := opts.ReplaceAttr
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) < 1 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return named(groups, a)
+		}
+		out = &sink{send: send}
+		w = &out.buf
+	}
+
+	var h slog.Handler
+	switch format {
+	case "", LogFormatText:
+		h = slog.NewTextHandler(w, opts)
+	case LogFormatJSON:
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("log format %q isn't %q or %q", format, LogFormatText, LogFormatJSON)
+	}
+	if out != nil {
+		h = &sinkHandler{Handler: h, out: out}
+	}
+	if len(c.LogRateLimit) > 0 {
+		ls, err := newLogSampler(c.LogRateLimit, h)
+		if err != nil {
+			return err
+		}
+		h = &sampleHandler{Handler: h, ls: ls}
+	}
+	slog.SetDefault(slog.New(&levelHandler{Handler: h}))
+	return nil
+}
+
+// sink hands formatted records to a destination that keeps records apart and
+// needs their priority, like syslog and the journal.
+type sink struct {
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	send func(slog.Level, string) error
+}
+
+// sinkHandler formats records with the handler it wraps and sends them to the
+// sink, records it can't send go to stderr.
+type sinkHandler struct {
+	slog.Handler
+	out *sink
+}
+
+func (h *sinkHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	h.out.buf.Reset()
+	if err := h.Handler.Handle(ctx, r); err != nil {
+		return err
+	}
+	if err := h.out.send(r.Level, strings.TrimSuffix(h.out.buf.String(), "\n")); err != nil {
+		h.out.buf.WriteTo(os.Stderr)
+		return err
+	}
+	return nil
+}
+
+func (h *sinkHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &sinkHandler{Handler: h.Handler.WithAttrs(attrs), out: h.out}
+}
+
+func (h *sinkHandler) WithGroup(name string) slog.Handler {
+	return &sinkHandler{Handler: h.Handler.WithGroup(name), out: h.out}
+}
+
+// severity maps a level to a syslog severity, which the journal uses too.
+func severity(l slog.Level) int {
+	switch {
+	case l >= slog.LevelError:
+		return 3 // err
+	case l >= slog.LevelWarn:
+		return 4 // warning
+	case l >= slog.LevelInfo:
+		return 6 // info
+	default:
+		return 7 // debug
+	}
+}
+
+// fatal logs the error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -1,135 +1,876 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
 )
 
+// Supervisor owns the running instances and applies configuration reloads to
+// them. Reloads are serialized through the profileLoop go routine.
+type Supervisor struct {
+	c          *Configurations
+	mu         sync.Mutex // guards insts, stopped, draining, disabled, started and degraded
+	insts      []*Instance
+	degraded   map[string]*degradedProfile // failed to start, retried in the background
+	stopped    map[string]*Profile         // stopped through the admin server, skipped on reload
+	draining   map[string]*Instance        // stopped, until their connections are closed
+	disabled   map[string]*Profile         // not enabled in the configuration
+	started    map[string]bool             // disabled in the configuration but started through the admin server
+	lastReload *reloadStatus
+	reloads    chan reloadRequest
+	certs      *certWatcher
+	expiry     *expiryMonitor
+	heartbeat  chan struct{} // answered by the main loop for the systemd watchdog
+	// stopWatchdog stops pinging the systemd watchdog, the main loop doesn't
+	// answer once shutting down. Nil without a watchdog.
+	stopWatchdog func()
+}
+
+type reloadRequest struct {
+	apply  []*Profile
+	result chan error
+}
+
 func main() {
+	// the commands take the same flags and exit, drain takes a profile first
+	var command, profile string
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check", "print-config", "reload", "status", "drain", "version":
+			command = os.Args[1]
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+	if command == "drain" && len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		profile = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	config, err := getImmutableConfigs()
 	if err != nil {
-		log.Fatalf("Error getting configuring: %s", err.Error())
+		fatal("error getting configuration", "err", err)
+	}
+	if command == "version" || config.ShowVersion {
+		printVersion(os.Stdout)
+		return
+	}
+	switch command {
+	case "reload", "status", "drain":
+		if err := runControl(config, command, profile, os.Stdout); err != nil {
+			fatal("error running "+command, "err", err)
+		}
+		return
+	}
+	if err := config.loadSources(); err != nil {
+		fatal("error getting configuration", "err", err)
+	}
+	if command == "check" && !config.strictSet {
+		config.Strict = true
+	}
+	switch command {
+	case "check":
+		os.Exit(runCheck(config, os.Stdout))
+	case "print-config":
+		if err := printConfig(config, os.Stdout); err != nil {
+			fatal("error reading configuration", "err", err)
+		}
+		return
 	}
+	if err := setupLogging(config); err != nil {
+		fatal("error setting up logging", "err", err)
+	}
+	bi := getBuildInfo()
+	slog.Info("starting mtlsproxy", "version", bi.Version, "revision", bi.Revision, "modified", bi.Modified, "go_version", bi.GoVersion, "platform", bi.Platform, "features", bi.Features)
 
 	err = profileLoop(config)
+	if errors.Is(err, errShutdownTimeout) {
+		fatal("error shutting down", "code", errorCode(err), "err", err)
+	}
 	if err != nil {
-		log.Fatalf("Error with profiles: %s", err.Error())
+		fatal("error with profiles", "err", err)
 	}
 }
 
 func profileLoop(c *Configurations) error {
-	var insts []*Instance
-	profiles, err := c.getProfiles()
+	if err := sockets.loadInherited(); err != nil {
+		return err
+	}
+
+	if err := openKeyLog(c); err != nil {
+		return fmt.Errorf("opening TLS key log: %w", err)
+	}
+
+	if err := openAuditLog(c); err != nil {
+		return fmt.Errorf("opening audit log: %w", err)
+	}
+
+	if err := startFlowExport(c); err != nil {
+		return fmt.Errorf("starting flow export: %w", err)
+	}
+
+	stopTracing, err := startTracing(c)
 	if err != nil {
-		return fmt.Errorf("getting inital profiles: %w", err)
+		return fmt.Errorf("starting tracing: %w", err)
 	}
+	defer stopTracing(context.Background())
 
-	if len(profiles) < 1 {
-		log.Fatalf("Nothing to run")
+	quorum, err := parseQuorum(c.ReadyQuorum)
+	if err != nil {
+		return err
 	}
 
-	insts = make([]*Instance, len(profiles))
-	for i, p := range profiles {
-		if err := p.Resolve(); err != nil {
-			log.Fatalf("Error reading files for profile %q: %s", p.Name, err)
+	s := &Supervisor{c: c, reloads: make(chan reloadRequest), expiry: newExpiryMonitor(c.CertExpiryWarning)}
+	if err := s.start(); err != nil {
+		return err
+	}
+	s.checkExpiry()
+
+	var certChanges chan map[string]bool
+	if c.WatchCerts {
+		cw, err := newCertWatcher()
+		if err != nil {
+			return fmt.Errorf("starting certificate watcher: %w", err)
 		}
+		s.certs = cw
+		certChanges = cw.changes
+		s.watchCerts()
+	}
 
-		inst, err := NewInstance(p)
+	var configChanges chan struct{}
+	if c.WatchConfig {
+		cw, err := newConfigWatcher(c)
 		if err != nil {
-			log.Fatalf("Error inilizing %q: %s", p.Name, err)
+			return fmt.Errorf("starting config watcher: %w", err)
 		}
-		insts[i] = inst
+		configChanges = cw.changes
+	}
+
+	var remoteChanges <-chan struct{}
+	if c.remote != nil {
+		remoteChanges = c.remote.poll(c.ConfigURLInterval)
+	}
+
+	var kubeChanges <-chan struct{}
+	if c.kube != nil {
+		kubeChanges = c.kube.watch()
+	}
+
+	var etcdChanges <-chan struct{}
+	if c.etcd != nil {
+		etcdChanges = c.etcd.watch()
+	}
+
+	if err := startControlServer(c, s); err != nil {
+		return fmt.Errorf("starting control server: %w", err)
+	}
+
+	if err := startAdminServer(c, s); err != nil {
+		return fmt.Errorf("starting admin server: %w", err)
+	}
+
+	closeSocket, err := startControlSocket(c, s)
+	if err != nil {
+		return fmt.Errorf("starting control socket: %w", err)
+	}
+	defer closeSocket()
+
+	if err := startHealthServer(c, s); err != nil {
+		return fmt.Errorf("starting health server: %w", err)
+	}
+
+	if err := startMetricsServer(c); err != nil {
+		return fmt.Errorf("starting metrics server: %w", err)
+	}
+
+	if err := startDebugServer(c, s); err != nil {
+		return fmt.Errorf("starting debug server: %w", err)
 	}
 
-	sig := make(chan os.Signal)
+	if err := startWatchdog(s); err != nil {
+		return fmt.Errorf("starting systemd watchdog: %w", err)
+	}
+
+	// systemd, and the binary this one upgrades, are told the proxy is ready
+	// once the profiles are listening
+	var readyTicker *time.Ticker
+	var readyCheck <-chan time.Time
+	if notifying() || sockets.upgrading() {
+		readyTicker = time.NewTicker(readyPoll)
+		defer readyTicker.Stop()
+		readyCheck = readyTicker.C
+	}
+
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGHUP)
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	dump := make(chan os.Signal, 1)
+	if len(dumpSignals) > 0 {
+		signal.Notify(dump, dumpSignals...)
+	}
+	upgradeSig := make(chan os.Signal, 1)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(upgradeSig, upgradeSignals...)
+	}
+	var up *upgrade
+	var upgraded chan error
+	expiryTicker := time.NewTicker(expiryCheckInterval)
+	retryTicker := time.NewTicker(profileRetryPoll)
+	awsRefresh := time.NewTicker(c.AWSRefresh)
+	azureRefresh := time.NewTicker(c.AzureRefresh)
+	crlCheck := time.NewTicker(crlCheckInterval)
+
+	for {
+		select {
+		case x := <-term:
+			slog.Info("shutting down", "signal", x.String())
+			notifySystemd(daemon.SdNotifyStopping)
+			return s.shutdown(c.ShutdownTimeout)
+		case <-sig: // reload
+			ready := readyCheck == nil
+			if ready {
+				notifyReloading()
+			}
+			_, _, err := s.reload()
+			if err != nil {
+				slog.Error("failed to reload profiles", "code", errorCode(err), "err", err)
+			}
+			if ready {
+				notifyReloaded(err)
+			}
+			if err := reopenAuditLog(); err != nil {
+				slog.Error("error reopening audit log", "err", err)
+			}
+			s.watchCerts()
+			s.checkExpiry()
+		case <-configChanges:
+			slog.Info("configuration changed, reloading")
+			if _, _, err := s.reload(); err != nil {
+				slog.Error("failed to reload profiles", "code", errorCode(err), "err", err)
+			}
+			s.watchCerts()
+			s.checkExpiry()
+		case <-remoteChanges:
+			slog.Info("configuration changed, reloading", "url", c.remote.source)
+			if _, _, err := s.reload(); err != nil {
+				slog.Error("failed to reload profiles", "code", errorCode(err), "err", err)
+			}
+			s.watchCerts()
+			s.checkExpiry()
+		case <-kubeChanges:
+			slog.Info("configuration changed, reloading", "namespace", c.kube.namespace)
+			if _, _, err := s.reload(); err != nil {
+				slog.Error("failed to reload profiles", "code", errorCode(err), "err", err)
+			}
+			s.watchCerts()
+			s.checkExpiry()
+		case <-etcdChanges:
+			slog.Info("configuration changed, reloading", "prefix", c.etcd.prefix)
+			if _, _, err := s.reload(); err != nil {
+				slog.Error("failed to reload profiles", "code", errorCode(err), "err", err)
+			}
+			s.watchCerts()
+			s.checkExpiry()
+		case r := <-s.reloads:
+			r.result <- s.applyAndReload(r.apply)
+			s.watchCerts()
+			s.checkExpiry()
+		case <-vaultRenewals:
+			s.renewVaultCerts()
+			s.checkExpiry()
+		case <-awsRefresh.C:
+			s.refreshAWSSecrets()
+			s.checkExpiry()
+		case <-azureRefresh.C:
+			s.refreshAzureCerts()
+			s.checkExpiry()
+		case <-crlCheck.C:
+			s.refreshCRLs()
+		case changed := <-certChanges:
+			s.refreshCerts(changed)
+			s.checkExpiry()
+		case <-dump:
+			go s.dumpState()
+		case <-expiryTicker.C:
+			s.checkExpiry()
+		case <-retryTicker.C:
+			if s.retryDegraded() {
+				s.watchCerts()
+				s.checkExpiry()
+			}
+		case <-readyCheck:
+			if s.notifyReady(quorum) {
+				readyTicker.Stop()
+				readyCheck = nil
+				sockets.tookOver()
+			}
+		case <-upgradeSig:
+			if up != nil {
+				slog.Warn("an upgrade is already running", "pid", up.proc.Pid)
+				continue
+			}
+			var err error
+			if up, err = s.startUpgrade(); err != nil {
+				slog.Error("failed to upgrade", "err", err)
+				continue
+			}
+			upgraded = up.done
+		case err := <-upgraded:
+			if err != nil {
+				slog.Error("failed to upgrade, carrying on", "err", err)
+				up.resume()
+				up, upgraded = nil, nil
+				continue
+			}
+			slog.Info("upgraded, draining connections", "pid", up.proc.Pid)
+			notifySystemd(fmt.Sprintf("MAINPID=%d", up.proc.Pid))
+			sockets.release()
+			return s.shutdown(c.ShutdownTimeout)
+		case <-s.heartbeat:
+		}
+	}
+}
+
+// errShutdownTimeout is returned when connections were still open at the end
+// of the shutdown timeout.
+var errShutdownTimeout = withCode(codeDrainTimeout, errors.New("connections still open"))
+
+// shutdown stops accepting connections, waits up to timeout for the open ones
+// to finish and stops the instances.
+func (s *Supervisor) shutdown(timeout time.Duration) error {
+	if s.stopWatchdog != nil {
+		s.stopWatchdog()
+		s.stopWatchdog = nil
+	}
+	insts := s.Instances()
+	for _, inst := range insts {
+		inst.StopListening()
+	}
+
+	open := waitForConnections(insts, timeout)
+	for _, inst := range insts {
+		if open > 0 {
+			inst.CloseConnections("shutdown timeout")
+		}
+		inst.Stop()
+	}
+	if open > 0 {
+		return fmt.Errorf("%w: closing %d after %s", errShutdownTimeout, open, timeout)
+	}
+	return nil
+}
 
+// waitForConnections waits up to timeout for the connections of insts to
+// finish, what is still open is returned.
+func waitForConnections(insts []*Instance, timeout time.Duration) int64 {
+	deadline := time.Now().Add(timeout)
 	for {
-		<-sig // reload
+		var open int64
+		for _, inst := range insts {
+			open += inst.Active()
+		}
+		if open < 1 || time.Now().After(deadline) {
+			return open
+		}
+		slog.Debug("waiting for connections to finish", "open", open)
+		time.Sleep(250 * time.Millisecond)
+	}
+}
 
-		np, err := c.getProfiles()
-		if err != nil {
-			log.Println("Failed to reload profiles: " + err.Error())
+// StopProfile stops the named profile until StartProfile, reloads leave it
+// alone. It stops listening right away, open connections get the shutdown
+// timeout to finish.
+func (s *Supervisor) StopProfile(name string) error {
+	s.mu.Lock()
+	var inst *Instance
+	for i := range s.insts {
+		if s.insts[i].p.Name == name {
+			inst = s.insts[i]
+			s.insts = append(s.insts[:i], s.insts[i+1:]...)
+			break
+		}
+	}
+	if inst == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("no running profile %q", name)
+	}
+	if s.stopped == nil {
+		s.stopped = make(map[string]*Profile)
+	}
+	s.stopped[name] = inst.Profile()
+	delete(s.started, name)
+	if s.draining == nil {
+		s.draining = make(map[string]*Instance)
+	}
+	s.draining[name] = inst
+	s.mu.Unlock()
+
+	inst.StopListening()
+	go func() {
+		if open := waitForConnections([]*Instance{inst}, s.c.ShutdownTimeout); open > 0 {
+			slog.Warn("closing connections of stopped profile", "profile", name, "open", open)
+			inst.CloseConnections("shutdown timeout")
+		}
+		inst.Stop()
+		s.mu.Lock()
+		if s.draining[name] == inst {
+			delete(s.draining, name)
+		}
+		s.mu.Unlock()
+		slog.Info("stopped", "profile", name)
+	}()
+	return nil
+}
+
+// Draining is the instance of a stopped profile while its connections are
+// given the shutdown timeout to finish, nil after.
+func (s *Supervisor) Draining(name string) *Instance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining[name]
+}
+
+// StartProfile runs a profile stopped with StopProfile again, or one disabled
+// in the configuration until it is enabled there.
+func (s *Supervisor) StartProfile(name string) error {
+	s.mu.Lock()
+	_, stopped := s.stopped[name]
+	_, disabled := s.disabled[name]
+	if !stopped && !disabled {
+		s.mu.Unlock()
+		return fmt.Errorf("profile %q isn't stopped or disabled", name)
+	}
+	delete(s.stopped, name)
+	if s.started == nil {
+		s.started = make(map[string]bool)
+	}
+	s.started[name] = true
+	s.mu.Unlock()
+	return s.Reload()
+}
+
+// Disabled returns the profiles disabled in the configuration that aren't
+// running.
+func (s *Supervisor) Disabled() []*Profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps := make([]*Profile, 0, len(s.disabled))
+	for _, p := range s.disabled {
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+// setAsideDisabled takes the profiles disabled in the configuration out of
+// ps, unless they were started through the admin server. Stopped profiles are
+// left to the caller. s.mu must be held.
+func (s *Supervisor) setAsideDisabled(ps []*Profile) []*Profile {
+	s.disabled = make(map[string]*Profile)
+	started := make(map[string]bool)
+	enabled := make([]*Profile, 0, len(ps))
+	for _, p := range ps {
+		if !p.enabled() && s.started[p.Name] {
+			started[p.Name] = true
+		}
+		if _, stopped := s.stopped[p.Name]; !stopped && !p.enabled() && !s.started[p.Name] {
+			s.disabled[p.Name] = p
 			continue
 		}
+		enabled = append(enabled, p)
+	}
+	s.started = started // forgotten once the configuration enables the profile
+	return enabled
+}
 
-		var abort bool
-		removeInst := make([]*Instance, len(insts))
-		modifyInst := make([]struct {
-			P *Profile
-			I *Instance
-		}, 0, len(insts))
-		addInst := make([]*Profile, 0, len(insts))
-		copy(removeInst, insts)
+// Stopped returns the profiles stopped with StopProfile.
+func (s *Supervisor) Stopped() []*Profile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps := make([]*Profile, 0, len(s.stopped))
+	for _, p := range s.stopped {
+		ps = append(ps, p)
+	}
+	return ps
+}
 
-		for _, p := range np {
-			if err := p.Resolve(); err != nil {
-				log.Println(fmt.Sprintf("Error reading files for profile %q: %s", p.Name, err))
-				abort = true
-				break
-			}
+// Reload re-reads the configuration and applies it, the same as sending HUP.
+func (s *Supervisor) Reload() error {
+	r := reloadRequest{result: make(chan error)}
+	s.reloads <- r
+	return <-r.result
+}
+
+// Apply adds or replaces runtime profiles and reloads. The profiles that fail
+// to start or apply are discarded again, the error names each of them.
+func (s *Supervisor) Apply(ps []*Profile) error {
+	r := reloadRequest{apply: ps, result: make(chan error)}
+	s.reloads <- r
+	return <-r.result
+}
+
+// Instances returns a snapshot of the running instances.
+func (s *Supervisor) Instances() []*Instance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	insts := make([]*Instance, len(s.insts))
+	copy(insts, s.insts)
+	return insts
+}
+
+// watchCerts points the certificate watcher at the files of the running
+// profiles.
+func (s *Supervisor) watchCerts() {
+	if s.certs == nil {
+		return
+	}
+	var paths []string
+	for _, inst := range s.Instances() {
+		paths = append(paths, inst.Profile().filePaths()...)
+	}
+	s.certs.watch(paths)
+}
+
+// checkExpiry looks for certificates of the running profiles nearing expiry.
+func (s *Supervisor) checkExpiry() {
+	insts := s.Instances()
+	profiles := make([]*Profile, len(insts))
+	for i, inst := range insts {
+		profiles[i] = inst.Profile()
+	}
+	s.expiry.check(profiles)
+}
 
-			var found bool
-			for i := 0; i < len(removeInst); {
-				if p.Name != removeInst[i].p.Name {
-					i++
-					continue
-				}
-
-				found = true
-				modifyInst = append(modifyInst, struct {
-					P *Profile
-					I *Instance
-				}{P: p, I: removeInst[i]})
-				removeInst[i] = removeInst[len(removeInst)-1]
-				removeInst = removeInst[:len(removeInst)-1]
+// refreshCerts reads the files of the instances using any of the changed
+// files again and adapts the instances to them.
+func (s *Supervisor) refreshCerts(changed map[string]bool) {
+	for _, inst := range s.Instances() {
+		p := inst.Profile()
+		var uses bool
+		for _, path := range p.filePaths() {
+			if changed[filepath.Clean(path)] {
+				uses = true
 				break
 			}
+		}
+		if !uses {
+			continue
+		}
 
-			if !found {
-				addInst = append(addInst, p)
-			}
+		np, err := p.Reresolve()
+		if err != nil {
+			slog.Error("error reading changed files", "profile", p.Name, "err", err)
+			continue
+		}
+		if err := inst.AdaptTo(np); err != nil {
+			slog.Error("error applying changed files", "profile", p.Name, "err", err)
+		} else {
+			slog.Debug("reloaded files", "profile", p.Name)
+		}
+	}
+}
+
+// renewVaultCerts applies the certificates Vault issued again to the profiles
+// using them.
+func (s *Supervisor) renewVaultCerts() {
+	for _, inst := range s.Instances() {
+		p := inst.Profile()
+		if !p.usesVault() {
+			continue
+		}
+
+		np, err := p.Reresolve()
+		if err != nil {
+			slog.Error("error renewing Vault certificates", "profile", p.Name, "err", err)
+			continue
+		}
+		if err := inst.AdaptTo(np); err != nil {
+			slog.Error("error applying renewed Vault certificates", "profile", p.Name, "err", err)
+		} else {
+			slog.Debug("renewed Vault certificates", "profile", p.Name)
+		}
+	}
+}
+
+// refreshAWSSecrets reads the paths in AWS again and adapts the instances
+// using them.
+func (s *Supervisor) refreshAWSSecrets() {
+	expireAWSSecrets()
+	for _, inst := range s.Instances() {
+		p := inst.Profile()
+		if !p.usesAWSSecrets() {
+			continue
+		}
+
+		np, err := p.Reresolve()
+		if err != nil {
+			slog.Error("error reading secrets from AWS", "profile", p.Name, "err", err)
+			continue
+		}
+		if err := inst.AdaptTo(np); err != nil {
+			slog.Error("error applying secrets from AWS", "profile", p.Name, "err", err)
+		} else {
+			slog.Debug("refreshed secrets from AWS", "profile", p.Name)
+		}
+	}
+}
+
+// refreshAzureCerts looks for new versions of the certificates in Azure Key
+// Vault and adapts the instances using them.
+func (s *Supervisor) refreshAzureCerts() {
+	expireAzureCerts()
+	for _, inst := range s.Instances() {
+		p := inst.Profile()
+		if !p.usesAzure() {
+			continue
+		}
+
+		np, err := p.Reresolve()
+		if err != nil {
+			slog.Error("error reading certificates from Azure Key Vault", "profile", p.Name, "err", err)
+			continue
+		}
+		if err := inst.AdaptTo(np); err != nil {
+			slog.Error("error applying certificates from Azure Key Vault", "profile", p.Name, "err", err)
+		} else {
+			slog.Debug("refreshed certificates from Azure Key Vault", "profile", p.Name)
+		}
+	}
+}
+
+func (s *Supervisor) applyAndReload(ps []*Profile) error {
+	if len(ps) < 1 {
+		_, degraded, err := s.reload()
+		return errors.Join(err, degraded)
+	}
+
+	prev := s.c.Overrides
+	s.c.Overrides = replaceProfiles(prev, ps...)
+	applied, degraded, err := s.reload()
+	if !applied {
+		// nothing changed, the profiles are discarded
+		s.c.Overrides = prev
+		return err
+	}
+
+	st, _ := s.LastReload()
+	var kept []*Profile
+	for _, p := range ps {
+		if _, failed := st.Errors[p.Name]; !failed {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) < len(ps) {
+		// the profiles that failed are discarded and what they replaced is
+		// reloaded again, so the overrides match what runs
+		s.c.Overrides = replaceProfiles(prev, kept...)
+		if _, _, err := s.reload(); err != nil {
+			slog.Error("error reloading after discarding applied profiles", "code", errorCode(err), "err", err)
+		}
+	}
+	return errors.Join(err, degraded)
+}
+
+func (s *Supervisor) start() error {
+	profiles, err := s.c.getProfiles()
+	if err != nil {
+		return fmt.Errorf("getting inital profiles: %w", err)
+	}
+
+	if len(profiles) < 1 {
+		fatal("nothing to run")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	profiles = s.setAsideDisabled(profiles)
+	s.insts = make([]*Instance, 0, len(profiles))
+	for _, p := range profiles {
+		if err := p.Resolve(); err != nil {
+			s.degrade(p, fmt.Errorf("reading files: %w", err))
+			continue
 		}
 
-		if abort {
+		inst, err := NewInstance(p)
+		if err != nil {
+			s.degrade(p, err)
 			continue
 		}
+		s.insts = append(s.insts, inst)
+	}
+	configureLevels(profiles)
+	return nil
+}
+
+// running tells if the named profile has an instance. s.mu must be held.
+func (s *Supervisor) running(name string) bool {
+	for _, inst := range s.insts {
+		if inst.p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// crlCheckInterval is how often the revocation lists are checked for passing
+// their next update.
+const crlCheckInterval = 5 * time.Minute
+
+// refreshCRLs reads the files of the instances with a revocation list past its
+// next update again. Until there is a newer list the expired one stays in use,
+// which is logged on every check.
+func (s *Supervisor) refreshCRLs() {
+	now := time.Now()
+	for _, inst := range s.Instances() {
+		p := inst.Profile()
+		if !crlsExpired(p.listenCRLs, now) {
+			continue
+		}
+
+		np, err := p.Reresolve()
+		if err != nil {
+			slog.Error("revocation list expired, still using it", "profile", p.Name, "code", countError(p.Name, err), "err", err)
+			continue
+		}
+		if err := inst.AdaptTo(np); err != nil {
+			slog.Error("error applying revocation list", "profile", p.Name, "code", countError(p.Name, err), "err", err)
+		} else {
+			slog.Info("reloaded expired revocation list", "profile", p.Name)
+		}
+	}
+}
 
-		for _, i := range removeInst {
-			if Debug {
-				log.Println(fmt.Sprintf("Removing %q", i.p.Name))
+// reload applies the configuration to the instances. It tells if it got as far
+// as changing any, degraded is why profiles that can't start yet failed, they
+// are retried in the background, err why the others did.
+func (s *Supervisor) reload() (applied bool, degraded, err error) {
+	st := newReloadStatus()
+	defer func() { s.recordReload(st, errors.Join(err, degraded)) }()
+
+	np, err := s.c.getProfiles()
+	if err != nil {
+		return false, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	np = s.setAsideDisabled(np)
+
+	removeInst := make([]*Instance, len(s.insts))
+	modifyInst := make([]struct {
+		P *Profile
+		I *Instance
+	}, 0, len(s.insts))
+	addInst := make([]*Profile, 0, len(s.insts))
+	copy(removeInst, s.insts)
+
+	var errs, degrades []error
+	var unresolved []degradedProfile // degraded once nothing can stop the reload
+	configured := make(map[string]bool, len(np))
+	for _, p := range np {
+		if _, ok := s.stopped[p.Name]; ok {
+			s.stopped[p.Name] = p
+			continue
+		}
+		configured[p.Name] = true
+		if err := p.Resolve(); err != nil {
+			if !s.running(p.Name) {
+				// a new or degraded profile is retried in the background,
+				// the others are still reloaded
+				unresolved = append(unresolved, degradedProfile{p: p, err: fmt.Errorf("reading files: %w", err)})
+				continue
 			}
-			i.Stop()
+			countError(p.Name, err)
+			st.fail(p.Name, err)
+			return false, nil, fmt.Errorf("reading files for profile %q: %w", p.Name, err)
+		}
 
-			for ii := 0; ii < len(insts); ii++ {
-				if i == insts[ii] {
-					insts[ii] = insts[len(insts)-1]
-					insts = insts[:len(insts)-1]
-					break
-				}
+		var found bool
+		for i := 0; i < len(removeInst); {
+			if p.Name != removeInst[i].p.Name {
+				i++
+				continue
 			}
+
+			found = true
+			modifyInst = append(modifyInst, struct {
+				P *Profile
+				I *Instance
+			}{P: p, I: removeInst[i]})
+			removeInst[i] = removeInst[len(removeInst)-1]
+			removeInst = removeInst[:len(removeInst)-1]
+			break
+		}
+
+		if !found {
+			addInst = append(addInst, p)
 		}
+	}
+	configureLevels(np)
+	for _, d := range unresolved {
+		s.degrade(d.p, d.err)
+		degrades = append(degrades, fmt.Errorf("adding profile %q: %w", d.p.Name, d.err))
+		st.fail(d.p.Name, d.err)
+	}
+	for name := range s.degraded {
+		if !configured[name] {
+			slog.Info("degraded profile is gone, no longer retrying", "profile", name)
+			s.undegrade(name)
+		}
+	}
 
-		for _, m := range modifyInst {
-			if err := m.I.AdaptTo(m.P); err != nil {
-				log.Println(fmt.Sprintf("Error modifying profile %q: %s", m.P.Name, err))
-			} else if Debug {
-				log.Println(fmt.Sprintf("Reloaded %q", m.P.Name))
+	for _, i := range removeInst {
+		slog.Debug("removing", "profile", i.p.Name)
+		i.Stop()
+		st.Removed = append(st.Removed, i.p.Name)
+
+		for ii := 0; ii < len(s.insts); ii++ {
+			if i == s.insts[ii] {
+				s.insts[ii] = s.insts[len(s.insts)-1]
+				s.insts = s.insts[:len(s.insts)-1]
+				break
 			}
 		}
+	}
 
-		for _, p := range addInst {
-			i, err := NewInstance(p)
-			if err != nil {
-				log.Println(fmt.Sprintf("Error adding profile %q: %s", p.Name, err))
-				continue
-			} else if Debug {
-				log.Println(fmt.Sprintf("Added %q", p.Name))
+	for _, m := range modifyInst {
+		old := m.I.Profile()
+		changed := old.ListenChanged(m.P) || old.DestinationChanged(m.P)
+		if err := m.I.AdaptTo(m.P); err != nil {
+			slog.Error("error modifying profile", "profile", m.P.Name, "code", countError(m.P.Name, err), "err", err)
+			errs = append(errs, fmt.Errorf("modifying profile %q: %w", m.P.Name, err))
+			st.fail(m.P.Name, err)
+		} else {
+			slog.Debug("reloaded", "profile", m.P.Name)
+			if changed {
+				st.Modified = append(st.Modified, m.P.Name)
 			}
-			insts = append(insts, i)
 		}
 	}
+
+	for _, p := range addInst {
+		i, err := NewInstance(p)
+		if err != nil {
+			s.degrade(p, err)
+			degrades = append(degrades, fmt.Errorf("adding profile %q: %w", p.Name, err))
+			st.fail(p.Name, err)
+			continue
+		}
+		slog.Debug("added", "profile", p.Name)
+		s.undegrade(p.Name)
+		s.insts = append(s.insts, i)
+		st.Added = append(st.Added, p.Name)
+	}
+
+	return true, errors.Join(degrades...), errors.Join(errs...)
 }
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestStopProfileClosesAfterTimeout(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: testEcho(t)})
+	s := &Supervisor{c: &Configurations{ShutdownTimeout: 200 * time.Millisecond}, insts: []*Instance{inst}}
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c) {
+		t.Fatal("connection wasn't proxied")
+	}
+
+	if err := s.StopProfile("test"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Draining("test") != inst {
+		t.Error("stopped profile isn't draining")
+	}
+	if !closed(c) {
+		t.Fatal("connection still open after the shutdown timeout")
+	}
+	waitFor(t, "the profile to finish draining", func() bool { return s.Draining("test") == nil })
+	if err := s.StopProfile("test"); err == nil {
+		t.Error("stopped a profile that isn't running")
+	}
+}
+
+func TestShutdownClosesAfterTimeout(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: testEcho(t)})
+	s := &Supervisor{insts: []*Instance{inst}}
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	echoes(c)
+
+	if err := s.shutdown(100 * time.Millisecond); !errors.Is(err, errShutdownTimeout) {
+		t.Errorf("got %v, want %v", err, errShutdownTimeout)
+	}
+	if !closed(c) {
+		t.Error("connection still open after shutdown")
+	}
+}
+
+func TestRefreshCRLs(t *testing.T) {
+	ca := newTestCA(t)
+	path := filepath.Join(t.TempDir(), "crl.pem")
+	if err := os.WriteFile(path, []byte(ca.crl(t, time.Now().Add(time.Second))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := &Profile{Proxy: testEcho(t), ListenCRLPath: path}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+	s := &Supervisor{insts: []*Instance{inst}}
+
+	s.refreshCRLs()
+	if inst.Profile() != p {
+		t.Fatal("current revocation list was reloaded")
+	}
+
+	time.Sleep(time.Until(p.listenCRLs[0].NextUpdate) + 10*time.Millisecond)
+	s.refreshCRLs()
+	if inst.Profile() != p {
+		t.Fatal("revocation list was replaced without a newer one")
+	}
+
+	next := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err := os.WriteFile(path, []byte(ca.crl(t, next)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s.refreshCRLs()
+	if crls := inst.Profile().listenCRLs; len(crls) != 1 || !crls[0].NextUpdate.Equal(next) {
+		t.Error("newer revocation list wasn't loaded")
+	}
+}
+
+// servedCN is the common name of the certificate the listener at addr serves.
+func servedCN(t *testing.T, addr string, tlsconf *tls.Config) string {
+	t.Helper()
+	c, err := tls.Dial("tcp", addr, tlsconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestRefreshCerts(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	write := func(cn string) {
+		certPEM, keyPEM := ca.issue(t, cn)
+		if err := os.WriteFile(certPath, []byte(certPEM), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(keyPath, []byte(keyPEM), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("first")
+	inst := testInstance(t, &Profile{Proxy: testEcho(t), ListenCertPath: certPath, ListenPrivatePath: keyPath, ListenAuthorityRaw: ca.pem})
+	s := &Supervisor{insts: []*Instance{inst}}
+	tlsconf := ca.clientConfig(t, "client")
+	if cn := servedCN(t, inst.ListenAddr(), tlsconf); cn != "first" {
+		t.Fatalf("serving %s", cn)
+	}
+
+	write("second")
+	s.refreshCerts(map[string]bool{filepath.Join(dir, "unrelated.pem"): true})
+	if cn := servedCN(t, inst.ListenAddr(), tlsconf); cn != "first" {
+		t.Errorf("reloaded for a file it doesn't use, serving %s", cn)
+	}
+	s.refreshCerts(map[string]bool{certPath: true})
+	if cn := servedCN(t, inst.ListenAddr(), tlsconf); cn != "second" {
+		t.Errorf("serving %s after the files changed", cn)
+	}
+}
+
+func TestShutdownWaitsForConnections(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: testBanner(t, "dest")})
+	addr := inst.ListenAddr()
+	s := &Supervisor{insts: []*Instance{inst}}
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// the destination is done, the connection lasts until the client is too
+	if line, _ := bufio.NewReader(c).ReadString('\n'); line != "dest\n" {
+		t.Fatalf("got %q", line)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.shutdown(5 * time.Second) }()
+	waitFor(t, "the listener to close", func() bool {
+		nc, err := net.Dial("tcp", addr)
+		if err == nil {
+			nc.Close()
+		}
+		return err != nil
+	})
+	select {
+	case err := <-done:
+		t.Fatalf("shutdown with a connection open: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("connections finished in time, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("shutdown didn't finish with the connections")
+	}
+}
+
+// running lists the names of the instances of s.
+func running(s *Supervisor) (names []string) {
+	for _, inst := range s.Instances() {
+		names = append(names, inst.Profile().Name)
+	}
+	slices.Sort(names)
+	return
+}
+
+func TestDisabledProfiles(t *testing.T) {
+	echo := testEcho(t)
+	disabled := false
+	s := &Supervisor{c: &Configurations{Profiles: []*Profile{
+		{Name: "a", Listen: "127.0.0.1:0", Proxy: echo},
+		{Name: "b", Listen: "127.0.0.1:0", Proxy: echo, Enabled: &disabled},
+	}}}
+	t.Cleanup(func() {
+		for _, inst := range s.Instances() {
+			inst.Stop()
+		}
+	})
+	if _, _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := running(s); !slices.Equal(got, []string{"a"}) {
+		t.Fatalf("running %v", got)
+	}
+	var st profileStatus
+	if w := adminDo(s, http.MethodGet, "/profiles/b", ""); json.Unmarshal(w.Body.Bytes(), &st) != nil || !st.Disabled || st.Stopped {
+		t.Errorf("admin server shows %s", w.Body)
+	}
+
+	// started through the admin server it keeps running over reloads
+	serveReloads(s)
+	if w := adminDo(s, http.MethodPost, "/profiles/b/start", ""); w.Code != http.StatusAccepted {
+		t.Fatalf("start: %d %s", w.Code, w.Body)
+	}
+	if _, _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := running(s); !slices.Equal(got, []string{"a", "b"}) || len(s.Disabled()) > 0 {
+		t.Errorf("running %v, disabled %v", got, s.Disabled())
+	}
+	if err := s.StartProfile("a"); err == nil {
+		t.Error("started a running profile")
+	}
+
+	// until the configuration enables it, disabling it again stops it
+	enabled := true
+	s.c.Profiles[1].Enabled = &enabled
+	if _, _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	s.c.Profiles[1].Enabled = &disabled
+	if _, _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := running(s); !slices.Equal(got, []string{"a"}) || len(s.Disabled()) != 1 {
+		t.Errorf("running %v, disabled %v", got, s.Disabled())
+	}
+}
+
+func TestEnabledPrecedence(t *testing.T) {
+	t.Setenv(EnvProfilePrefix+"WEB"+EnvEnabledSuffix, "false")
+	ps, _, err := profilesFromEnv()
+	if err != nil || len(ps) != 1 || ps[0].enabled() {
+		t.Fatalf("got %v, %v", ps, err)
+	}
+	// false set anywhere above wins over true below
+	enabled := true
+	if p := mergeProfile(ps[0].Copy(), &Profile{Name: "WEB", Enabled: &enabled}); p.enabled() {
+		t.Error("enabled by a lower layer")
+	}
+	if !(&Profile{}).enabled() {
+		t.Error("profiles without Enabled aren't started")
+	}
+
+	t.Setenv(EnvProfilePrefix+"WEB"+EnvEnabledSuffix, "maybe")
+	if _, _, err := profilesFromEnv(); err == nil {
+		t.Error("parsed a bad value")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var connectionsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mtlsproxy_connections_rejected_total",
+	Help: "Connections closed right after being accepted because the profile was at MaxConnections.",
+}, []string{"profile"})
+
+var (
+	connectionsAccepted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mtlsproxy_connections_total",
+		Help: "Connections each profile accepted.",
+	}, []string{"profile"})
+	connectionsOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mtlsproxy_active_connections",
+		Help: "Connections each profile has open.",
+	}, []string{"profile"})
+	bytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mtlsproxy_bytes_total",
+		Help: "Bytes read from clients (up) and destinations (down), counted as they are proxied.",
+	}, []string{"profile", "backend", "direction"})
+	listenerUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mtlsproxy_listener_up",
+		Help: "Whether each profile's listener is open, 0 while opening it is retried or it was stopped.",
+	}, []string{"profile"})
+	acceptErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mtlsproxy_accept_errors_total",
+		Help: "Failed accepts of each profile's listener by kind, transient or other, both are retried.",
+	}, []string{"profile", "kind"})
+	acceptBackoff = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mtlsproxy_accept_backoff_seconds",
+		Help: "How long each profile's listener waits to accept again after failing, 0 while accepting.",
+	}, []string{"profile"})
+	dialRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mtlsproxy_dial_retries_total",
+		Help: "Attempts to connect to each profile's destination again after one failed.",
+	}, []string{"profile"})
+)
+
+func init() {
+	prometheus.MustRegister(connectionsRejected, connectionsAccepted, connectionsOpen, bytesTotal, listenerUp, acceptErrors, acceptBackoff, dialRetriesTotal)
+}
+
+// startMetricsServer serves the Prometheus metrics at /metrics.
+func startMetricsServer(c *Configurations) error {
+	if len(c.MetricsListen) < 1 {
+		return nil
+	}
+
+	l, err := listenSocket("tcp", c.MetricsListen)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.Serve(l, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("metrics server stopped", "err", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConnectionMetrics(t *testing.T) {
+	echo := testEcho(t)
+	inst := testInstance(t, &Profile{Name: "metrics", Proxy: echo})
+	accepted := connectionsAccepted.WithLabelValues(inst.ident)
+	up, down := bytesTotal.WithLabelValues(inst.ident, echo, "up"), bytesTotal.WithLabelValues(inst.ident, echo, "down")
+	before := []float64{testutil.ToFloat64(accepted), testutil.ToFloat64(up), testutil.ToFloat64(down)}
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c) {
+		t.Fatal("no echo")
+	}
+
+	// bytes are counted while the connection is open
+	if got := testutil.ToFloat64(accepted) - before[0]; got != 1 {
+		t.Errorf("%v connections accepted", got)
+	}
+	if got := testutil.ToFloat64(connectionsOpen.WithLabelValues(inst.ident)); got != 1 {
+		t.Errorf("%v connections open", got)
+	}
+	if got := []float64{testutil.ToFloat64(up) - before[1], testutil.ToFloat64(down) - before[2]}; got[0] != 5 || got[1] != 5 {
+		t.Errorf("counted %v bytes up and down", got)
+	}
+	if up, down := inst.Bytes(); up != 5 || down != 5 {
+		t.Errorf("instance read %d up, %d down", up, down)
+	}
+	w := adminDo(&Supervisor{insts: []*Instance{inst}}, http.MethodGet, "/profiles/metrics", "")
+	if !strings.Contains(w.Body.String(), `"bytes_up":5,"bytes_down":5`) {
+		t.Errorf("admin server shows %s", w.Body)
+	}
+
+	inst.CloseConnections("test")
+	waitFor(t, "the connection to close", func() bool { return testutil.ToFloat64(connectionsOpen.WithLabelValues(inst.ident)) == 0 })
+	if up, down := inst.Bytes(); up != 5 || down != 5 {
+		t.Errorf("instance read %d up, %d down once closed", up, down)
+	}
+}
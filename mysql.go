@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const StartTLSMySQL = "mysql"
+
+// MySQL capability flags the proxy looks at or asks for.
+const (
+	mysqlClientLongPassword     = 0x00000001
+	mysqlClientLongFlag         = 0x00000004
+	mysqlClientProtocol41       = 0x00000200
+	mysqlClientSSL              = 0x00000800
+	mysqlClientTransactions     = 0x00002000
+	mysqlClientSecureConnection = 0x00008000
+	mysqlClientPluginAuth       = 0x00080000
+)
+
+const (
+	mysqlMaxPacket       = 1<<24 - 1
+	mysqlSSLRequestSize  = 32
+	mysqlSecureTransport = 3159 // ER_SECURE_TRANSPORT_REQUIRED
+)
+
+// readMySQLPacket reads one packet, header included.
+func readMySQLPacket(r io.Reader) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	size := int(hdr[0]) | int(hdr[1])<<8 | int(hdr[2])<<16
+	pkt := make([]byte, 4+size)
+	copy(pkt, hdr[:])
+	if _, err := io.ReadFull(r, pkt[4:]); err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+func mysqlPacket(seq byte, payload []byte) []byte {
+	pkt := []byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}
+	return append(pkt, payload...)
+}
+
+// greetingCaps finds the lower capability flags in the server's greeting.
+func greetingCaps(pkt []byte) (int, error) {
+	payload := pkt[4:]
+	if len(payload) < 1 || payload[0] != 10 {
+		return 0, errors.New("not a protocol 10 greeting")
+	}
+	end := bytes.IndexByte(payload[1:], 0)
+	if end < 0 {
+		return 0, errors.New("malformed greeting")
+	}
+	off := 4 + 1 + end + 1 + 4 + 8 + 1 // header, version, server version, thread id, scramble, filler
+	if len(pkt) < off+2 {
+		return 0, errors.New("greeting too short")
+	}
+	return off, nil
+}
+
+// mysqlClientStartTLS reads the destination's greeting and asks to switch to
+// TLS, the greeting is returned for the client.
+func mysqlClientStartTLS(c net.Conn, r *bufio.Reader) ([]byte, error) {
+	greeting, err := readMySQLPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(greeting) > 4 && greeting[4] == 0xff {
+		return nil, errors.New("destination refused the connection")
+	}
+	off, err := greetingCaps(greeting)
+	if err != nil {
+		return nil, err
+	}
+	serverCaps := uint32(binary.LittleEndian.Uint16(greeting[off:]))
+	if serverCaps&mysqlClientSSL == 0 {
+		return nil, errors.New("destination doesn't support TLS")
+	}
+	charset := byte(33) // utf8
+	if len(greeting) > off+2 {
+		charset = greeting[off+2]
+	}
+
+	req := make([]byte, mysqlSSLRequestSize)
+	caps := uint32(mysqlClientLongPassword|mysqlClientLongFlag|mysqlClientProtocol41|mysqlClientTransactions|mysqlClientSecureConnection|mysqlClientPluginAuth) | mysqlClientSSL
+	binary.LittleEndian.PutUint32(req, caps)
+	binary.LittleEndian.PutUint32(req[4:], mysqlMaxPacket)
+	req[8] = charset
+	if _, err := c.Write(mysqlPacket(greeting[3]+1, req)); err != nil {
+		return nil, err
+	}
+	return greeting, nil
+}
+
+// mysqlStartTLS passes the destination's greeting on to the client and, when
+// l is waiting to upgrade, takes the client's request to switch to TLS. The
+// returned connections make up for one side having switched and the other
+// not.
+func mysqlStartTLS(l, c net.Conn, sendUpgraded bool) (net.Conn, net.Conn, *tls.ConnectionState, error) {
+	sc, listenTLS := l.(*startTLSConn)
+	if !listenTLS && !sendUpgraded {
+		return l, c, nil, nil
+	}
+
+	cr := bufio.NewReader(c)
+	greeting, err := readMySQLPacket(cr)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("reading destination greeting: %w", err)
+	}
+	if len(greeting) > 4 && greeting[4] != 0xff {
+		off, err := greetingCaps(greeting)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("destination greeting: %w", err)
+		}
+		caps := binary.LittleEndian.Uint16(greeting[off:])
+		if listenTLS {
+			caps |= mysqlClientSSL
+		} else {
+			caps &^= mysqlClientSSL
+		}
+		binary.LittleEndian.PutUint16(greeting[off:], caps)
+	}
+	if _, err := l.Write(greeting); err != nil {
+		return nil, nil, nil, err
+	}
+
+	var cs *tls.ConnectionState
+	lr := bufio.NewReader(l)
+	if listenTLS {
+		sc.Conn.SetReadDeadline(time.Now().Add(helloTimeout))
+		pkt, err := readMySQLPacket(lr)
+		sc.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if len(pkt) != 4+mysqlSSLRequestSize || binary.LittleEndian.Uint32(pkt[4:])&mysqlClientSSL == 0 {
+			msg := []byte{0xff, byte(mysqlSecureTransport & 0xff), byte(mysqlSecureTransport >> 8), '#', 'H', 'Y', '0', '0', '0'}
+			msg = append(msg, "TLS is required"...)
+			l.Write(mysqlPacket(pkt[3]+1, msg))
+			return nil, nil, nil, errors.New("client started without TLS")
+		}
+		// clients don't wait for an answer to the request, their ClientHello
+		// may be buffered already
+		tc := tls.Server(&replayConn{Conn: sc.Conn, r: lr}, sc.tlsconf)
+		tc.SetDeadline(time.Now().Add(helloTimeout))
+		if err := tc.Handshake(); err != nil {
+			return nil, nil, nil, fmt.Errorf("handshake error from %s: %w", l.RemoteAddr().String(), err)
+		}
+		tc.SetDeadline(time.Time{})
+		state := tc.ConnectionState()
+		cs = &state
+		l, lr = tc, bufio.NewReader(tc)
+	}
+
+	l = &replayConn{Conn: l, r: lr}
+	c = &replayConn{Conn: c, r: cr}
+	if listenTLS == sendUpgraded {
+		return l, c, cs, nil
+	}
+	// the side that switched counted its request to as a packet, the
+	// sequence numbers differ by one until authentication is over
+	shift := 1
+	if listenTLS {
+		shift = -1
+	}
+	var authed atomic.Bool
+	l = &replayConn{Conn: l, r: &mysqlAuthReader{r: lr, shift: shift, authed: &authed, caps: true, ssl: sendUpgraded}}
+	c = &replayConn{Conn: c, r: &mysqlAuthReader{r: cr, shift: -shift, authed: &authed, server: true}}
+	return l, c, cs, nil
+}
+
+// mysqlAuthReader renumbers the packets of the authentication phase, which
+// ends with the server's OK or ERR.
+type mysqlAuthReader struct {
+	r      *bufio.Reader
+	shift  int
+	authed *atomic.Bool
+	server bool // reading the server, whose OK or ERR ends authentication
+	caps   bool // the next packet is the client's handshake response
+	ssl    bool // whether the destination switched to TLS
+	buf    []byte
+}
+
+func (m *mysqlAuthReader) Read(b []byte) (int, error) {
+	if len(m.buf) < 1 {
+		if _, err := m.r.Peek(1); err != nil {
+			return 0, err
+		}
+		// checked once data arrived, the client only sends its first
+		// command after the OK went through
+		if m.authed.Load() {
+			return m.r.Read(b)
+		}
+		pkt, err := readMySQLPacket(m.r)
+		if err != nil {
+			return 0, err
+		}
+		pkt[3] = byte(int(pkt[3]) + m.shift)
+		if m.caps && len(pkt) >= 8 {
+			caps := binary.LittleEndian.Uint32(pkt[4:])
+			if m.ssl {
+				caps |= mysqlClientSSL
+			} else {
+				caps &^= mysqlClientSSL
+			}
+			binary.LittleEndian.PutUint32(pkt[4:], caps)
+			m.caps = false
+		}
+		if m.server && len(pkt) > 4 && (pkt[4] == 0x00 || pkt[4] == 0xff) {
+			m.authed.Store(true)
+		}
+		m.buf = pkt
+	}
+	n := copy(b, m.buf)
+	m.buf = m.buf[n:]
+	return n, nil
+}
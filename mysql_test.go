@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// mysqlGreeting is a protocol 10 greeting with caps as its lower flags.
+func mysqlGreeting(caps uint16) []byte {
+	payload := []byte{10}
+	payload = append(payload, "8.0.0\x00"...)
+	payload = append(payload, 1, 0, 0, 0)
+	payload = append(payload, "scramble"...)
+	payload = append(payload, 0, byte(caps), byte(caps>>8), 33, 2, 0, 0, 0)
+	return mysqlPacket(0, payload)
+}
+
+func TestMySQLClientStartTLS(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		greeting []byte
+		err      bool
+	}{
+		{"TLS offered", mysqlGreeting(mysqlClientProtocol41 | mysqlClientSSL), false},
+		{"TLS not offered", mysqlGreeting(mysqlClientProtocol41), true},
+		{"refused", mysqlPacket(0, []byte{0xff, 0x10, 0x04, 'n', 'o'}), true},
+	} {
+		s, cl := net.Pipe()
+		go s.Write(c.greeting)
+		sent := make(chan []byte, 1)
+		go func() {
+			pkt, _ := readMySQLPacket(s)
+			sent <- pkt
+		}()
+		greeting, err := mysqlClientStartTLS(cl, bufio.NewReader(cl))
+		if (err != nil) != c.err {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+		if err == nil {
+			if !bytes.Equal(greeting, c.greeting) {
+				t.Errorf("%s: greeting %q not returned as is", c.name, greeting)
+			}
+			req := <-sent
+			if len(req) != 4+mysqlSSLRequestSize || req[3] != 1 || binary.LittleEndian.Uint32(req[4:])&mysqlClientSSL == 0 {
+				t.Errorf("%s: sent %v", c.name, req)
+			}
+		}
+		s.Close()
+		cl.Close()
+	}
+}
+
+// testMySQL is a destination without TLS that authenticates anyone, sends
+// the client's handshake response to got and echoes commands.
+func testMySQL(t *testing.T, got chan<- []byte) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Write(mysqlGreeting(mysqlClientProtocol41 | mysqlClientSecureConnection))
+				pkt, err := readMySQLPacket(c)
+				if err != nil {
+					return
+				}
+				got <- pkt
+				c.Write(mysqlPacket(pkt[3]+1, []byte{0, 0, 0, 2, 0, 0, 0}))
+				for {
+					if pkt, err = readMySQLPacket(c); err != nil {
+						return
+					}
+					c.Write(mysqlPacket(pkt[3]+1, pkt[4:]))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestInstanceMySQLStartTLS(t *testing.T) {
+	ca := newTestCA(t)
+	got := make(chan []byte, 1)
+	p := &Profile{Proxy: testMySQL(t, got), StartTLS: StartTLSMySQL}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	greeting, err := mysqlClientStartTLS(c, bufio.NewReader(c))
+	if err != nil {
+		t.Fatalf("proxy doesn't offer TLS: %v", err)
+	}
+	tc := tls.Client(c, ca.clientConfig(t, "client"))
+	response := make([]byte, 32)
+	binary.LittleEndian.PutUint32(response, mysqlClientProtocol41|mysqlClientSecureConnection|mysqlClientSSL)
+	response = append(response, "user\x00"...)
+	tc.Write(mysqlPacket(greeting[3]+2, response))
+
+	// the destination never saw the request to switch, the sequence numbers
+	// are shifted on both ways
+	sent := <-got
+	if sent[3] != 1 || binary.LittleEndian.Uint32(sent[4:])&mysqlClientSSL != 0 {
+		t.Errorf("destination got sequence %d, flags %x", sent[3], binary.LittleEndian.Uint32(sent[4:]))
+	}
+	ok, err := readMySQLPacket(tc)
+	if err != nil || ok[3] != 3 || ok[4] != 0 {
+		t.Fatalf("got %v, %v for the OK", ok, err)
+	}
+	tc.Write(mysqlPacket(0, []byte("\x03SELECT 1")))
+	if echo, err := readMySQLPacket(tc); err != nil || echo[3] != 1 || string(echo[4:]) != "\x03SELECT 1" {
+		t.Errorf("got %q, %v after authentication", echo, err)
+	}
+
+	p = &Profile{StartTLS: StartTLSMySQL, Routes: map[string]*Route{"a.example.test": {Proxy: "127.0.0.1:1"}}}
+	if err := p.checkStartTLS(); err == nil {
+		t.Error("Routes passed with StartTLS mysql")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	ocspRetry   = time.Minute
+	ocspTimeout = 30 * time.Second
+	// ocspRefresh is how often a response without a next update is
+	// refreshed, unless ListenOCSPRefresh is set
+	ocspRefresh = time.Hour
+)
+
+// ocspClient is shared by the staplers of every profile.
+var ocspClient = &http.Client{Timeout: ocspTimeout}
+
+// ocspStapler keeps a fresh OCSP response for the listen certificate and
+// staples it into handshakes through GetCertificate.
+type ocspStapler struct {
+	ident     string
+	cert      tls.Certificate
+	leaf      *x509.Certificate
+	issuer    *x509.Certificate
+	responder string
+	refresh   time.Duration
+	mu        sync.Mutex // guards staple and expires
+	staple    []byte
+	expires   time.Time // zero when the responder gave no next update
+	stop      chan struct{}
+}
+
+func newOCSPStapler(ident string, cert tls.Certificate, responder string, refresh time.Duration) (*ocspStapler, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, errors.New("OCSP stapling requires the issuer certificate in the listen certificate chain")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(responder) < 1 {
+		if len(leaf.OCSPServer) < 1 {
+			return nil, errors.New("the listen certificate has no OCSP responder, set ListenOCSPResponder")
+		}
+		responder = leaf.OCSPServer[0]
+	}
+
+	st := &ocspStapler{
+		ident:     ident,
+		cert:      cert,
+		leaf:      leaf,
+		issuer:    issuer,
+		responder: responder,
+		refresh:   refresh,
+		stop:      make(chan struct{}),
+	}
+	go st.run()
+	return st, nil
+}
+
+// getCertificate is used as tls.Config.GetCertificate.
+func (st *ocspStapler) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := st.cert
+	st.mu.Lock()
+	if len(st.staple) > 0 && (st.expires.IsZero() || time.Now().Before(st.expires)) {
+		cert.OCSPStaple = st.staple
+	}
+	st.mu.Unlock()
+	return &cert, nil
+}
+
+func (st *ocspStapler) close() {
+	close(st.stop)
+}
+
+func (st *ocspStapler) run() {
+	for {
+		next := ocspRetry
+		resp, raw, err := st.fetch()
+		if err != nil {
+			slog.Warn("error fetching OCSP response", "profile", st.ident, "err", err)
+		} else {
+			st.mu.Lock()
+			st.staple = raw
+			st.expires = resp.NextUpdate
+			st.mu.Unlock()
+
+			next = st.refresh
+			if next < 1 && resp.NextUpdate.IsZero() {
+				// newer information is always available, the response
+				// doesn't say for how long it holds
+				next = ocspRefresh
+			} else if next < 1 {
+				// half way to the next update like most servers do
+				next = time.Until(resp.NextUpdate) / 2
+			}
+			if next < ocspRetry {
+				next = ocspRetry
+			}
+			slog.Debug("OCSP response fetched", "profile", st.ident, "valid_until", resp.NextUpdate.Format(time.RFC3339), "refresh", next)
+		}
+
+		select {
+		case <-st.stop:
+			return
+		case <-time.After(next):
+		}
+	}
+}
+
+func (st *ocspStapler) fetch() (*ocsp.Response, []byte, error) {
+	req, err := ocsp.CreateRequest(st.leaf, st.issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hr, err := ocspClient.Post(st.responder, "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer hr.Body.Close()
+	if hr.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("responder %q returned %s", st.responder, hr.Status)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(hr.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := ocsp.ParseResponseForCert(raw, st.leaf, st.issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Status != ocsp.Good {
+		return nil, nil, fmt.Errorf("certificate status is not good (%d)", resp.Status)
+	}
+	return resp, raw, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// testResponder answers OCSP requests for certificates of ca as good, until
+// nextUpdate when it isn't zero.
+func testResponder(t *testing.T, ca *testCA, nextUpdate time.Time) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(b)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: req.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   nextUpdate,
+		}, ca.key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// testChain is a certificate of ca with ca in its chain, as stapling needs.
+func testChain(t *testing.T, ca *testCA) tls.Certificate {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, "proxy")
+	cert, err := tls.X509KeyPair([]byte(certPEM+ca.pem), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestOCSPStapler(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		nextUpdate time.Time
+	}{
+		{"next update", time.Now().Add(time.Hour)},
+		{"no next update", time.Time{}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ca := newTestCA(t)
+			st, err := newOCSPStapler("test", testChain(t, ca), testResponder(t, ca, c.nextUpdate), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer st.close()
+			waitFor(t, "a staple", func() bool {
+				cert, _ := st.getCertificate(nil)
+				return len(cert.OCSPStaple) > 0
+			})
+		})
+	}
+}
+
+func TestOCSPStaplerExpired(t *testing.T) {
+	ca := newTestCA(t)
+	st := &ocspStapler{cert: testChain(t, ca), staple: []byte("response"), expires: time.Now().Add(-time.Second)}
+	if cert, _ := st.getCertificate(nil); len(cert.OCSPStaple) > 0 {
+		t.Error("expired response was stapled")
+	}
+}
+
+func TestOCSPStaplerNeedsIssuer(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "proxy")
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newOCSPStapler("test", cert, "http://127.0.0.1:1", 0); err == nil {
+		t.Error("stapler created without the issuer in the chain")
+	}
+}
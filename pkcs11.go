@@ -0,0 +1,59 @@
+//go:build pkcs11
+
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// pkcs11Support tells if the build can use PKCS#11 tokens.
+const pkcs11Support = true
+
+var (
+	pkcs11Contexts   = make(map[string]*crypto11.Context) // by module, token and slot
+	pkcs11ContextsMu sync.Mutex
+)
+
+// pkcs11Signer finds the private key with the label on the profile's token.
+// Token sessions are shared by every profile using the same token.
+func pkcs11Signer(p *Profile, label string) (crypto.Signer, error) {
+	pkcs11ContextsMu.Lock()
+	defer pkcs11ContextsMu.Unlock()
+
+	id := p.PKCS11Module + "\x00" + p.PKCS11TokenLabel + "\x00" + p.PKCS11Slot
+	ctx, ok := pkcs11Contexts[id]
+	if !ok {
+		config := &crypto11.Config{
+			Path:       p.PKCS11Module,
+			TokenLabel: p.PKCS11TokenLabel,
+			Pin:        p.PKCS11PIN,
+		}
+		if len(p.PKCS11Slot) > 0 {
+			slot, err := strconv.Atoi(p.PKCS11Slot)
+			if err != nil {
+				return nil, fmt.Errorf("parsing PKCS11Slot %q: %w", p.PKCS11Slot, err)
+			}
+			config.SlotNumber = &slot
+		}
+
+		var err error
+		if ctx, err = crypto11.Configure(config); err != nil {
+			return nil, fmt.Errorf("opening PKCS#11 token: %w", err)
+		}
+		pkcs11Contexts[id] = ctx
+	}
+
+	signer, err := ctx.FindKeyPair(nil, []byte(label))
+	if err != nil {
+		return nil, fmt.Errorf("finding PKCS#11 key %q: %w", label, err)
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("no PKCS#11 key with the label %q", label)
+	}
+	return signer, nil
+}
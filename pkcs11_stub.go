@@ -0,0 +1,15 @@
+//go:build !pkcs11
+
+package main
+
+import (
+	"crypto"
+	"errors"
+)
+
+// pkcs11Support tells if the build can use PKCS#11 tokens.
+const pkcs11Support = false
+
+func pkcs11Signer(p *Profile, label string) (crypto.Signer, error) {
+	return nil, errors.New("this build has no PKCS#11 support, rebuild with -tags pkcs11")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// redactedFields hold secrets, print-config shows that they are set but not
+// their values. PrivateRaw is the key of ListenCertificates.
+var redactedFields = map[string]bool{
+	"ListenPrivateRaw":           true,
+	"SendPrivateRaw":             true,
+	"PrivateRaw":                 true,
+	"ListenPrivatePassphrase":    true,
+	"SendPrivatePassphrase":      true,
+	"ListenP12Passphrase":        true,
+	"SendP12Passphrase":          true,
+	"PKCS11PIN":                  true,
+	"ListenSessionTicketKeysRaw": true,
+}
+
+// printConfig writes the profiles as they are after merging every source, in
+// Toml with the source of each option in a comment. Files aren't read.
+func printConfig(c *Configurations, w io.Writer) error {
+	layers, err := c.configLayers()
+	if err != nil {
+		return err
+	}
+	logLayerErrors(layers)
+	// merging changes the profiles, the layers are needed as they are
+	copies := make([]configLayer, len(layers))
+	for i, l := range layers {
+		copies[i] = l
+		copies[i].profiles = make([]*Profile, len(l.profiles))
+		for j, p := range l.profiles {
+			copies[i].profiles[j] = p.Copy()
+		}
+	}
+	profiles := mergeLayers(copies)
+	sort.Slice(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+
+	for n, p := range profiles {
+		if n > 0 {
+			fmt.Fprintln(w)
+		}
+		key := tomlKey(p.Name)
+		fmt.Fprintf(w, "[%s] # %s\n", key, strings.Join(profileSources(layers, p.Name), ", "))
+
+		v := reflect.ValueOf(p).Elem()
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() || f.Name == "Name" || f.Name == "Source" || f.Name == "Routes" || f.Name == "ListenCertificates" || !fieldSet(v.Field(i)) {
+				continue
+			}
+			fmt.Fprintf(w, "%s = %s # %s\n", f.Name, tomlValue(f.Name, v.Field(i)), layerSource(layers, p.Name, i))
+		}
+
+		if len(p.ListenCertificates) > 0 {
+			source := layerSource(layers, p.Name, fieldIndex(t, "ListenCertificates"))
+			for _, cp := range p.ListenCertificates {
+				fmt.Fprintf(w, "[[%s.ListenCertificates]] # %s\n", key, source)
+				printStruct(w, reflect.ValueOf(cp).Elem())
+			}
+		}
+		if len(p.Routes) > 0 {
+			source := layerSource(layers, p.Name, fieldIndex(t, "Routes"))
+			names := make([]string, 0, len(p.Routes))
+			for name := range p.Routes {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				fmt.Fprintf(w, "[%s.Routes.%s] # %s\n", key, tomlKey(name), source)
+				printStruct(w, reflect.ValueOf(p.Routes[name]).Elem())
+			}
+		}
+	}
+	return nil
+}
+
+// profileSources are the sources with options for the profile, highest
+// precedence first.
+func profileSources(layers []configLayer, name string) (sources []string) {
+	for _, l := range layers {
+		for _, p := range l.profiles {
+			if p.Name == name {
+				sources = append(sources, l.source)
+				break
+			}
+		}
+	}
+	return
+}
+
+// layerSource is the source of the first layer setting the field of the
+// profile, the one mergeProfile keeps, or of the first defaults setting it.
+func layerSource(layers []configLayer, name string, field int) string {
+	for _, l := range layers {
+		for _, p := range l.profiles {
+			if p.Name == name && fieldSet(reflect.ValueOf(p).Elem().Field(field)) {
+				return l.source
+			}
+		}
+	}
+	for _, l := range layers {
+		if l.defaults != nil && fieldSet(reflect.ValueOf(l.defaults).Elem().Field(field)) {
+			return "defaults in " + l.source
+		}
+	}
+	return "unknown"
+}
+
+func fieldIndex(t reflect.Type, name string) int {
+	f, _ := t.FieldByName(name)
+	return f.Index[0]
+}
+
+// fieldSet reports if mergeProfile would keep the value over a later one.
+func fieldSet(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() > 0
+	}
+	return !v.IsZero()
+}
+
+func printStruct(w io.Writer, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.IsExported() && fieldSet(v.Field(i)) {
+			fmt.Fprintf(w, "%s = %s\n", f.Name, tomlValue(f.Name, v.Field(i)))
+		}
+	}
+}
+
+func tomlValue(name string, v reflect.Value) string {
+	if redactedFields[name] {
+		return `"<redacted>"`
+	}
+	switch v.Kind() {
+	case reflect.String:
+		s := v.String()
+		if name == "HTTPProxy" || name == "SOCKSProxy" {
+			if u, err := url.Parse(s); err == nil {
+				s = u.Redacted()
+			}
+		}
+		return strconv.Quote(s)
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Pointer:
+		return tomlValue(name, v.Elem())
+	case reflect.Int:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Slice:
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = tomlValue(name, v.Index(i))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return strconv.Quote(fmt.Sprint(v.Interface()))
+}
+
+// tomlKey quotes keys that can't be bare.
+func tomlKey(s string) string {
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return strconv.Quote(s)
+		}
+	}
+	if len(s) < 1 {
+		return `""`
+	}
+	return s
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
+)
+
+// errUntrustedPeer is a connection from outside ListenProxyProtocolSources.
+var errUntrustedPeer = errors.New("not from a trusted source")
+
+// PROXY protocol v2, https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV2Local = 0x20
+	proxyV2Proxy = 0x21
+
+	proxyV2Unspec = 0x00
+	proxyV2TCP4   = 0x11
+	proxyV2UDP4   = 0x12
+	proxyV2TCP6   = 0x21
+	proxyV2UDP6   = 0x22
+
+	pp2TypeALPN      = 0x01
+	pp2TypeAuthority = 0x02
+	pp2TypeUniqueID  = 0x05
+	pp2TypeSSL       = 0x20
+	pp2SubtypeSSLVer = 0x21
+	pp2SubtypeSSLCN  = 0x22
+	pp2SubtypeCipher = 0x23
+
+	pp2ClientSSL      = 0x01
+	pp2ClientCertConn = 0x02
+)
+
+// proxyHeader builds the PROXY protocol header telling the destination who
+// src is. The v2 header also carries the client's TLS details when cs is set
+// and the connection ID when id is.
+func proxyHeader(version string, src, dst net.Addr, cs *tls.ConnectionState, id string) []byte {
+	if version == ProxyProtocolV1 {
+		return proxyHeaderV1(src, dst)
+	}
+	return proxyHeaderV2(src, dst, cs, id)
+}
+
+// proxyAddrs returns the IPs and ports of src and dst, ok is false for
+// anything that isn't IP or mixes families.
+func proxyAddrs(src, dst net.Addr) (sip, dip net.IP, sport, dport int, udp, ok bool) {
+	switch s := src.(type) {
+	case *net.TCPAddr:
+		d, dok := dst.(*net.TCPAddr)
+		if !dok {
+			return
+		}
+		sip, dip, sport, dport = s.IP, d.IP, s.Port, d.Port
+	case *net.UDPAddr:
+		d, dok := dst.(*net.UDPAddr)
+		if !dok {
+			return
+		}
+		sip, dip, sport, dport, udp = s.IP, d.IP, s.Port, d.Port, true
+	default:
+		return
+	}
+	if (sip.To4() == nil) != (dip.To4() == nil) {
+		return
+	}
+	ok = true
+	return
+}
+
+func proxyHeaderV1(src, dst net.Addr) []byte {
+	sip, dip, sport, dport, udp, ok := proxyAddrs(src, dst)
+	if !ok || udp {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	family := "TCP4"
+	if sip.To4() == nil {
+		family = "TCP6"
+	}
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, sip.String(), dip.String(), sport, dport))
+}
+
+func proxyHeaderV2(src, dst net.Addr, cs *tls.ConnectionState, id string) []byte {
+	var body bytes.Buffer
+	command, family := byte(proxyV2Local), byte(proxyV2Unspec)
+	if sip, dip, sport, dport, udp, ok := proxyAddrs(src, dst); ok {
+		command = proxyV2Proxy
+		if s4, d4 := sip.To4(), dip.To4(); s4 != nil {
+			family = proxyV2TCP4
+			body.Write(s4)
+			body.Write(d4)
+		} else {
+			family = proxyV2TCP6
+			body.Write(sip.To16())
+			body.Write(dip.To16())
+		}
+		if udp {
+			family++ // the UDP family follows TCP's
+		}
+		binary.Write(&body, binary.BigEndian, uint16(sport))
+		binary.Write(&body, binary.BigEndian, uint16(dport))
+	}
+	if cs != nil {
+		writeTLV(&body, pp2TypeSSL, sslTLV(cs))
+		if len(cs.ServerName) > 0 {
+			writeTLV(&body, pp2TypeAuthority, []byte(cs.ServerName))
+		}
+		if len(cs.NegotiatedProtocol) > 0 {
+			writeTLV(&body, pp2TypeALPN, []byte(cs.NegotiatedProtocol))
+		}
+	}
+	if len(id) > 0 {
+		writeTLV(&body, pp2TypeUniqueID, []byte(id))
+	}
+
+	hdr := bytes.NewBuffer(append([]byte(nil), proxyV2Signature...))
+	hdr.WriteByte(command)
+	hdr.WriteByte(family)
+	binary.Write(hdr, binary.BigEndian, uint16(body.Len()))
+	hdr.Write(body.Bytes())
+	return hdr.Bytes()
+}
+
+// sslTLV is the PP2_TYPE_SSL value, the client certificate was verified when
+// there is one since unverified handshakes never get this far.
+func sslTLV(cs *tls.ConnectionState) []byte {
+	var v bytes.Buffer
+	client := byte(pp2ClientSSL)
+	if len(cs.PeerCertificates) > 0 {
+		client |= pp2ClientCertConn
+	}
+	v.WriteByte(client)
+	binary.Write(&v, binary.BigEndian, uint32(0)) // verify result, 0 is success
+	writeTLV(&v, pp2SubtypeSSLVer, []byte(tls.VersionName(cs.Version)))
+	writeTLV(&v, pp2SubtypeCipher, []byte(tls.CipherSuiteName(cs.CipherSuite)))
+	if len(cs.PeerCertificates) > 0 && len(cs.PeerCertificates[0].Subject.CommonName) > 0 {
+		writeTLV(&v, pp2SubtypeSSLCN, []byte(cs.PeerCertificates[0].Subject.CommonName))
+	}
+	return v.Bytes()
+}
+
+func writeTLV(b *bytes.Buffer, typ byte, value []byte) {
+	b.WriteByte(typ)
+	binary.Write(b, binary.BigEndian, uint16(len(value)))
+	b.Write(value)
+}
+
+// proxyListener reads the PROXY protocol header a load balancer in front
+// sends on every connection, the accepted connections report the client the
+// header names as their remote address. Only peers in from are believed,
+// connections from anywhere else are closed.
+type proxyListener struct {
+	net.Listener
+	from []*net.IPNet
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c, from: l.from}, nil
+}
+
+// trustedPeer tells if the header of a connection from addr is believed.
+// Unix socket peers are, who can connect is up to the socket's permissions.
+func trustedPeer(addr net.Addr, from []*net.IPNet) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UnixAddr:
+		return true
+	default:
+		return false
+	}
+	return slices.ContainsFunc(from, func(n *net.IPNet) bool { return n.Contains(ip) })
+}
+
+// proxyConn strips the PROXY protocol header before the first read. Reading
+// the header waits for the client, so it happens on first use instead of in
+// Accept.
+type proxyConn struct {
+	net.Conn
+	from     []*net.IPNet // peers allowed to send the header
+	once     sync.Once
+	r        *bufio.Reader
+	remote   net.Addr
+	local    net.Addr
+	id       string // from the unique ID TLV
+	err      error
+	mu       sync.Mutex // guards deadline
+	deadline time.Time
+}
+
+func (c *proxyConn) header() error {
+	c.once.Do(func() {
+		if !trustedPeer(c.Conn.RemoteAddr(), c.from) {
+			c.err = fmt.Errorf("PROXY protocol header from %s: %w", c.Conn.RemoteAddr().String(), errUntrustedPeer)
+			return
+		}
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+		if limit := time.Now().Add(helloTimeout); deadline.IsZero() || limit.Before(deadline) {
+			c.Conn.SetReadDeadline(limit)
+		}
+		c.r = bufio.NewReader(c.Conn)
+		c.remote, c.local, c.id, c.err = readProxyHeader(c.r)
+		if c.err != nil {
+			c.err = fmt.Errorf("PROXY protocol header from %s: %w", c.Conn.RemoteAddr().String(), c.err)
+		}
+		c.Conn.SetReadDeadline(deadline)
+	})
+	return c.err
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.header(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
+
+// RemoteAddr is the client named in the header, or the connecting address
+// when the header is missing or came from the load balancer's health checks.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.header() == nil && c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// ConnectionID is the ID the proxy in front gave the connection in the
+// header, empty when it gave none.
+func (c *proxyConn) ConnectionID() string {
+	if c.header() == nil {
+		return c.id
+	}
+	return ""
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.header() == nil && c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header, the addresses are
+// nil for LOCAL and UNKNOWN headers. The ID is the unique ID TLV of a v2
+// header.
+func readProxyHeader(r *bufio.Reader) (src, dst net.Addr, id string, err error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if p, perr := r.Peek(6); perr == nil && string(p) == "PROXY " {
+		src, dst, err = readProxyHeaderV1(r)
+		return src, dst, "", err
+	}
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return nil, nil, "", errors.New("missing")
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < 107 { // the longest a v1 header can be
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, errors.New("v1 header too long")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) > 1 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	sip, dip := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	sport, serr := strconv.ParseUint(fields[4], 10, 16)
+	dport, derr := strconv.ParseUint(fields[5], 10, 16)
+	if sip == nil || dip == nil || serr != nil || derr != nil {
+		return nil, nil, fmt.Errorf("malformed v1 header %q", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: sip, Port: int(sport)}, &net.TCPAddr{IP: dip, Port: int(dport)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (src, dst net.Addr, id string, err error) {
+	fixed := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, nil, "", err
+	}
+	command, family := fixed[12], fixed[13]
+	body := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, "", err
+	}
+	if command&0xf0 != 0x20 {
+		return nil, nil, "", fmt.Errorf("unsupported v2 version %d", command>>4)
+	}
+	if command == proxyV2Local {
+		return nil, nil, "", nil
+	}
+	if command != proxyV2Proxy {
+		return nil, nil, "", fmt.Errorf("unsupported v2 command %d", command&0x0f)
+	}
+
+	size := 0
+	switch family {
+	case proxyV2TCP4, proxyV2UDP4:
+		size = net.IPv4len
+	case proxyV2TCP6, proxyV2UDP6:
+		size = net.IPv6len
+	default:
+		return nil, nil, "", nil // unix and unspecified addresses are of no use
+	}
+	if len(body) < size*2+4 {
+		return nil, nil, "", errors.New("v2 header too short for its addresses")
+	}
+	sip, dip := net.IP(body[:size]), net.IP(body[size:size*2])
+	sport := int(binary.BigEndian.Uint16(body[size*2:]))
+	dport := int(binary.BigEndian.Uint16(body[size*2+2:]))
+	id = tlvValue(body[size*2+4:], pp2TypeUniqueID)
+	if family == proxyV2UDP4 || family == proxyV2UDP6 {
+		return &net.UDPAddr{IP: sip, Port: sport}, &net.UDPAddr{IP: dip, Port: dport}, id, nil
+	}
+	return &net.TCPAddr{IP: sip, Port: sport}, &net.TCPAddr{IP: dip, Port: dport}, id, nil
+}
+
+// tlvValue is the value of the first TLV of the type, empty when there is
+// none or the TLVs are cut short.
+func tlvValue(tlvs []byte, typ byte) string {
+	for len(tlvs) >= 3 {
+		n := int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+n {
+			return ""
+		}
+		if tlvs[0] == typ {
+			return string(tlvs[3 : 3+n])
+		}
+		tlvs = tlvs[3+n:]
+	}
+	return ""
+}
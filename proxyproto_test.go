@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 443}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	for _, c := range []struct {
+		name     string
+		version  string
+		src, dst net.Addr
+		id       string
+	}{
+		{"v1", ProxyProtocolV1, src, dst, ""},
+		{"v1 ipv6", ProxyProtocolV1, src6, dst6, ""},
+		{"v2", ProxyProtocolV2, src, dst, "conn-1"},
+		{"v2 ipv6", ProxyProtocolV2, src6, dst6, ""},
+		{"v2 udp", ProxyProtocolV2, &net.UDPAddr{IP: src.IP, Port: 53}, &net.UDPAddr{IP: dst.IP, Port: 53}, ""},
+	} {
+		hdr := proxyHeader(c.version, c.src, c.dst, &tls.ConnectionState{Version: tls.VersionTLS13, ServerName: "example.test"}, c.id)
+		r := bufio.NewReader(io.MultiReader(bytes.NewReader(hdr), bytes.NewReader([]byte("data"))))
+		gsrc, gdst, id, err := readProxyHeader(r)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if gsrc.String() != c.src.String() || gdst.String() != c.dst.String() || id != c.id {
+			t.Errorf("%s: got %s %s %q", c.name, gsrc, gdst, id)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "data" {
+			t.Errorf("%s: header not consumed, %q left", c.name, rest)
+		}
+	}
+
+	// addresses it can't describe go as LOCAL and UNKNOWN
+	unix := &net.UnixAddr{Name: "/run/client.sock", Net: "unix"}
+	for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+		src, dst, _, err := readProxyHeader(bufio.NewReader(bytes.NewReader(proxyHeader(version, unix, unix, nil, ""))))
+		if err != nil || src != nil || dst != nil {
+			t.Errorf("%s unix: got %v %v %v", version, src, dst, err)
+		}
+	}
+
+	if _, _, _, err := readProxyHeader(bufio.NewReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n")))); err == nil {
+		t.Error("read a header that isn't there")
+	}
+}
+
+// proxyAccept sends hdr and data to a proxyListener accepting from the
+// sources and returns the accepted connection.
+func proxyAccept(t *testing.T, sources []string, hdr []byte) net.Conn {
+	t.Helper()
+	from, err := parseNets(sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &proxyListener{Listener: ln, from: from}
+	t.Cleanup(func() { l.Close() })
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.Write(append(hdr, "data"...))
+	a, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	a.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return a
+}
+
+func TestProxyListener(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	hdr := proxyHeader(ProxyProtocolV2, client, &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 443}, nil, "")
+
+	a := proxyAccept(t, []string{"127.0.0.1"}, hdr)
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(a, b); err != nil || string(b) != "data" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+	if a.RemoteAddr().String() != client.String() {
+		t.Errorf("remote address %s, want %s", a.RemoteAddr(), client)
+	}
+
+	// the header from anyone but the load balancer is a lie
+	a = proxyAccept(t, []string{"192.0.2.0/24"}, hdr)
+	if _, err := a.Read(b); !errors.Is(err, errUntrustedPeer) {
+		t.Errorf("got %v, want %v", err, errUntrustedPeer)
+	}
+	if a.RemoteAddr().String() == client.String() {
+		t.Error("untrusted header named the client")
+	}
+
+	a = proxyAccept(t, []string{"127.0.0.0/8"}, []byte("GET / HTTP/1.1\r\n\r\n"))
+	if _, err := a.Read(b); err == nil {
+		t.Error("connection without a header was read")
+	}
+}
+
+func TestResolveProxyProtocolSources(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		p    Profile
+		ok   bool
+	}{
+		{"sources", Profile{ListenAcceptProxyProtocol: true, ListenProxyProtocolSources: []string{"10.0.0.0/8", "192.0.2.1"}}, true},
+		{"no sources", Profile{ListenAcceptProxyProtocol: true}, false},
+		{"unix", Profile{ListenAcceptProxyProtocol: true, ListenProtocol: "unix"}, true},
+		{"without accepting", Profile{ListenProxyProtocolSources: []string{"10.0.0.0/8"}}, false},
+		{"bad source", Profile{ListenAcceptProxyProtocol: true, ListenProxyProtocolSources: []string{"10.0.0.0/33"}}, false},
+	} {
+		p := c.p
+		p.Name, p.Listen, p.Proxy = "test", ":0", "127.0.0.1:1"
+		if err := p.Resolve(); (err == nil) != c.ok {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+	}
+}
+
+// testProxySource reads the PROXY protocol header of every connection and
+// writes back the source address it carries.
+func testProxySource(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			src, _, _, err := readProxyHeader(bufio.NewReader(c))
+			if err == nil && src != nil {
+				io.WriteString(c, src.String()+"\n")
+			}
+			c.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	dest := testProxySource(t)
+	for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+		inst := testInstance(t, &Profile{Proxy: dest, SendProxyProtocol: version})
+		c, err := net.Dial("tcp", inst.ListenAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		line, _ := bufio.NewReader(c).ReadString('\n')
+		c.Close()
+		if line != c.LocalAddr().String()+"\n" {
+			t.Errorf("%s: destination saw %q, want %s", version, line, c.LocalAddr())
+		}
+	}
+
+	p := &Profile{Name: "test", Listen: ":0", Proxy: dest, SendProxyProtocol: "v3"}
+	if err := p.Resolve(); err == nil {
+		t.Error("resolved an unknown PROXY protocol version")
+	}
+}
+
+func TestProxyProtocolFromEnvironment(t *testing.T) {
+	t.Setenv(EnvProfilePrefix+"WEB"+EnvSendProtocolSuffix, "tcp4")
+	t.Setenv(EnvProfilePrefix+"WEB"+EnvSendProxyProtocolSuffix, "v2")
+	t.Setenv(EnvProfilePrefix+"WEB"+EnvListenProtocolSuffix, "tcp6")
+	t.Setenv(EnvProfilePrefix+"WEB"+EnvListenAcceptProxyProtocolSuffix, "true")
+	p := envProfile(t, "WEB")
+	if p.SendProxyProtocol != "v2" || p.SendProtocol != "tcp4" {
+		t.Errorf("got SendProxyProtocol %q, SendProtocol %q", p.SendProxyProtocol, p.SendProtocol)
+	}
+	if !p.ListenAcceptProxyProtocol || p.ListenProtocol != "tcp6" {
+		t.Errorf("got ListenAcceptProxyProtocol %v, ListenProtocol %q", p.ListenAcceptProxyProtocol, p.ListenProtocol)
+	}
+}
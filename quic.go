@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ProtocolQUIC listens for QUIC, every bidirectional stream a client opens is
+// proxied as a connection of its own.
+const ProtocolQUIC = "quic"
+
+// quicKeepAlive keeps connections whose streams are quiet from idling out.
+const quicKeepAlive = 15 * time.Second
+
+func isQUIC(network string) bool {
+	return network == ProtocolQUIC
+}
+
+// quicListener turns the streams of QUIC connections into a net.Listener.
+type quicListener struct {
+	ql     *quic.Listener
+	accept chan *quicStream
+	closed chan struct{}
+	close  sync.Once
+}
+
+func listenQUIC(addr string, tlsconf *tls.Config) (*quicListener, error) {
+	ql, err := quic.ListenAddr(addr, tlsconf, &quic.Config{KeepAlivePeriod: quicKeepAlive})
+	if err != nil {
+		return nil, err
+	}
+	l := &quicListener{
+		ql:     ql,
+		accept: make(chan *quicStream),
+		closed: make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *quicListener) run() {
+	for {
+		conn, err := l.ql.Accept(context.Background())
+		if err != nil {
+			l.Close()
+			return
+		}
+		go l.streams(conn)
+	}
+}
+
+func (l *quicListener) streams(conn quic.Connection) {
+	for {
+		s, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		select {
+		case l.accept <- &quicStream{Stream: s, conn: conn}:
+		case <-l.closed:
+			s.CancelRead(0)
+			s.Close()
+			return
+		}
+	}
+}
+
+func (l *quicListener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.accept:
+		return s, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *quicListener) Close() error {
+	var err error
+	l.close.Do(func() {
+		close(l.closed)
+		err = l.ql.Close()
+	})
+	return err
+}
+
+func (l *quicListener) Addr() net.Addr {
+	return l.ql.Addr()
+}
+
+// quicStream is one stream of a QUIC connection.
+type quicStream struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *quicStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) && appErr.Remote && appErr.ErrorCode == 0 {
+		// the client closed the connection without an error
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Close ends the stream both ways, Close of a quic.Stream only ends sending.
+func (s *quicStream) Close() error {
+	s.Stream.CancelRead(0)
+	return s.Stream.Close()
+}
+
+func (s *quicStream) ConnectionState() tls.ConnectionState {
+	return s.conn.ConnectionState().TLS
+}
+
+// checkQUIC rejects the options that don't work with a QUIC listener.
+func (p *Profile) checkQUIC() error {
+	if isQUIC(p.sendNetwork()) {
+		return errors.New("QUIC can only be used on the listen side, set ListenProtocol")
+	}
+	if !isQUIC(p.listenNetwork()) {
+		return nil
+	}
+	if !p.listenCertificate() {
+		return errors.New("a QUIC listener requires a listen certificate")
+	}
+	if len(p.ListenALPN) < 1 {
+		return errors.New("a QUIC listener requires ListenALPN, QUIC clients always ask for a protocol")
+	}
+	for _, proto := range p.ListenALPN {
+		if proto == "h3" || strings.HasPrefix(proto, "h3-") {
+			// HTTP/3 needs its unidirectional control and QPACK streams,
+			// only bidirectional streams are proxied
+			return fmt.Errorf("ListenALPN %q: HTTP/3 isn't supported on a QUIC listener", proto)
+		}
+	}
+	if p.passthrough() {
+		return errors.New("passthrough mode can't be used with a QUIC listener")
+	}
+	if p.ListenAcceptProxyProtocol {
+		return errors.New("ListenAcceptProxyProtocol can't be used with a QUIC listener")
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestQUICStreamsProxied(t *testing.T) {
+	ca := newTestCA(t)
+	p := &Profile{Proxy: testEcho(t), ListenProtocol: ProtocolQUIC, ListenALPN: []string{"echo"}}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+
+	tlsconf := ca.clientConfig(t, "client")
+	tlsconf.NextProtos = []string{"echo"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, inst.ListenAddr(), tlsconf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseWithError(0, "")
+
+	// every stream is a connection of its own to the destination
+	for i := 0; i < 2; i++ {
+		s, err := conn.OpenStreamSync(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(s, "ping\n"); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 5)
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(s, b); err != nil || string(b) != "ping\n" {
+			t.Fatalf("stream %d: got %q, %v", i, b, err)
+		}
+	}
+	waitFor(t, "both streams to be proxied", func() bool { return inst.Active() == 2 })
+}
+
+func TestCheckQUIC(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		p    Profile
+		ok   bool
+	}{
+		{"alpn", Profile{ListenProtocol: ProtocolQUIC, ListenCertRaw: "x", ListenALPN: []string{"echo"}}, true},
+		{"no alpn", Profile{ListenProtocol: ProtocolQUIC, ListenCertRaw: "x"}, false},
+		{"http3", Profile{ListenProtocol: ProtocolQUIC, ListenCertRaw: "x", ListenALPN: []string{"echo", "h3"}}, false},
+		{"http3 draft", Profile{ListenProtocol: ProtocolQUIC, ListenCertRaw: "x", ListenALPN: []string{"h3-29"}}, false},
+		{"no certificate", Profile{ListenProtocol: ProtocolQUIC, ListenALPN: []string{"echo"}}, false},
+		{"send side", Profile{Protocol: ProtocolQUIC}, false},
+	} {
+		if err := c.p.checkQUIC(); (err == nil) != c.ok {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+	}
+}
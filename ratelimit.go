@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateSweep is how often addresses that went quiet are forgotten.
+const rateSweep = time.Minute
+
+// ipRateLimiter is a token bucket per client IP for new connections.
+type ipRateLimiter struct {
+	ident     string
+	limit     rate.Limit
+	burst     int
+	mu        sync.Mutex // guards the fields below
+	clients   map[string]*ipBucket
+	lastSweep time.Time
+}
+
+type ipBucket struct {
+	lim      *rate.Limiter
+	seen     time.Time
+	limiting bool // logged as over the limit and not allowed since
+}
+
+func newIPRateLimiter(ident string, perSecond float64, burst int) *ipRateLimiter {
+	if burst < 1 {
+		burst = int(perSecond)
+		if burst < 1 {
+			burst = 1
+		}
+	}
+	return &ipRateLimiter{
+		ident:     ident,
+		limit:     rate.Limit(perSecond),
+		burst:     burst,
+		clients:   make(map[string]*ipBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token for the client at addr, an address is logged when it
+// first goes over the limit rather than for every refused connection.
+func (rl *ipRateLimiter) allow(addr net.Addr) bool {
+	ip := addr.String()
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	now := time.Now()
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now.Sub(rl.lastSweep) > rateSweep {
+		for k, b := range rl.clients {
+			// a full bucket is the same as a new one
+			if now.Sub(b.seen) > rateSweep && b.lim.TokensAt(now) >= float64(rl.burst) {
+				delete(rl.clients, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, ok := rl.clients[ip]
+	if !ok {
+		b = &ipBucket{lim: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.clients[ip] = b
+	}
+	b.seen = now
+	if b.lim.AllowN(now, 1) {
+		b.limiting = false
+		return true
+	}
+	if !b.limiting {
+		b.limiting = true
+		slog.Warn("over the connection rate limit, refusing its connections", "profile", rl.ident, "peer", ip)
+	}
+	return false
+}
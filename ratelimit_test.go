@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPRateLimiter(t *testing.T) {
+	rl := newIPRateLimiter("test", 0.001, 2)
+	a := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	b := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000}
+	for i := 0; i < 2; i++ {
+		if !rl.allow(&net.TCPAddr{IP: a.IP, Port: 1000 + i}) {
+			t.Fatalf("connection %d refused within the burst", i)
+		}
+	}
+	if rl.allow(a) {
+		t.Error("connection over the burst allowed")
+	}
+	if !rl.allow(b) {
+		t.Error("another client limited")
+	}
+	if !rl.clients["192.0.2.1"].limiting {
+		t.Error("limited client not marked")
+	}
+
+	if rl := newIPRateLimiter("test", 5, 0); rl.burst != 5 {
+		t.Errorf("burst %d, want the rate", rl.burst)
+	}
+	if rl := newIPRateLimiter("test", 0.5, 0); rl.burst != 1 {
+		t.Errorf("burst %d, want at least one", rl.burst)
+	}
+}
+
+func TestInstanceRateLimit(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: testEcho(t), ConnectionRate: "0.001", ConnectionBurst: 1})
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c) {
+		t.Fatal("first connection not proxied")
+	}
+	c2, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if !closed(c2) {
+		t.Error("connection over the rate proxied")
+	}
+
+	for _, p := range []*Profile{{ConnectionRate: "0"}, {ConnectionRate: "fast"}, {ConnectionRate: "1", ConnectionBurst: -1}} {
+		p.Name, p.Listen, p.Proxy = "test", ":0", "127.0.0.1:1"
+		if err := p.Resolve(); err == nil {
+			t.Errorf("resolved rate %q burst %d", p.ConnectionRate, p.ConnectionBurst)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// startHealthServer serves /healthz, which answers while the process runs,
+// and /readyz, which only succeeds once enough profiles are ready.
+func startHealthServer(c *Configurations, s *Supervisor) error {
+	if len(c.HealthListen) < 1 {
+		return nil
+	}
+	quorum, err := parseQuorum(c.ReadyQuorum)
+	if err != nil {
+		return err
+	}
+
+	l, err := listenSocket("tcp", c.HealthListen)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		var b strings.Builder
+		var ready int
+		insts := s.Instances()
+		for _, inst := range insts {
+			name := inst.Profile().Name
+			if err := inst.ready(); err != nil {
+				fmt.Fprintf(&b, "[-]%s not ready: %v\n", name, err)
+			} else {
+				fmt.Fprintf(&b, "[+]%s ok\n", name)
+				ready++
+			}
+		}
+		degraded := s.Degraded()
+		for _, d := range degraded {
+			fmt.Fprintf(&b, "[-]%s not ready: degraded: %v\n", d.p.Name, d.err)
+		}
+		total := len(insts) + len(degraded)
+		need := quorum(total)
+		if total < 1 || ready < need {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(&b, "not ready: %d of %d profiles ready, %d needed\n", ready, total, need)
+		} else {
+			fmt.Fprintf(&b, "ready: %d of %d profiles ready\n", ready, total)
+		}
+		fmt.Fprint(w, b.String())
+	})
+	go func() {
+		if err := http.Serve(l, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("health server stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// parseQuorum reads how many of the profiles need to be ready, a count or a
+// percentage. All of them when empty.
+func parseQuorum(s string) (func(total int) int, error) {
+	if len(s) < 1 {
+		return func(total int) int { return total }, nil
+	}
+	if pct, ok := strings.CutSuffix(s, "%"); ok {
+		n, err := strconv.Atoi(pct)
+		if err != nil || n < 0 || n > 100 {
+			return nil, fmt.Errorf("ready quorum %q isn't a percentage from 0%% to 100%%", s)
+		}
+		return func(total int) int { return (total*n + 99) / 100 }, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("ready quorum %q isn't a count or percentage", s)
+	}
+	return func(total int) int { return min(n, total) }, nil
+}
+
+// ready tells why the instance can't serve connections, if it can't: it isn't
+// listening or its listen certificate expired.
+func (inst *Instance) ready() error {
+	listening, err := inst.ListenStatus()
+	if err != nil {
+		return err
+	}
+	if !listening {
+		return errors.New("not listening")
+	}
+	now := time.Now()
+	for _, lc := range profileCerts(inst.Profile()) {
+		if lc.use == "listen" && now.After(lc.cert.NotAfter) {
+			return fmt.Errorf("listen certificate %q expired", lc.cert.Subject.String())
+		}
+	}
+	return nil
+}
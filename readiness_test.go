@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuorum(t *testing.T) {
+	for _, c := range []struct {
+		s     string
+		total int
+		want  int
+	}{
+		{"", 4, 4},
+		{"2", 4, 2},
+		{"6", 4, 4},
+		{"50%", 3, 2},
+		{"0%", 3, 0},
+		{"100%", 3, 3},
+	} {
+		quorum, err := parseQuorum(c.s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := quorum(c.total); got != c.want {
+			t.Errorf("%q of %d: got %d, want %d", c.s, c.total, got, c.want)
+		}
+	}
+	for _, s := range []string{"-1", "101%", "half", "%"} {
+		if _, err := parseQuorum(s); err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+}
+
+// freeAddr is a loopback address nothing listens on, for servers that only
+// take an address.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestHealthServer(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: testEcho(t)})
+	s := &Supervisor{insts: []*Instance{inst}, degraded: map[string]*degradedProfile{
+		"broken": {p: &Profile{Name: "broken"}, err: errors.New("no certificate")},
+	}}
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, c := range []struct {
+		quorum string
+		code   int
+		want   []string
+	}{
+		{"50%", http.StatusOK, []string{"[+]test ok\n", "[-]broken not ready: degraded: no certificate\n", "ready: 1 of 2 profiles ready\n"}},
+		{"", http.StatusServiceUnavailable, []string{"not ready: 1 of 2 profiles ready, 2 needed\n"}},
+	} {
+		addr := freeAddr(t)
+		if err := startHealthServer(&Configurations{HealthListen: addr, ReadyQuorum: c.quorum}, s); err != nil {
+			t.Fatal(err)
+		}
+		res, err := client.Get("http://" + addr + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != c.code {
+			t.Errorf("quorum %q: got %d", c.quorum, res.StatusCode)
+		}
+		for _, want := range c.want {
+			if !strings.Contains(string(b), want) {
+				t.Errorf("quorum %q: no %q in\n%s", c.quorum, want, b)
+			}
+		}
+		if res, err = client.Get("http://" + addr + "/healthz"); err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("healthz: got %d", res.StatusCode)
+		}
+	}
+
+	if err := startHealthServer(&Configurations{HealthListen: freeAddr(t), ReadyQuorum: "most"}, s); err == nil {
+		t.Error("started with a bad quorum")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// acceptRestart is how long the acceptance of a listener pauses after it
+// recovered from a panic, so a panic on every accept doesn't spin.
+const acceptRestart = 100 * time.Millisecond
+
+var panicsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "mtlsproxy_panics_total",
+	Help: "Panics recovered in the goroutines of each profile.",
+}, []string{"profile", "goroutine"})
+
+func init() {
+	prometheus.MustRegister(panicsTotal)
+}
+
+// recovered logs and counts the panic p recovered in the goroutine where,
+// and turns it into an error. It is called from the deferred function that
+// recovered, so the stack still has where it panicked.
+func (inst *Instance) recovered(where string, p any, attrs ...any) error {
+	err := withCode(codePanic, fmt.Errorf("panic: %v", p))
+	panicsTotal.WithLabelValues(inst.ident, where).Inc()
+	attrs = append([]any{"profile", inst.ident, "goroutine", where}, attrs...)
+	slog.Error("recovered from a panic", append(attrs, "code", codePanic, "err", err, "stack", string(debug.Stack()))...)
+	return err
+}
+
+// recoverTransfer is deferred by the goroutines copying a connection, when
+// one panics it ends the directions it carried with the panic, so the
+// connection closes instead of waiting on them.
+func (inst *Instance) recoverTransfer(e chan<- conConculsion, idents ...string) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	err := inst.recovered("transfer", p, "conn", idents[0])
+	for _, ident := range idents {
+		e <- conConculsion{ident: ident, err: err}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAcceptRecovers(t *testing.T) {
+	inst := &Instance{ident: "test", newCon: make(chan newConnection, 1)}
+	l := &scriptedListener{steps: []func() (net.Conn, error){
+		func() (net.Conn, error) { panic("accept blew up") },
+	}}
+	count := new(atomic.Uint64)
+	if !inst.accept("test", l, count) {
+		t.Error("acceptance not restarted after a panic")
+	}
+	if inst.accept("test", l, count) {
+		t.Error("acceptance restarted after the listener closed")
+	}
+}
+
+func TestRecoverTransfer(t *testing.T) {
+	inst := &Instance{ident: "test"}
+	e := make(chan conConculsion, 2)
+	func() {
+		defer inst.recoverTransfer(e, "up", "down")
+		panic("copy blew up")
+	}()
+	for _, want := range []string{"up", "down"} {
+		c := <-e
+		if c.ident != want || errorCode(c.err) != codePanic {
+			t.Errorf("got %s %v, want %s ended with a panic", c.ident, c.err, want)
+		}
+	}
+
+	func() {
+		defer inst.recoverTransfer(e, "up")
+	}()
+	if len(e) > 0 {
+		t.Error("transfer ended without a panic")
+	}
+}
+
+// panicConn panics when the connection is read.
+type panicConn struct {
+	net.Conn
+}
+
+func (c panicConn) Read(b []byte) (int, error) {
+	panic("read blew up")
+}
+
+func TestConnectionRecovers(t *testing.T) {
+	echo := testEcho(t)
+	inst := testInstance(t, &Profile{Proxy: echo})
+	a, b := net.Pipe()
+	defer b.Close()
+	inst.active.Add(1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		inst.connection("test#panic", panicConn{a}, socketInfo{net: "tcp", addr: echo}, nil)
+	}()
+	<-done
+	if !closed(b) {
+		t.Error("client connection open after a panic")
+	}
+	if _, code, _ := inst.LastError(); code != codePanic {
+		t.Errorf("last error code %q, want %q", code, codePanic)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	reloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mtlsproxy_reloads_total",
+		Help: "Reloads of the configuration by result, success or failure.",
+	}, []string{"result"})
+	reloadProfiles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mtlsproxy_reload_profiles_total",
+		Help: "Profiles added, modified, removed or failed by reloads.",
+	}, []string{"action"})
+	lastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mtlsproxy_last_reload_successful",
+		Help: "Whether the last reload succeeded.",
+	})
+	lastReloadTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "mtlsproxy_last_reload_timestamp_seconds",
+		Help: "When the last reload happened, in seconds since the epoch.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(reloadsTotal, reloadProfiles, lastReloadSuccess, lastReloadTime)
+	for _, action := range []string{"added", "modified", "removed", "failed"} {
+		reloadProfiles.WithLabelValues(action)
+	}
+}
+
+// reloadStatus is the outcome of a reload. Profiles that failed to be added
+// or modified are in Errors, the others kept running.
+type reloadStatus struct {
+	Time     time.Time         `json:"time"`
+	Success  bool              `json:"success"`
+	Added    []string          `json:"added"`
+	Modified []string          `json:"modified"`
+	Removed  []string          `json:"removed"`
+	Errors   map[string]string `json:"errors,omitempty"` // by profile
+	Error    string            `json:"error,omitempty"`
+	Code     string            `json:"code,omitempty"`
+}
+
+func newReloadStatus() *reloadStatus {
+	return &reloadStatus{Time: time.Now(), Added: []string{}, Modified: []string{}, Removed: []string{}, Errors: make(map[string]string)}
+}
+
+func (st *reloadStatus) fail(profile string, err error) {
+	st.Errors[profile] = err.Error()
+}
+
+// recordReload keeps the outcome of a reload for LastReload and the metrics.
+func (s *Supervisor) recordReload(st *reloadStatus, err error) {
+	st.Success = err == nil
+	result := "success"
+	if err != nil {
+		result = "failure"
+		st.Error, st.Code = err.Error(), errorCode(err)
+	}
+	for _, names := range [][]string{st.Added, st.Modified, st.Removed} {
+		sort.Strings(names)
+	}
+	reloadsTotal.WithLabelValues(result).Inc()
+	reloadProfiles.WithLabelValues("added").Add(float64(len(st.Added)))
+	reloadProfiles.WithLabelValues("modified").Add(float64(len(st.Modified)))
+	reloadProfiles.WithLabelValues("removed").Add(float64(len(st.Removed)))
+	reloadProfiles.WithLabelValues("failed").Add(float64(len(st.Errors)))
+	lastReloadTime.Set(float64(st.Time.Unix()))
+	if st.Success {
+		lastReloadSuccess.Set(1)
+	} else {
+		lastReloadSuccess.Set(0)
+	}
+
+	s.mu.Lock()
+	s.lastReload = st
+	s.mu.Unlock()
+}
+
+// errNoReload is returned by LastReload before the first reload.
+var errNoReload = errors.New("nothing was reloaded yet")
+
+// LastReload is the outcome of the last reload.
+func (s *Supervisor) LastReload() (reloadStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastReload == nil {
+		return reloadStatus{}, errNoReload
+	}
+	return *s.lastReload, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReloadStatus(t *testing.T) {
+	echo, other := testEcho(t), testEcho(t)
+	a := testInstance(t, &Profile{Name: "a", Proxy: echo})
+	c := testInstance(t, &Profile{Name: "c", Proxy: echo})
+	s := &Supervisor{c: &Configurations{Profiles: []*Profile{
+		{Name: "a", Listen: "127.0.0.1:0", Proxy: other},
+		{Name: "b", Listen: "127.0.0.1:0", Proxy: echo},
+	}}, insts: []*Instance{a, c}}
+	t.Cleanup(func() {
+		for _, inst := range s.Instances() {
+			inst.Stop()
+		}
+	})
+
+	if w := adminDo(s, http.MethodGet, "/reload", ""); w.Code != http.StatusNotFound {
+		t.Errorf("status before any reload: %d", w.Code)
+	}
+	successes := testutil.ToFloat64(reloadsTotal.WithLabelValues("success"))
+	if _, _, err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	st, err := s.LastReload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Success || !slices.Equal(st.Added, []string{"b"}) || !slices.Equal(st.Modified, []string{"a"}) || !slices.Equal(st.Removed, []string{"c"}) || len(st.Errors) > 0 {
+		t.Errorf("got %+v", st)
+	}
+	if testutil.ToFloat64(reloadsTotal.WithLabelValues("success")) != successes+1 || testutil.ToFloat64(lastReloadSuccess) != 1 {
+		t.Error("reload not counted as a success")
+	}
+
+	s.recordReload(newReloadStatus(), withCode(codeCertParse, errors.New("bad PEM")))
+	w := adminDo(s, http.MethodGet, "/reload", "")
+	var got reloadStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Success || got.Code != codeCertParse || got.Error != "bad PEM" {
+		t.Errorf("admin server shows %s", w.Body)
+	}
+	if testutil.ToFloat64(lastReloadSuccess) != 0 {
+		t.Error("failed reload not shown in the metrics")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultConfigURLInterval is how often the config URL is polled when
+	// ConfigURLInterval isn't set.
+	defaultConfigURLInterval = time.Minute
+	// configFetchTimeout bounds a single request for the config URL.
+	configFetchTimeout = 30 * time.Second
+	// maxConfigBundle is the largest configuration read from the config URL.
+	maxConfigBundle = 16 << 20
+)
+
+// remoteConfig is a configuration served over HTTPS. It is fetched at start
+// and polled after, a conditional request only downloads it when it changed.
+type remoteConfig struct {
+	url    string
+	source string // the URL without its password
+	client *http.Client
+	mu     sync.Mutex // guards what follows
+	etag   string
+	mod    string // Last-Modified
+	body   []byte
+	format string
+}
+
+func newRemoteConfig(c *Configurations) (*remoteConfig, error) {
+	u, err := url.Parse(c.ConfigURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && (u.Scheme != "http" || !c.InsecureDebugging) {
+		return nil, errors.New("the config URL needs to be https, http requires -insecuredebugging")
+	}
+
+	tlsconf := &tls.Config{}
+	if len(c.ConfigURLAuthority) > 0 {
+		ca, err := os.ReadFile(c.ConfigURLAuthority)
+		if err != nil {
+			return nil, fmt.Errorf("reading file %q: %w", c.ConfigURLAuthority, err)
+		}
+		capool := x509.NewCertPool()
+		if ok := capool.AppendCertsFromPEM(ca); !ok {
+			return nil, errors.New("no certs found for the config URL authority")
+		}
+		tlsconf.RootCAs = capool
+	}
+	if len(c.ConfigURLCert) > 0 || len(c.ConfigURLKey) > 0 {
+		cert, err := tls.LoadX509KeyPair(c.ConfigURLCert, c.ConfigURLKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading cert/key pair: %w", err)
+		}
+		tlsconf.Certificates = []tls.Certificate{cert}
+	}
+
+	return &remoteConfig{
+		url:    c.ConfigURL,
+		source: u.Redacted(),
+		client: &http.Client{
+			Timeout:   configFetchTimeout,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsconf},
+		},
+	}, nil
+}
+
+// fetch downloads the configuration if it changed since the last fetch, and
+// reports if it did.
+func (rc *remoteConfig) fetch() (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, rc.url, nil)
+	if err != nil {
+		return false, err
+	}
+	rc.mu.Lock()
+	if len(rc.etag) > 0 {
+		req.Header.Set("If-None-Match", rc.etag)
+	}
+	if len(rc.mod) > 0 {
+		req.Header.Set("If-Modified-Since", rc.mod)
+	}
+	rc.mu.Unlock()
+
+	resp, err := rc.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigBundle+1))
+	if err != nil {
+		return false, err
+	}
+	if len(body) > maxConfigBundle {
+		return false, fmt.Errorf("the configuration is larger than %d bytes", maxConfigBundle)
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.etag, rc.mod = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	if rc.body != nil && bytes.Equal(body, rc.body) {
+		return false, nil
+	}
+	rc.body, rc.format = body, bundleFormat(resp.Header.Get("Content-Type"), req.URL.Path, body)
+	return true, nil
+}
+
+// bundleFormat tells the format of the configuration by its content type,
+// then by the extension of the URL path and then by its content.
+func bundleFormat(contentType, urlPath string, body []byte) string {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+		return ConfigJSON
+	case strings.Contains(mt, "yaml"):
+		return ConfigYAML
+	case strings.Contains(mt, "toml"):
+		return ConfigTOML
+	}
+	switch strings.ToLower(path.Ext(urlPath)) {
+	case ".json", ".yaml", ".yml", ".toml":
+		return configFormat(urlPath)
+	}
+	return sniffFormat(body)
+}
+
+// layer is the profiles of the last configuration fetched.
+func (rc *remoteConfig) layer() (configLayer, error) {
+	rc.mu.Lock()
+	body, format := rc.body, rc.format
+	rc.mu.Unlock()
+	return parseConfig(body, format, rc.source)
+}
+
+// poll fetches the configuration every interval, and sends on the returned
+// channel when it changed. The last configuration is kept when a fetch fails.
+func (rc *remoteConfig) poll(interval time.Duration) <-chan struct{} {
+	changes := make(chan struct{})
+	go func() {
+		for range time.Tick(interval) {
+			changed, err := rc.fetch()
+			if err != nil {
+				slog.Error("error fetching configuration", "url", rc.source, "err", err)
+				continue
+			}
+			if changed {
+				changes <- struct{}{}
+			}
+		}
+	}()
+	return changes
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBundleFormat(t *testing.T) {
+	for _, c := range []struct {
+		contentType, path, body, want string
+	}{
+		{"application/json; charset=utf-8", "/config", "", ConfigJSON},
+		{"application/vnd.proxy+json", "/config", "", ConfigJSON},
+		{"application/yaml", "/config.toml", "", ConfigYAML},
+		{"application/toml", "/config.json", "", ConfigTOML},
+		{"text/plain", "/config.YML", "", ConfigYAML},
+		{"", "/config", `{"web": {}}`, ConfigJSON},
+		{"application/octet-stream", "/config", "[web]", ConfigTOML},
+	} {
+		if got := bundleFormat(c.contentType, c.path, []byte(c.body)); got != c.want {
+			t.Errorf("%q %s: got %s, want %s", c.contentType, c.path, got, c.want)
+		}
+	}
+}
+
+// testConfigServer serves the config in body over HTTPS with an ETag, the
+// authority to trust it is written to a file.
+func testConfigServer(t *testing.T, body *string, mu *sync.Mutex) (*httptest.Server, string) {
+	t.Helper()
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		etag := `"` + strings.ReplaceAll(*body, "\n", "") + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/toml")
+		w.Write([]byte(*body))
+	}))
+	t.Cleanup(srv.Close)
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return srv, ca
+}
+
+func TestRemoteConfig(t *testing.T) {
+	var mu sync.Mutex
+	body := "[web]\nListen = \"127.0.0.1:8443\"\nProxy = \"10.0.0.1:443\"\n"
+	srv, ca := testConfigServer(t, &body, &mu)
+	u := strings.Replace(srv.URL, "https://", "https://user:password@", 1) + "/config"
+	c := &Configurations{ConfigURL: u, ConfigURLAuthority: ca}
+	rc, err := newRemoteConfig(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(rc.source, "password") {
+		t.Errorf("source %q shows the password", rc.source)
+	}
+
+	if changed, err := rc.fetch(); err != nil || !changed {
+		t.Fatalf("got %v, %v on the first fetch", changed, err)
+	}
+	c.remote = rc
+	ps, err := c.getProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := profileNamed(ps, "web"); p == nil || p.Proxy != "10.0.0.1:443" || p.Source != rc.source {
+		t.Errorf("got %v", ps)
+	}
+
+	// unchanged it isn't downloaded again
+	if changed, err := rc.fetch(); err != nil || changed {
+		t.Errorf("got %v, %v when not modified", changed, err)
+	}
+	mu.Lock()
+	body = "[web]\nListen = \"127.0.0.1:8443\"\nProxy = \"10.0.0.2:443\"\n"
+	mu.Unlock()
+	if changed, err := rc.fetch(); err != nil || !changed {
+		t.Errorf("got %v, %v once modified", changed, err)
+	}
+	if ps, err = c.getProfiles(); err != nil || profileNamed(ps, "web") == nil || profileNamed(ps, "web").Proxy != "10.0.0.2:443" {
+		t.Errorf("got %v, %v", ps, err)
+	}
+
+	// the server isn't trusted without the authority
+	if rc, err = newRemoteConfig(&Configurations{ConfigURL: srv.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rc.fetch(); err == nil {
+		t.Error("fetched from an untrusted server")
+	}
+	for _, bad := range []*Configurations{
+		{ConfigURL: "http://config.example.test/"},
+		{ConfigURL: srv.URL, ConfigURLAuthority: filepath.Join(t.TempDir(), "missing.pem")},
+	} {
+		if _, err := newRemoteConfig(bad); err == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+	if _, err := newRemoteConfig(&Configurations{ConfigURL: "http://config.example.test/", InsecureDebugging: true}); err != nil {
+		t.Errorf("http with -insecuredebugging: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Route is a destination selected by the server name (SNI) the client asked
+// for. When a route has no certificates of its own, the profile's send
+// certificates are used.
+type Route struct {
+	Proxy             string
+	SendCertPath      string
+	SendCertRaw       string
+	SendPrivatePath   string
+	SendPrivateRaw    string
+	SendAuthorityPath string
+	SendAuthorityRaw  string
+}
+
+// parseRoutes reads routes in the env format: name=address,name=address
+func parseRoutes(s string) (map[string]*Route, error) {
+	routes := make(map[string]*Route)
+	for _, x := range strings.Split(s, ",") {
+		x = strings.TrimSpace(x)
+		if len(x) < 1 {
+			continue
+		}
+		name, addr, ok := strings.Cut(x, "=")
+		if !ok || len(name) < 1 || len(addr) < 1 {
+			return nil, fmt.Errorf("invalid route %q, expected name=address", x)
+		}
+		routes[strings.ToLower(name)] = &Route{Proxy: addr}
+	}
+	return routes, nil
+}
+
+func copyRoutes(routes map[string]*Route) map[string]*Route {
+	if routes == nil {
+		return nil
+	}
+	nu := make(map[string]*Route, len(routes))
+	for k, r := range routes {
+		c := *r
+		nu[k] = &c
+	}
+	return nu
+}
+
+func routesEqual(a, b map[string]*Route) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, ra := range a {
+		rb, ok := b[k]
+		if !ok || ra.Proxy != rb.Proxy || ra.SendCertRaw != rb.SendCertRaw ||
+			ra.SendPrivateRaw != rb.SendPrivateRaw || ra.SendAuthorityRaw != rb.SendAuthorityRaw {
+			return false
+		}
+	}
+	return true
+}
+
+// resolve will load any files for the route that are pending
+func (r *Route) resolve() error {
+	if err := readPending(&r.SendCertRaw, r.SendCertPath); err != nil {
+		return err
+	}
+	if err := readPending(&r.SendPrivateRaw, r.SendPrivatePath); err != nil {
+		return err
+	}
+	return readPending(&r.SendAuthorityRaw, r.SendAuthorityPath)
+}
+
+func (r *Route) hasTLS() bool {
+	return len(r.SendAuthorityRaw) > 0 || len(r.SendCertRaw) > 0
+}
+
+// readPending fills raw from the file at path, unless raw is already set.
+func readPending(raw *string, path string) error {
+	if len(*raw) > 0 || len(path) < 1 {
+		return nil
+	}
+	b, err := readFile(path)
+	if err != nil {
+		return fmt.Errorf("reading file %q: %w", path, err)
+	}
+	*raw = string(b)
+	return nil
+}
+
+// route picks the destination for a server name, falling back to info when no
+// route matches. A wildcard route "*.example.com" matches one label.
+func (info *socketInfo) route(name string) *socketInfo {
+	if len(info.routes) < 1 || len(name) < 1 {
+		return info
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if r, ok := info.routes[name]; ok {
+		return r
+	}
+	if i := strings.IndexByte(name, '.'); i > -1 {
+		if r, ok := info.routes["*"+name[i:]]; ok {
+			return r
+		}
+	}
+	return info
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := parseRoutes(" API.example.com=10.0.0.1:443, *.example.com=10.0.0.2:443,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 || routes["api.example.com"].Proxy != "10.0.0.1:443" || routes["*.example.com"].Proxy != "10.0.0.2:443" {
+		t.Errorf("got %v", routes)
+	}
+	for _, s := range []string{"api.example.com", "=10.0.0.1:443", "api.example.com="} {
+		if _, err := parseRoutes(s); err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	api, wild := &socketInfo{addr: "api"}, &socketInfo{addr: "wild"}
+	info := &socketInfo{addr: "default", routes: map[string]*socketInfo{"api.example.com": api, "*.example.com": wild}}
+	for _, c := range []struct {
+		name string
+		want *socketInfo
+	}{
+		{"api.example.com", api},
+		{"API.Example.com.", api},
+		{"www.example.com", wild},
+		{"a.www.example.com", info},
+		{"example.com", info},
+		{"", info},
+	} {
+		if got := info.route(c.name); got != c.want {
+			t.Errorf("%q went to %s, want %s", c.name, got.addr, c.want.addr)
+		}
+	}
+}
+
+// testBanner writes name to every connection and closes it.
+func testBanner(t *testing.T, name string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(c, name+"\n")
+			c.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// banner connects with tlsconf and reads the destination's name.
+func banner(t *testing.T, addr string, tlsconf *tls.Config) string {
+	t.Helper()
+	c, err := tls.Dial("tcp", addr, tlsconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	line, _ := bufio.NewReader(c).ReadString('\n')
+	return line
+}
+
+func TestInstanceRoutes(t *testing.T) {
+	ca := newTestCA(t)
+	p := &Profile{Proxy: testBanner(t, "default"), Routes: map[string]*Route{
+		"api.example.test": {Proxy: testBanner(t, "api")},
+		"*.example.test":   {Proxy: testBanner(t, "wildcard")},
+	}}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+
+	for _, c := range []struct{ name, want string }{
+		{"api.example.test", "api\n"},
+		{"www.example.test", "wildcard\n"},
+		{"localhost", "default\n"},
+	} {
+		tlsconf := ca.clientConfig(t, "client")
+		// the listen certificate is only for localhost, the name is for routing
+		tlsconf.ServerName, tlsconf.InsecureSkipVerify = c.name, true
+		if got := banner(t, inst.ListenAddr(), tlsconf); got != c.want {
+			t.Errorf("%s went to %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRoutedAccessLog(t *testing.T) {
+	lb, records := captureLog(t), captureAccess(t)
+	inst := testInstance(t, &Profile{Proxy: testBanner(t, "default"), Mode: ModePassthrough, AccessLog: true, AccessLogFormat: AccessLogJSON, Routes: map[string]*Route{
+		"api.example.test": {Proxy: testBanner(t, "api route")},
+	}})
+	// the banner isn't TLS, the handshake only has to send the server name
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	tls.Client(c, &tls.Config{ServerName: "api.example.test"}).Handshake()
+	c.Close()
+
+	waitFor(t, "the access log", func() bool { return strings.HasSuffix(records.String(), "\n") })
+	var a accessRecord
+	if err := json.Unmarshal([]byte(records.String()), &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.ServerName != "api.example.test" || a.Destination != inst.Profile().Routes["api.example.test"].Proxy {
+		t.Errorf("got %+v", a)
+	}
+	if got := lb.String(); !strings.Contains(got, "accepted, passthrough") || !strings.Contains(got, "server_name=api.example.test") {
+		t.Errorf("routed connection not logged: %s", got)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLimit lets count records through per interval.
+type logLimit struct {
+	count    int
+	interval time.Duration
+}
+
+// parseLogLimits reads comma separated limits like 10/1s, the ones prefixed
+// with a message and = apply to records with that message, the other one to
+// every warning and error.
+func parseLogLimits(s string) (def *logLimit, byMsg map[string]logLimit, err error) {
+	byMsg = make(map[string]logLimit)
+	for _, entry := range splitList(s) {
+		msg, spec := "", entry
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			msg, spec = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		}
+		count, per, ok := strings.Cut(spec, "/")
+		n, cerr := strconv.Atoi(count)
+		d, derr := time.ParseDuration(per)
+		if !ok || cerr != nil || derr != nil || n < 0 || d <= 0 {
+			return nil, nil, fmt.Errorf("log rate limit %q isn't like 10/1s", entry)
+		}
+		if len(msg) < 1 {
+			def = &logLimit{count: n, interval: d}
+		} else {
+			byMsg[msg] = logLimit{count: n, interval: d}
+		}
+	}
+	return def, byMsg, nil
+}
+
+// logSampler counts the records of each message and profile, the ones over
+// their limit are dropped and summarized once the interval is over.
+type logSampler struct {
+	def   *logLimit
+	byMsg map[string]logLimit
+	out   slog.Handler // for the summaries
+	mu    sync.Mutex
+	seen  map[sampleKey]*sampleWindow
+}
+
+type sampleKey struct {
+	msg, profile string
+}
+
+type sampleWindow struct {
+	start      time.Time
+	level      slog.Level
+	count      int
+	suppressed int
+	interval   time.Duration
+}
+
+func newLogSampler(spec string, out slog.Handler) (*logSampler, error) {
+	def, byMsg, err := parseLogLimits(spec)
+	if err != nil {
+		return nil, err
+	}
+	ls := &logSampler{def: def, byMsg: byMsg, out: out, seen: make(map[sampleKey]*sampleWindow)}
+	go func() {
+		for range time.Tick(time.Second) {
+			ls.summarize(time.Now())
+		}
+	}()
+	return ls, nil
+}
+
+// allow counts the record and tells if it is within its limit.
+func (ls *logSampler) allow(r slog.Record, profile string) bool {
+	limit, ok := ls.byMsg[r.Message]
+	if !ok {
+		if ls.def == nil || r.Level < slog.LevelWarn {
+			return true
+		}
+		limit = *ls.def
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	key := sampleKey{msg: r.Message, profile: profile}
+	w := ls.seen[key]
+	if w == nil {
+		w = &sampleWindow{start: r.Time, interval: limit.interval}
+		ls.seen[key] = w
+	}
+	w.level = r.Level
+	w.count++
+	if w.count > limit.count {
+		w.suppressed++
+		return false
+	}
+	return true
+}
+
+// summarize logs how many records were dropped in the intervals that are
+// over and forgets those intervals.
+func (ls *logSampler) summarize(now time.Time) {
+	ls.mu.Lock()
+	var summaries []slog.Record
+	for key, w := range ls.seen {
+		if now.Sub(w.start) < w.interval {
+			continue
+		}
+		if w.suppressed > 0 {
+			r := slog.NewRecord(now, w.level, "suppressed similar messages", 0)
+			r.AddAttrs(slog.String("message", key.msg), slog.Int("suppressed", w.suppressed), slog.Duration("interval", w.interval))
+			if len(key.profile) > 0 {
+				r.AddAttrs(slog.String("profile", key.profile))
+			}
+			summaries = append(summaries, r)
+		}
+		delete(ls.seen, key)
+	}
+	ls.mu.Unlock()
+	for _, r := range summaries {
+		ls.out.Handle(context.Background(), r)
+	}
+}
+
+// sampleHandler drops the records over their limit.
+type sampleHandler struct {
+	slog.Handler
+	ls      *logSampler
+	profile string
+}
+
+func (h *sampleHandler) Handle(ctx context.Context, r slog.Record) error {
+	if !h.ls.allow(r, recordProfile(h.profile, r)) {
+		return nil
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *sampleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &sampleHandler{Handler: h.Handler.WithAttrs(attrs), ls: h.ls, profile: attrsProfile(h.profile, attrs)}
+}
+
+func (h *sampleHandler) WithGroup(name string) slog.Handler {
+	return &sampleHandler{Handler: h.Handler.WithGroup(name), ls: h.ls, profile: h.profile}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLimits(t *testing.T) {
+	def, byMsg, err := parseLogLimits("10/1s, handshake error=1/10s, a=b=2/1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def == nil || *def != (logLimit{10, time.Second}) {
+		t.Errorf("default %v", def)
+	}
+	if byMsg["handshake error"] != (logLimit{1, 10 * time.Second}) || byMsg["a=b"] != (logLimit{2, time.Minute}) {
+		t.Errorf("by message %v", byMsg)
+	}
+	for _, s := range []string{"10", "10/s", "x/1s", "-1/1s", "1/0s", "msg=1"} {
+		if _, _, err := parseLogLimits(s); err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+}
+
+func TestLogSampler(t *testing.T) {
+	lb := &logBuffer{}
+	out := slog.NewTextHandler(lb, nil)
+	def, byMsg, err := parseLogLimits("2/1m,noisy=1/1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without the ticker of newLogSampler, the test summarizes
+	ls := &logSampler{def: def, byMsg: byMsg, out: out, seen: make(map[sampleKey]*sampleWindow)}
+	logger := slog.New(&sampleHandler{Handler: out, ls: ls})
+
+	for i := 0; i < 3; i++ {
+		logger.Warn("dial failed", "profile", "web")
+		logger.With("profile", "api").Warn("dial failed")
+		logger.Info("accepted", "profile", "web")
+		logger.Info("noisy")
+	}
+	for msg, want := range map[string]int{`msg="dial failed" profile=web`: 2, `msg="dial failed" profile=api`: 2, "msg=accepted": 3, "msg=noisy": 1} {
+		if got := strings.Count(lb.String(), msg); got != want {
+			t.Errorf("%s logged %d times, want %d", msg, got, want)
+		}
+	}
+
+	ls.summarize(time.Now())
+	if strings.Contains(lb.String(), "suppressed") {
+		t.Error("summarized before the interval is over")
+	}
+	ls.summarize(time.Now().Add(time.Minute))
+	for _, want := range []string{
+		`level=WARN msg="suppressed similar messages" message="dial failed" suppressed=1 interval=1m0s profile=web`,
+		`level=WARN msg="suppressed similar messages" message="dial failed" suppressed=1 interval=1m0s profile=api`,
+		`level=INFO msg="suppressed similar messages" message=noisy suppressed=2 interval=1m0s`,
+	} {
+		if !strings.Contains(lb.String(), want) {
+			t.Errorf("no %s in\n%s", want, lb)
+		}
+	}
+	if len(ls.seen) > 0 {
+		t.Error("intervals over are kept")
+	}
+	logger.Warn("dial failed", "profile", "web")
+	if got := strings.Count(lb.String(), `msg="dial failed" profile=web`); got != 3 {
+		t.Error("not let through in a new interval")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// readyPoll is how often the profiles are looked at until systemd is told the
+// proxy is ready.
+const readyPoll = 100 * time.Millisecond
+
+// notifying tells if systemd started the proxy with Type=notify or
+// Type=notify-reload and waits for its notifications.
+func notifying() bool {
+	return len(os.Getenv("NOTIFY_SOCKET")) > 0
+}
+
+// notifySystemd sends state to systemd, it does nothing when systemd doesn't
+// wait for notifications.
+func notifySystemd(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		slog.Warn("error notifying systemd", "state", state, "err", err)
+	}
+}
+
+// readyProfiles counts the profiles that are ready, like /readyz.
+func (s *Supervisor) readyProfiles() (ready, total int) {
+	insts := s.Instances()
+	for _, inst := range insts {
+		if inst.ready() == nil {
+			ready++
+		}
+	}
+	return ready, len(insts) + len(s.Degraded())
+}
+
+// notifyReady tells systemd the proxy is ready when the ready quorum of
+// profiles is listening, or there are no profiles to wait for.
+func (s *Supervisor) notifyReady(quorum func(total int) int) bool {
+	ready, total := s.readyProfiles()
+	if total > 0 && ready < quorum(total) {
+		return false
+	}
+	notifySystemd(fmt.Sprintf("%s\nSTATUS=%d of %d profiles ready", daemon.SdNotifyReady, ready, total))
+	return true
+}
+
+// notifyReloading tells systemd a reload started, notifyReloaded that it
+// finished.
+func notifyReloading() {
+	state := daemon.SdNotifyReloading
+	if usec := monotonicUsec(); usec > 0 {
+		state += fmt.Sprintf("\nMONOTONIC_USEC=%d", usec)
+	}
+	notifySystemd(state)
+}
+
+func notifyReloaded(err error) {
+	status := "reloaded"
+	if err != nil {
+		status = "reload failed: " + err.Error()
+	}
+	notifySystemd(daemon.SdNotifyReady + "\nSTATUS=" + status)
+}
+
+// startWatchdog pings the systemd watchdog at half its interval when
+// WatchdogSec is set for the service. A ping is only sent when the main loop
+// answers the heartbeat, so a wedged proxy is restarted.
+func startWatchdog(s *Supervisor) error {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil {
+		return err
+	}
+	if interval <= 0 {
+		return nil
+	}
+	s.heartbeat = make(chan struct{})
+	stop := make(chan struct{})
+	s.stopWatchdog = func() { close(stop) }
+	go func() {
+		t := time.NewTicker(interval / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-stop:
+				return
+			}
+			select {
+			case s.heartbeat <- struct{}{}:
+				notifySystemd(daemon.SdNotifyWatchdog)
+			case <-stop:
+				return
+			case <-time.After(interval / 2):
+				slog.Warn("the main loop isn't answering, not pinging the systemd watchdog", "interval", interval)
+			}
+		}
+	}()
+	slog.Debug("pinging the systemd watchdog", "interval", interval)
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// monotonicUsec is 0 where there is no systemd to send it to.
+func monotonicUsec() int64 {
+	return 0
+}
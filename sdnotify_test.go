@@ -0,0 +1,151 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNotifySocket is systemd's notification socket, set in NOTIFY_SOCKET for
+// the test. It returns the notifications as they come.
+func testNotifySocket(t *testing.T) <-chan string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	t.Setenv("NOTIFY_SOCKET", path)
+	states := make(chan string, 16)
+	go func() {
+		b := make([]byte, 4096)
+		for {
+			n, err := c.Read(b)
+			if err != nil {
+				return
+			}
+			states <- string(b[:n])
+		}
+	}()
+	return states
+}
+
+// nextState waits for a notification, empty when none came.
+func nextState(states <-chan string, wait time.Duration) string {
+	select {
+	case s := <-states:
+		return s
+	case <-time.After(wait):
+		return ""
+	}
+}
+
+func TestNotifySystemd(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if notifying() {
+		t.Error("notifying without NOTIFY_SOCKET")
+	}
+	// nothing is sent and nothing fails
+	notifySystemd("READY=1")
+
+	states := testNotifySocket(t)
+	if !notifying() {
+		t.Error("not notifying with NOTIFY_SOCKET")
+	}
+	notifyReloading()
+	got := nextState(states, 5*time.Second)
+	if !strings.HasPrefix(got, "RELOADING=1") {
+		t.Errorf("reloading sent %q", got)
+	}
+	if runtime.GOOS == "linux" && !strings.Contains(got, "\nMONOTONIC_USEC=") {
+		t.Errorf("reloading sent %q without the time", got)
+	}
+	notifyReloaded(nil)
+	if got := nextState(states, 5*time.Second); got != "READY=1\nSTATUS=reloaded" {
+		t.Errorf("reloaded sent %q", got)
+	}
+	notifyReloaded(errors.New("bad config"))
+	if got := nextState(states, 5*time.Second); got != "READY=1\nSTATUS=reload failed: bad config" {
+		t.Errorf("failed reload sent %q", got)
+	}
+}
+
+func TestNotifyReady(t *testing.T) {
+	states := testNotifySocket(t)
+	up := testInstance(t, &Profile{Name: "up", Proxy: testEcho(t)})
+	down := testInstance(t, &Profile{Name: "down", Proxy: testEcho(t)})
+	down.StopListening()
+	waitFor(t, "down to stop listening", func() bool { return len(down.ListenAddr()) < 1 })
+	s := &Supervisor{insts: []*Instance{up, down}}
+
+	all := func(total int) int { return total }
+	if s.notifyReady(all) {
+		t.Error("ready with a profile not listening")
+	}
+	if got := nextState(states, 200*time.Millisecond); len(got) > 0 {
+		t.Errorf("sent %q before being ready", got)
+	}
+	if !s.notifyReady(func(int) int { return 1 }) {
+		t.Error("not ready with the quorum listening")
+	}
+	if got := nextState(states, 5*time.Second); got != "READY=1\nSTATUS=1 of 2 profiles ready" {
+		t.Errorf("sent %q", got)
+	}
+
+	if !(&Supervisor{}).notifyReady(all) {
+		t.Error("not ready without profiles")
+	}
+	if got := nextState(states, 5*time.Second); got != "READY=1\nSTATUS=0 of 0 profiles ready" {
+		t.Errorf("sent %q without profiles", got)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	states := testNotifySocket(t)
+	for _, c := range []struct{ usec, pid string }{
+		{"", ""},
+		{"400000", strconv.Itoa(os.Getpid() + 1)}, // for another process
+	} {
+		t.Setenv("WATCHDOG_USEC", c.usec)
+		t.Setenv("WATCHDOG_PID", c.pid)
+		s := &Supervisor{}
+		if err := startWatchdog(s); err != nil || s.heartbeat != nil {
+			t.Errorf("%q for %q: started with %v", c.usec, c.pid, err)
+		}
+	}
+
+	t.Setenv("WATCHDOG_USEC", "400000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	s := &Supervisor{}
+	if err := startWatchdog(s); err != nil || s.heartbeat == nil {
+		t.Fatalf("not started: %v", err)
+	}
+	defer s.shutdown(0)
+	// the main loop doesn't answer, systemd isn't pinged
+	if got := nextState(states, 600*time.Millisecond); len(got) > 0 {
+		t.Errorf("sent %q without the main loop answering", got)
+	}
+	<-s.heartbeat
+	if got := nextState(states, 5*time.Second); got != "WATCHDOG=1" {
+		t.Errorf("sent %q", got)
+	}
+	// shutting down stops it, the main loop isn't there to answer anymore
+	s.shutdown(0)
+	if got := nextState(states, 600*time.Millisecond); len(got) > 0 {
+		t.Errorf("sent %q after shutting down", got)
+	}
+
+	t.Setenv("WATCHDOG_USEC", "soon")
+	if err := startWatchdog(&Supervisor{}); err == nil {
+		t.Error("started with a bad interval")
+	}
+}
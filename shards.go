@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// shardListener is the listeners sharing an address with SO_REUSEPORT, the
+// kernel spreads new connections over their accept queues. Instances accept
+// from each shard in its own loop, Accept takes from all of them through one
+// for other callers.
+type shardListener struct {
+	shards []net.Listener
+	accept chan shardAccept
+	closed chan struct{}
+	start  sync.Once // of the Go routines Accept takes from
+	close  sync.Once
+}
+
+type shardAccept struct {
+	conn net.Conn
+	err  error
+}
+
+// listenShards opens n listeners on addr.
+func listenShards(network, addr string, n int) (*shardListener, error) {
+	l := &shardListener{
+		accept: make(chan shardAccept),
+		closed: make(chan struct{}),
+	}
+	bind := addr
+	for i := 1; i <= n; i++ {
+		sl, err := listenShard(network, addr, bind, i)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("listener %d of %d: %w", i, n, err)
+		}
+		l.shards = append(l.shards, sl)
+		// with port 0 the others share the port the first one got
+		bind = sl.Addr().String()
+	}
+	return l, nil
+}
+
+// listenShard opens shard, counting from 1, of the listeners on addr by
+// binding bind.
+func listenShard(network, addr, bind string, shard int) (net.Listener, error) {
+	lc := net.ListenConfig{Control: reusePort}
+	return sockets.listen(handedSocket{Net: network, Addr: addr, Shard: shard}, func(network, _ string) (net.Listener, error) {
+		return lc.Listen(context.Background(), network, bind)
+	})
+}
+
+func (l *shardListener) run(sl net.Listener) {
+	for {
+		c, err := sl.Accept()
+		select {
+		case l.accept <- shardAccept{conn: c, err: err}:
+		case <-l.closed:
+			if c != nil {
+				c.Close()
+			}
+			return
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+func (l *shardListener) Accept() (net.Conn, error) {
+	l.start.Do(func() {
+		for _, sl := range l.shards {
+			go l.run(sl)
+		}
+	})
+	select {
+	case a := <-l.accept:
+		return a.conn, a.err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *shardListener) Close() error {
+	var err error
+	l.close.Do(func() {
+		close(l.closed)
+		for _, sl := range l.shards {
+			if cerr := sl.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+func (l *shardListener) Addr() net.Addr {
+	return l.shards[0].Addr()
+}
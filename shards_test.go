@@ -0,0 +1,76 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestListenShards(t *testing.T) {
+	l, err := listenShards("tcp", "127.0.0.1:0", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i, sl := range l.shards {
+		if sl.Addr().String() != l.Addr().String() {
+			t.Errorf("shard %d on %s, want %s", i+1, sl.Addr(), l.Addr())
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		acceptOne(t, l, "tcp", l.Addr().String())
+	}
+
+	l.Close()
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("got %v after closing, want %v", err, net.ErrClosed)
+	}
+	if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		c.Close()
+		t.Error("a shard still listens after closing")
+	}
+}
+
+func TestInstanceShards(t *testing.T) {
+	inst := testInstance(t, &Profile{Proxy: testEcho(t), ListenShards: 2})
+	for i := 0; i < 4; i++ {
+		c, err := net.Dial("tcp", inst.ListenAddr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !echoes(c) {
+			t.Errorf("connection %d wasn't proxied", i)
+		}
+		c.Close()
+	}
+}
+
+func TestInstanceShardsTLS(t *testing.T) {
+	ca := newTestCA(t)
+	p := &Profile{Proxy: testEcho(t), ListenShards: 3}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+	for i := 0; i < 8; i++ {
+		c, err := tls.Dial("tcp", inst.ListenAddr(), ca.clientConfig(t, "client"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if !echoes(c) {
+			t.Fatalf("connection %d wasn't proxied", i)
+		}
+	}
+	// the shards accept on their own, the connections are still numbered
+	// one after the other
+	idents := make(map[string]bool)
+	for _, lc := range inst.Connections() {
+		idents[lc.ident] = true
+	}
+	if len(idents) != 8 {
+		t.Errorf("got %d connections by ident, want 8: %v", len(idents), idents)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// helloTimeout bounds how long a passthrough client has to send its ClientHello.
+const helloTimeout = 10 * time.Second
+
+var errHelloRead = errors.New("client hello read")
+
+// replayConn replays the bytes read while peeking before reading the
+// connection again.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// peekOnlyConn lets crypto/tls read a ClientHello without being able to
+// answer, the alert sent when the handshake is aborted is dropped.
+type peekOnlyConn struct {
+	replayConn
+}
+
+func (c *peekOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// peekServerName reads the ClientHello on c and returns the server name it
+// asks for along with a connection that replays the hello to the reader.
+func peekServerName(c net.Conn) (string, net.Conn, error) {
+	var buf bytes.Buffer
+	var hello *tls.ClientHelloInfo
+
+	c.SetReadDeadline(time.Now().Add(helloTimeout))
+	err := tls.Server(&peekOnlyConn{replayConn{Conn: c, r: io.TeeReader(c, &buf)}}, &tls.Config{
+		GetConfigForClient: func(h *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = h
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	c.SetReadDeadline(time.Time{})
+
+	if hello == nil {
+		return "", nil, err
+	}
+	return hello.ServerName, &replayConn{Conn: c, r: io.MultiReader(&buf, c)}, nil
+}
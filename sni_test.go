@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestPeekServerName(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "server")
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	tlsconf := ca.clientConfig(t, "client")
+	done := make(chan error, 1)
+	go func() {
+		c := tls.Client(client, tlsconf)
+		if err := c.Handshake(); err != nil {
+			done <- err
+			return
+		}
+		_, err := io.WriteString(c, "hello\n")
+		done <- err
+	}()
+
+	name, c, err := peekServerName(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "localhost" {
+		t.Errorf("server name %q", name)
+	}
+	// the hello is replayed, so the real server can still do the handshake
+	tc := tls.Server(c, &tls.Config{Certificates: []tls.Certificate{cert}})
+	line, err := bufio.NewReader(tc).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Errorf("got %q, %v after peeking", line, err)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPeekServerNameNotTLS(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		io.WriteString(client, "GET / HTTP/1.1\r\n\r\n")
+		client.Close()
+	}()
+	if _, _, err := peekServerName(server); err == nil {
+		t.Error("read a server name from plain text")
+	}
+}
+
+// testTLSBanner is testBanner behind TLS with a certificate of ca, valid for
+// names when given.
+func testTLSBanner(t *testing.T, ca *testCA, name string, names ...string) string {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, name)
+	if len(names) > 0 {
+		certPEM, keyPEM = ca.issueFor(t, name, names...)
+	}
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(c, name+"\n")
+			c.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestInstancePassthrough(t *testing.T) {
+	ca := newTestCA(t)
+	p := &Profile{Proxy: testTLSBanner(t, ca, "default"), Mode: ModePassthrough, Routes: map[string]*Route{
+		"api.example.test": {Proxy: testTLSBanner(t, ca, "api")},
+	}}
+	inst := testInstance(t, p)
+
+	for _, c := range []struct{ name, want string }{
+		{"api.example.test", "api\n"},
+		{"localhost", "default\n"},
+	} {
+		tlsconf := ca.clientConfig(t, "client")
+		tlsconf.ServerName, tlsconf.InsecureSkipVerify = c.name, true
+		if got := banner(t, inst.ListenAddr(), tlsconf); got != c.want {
+			t.Errorf("%s went to %q, want %q", c.name, got, c.want)
+		}
+	}
+	// the destination's own certificate reaches the client
+	c, err := tls.Dial("tcp", inst.ListenAddr(), ca.clientConfig(t, "client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if cn := c.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "default" {
+		t.Errorf("client saw the certificate of %q", cn)
+	}
+}
+
+func TestResolvePassthrough(t *testing.T) {
+	ca := newTestCA(t)
+	for _, c := range []struct {
+		name string
+		p    Profile
+		ok   bool
+	}{
+		{"routes", Profile{Mode: ModePassthrough, Routes: map[string]*Route{"a.example.test": {Proxy: "127.0.0.1:2"}}}, true},
+		{"listen authority", Profile{Mode: ModePassthrough, ListenAuthorityRaw: ca.pem}, false},
+		{"send authority", Profile{Mode: ModePassthrough, SendAuthorityRaw: ca.pem}, false},
+		{"unknown", Profile{Mode: "bridge"}, false},
+	} {
+		p := c.p
+		p.Name, p.Listen, p.Proxy = "test", ":0", "127.0.0.1:1"
+		if err := p.Resolve(); (err == nil) != c.ok {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"gopkg.in/yaml.v3"
+)
+
+// sopsValue is a value encrypted by SOPS.
+var sopsValue = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.+),iv:(.+),tag:(.+),type:(.+)\]`)
+
+// sopsKeys are the encrypted copies of the data key of a SOPS file.
+type sopsKeys struct {
+	KMS []struct {
+		ARN     string            `yaml:"arn"`
+		Role    string            `yaml:"role"`
+		Context map[string]string `yaml:"context"`
+		Profile string            `yaml:"aws_profile"`
+		Enc     string            `yaml:"enc"`
+	} `yaml:"kms"`
+	PGP []struct {
+		FP  string `yaml:"fp"`
+		Enc string `yaml:"enc"`
+	} `yaml:"pgp"`
+	Age []struct {
+		Recipient string `yaml:"recipient"`
+		Enc       string `yaml:"enc"`
+	} `yaml:"age"`
+}
+
+type sopsMetadata struct {
+	sopsKeys         `yaml:",inline"`
+	KeyGroups        []sopsKeys `yaml:"key_groups"`
+	LastModified     string     `yaml:"lastmodified"`
+	MAC              string     `yaml:"mac"`
+	MACOnlyEncrypted bool       `yaml:"mac_only_encrypted"`
+}
+
+// sopsDocument returns the document of a config file when it was encrypted
+// by SOPS. SOPS keeps YAML as YAML and JSON as JSON, other formats like TOML
+// are encrypted whole into the data key of a JSON document.
+func sopsDocument(b []byte) *yaml.Node {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil || len(doc.Content) < 1 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "sops" && root.Content[i+1].Kind == yaml.MappingNode {
+			return &doc
+		}
+	}
+	return nil
+}
+
+// decryptSOPS decrypts a config file encrypted by SOPS with the data key from
+// age, AWS KMS or PGP, and verifies its MAC. It returns the config in its
+// format, or as JSON when it was YAML or JSON.
+func decryptSOPS(doc *yaml.Node, format string) ([]byte, string, error) {
+	root := doc.Content[0]
+	var meta sopsMetadata
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "sops" {
+			if err := root.Content[i+1].Decode(&meta); err != nil {
+				return nil, "", fmt.Errorf("reading the sops section: %w", err)
+			}
+			root.Content = append(root.Content[:i], root.Content[i+2:]...)
+			break
+		}
+	}
+
+	keys := meta.sopsKeys
+	if len(meta.KeyGroups) > 1 {
+		return nil, "", errors.New("files with more than one key group aren't supported")
+	}
+	if len(meta.KeyGroups) > 0 {
+		keys = meta.KeyGroups[0]
+	}
+	key, err := sopsDataKey(keys)
+	if err != nil {
+		return nil, "", err
+	}
+
+	t := &sopsTree{key: key, mac: sha512.New(), macOnlyEncrypted: meta.MACOnlyEncrypted}
+	if err := t.node(doc, nil, false); err != nil {
+		return nil, "", err
+	}
+	lastModified, err := time.Parse(time.RFC3339, meta.LastModified)
+	if err != nil {
+		return nil, "", fmt.Errorf("parsing lastmodified: %w", err)
+	}
+	mac, err := decryptSOPSValue(meta.MAC, key, lastModified.Format(time.RFC3339))
+	if err != nil {
+		return nil, "", fmt.Errorf("decrypting the MAC: %w", err)
+	}
+	if mac != fmt.Sprintf("%X", t.mac.Sum(nil)) {
+		return nil, "", errors.New("the MAC doesn't match, the file was changed after it was encrypted")
+	}
+
+	var plain map[string]any
+	if err := doc.Decode(&plain); err != nil {
+		return nil, "", err
+	}
+	if format != ConfigYAML && format != ConfigJSON {
+		data, ok := plain["data"].(string)
+		if !ok || len(plain) != 1 {
+			return nil, "", errors.New("a sops file in this format has only a data key")
+		}
+		return []byte(data), format, nil
+	}
+	b, err := json.Marshal(plain)
+	return b, ConfigJSON, err
+}
+
+// sopsDataKey decrypts the data key with the first key that works.
+func sopsDataKey(keys sopsKeys) ([]byte, error) {
+	var errs []error
+	if len(keys.Age) > 0 {
+		ids, err := sopsAgeIdentities()
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, k := range keys.Age {
+			if len(ids) < 1 {
+				break
+			}
+			r, err := age.Decrypt(armor.NewReader(strings.NewReader(k.Enc)), ids...)
+			if err == nil {
+				return io.ReadAll(r)
+			}
+			errs = append(errs, fmt.Errorf("age %s: %w", k.Recipient, err))
+		}
+	}
+	for _, k := range keys.KMS {
+		key, err := sopsKMSKey(k.ARN, k.Role, k.Profile, k.Context, k.Enc)
+		if err == nil {
+			return key, nil
+		}
+		errs = append(errs, fmt.Errorf("kms %s: %w", k.ARN, err))
+	}
+	for _, k := range keys.PGP {
+		gpg := os.Getenv("SOPS_GPG_EXEC")
+		if len(gpg) < 1 {
+			gpg = "gpg"
+		}
+		cmd := exec.Command(gpg, "--batch", "--quiet", "--decrypt")
+		cmd.Stdin = strings.NewReader(k.Enc)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		key, err := cmd.Output()
+		if err == nil {
+			return key, nil
+		}
+		errs = append(errs, fmt.Errorf("pgp %s: %w: %s", k.FP, err, strings.TrimSpace(stderr.String())))
+	}
+	if len(errs) < 1 {
+		return nil, errors.New("no age, KMS or PGP key to decrypt with")
+	}
+	return nil, fmt.Errorf("no key decrypted the data key: %w", errors.Join(errs...))
+}
+
+// sopsAgeIdentities reads the age keys from SOPS_AGE_KEY, SOPS_AGE_KEY_FILE
+// or sops/age/keys.txt in the user config directory like sops does.
+func sopsAgeIdentities() ([]age.Identity, error) {
+	var ids []age.Identity
+	if env := os.Getenv("SOPS_AGE_KEY"); len(env) > 0 {
+		parsed, err := age.ParseIdentities(strings.NewReader(env))
+		if err != nil {
+			return nil, fmt.Errorf("parsing SOPS_AGE_KEY: %w", err)
+		}
+		ids = append(ids, parsed...)
+	}
+	path := os.Getenv("SOPS_AGE_KEY_FILE")
+	if len(path) < 1 {
+		dir := os.Getenv("XDG_CONFIG_HOME")
+		if len(dir) < 1 {
+			var err error
+			if dir, err = os.UserConfigDir(); err != nil {
+				return ids, nil
+			}
+		}
+		path = filepath.Join(dir, "sops", "age", "keys.txt")
+		if _, err := os.Stat(path); err != nil {
+			return ids, nil
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	parsed, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %q: %w", path, err)
+	}
+	return append(ids, parsed...), nil
+}
+
+func sopsKMSKey(arn, role, profile string, encContext map[string]string, enc string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), awsTimeout)
+	defer cancel()
+	blob, err := base64.StdEncoding.DecodeString(enc)
+	if err != nil {
+		return nil, err
+	}
+	opts := []func(*config.LoadOptions) error{config.WithRegion(arnRegion(arn))}
+	if len(profile) > 0 {
+		opts = append(opts, config.WithSharedConfigProfile(profile))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if len(role) > 0 {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), role))
+	}
+	out, err := kms.NewFromConfig(cfg).Decrypt(ctx, &kms.DecryptInput{
+		CiphertextBlob:    blob,
+		EncryptionContext: encContext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
+
+// decryptSOPSValue decrypts a value, the additional data is the path of the
+// value.
+func decryptSOPSValue(value string, key []byte, additional string) (string, error) {
+	m := sopsValue.FindStringSubmatch(value)
+	if m == nil {
+		return "", errors.New("not a sops encrypted value")
+	}
+	var parts [3][]byte
+	for i := range parts {
+		var err error
+		if parts[i], err = base64.StdEncoding.DecodeString(m[i+1]); err != nil {
+			return "", err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, len(parts[1]))
+	if err != nil {
+		return "", err
+	}
+	plain, err := gcm.Open(nil, parts[1], append(parts[0], parts[2]...), []byte(additional))
+	if err != nil {
+		return "", errors.New("decrypting failed, the value was changed or moved")
+	}
+	return string(plain), nil
+}
+
+// sopsTree walks a document like sops does, comments included, decrypting the
+// values in place and hashing them for the MAC.
+type sopsTree struct {
+	key              []byte
+	mac              hash.Hash
+	macOnlyEncrypted bool
+}
+
+func (t *sopsTree) node(n *yaml.Node, path []string, commentsHandled bool) error {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if err := t.comments(path, n.HeadComment, n.LineComment); err != nil {
+			return err
+		}
+		for _, c := range n.Content {
+			if err := t.node(c, path, false); err != nil {
+				return err
+			}
+		}
+		return t.comments(path, n.FootComment)
+	case yaml.MappingNode:
+		if !commentsHandled {
+			if err := t.comments(path, n.HeadComment, n.LineComment); err != nil {
+				return err
+			}
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if err := t.comments(path, k.HeadComment, k.LineComment); err != nil {
+				return err
+			}
+			scalar := v.Kind == yaml.ScalarNode || v.Kind == yaml.AliasNode
+			if scalar {
+				if err := t.comments(path, v.HeadComment, v.LineComment); err != nil {
+					return err
+				}
+			}
+			if err := t.node(v, append(path[:len(path):len(path)], k.Value), scalar); err != nil {
+				return err
+			}
+			if scalar {
+				if err := t.comments(path, v.FootComment); err != nil {
+					return err
+				}
+			}
+			if err := t.comments(path, k.FootComment); err != nil {
+				return err
+			}
+		}
+		if !commentsHandled {
+			return t.comments(path, n.FootComment)
+		}
+		return nil
+	case yaml.SequenceNode:
+		// items share the path of the sequence
+		if !commentsHandled {
+			if err := t.comments(path, n.HeadComment, n.LineComment); err != nil {
+				return err
+			}
+		}
+		for _, c := range n.Content {
+			if err := t.comments(path, c.HeadComment, c.LineComment); err != nil {
+				return err
+			}
+			if err := t.node(c, path, true); err != nil {
+				return err
+			}
+			if err := t.comments(path, c.FootComment); err != nil {
+				return err
+			}
+		}
+		return nil
+	case yaml.AliasNode:
+		return t.node(n.Alias, path, false)
+	case yaml.ScalarNode:
+		var v any
+		if err := n.Decode(&v); err != nil {
+			return err
+		}
+		s, ok := v.(string)
+		if !ok || !sopsValue.MatchString(s) {
+			t.hash(v, false)
+			return nil
+		}
+		plain, err := decryptSOPSValue(s, t.key, strings.Join(path, ":")+":")
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(path, "."), err)
+		}
+		n.Style, n.Value = 0, plain
+		switch sopsValue.FindStringSubmatch(s)[4] {
+		case "int":
+			n.Tag = "!!int"
+			v, err = strconv.Atoi(plain)
+		case "float":
+			n.Tag = "!!float"
+			v, err = strconv.ParseFloat(plain, 64)
+		case "bool":
+			n.Tag = "!!bool"
+			v, err = strconv.ParseBool(plain)
+		default:
+			n.Tag, v = "!!str", plain
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(path, "."), err)
+		}
+		t.hash(v, true)
+		return nil
+	}
+	return nil
+}
+
+// comments hashes the lines of comments, sops encrypts them too.
+func (t *sopsTree) comments(path []string, comments ...string) error {
+	for _, c := range comments {
+		for _, line := range strings.Split(c, "\n") {
+			if len(line) < 1 {
+				continue
+			}
+			line = line[1:] // the #
+			if !sopsValue.MatchString(line) {
+				t.hash(line, false)
+				continue
+			}
+			plain, err := decryptSOPSValue(line, t.key, strings.Join(path, ":")+":")
+			if err != nil {
+				return fmt.Errorf("comment in %s: %w", strings.Join(path, "."), err)
+			}
+			t.hash(plain, true)
+		}
+	}
+	return nil
+}
+
+// hash adds a value to the MAC the way sops turns values into bytes.
+func (t *sopsTree) hash(v any, encrypted bool) {
+	if t.macOnlyEncrypted && !encrypted {
+		return
+	}
+	switch v := v.(type) {
+	case string:
+		t.mac.Write([]byte(v))
+	case int:
+		t.mac.Write([]byte(strconv.Itoa(v)))
+	case float64:
+		t.mac.Write([]byte(strconv.FormatFloat(v, 'f', -1, 64)))
+	case bool:
+		if v {
+			t.mac.Write([]byte("True"))
+		} else {
+			t.mac.Write([]byte("False"))
+		}
+	}
+}
+
+// sopsFile is the decrypted config of a SOPS file, kept so reloads don't
+// decrypt the data key again while the file stays the same.
+type sopsFile struct {
+	sum    [sha256.Size]byte
+	plain  []byte
+	format string
+}
+
+var (
+	sopsFiles   = make(map[string]sopsFile)
+	sopsFilesMu sync.Mutex
+)
+
+// decryptSOPSFile returns the config file decrypted and its format when it
+// was encrypted by SOPS, and as it is otherwise.
+func decryptSOPSFile(path string, b []byte, format string) ([]byte, string, error) {
+	sum := sha256.Sum256(b)
+	sopsFilesMu.Lock()
+	defer sopsFilesMu.Unlock()
+	if f, ok := sopsFiles[path]; ok && f.sum == sum {
+		return f.plain, f.format, nil
+	}
+	doc := sopsDocument(b)
+	if doc == nil {
+		return b, format, nil
+	}
+	plain, plainFormat, err := decryptSOPS(doc, format)
+	if err != nil {
+		return nil, "", err
+	}
+	sopsFiles[path] = sopsFile{sum: sum, plain: plain, format: plainFormat}
+	return plain, plainFormat, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// sopsFixture encrypts values like sops does with an age key.
+type sopsFixture struct {
+	id      *age.X25519Identity
+	key     []byte
+	dataKey string // the data key encrypted to id, armored
+}
+
+func newSOPSFixture(t *testing.T) *sopsFixture {
+	t.Helper()
+	id, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &sopsFixture{id: id, key: make([]byte, 32)}
+	rand.Read(f.key)
+	var b bytes.Buffer
+	aw := armor.NewWriter(&b)
+	w, err := age.Encrypt(aw, id.Recipient())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(f.key)
+	w.Close()
+	aw.Close()
+	f.dataKey = b.String()
+	return f
+}
+
+// encrypt encrypts value with the path of its keys, typ is str, int, float
+// or bool.
+func (f *sopsFixture) encrypt(t *testing.T, value, additional, typ string) string {
+	t.Helper()
+	block, err := aes.NewCipher(f.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := make([]byte, 32)
+	rand.Read(iv)
+	sealed := gcm.Seal(nil, iv, []byte(value), []byte(additional))
+	data, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+	enc := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]", enc(data), enc(iv), enc(tag), typ)
+}
+
+// metadata is the sops section of a file whose values hash to macValues.
+func (f *sopsFixture) metadata(t *testing.T, macValues ...string) string {
+	t.Helper()
+	mac := sha512.New()
+	for _, v := range macValues {
+		mac.Write([]byte(v))
+	}
+	lastModified := time.Now().UTC().Format(time.RFC3339)
+	return fmt.Sprintf("sops:\n  age:\n    - recipient: %s\n      enc: |\n        %s\n  lastmodified: %q\n  mac: %s\n  version: 3.8.1\n",
+		f.id.Recipient(), strings.ReplaceAll(strings.TrimSpace(f.dataKey), "\n", "\n        "), lastModified,
+		f.encrypt(t, fmt.Sprintf("%X", mac.Sum(nil)), lastModified, "str"))
+}
+
+func TestSOPSConfig(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("SOPS_AGE_KEY_FILE", "")
+	f := newSOPSFixture(t)
+	t.Setenv("SOPS_AGE_KEY", f.id.String())
+	dir := t.TempDir()
+
+	path := writeConfig(t, dir, "proxy.yaml", fmt.Sprintf("web:\n  listen: %s\n  proxy: 10.0.0.1:443\n  maxconnections: %s\n%s",
+		f.encrypt(t, "127.0.0.1:8443", "web:listen:", "str"), f.encrypt(t, "10", "web:maxconnections:", "int"),
+		f.metadata(t, "127.0.0.1:8443", "10.0.0.1:443", "10")))
+	ps, err := Configurations{ConfigFiles: []string{path}}.getProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := profileNamed(ps, "web"); p == nil || p.Listen != "127.0.0.1:8443" || p.Proxy != "10.0.0.1:443" || p.MaxConnections != 10 {
+		t.Errorf("got %v", ps)
+	}
+
+	// formats sops can't keep are encrypted whole
+	toml := writeConfig(t, dir, "api.toml", fmt.Sprintf("data: %s\n%s",
+		f.encrypt(t, "[api]\nListen = \"127.0.0.1:9443\"\nProxy = \"10.0.0.2:443\"\n", "data:", "str"),
+		f.metadata(t, "[api]\nListen = \"127.0.0.1:9443\"\nProxy = \"10.0.0.2:443\"\n")))
+	ps, err = Configurations{ConfigFiles: []string{path, toml}}.getProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := profileNamed(ps, "api"); len(ps) != 2 || p == nil || p.Proxy != "10.0.0.2:443" {
+		t.Errorf("got %v", ps)
+	}
+
+	// a file changed after it was encrypted is left out, the others are read
+	tampered := writeConfig(t, dir, "tampered.yaml", fmt.Sprintf("web:\n  listen: %s\n  proxy: 10.0.0.9:443\n  maxconnections: %s\n%s",
+		f.encrypt(t, "127.0.0.1:8443", "web:listen:", "str"), f.encrypt(t, "10", "web:maxconnections:", "int"),
+		f.metadata(t, "127.0.0.1:8443", "10.0.0.1:443", "10")))
+	c := &Configurations{ConfigFiles: []string{toml, tampered}}
+	if ps, err = c.getProfiles(); err != nil || len(ps) != 1 || profileNamed(ps, "api") == nil {
+		t.Errorf("got %v, %v", ps, err)
+	}
+	if status, report := check(c); status != 1 || !strings.Contains(report, "the MAC doesn't match") {
+		t.Errorf("got %d:\n%s", status, report)
+	}
+
+	other, _ := age.GenerateX25519Identity()
+	t.Setenv("SOPS_AGE_KEY", other.String())
+	sopsFilesMu.Lock()
+	sopsFiles = make(map[string]sopsFile)
+	sopsFilesMu.Unlock()
+	if status, report := check(&Configurations{ConfigFiles: []string{path}}); status != 1 || !strings.Contains(report, "no key decrypted the data key") {
+		t.Errorf("got %d with another key:\n%s", status, report)
+	}
+}
+
+func TestSOPSDocument(t *testing.T) {
+	for in, want := range map[string]bool{
+		"web:\n  listen: a\nsops:\n  mac: b\n": true,
+		`{"web": {}, "sops": {"mac": "b"}}`:    true,
+		"web:\n  listen: a\n":                  false,
+		"sops: plain\n":                        false,
+		"[web]\nListen = \"a\"\n":              false,
+	} {
+		if got := sopsDocument([]byte(in)) != nil; got != want {
+			t.Errorf("%q: got %v", in, got)
+		}
+	}
+}
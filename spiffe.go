@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/spiffetls/tlsconfig"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+const spiffeTimeout = 30 * time.Second
+
+var (
+	spiffeSources   = make(map[string]*workloadapi.X509Source) // by Workload API address
+	spiffeSourcesMu sync.Mutex
+)
+
+// spiffeSource returns the X509 source for a Workload API address, shared by
+// every profile using the same address. The source follows SVID and bundle
+// rotation by itself.
+func spiffeSource(addr string) (*workloadapi.X509Source, error) {
+	spiffeSourcesMu.Lock()
+	defer spiffeSourcesMu.Unlock()
+
+	if src, ok := spiffeSources[addr]; ok {
+		return src, nil
+	}
+
+	var opts []workloadapi.X509SourceOption
+	if len(addr) > 0 {
+		opts = append(opts, workloadapi.WithClientOptions(workloadapi.WithAddr(addr)))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), spiffeTimeout)
+	defer cancel()
+	src, err := workloadapi.NewX509Source(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the Workload API: %w", err)
+	}
+	spiffeSources[addr] = src
+	return src, nil
+}
+
+func parseSPIFFEIDs(ids []string) ([]spiffeid.ID, error) {
+	parsed := make([]spiffeid.ID, 0, len(ids))
+	for _, x := range ids {
+		id, err := spiffeid.FromString(x)
+		if err != nil {
+			return nil, fmt.Errorf("parsing SPIFFE ID %q: %w", x, err)
+		}
+		parsed = append(parsed, id)
+	}
+	return parsed, nil
+}
+
+func spiffeAuthorizer(ids []spiffeid.ID) tlsconfig.Authorizer {
+	if len(ids) < 1 {
+		return tlsconfig.AuthorizeAny()
+	}
+	return tlsconfig.AuthorizeOneOf(ids...)
+}
+
+func spiffeServerConfig(p *Profile) (*tls.Config, error) {
+	src, err := spiffeSource(p.SPIFFESocket)
+	if err != nil {
+		return nil, err
+	}
+	tlsconf := tlsconfig.MTLSServerConfig(src, src, spiffeAuthorizer(p.listenSPIFFEIDs))
+	tlsconf.MinVersion = p.listenMinTLS
+	tlsconf.MaxVersion = p.listenMaxTLS
+	tlsconf.CipherSuites = p.listenCiphers
+	return tlsconf, nil
+}
+
+func spiffeClientConfig(p *Profile) (*tls.Config, error) {
+	src, err := spiffeSource(p.SPIFFESocket)
+	if err != nil {
+		return nil, err
+	}
+	tlsconf := tlsconfig.MTLSClientConfig(src, src, spiffeAuthorizer(p.sendSPIFFEIDs))
+	tlsconf.MinVersion = p.sendMinTLS
+	tlsconf.MaxVersion = p.sendMaxTLS
+	tlsconf.CipherSuites = p.sendCiphers
+	return tlsconf, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+)
+
+func TestParseSPIFFEIDs(t *testing.T) {
+	ids, err := parseSPIFFEIDs([]string{"spiffe://example.test/web", "spiffe://example.test/db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0].Path() != "/web" || ids[1].TrustDomain().Name() != "example.test" {
+		t.Errorf("got %v", ids)
+	}
+	for _, s := range []string{"https://example.test/web", "spiffe://", "web"} {
+		if _, err := parseSPIFFEIDs([]string{s}); err == nil {
+			t.Errorf("parsed %q", s)
+		}
+	}
+}
+
+func TestSPIFFEAuthorizer(t *testing.T) {
+	web := spiffeid.RequireFromString("spiffe://example.test/web")
+	db := spiffeid.RequireFromString("spiffe://example.test/db")
+	if err := spiffeAuthorizer(nil)(db, nil); err != nil {
+		t.Errorf("no IDs should authorize any: %v", err)
+	}
+	allow := spiffeAuthorizer([]spiffeid.ID{web})
+	if err := allow(web, nil); err != nil {
+		t.Errorf("listed ID: %v", err)
+	}
+	if err := allow(db, nil); err == nil {
+		t.Error("ID not listed authorized")
+	}
+}
+
+func TestResolveSPIFFE(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		p    Profile
+		ok   bool
+	}{
+		{"both sides", Profile{ListenSPIFFE: true, SendSPIFFE: true, ListenSPIFFEIDs: []string{"spiffe://example.test/web"}}, true},
+		{"listen certificate", Profile{ListenSPIFFE: true, ListenCertRaw: "cert"}, false},
+		{"listen ACME", Profile{ListenSPIFFE: true, ListenACMEDomains: []string{"example.test"}}, false},
+		{"send authority", Profile{SendSPIFFE: true, SendAuthorityRaw: "ca"}, false},
+		{"send server name", Profile{SendSPIFFE: true, SendServerName: "example.test"}, false},
+		{"bad ID", Profile{ListenSPIFFE: true, ListenSPIFFEIDs: []string{"example.test/web"}}, false},
+	} {
+		p := c.p
+		p.Name, p.Listen, p.Proxy = "test", ":0", "127.0.0.1:1"
+		if err := p.Resolve(); (err == nil) != c.ok {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	StartTLSSMTP     = "smtp"
+	StartTLSPostgres = "postgres"
+)
+
+// PostgreSQL startup request codes.
+const (
+	pgSSLRequest    = 80877103
+	pgGSSENCRequest = 80877104
+)
+
+// maxPreTLSCommands bounds how long a client can talk before upgrading.
+const maxPreTLSCommands = 20
+
+// localName is what the proxy calls itself in the protocols' greetings.
+var localName = func() string {
+	name, err := os.Hostname()
+	if err != nil || len(name) < 1 {
+		return "localhost"
+	}
+	return name
+}()
+
+// startTLSListener accepts connections that start in plaintext and upgrade to
+// TLS within the application protocol.
+type startTLSListener struct {
+	net.Listener
+	proto   string
+	tlsconf *tls.Config
+}
+
+func (l *startTLSListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &startTLSConn{Conn: c, proto: l.proto, tlsconf: l.tlsconf}, nil
+}
+
+// startTLSConn is a connection that still has to upgrade. The exchange waits
+// for the client, so it happens in upgrade instead of in Accept.
+type startTLSConn struct {
+	net.Conn
+	proto   string
+	tlsconf *tls.Config
+}
+
+// upgrade plays the server side of the protocol up to its switch to TLS, the
+// handshake is left to the returned connection.
+func (c *startTLSConn) upgrade() (*tls.Conn, error) {
+	c.Conn.SetDeadline(time.Now().Add(helloTimeout))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	r := bufio.NewReader(c.Conn)
+	var direct bool
+	var err error
+	switch c.proto {
+	case StartTLSSMTP:
+		err = smtpServerStartTLS(c.Conn, r)
+	case StartTLSPostgres:
+		direct, err = pgServerStartTLS(c.Conn, r)
+	default:
+		err = fmt.Errorf("unknown protocol %q", c.proto)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if direct {
+		// the client went straight to TLS, its ClientHello is buffered
+		return tls.Server(&replayConn{Conn: c.Conn, r: io.MultiReader(r, c.Conn)}, c.tlsconf), nil
+	}
+	if r.Buffered() > 0 {
+		// anything sent along with the request to upgrade would be taken as
+		// coming over TLS
+		return nil, errors.New("data sent before the TLS handshake")
+	}
+	return tls.Server(c.Conn, c.tlsconf), nil
+}
+
+// clientStartTLS plays the client side of the protocol up to its switch to
+// TLS on a connection to the destination. What the destination said that is
+// meant for the client, like the MySQL greeting, is returned.
+func clientStartTLS(ctx context.Context, c net.Conn, proto string) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+		defer c.SetDeadline(time.Time{})
+	}
+	r := bufio.NewReader(c)
+	var greeting []byte
+	var err error
+	switch proto {
+	case StartTLSSMTP:
+		err = smtpClientStartTLS(c, r)
+	case StartTLSPostgres:
+		err = pgClientStartTLS(c, r)
+	case StartTLSMySQL:
+		greeting, err = mysqlClientStartTLS(c, r)
+	default:
+		err = fmt.Errorf("unknown protocol %q", proto)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("STARTTLS: %w", err)
+	}
+	if r.Buffered() > 0 {
+		return nil, errors.New("STARTTLS: destination sent data before the TLS handshake")
+	}
+	return greeting, nil
+}
+
+// alignStartTLS makes up for one side having upgraded and the other not, so
+// the relayed conversation continues where each side expects.
+func alignStartTLS(proto string, listenUpgraded, sendUpgraded bool, l, c net.Conn) error {
+	switch proto {
+	case StartTLSSMTP:
+		if listenUpgraded && !sendUpgraded {
+			// the client was greeted by the proxy already
+			_, _, err := textproto.NewReader(bufio.NewReader(c)).ReadResponse(220)
+			if err != nil {
+				return fmt.Errorf("reading destination greeting: %w", err)
+			}
+		}
+		if !listenUpgraded && sendUpgraded {
+			// the destination's greeting went to the proxy
+			if _, err := fmt.Fprintf(l, "220 %s ESMTP\r\n", localName); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func smtpServerStartTLS(c net.Conn, r *bufio.Reader) error {
+	if _, err := fmt.Fprintf(c, "220 %s ESMTP\r\n", localName); err != nil {
+		return err
+	}
+	tr := textproto.NewReader(r)
+	for i := 0; i < maxPreTLSCommands; i++ {
+		line, err := tr.ReadLine()
+		if err != nil {
+			return err
+		}
+		verb, _, _ := strings.Cut(line, " ")
+		var reply string
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			reply = fmt.Sprintf("250-%s\r\n250 STARTTLS\r\n", localName)
+		case "HELO":
+			reply = fmt.Sprintf("250 %s\r\n", localName)
+		case "NOOP", "RSET":
+			reply = "250 2.0.0 OK\r\n"
+		case "STARTTLS":
+			_, err := fmt.Fprint(c, "220 2.0.0 Ready to start TLS\r\n")
+			return err
+		case "QUIT":
+			fmt.Fprint(c, "221 2.0.0 Bye\r\n")
+			return errors.New("client quit before STARTTLS")
+		default:
+			reply = "530 5.7.0 Must issue a STARTTLS command first\r\n"
+		}
+		if _, err := fmt.Fprint(c, reply); err != nil {
+			return err
+		}
+	}
+	return errors.New("too many commands before STARTTLS")
+}
+
+func smtpClientStartTLS(c net.Conn, r *bufio.Reader) error {
+	tr := textproto.NewReader(r)
+	if _, _, err := tr.ReadResponse(220); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(c, "EHLO %s\r\n", localName); err != nil {
+		return err
+	}
+	_, msg, err := tr.ReadResponse(250)
+	if err != nil {
+		return err
+	}
+	offered := false
+	for _, ext := range strings.Split(msg, "\n") {
+		if strings.EqualFold(strings.TrimSpace(ext), "STARTTLS") {
+			offered = true
+		}
+	}
+	if !offered {
+		return errors.New("destination doesn't offer STARTTLS")
+	}
+	if _, err := fmt.Fprint(c, "STARTTLS\r\n"); err != nil {
+		return err
+	}
+	_, _, err = tr.ReadResponse(220)
+	return err
+}
+
+// pgServerStartTLS answers the SSLRequest of a PostgreSQL client, direct is
+// for clients starting with the TLS handshake right away.
+func pgServerStartTLS(c net.Conn, r *bufio.Reader) (direct bool, err error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return false, err
+	}
+	if first[0] == 0x16 { // TLS handshake record
+		return true, nil
+	}
+	for i := 0; i < maxPreTLSCommands; i++ {
+		var msg [8]byte
+		if _, err := io.ReadFull(r, msg[:]); err != nil {
+			return false, err
+		}
+		length, code := binary.BigEndian.Uint32(msg[:4]), binary.BigEndian.Uint32(msg[4:])
+		switch {
+		case length == 8 && code == pgSSLRequest:
+			_, err := c.Write([]byte{'S'})
+			return false, err
+		case length == 8 && code == pgGSSENCRequest:
+			if _, err := c.Write([]byte{'N'}); err != nil {
+				return false, err
+			}
+		default:
+			c.Write(pgError("28000", "TLS is required"))
+			return false, errors.New("client started without TLS")
+		}
+	}
+	return false, errors.New("too many requests before SSLRequest")
+}
+
+// pgError is an ErrorResponse message ending the connection.
+func pgError(code, message string) []byte {
+	var fields bytes.Buffer
+	fields.WriteString("SFATAL\x00")
+	fields.WriteString("VFATAL\x00")
+	fields.WriteString("C" + code + "\x00")
+	fields.WriteString("M" + message + "\x00")
+	fields.WriteByte(0)
+	msg := []byte{'E', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(fields.Len()+4))
+	return append(msg, fields.Bytes()...)
+}
+
+func pgClientStartTLS(c net.Conn, r *bufio.Reader) error {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint32(msg, 8)
+	binary.BigEndian.PutUint32(msg[4:], pgSSLRequest)
+	if _, err := c.Write(msg); err != nil {
+		return err
+	}
+	answer, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch answer {
+	case 'S':
+		return nil
+	case 'N':
+		return errors.New("destination doesn't support TLS")
+	default:
+		return fmt.Errorf("unexpected answer %q to SSLRequest", answer)
+	}
+}
+
+// checkStartTLS checks the StartTLS protocol can be used with the other options.
+func (p *Profile) checkStartTLS() error {
+	switch p.StartTLS {
+	case "":
+		return nil
+	case StartTLSSMTP, StartTLSPostgres, StartTLSMySQL:
+	default:
+		return fmt.Errorf("StartTLS %q isn't %q, %q or %q", p.StartTLS, StartTLSSMTP, StartTLSPostgres, StartTLSMySQL)
+	}
+	if p.passthrough() || p.Mode == ModeHTTP {
+		return fmt.Errorf("StartTLS can't be used in %s mode", p.Mode)
+	}
+	if isPacket(p.listenNetwork()) || isPacket(p.sendNetwork()) || isQUIC(p.listenNetwork()) {
+		return errors.New("StartTLS requires stream listen and send protocols")
+	}
+	if p.StartTLS == StartTLSMySQL && len(p.Routes) > 0 {
+		// the client's server name is only known after connecting
+		return errors.New("Routes can't be used with StartTLS mysql")
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSMTPStartTLS(t *testing.T) {
+	s, c := net.Pipe()
+	defer s.Close()
+	defer c.Close()
+	done := make(chan error, 1)
+	go func() { done <- smtpServerStartTLS(s, bufio.NewReader(s)) }()
+	if err := smtpClientStartTLS(c, bufio.NewReader(c)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// mail can't be sent before upgrading
+	s, c = net.Pipe()
+	defer s.Close()
+	defer c.Close()
+	go func() { done <- smtpServerStartTLS(s, bufio.NewReader(s)) }()
+	tc := textproto.NewConn(c)
+	if _, _, err := tc.ReadResponse(220); err != nil {
+		t.Fatal(err)
+	}
+	tc.PrintfLine("MAIL FROM:<a@example.test>")
+	if code, _, err := tc.ReadResponse(250); code != 530 {
+		t.Errorf("got %d, %v before STARTTLS", code, err)
+	}
+	tc.PrintfLine("QUIT")
+	tc.ReadResponse(221)
+	if err := <-done; err == nil {
+		t.Error("no error after the client quit")
+	}
+}
+
+// testSMTP greets as an SMTP server and answers every command after its
+// name, upgrading on STARTTLS to a certificate of ca when it's given.
+func testSMTP(t *testing.T, ca *testCA, name string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var tlsconf *tls.Config
+	if ca != nil {
+		certPEM, keyPEM := ca.issue(t, name)
+		cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsconf = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var conn net.Conn = c
+				tc := textproto.NewConn(conn)
+				tc.PrintfLine("220 %s ESMTP", name)
+				for {
+					line, err := tc.ReadLine()
+					if err != nil {
+						return
+					}
+					switch {
+					case strings.HasPrefix(line, "EHLO") && tlsconf != nil && conn == c:
+						tc.PrintfLine("250-%s\r\n250 STARTTLS", name)
+					case line == "STARTTLS" && tlsconf != nil && conn == c:
+						tc.PrintfLine("220 go ahead")
+						conn = tls.Server(c, tlsconf)
+						tc = textproto.NewConn(conn)
+					default:
+						tc.PrintfLine("250 %s got %s", name, line)
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// smtpUpgrade goes through STARTTLS on a connection to addr.
+func smtpUpgrade(t *testing.T, addr string, tlsconf *tls.Config) *textproto.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := smtpClientStartTLS(c, bufio.NewReader(c)); err != nil {
+		t.Fatal(err)
+	}
+	tc := tls.Client(c, tlsconf)
+	if err := tc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return textproto.NewConn(tc)
+}
+
+func TestInstanceSMTPStartTLS(t *testing.T) {
+	ca := newTestCA(t)
+	for _, c := range []struct {
+		name string
+		ca   *testCA
+	}{
+		{"plaintext destination", nil},
+		{"STARTTLS destination", ca},
+	} {
+		p := &Profile{Proxy: testSMTP(t, c.ca, "dest"), StartTLS: StartTLSSMTP}
+		ca.listenTLS(t, p)
+		if c.ca != nil {
+			p.SendAuthorityRaw = ca.pem
+		}
+		inst := testInstance(t, p)
+
+		// the destination's greeting was taken care of, the next reply is to
+		// what the client says over TLS
+		tc := smtpUpgrade(t, inst.ListenAddr(), ca.clientConfig(t, "client"))
+		tc.PrintfLine("NOOP")
+		if _, msg, err := tc.ReadResponse(250); err != nil || msg != "dest got NOOP" {
+			t.Errorf("%s: got %q, %v", c.name, msg, err)
+		}
+	}
+
+	// a plaintext client is greeted by the proxy, the destination's
+	// greeting went to the proxy's upgrade
+	p := &Profile{Proxy: testSMTP(t, ca, "dest"), StartTLS: StartTLSSMTP, SendAuthorityRaw: ca.pem}
+	inst := testInstance(t, p)
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	tc := textproto.NewConn(c)
+	if _, msg, err := tc.ReadResponse(220); err != nil || strings.HasPrefix(msg, "dest") {
+		t.Errorf("greeted with %q, %v", msg, err)
+	}
+	tc.PrintfLine("NOOP")
+	if _, msg, err := tc.ReadResponse(250); err != nil || msg != "dest got NOOP" {
+		t.Errorf("got %q, %v", msg, err)
+	}
+
+	for _, p := range []Profile{
+		{StartTLS: "imap"},
+		{StartTLS: StartTLSSMTP, Mode: ModeHTTP},
+		{StartTLS: StartTLSSMTP, ListenProtocol: "udp"},
+	} {
+		if err := p.checkStartTLS(); err == nil {
+			t.Errorf("%+v passed", p)
+		}
+	}
+}
+
+func TestPostgresStartTLS(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		sent   []byte
+		answer string
+		direct bool
+		err    bool
+	}{
+		{"SSLRequest", []byte{0, 0, 0, 8, 4, 210, 22, 47}, "S", false, false},
+		{"GSSENCRequest first", []byte{0, 0, 0, 8, 4, 210, 22, 48, 0, 0, 0, 8, 4, 210, 22, 47}, "NS", false, false},
+		{"direct TLS", []byte{0x16, 3, 1}, "", true, false},
+		{"plaintext startup", []byte{0, 0, 0, 8, 0, 3, 0, 0}, "E", false, true},
+	} {
+		var answer strings.Builder
+		r := bufio.NewReader(strings.NewReader(string(c.sent)))
+		direct, err := pgServerStartTLS(writerConn{w: &answer}, r)
+		if direct != c.direct || (err != nil) != c.err {
+			t.Errorf("%s: got %v, %v", c.name, direct, err)
+		}
+		if got := answer.String(); !strings.HasPrefix(got, c.answer) || (len(c.answer) < 1 && len(got) > 0) {
+			t.Errorf("%s: answered %q", c.name, got)
+		}
+	}
+}
+
+// writerConn is a connection that is only written to.
+type writerConn struct {
+	net.Conn
+	w *strings.Builder
+}
+
+func (c writerConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+// testPostgres accepts the SSLRequest and writes name once upgraded to a
+// certificate of ca.
+func testPostgres(t *testing.T, ca *testCA, name string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	certPEM, keyPEM := ca.issue(t, name)
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var req [8]byte
+				if _, err := io.ReadFull(c, req[:]); err != nil {
+					return
+				}
+				c.Write([]byte{'S'})
+				tc := tls.Server(c, &tls.Config{Certificates: []tls.Certificate{cert}})
+				io.WriteString(tc, name+"\n")
+				tc.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestInstancePostgresStartTLS(t *testing.T) {
+	ca := newTestCA(t)
+	p := &Profile{Proxy: testPostgres(t, ca, "dest"), StartTLS: StartTLSPostgres, SendAuthorityRaw: ca.pem}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := pgClientStartTLS(c, bufio.NewReader(c)); err != nil {
+		t.Fatal(err)
+	}
+	tc := tls.Client(c, ca.clientConfig(t, "client"))
+	if line, _ := bufio.NewReader(tc).ReadString('\n'); line != "dest\n" {
+		t.Errorf("got %q after SSLRequest", line)
+	}
+
+	// newer clients start with the handshake right away
+	if got := banner(t, inst.ListenAddr(), ca.clientConfig(t, "client")); got != "dest\n" {
+		t.Errorf("got %q with direct TLS", got)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// unknownOption is a key of a config that no option takes, or a variable
+// without an option suffix, which decoding ignores.
+type unknownOption struct {
+	where string // the source, with the line when it was found
+	what  string
+}
+
+func (u unknownOption) Error() string {
+	return u.where + ": " + u.what
+}
+
+// profilesType is what a config with profiles by name decodes into.
+var profilesType = reflect.TypeOf(map[string]*Profile(nil))
+
+// findUnknownOptions finds the keys of a config that no option takes, like
+// decoding it matches them to options regardless of case. The config has
+// profiles by name and a vars section, or is the one profile named profile.
+func findUnknownOptions(b []byte, format, source, profile string) []unknownOption {
+	t := profilesType
+	if len(profile) > 0 {
+		t = profilesType.Elem().Elem()
+	}
+	var paths [][]string
+	var lines []int
+	add := func(path []string, line int) {
+		if len(profile) > 0 {
+			path = append([]string{profile}, path...)
+		} else if len(path) > 0 && path[0] == configVars {
+			return
+		}
+		paths = append(paths, path)
+		lines = append(lines, line)
+	}
+
+	switch format {
+	case ConfigYAML, ConfigJSON:
+		var doc yaml.Node
+		if err := yaml.Unmarshal(b, &doc); err != nil || len(doc.Content) < 1 {
+			return nil
+		}
+		walkUnknownOptions(doc.Content[0], t, nil, add)
+	default:
+		md, err := toml.Decode(string(b), reflect.New(t).Interface())
+		if err != nil {
+			return nil
+		}
+		undecoded := md.Undecoded()
+		tables := make(map[string]bool)
+		for _, k := range undecoded {
+			tables[k.String()] = true
+		}
+		for _, k := range undecoded {
+			// the keys of an unknown table are only reported with it
+			if len(k) > 1 && tables[k[:len(k)-1].String()] {
+				continue
+			}
+			add(k, tomlLine(b, k))
+		}
+	}
+
+	unknown := make([]unknownOption, len(paths))
+	for i, path := range paths {
+		unknown[i] = newUnknownOption(source, lines[i], path)
+	}
+	return unknown
+}
+
+// walkUnknownOptions calls add with the keys of n that t has no field for.
+func walkUnknownOptions(n *yaml.Node, t reflect.Type, path []string, add func([]string, int)) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if k.Tag == "!!merge" {
+				walkUnknownOptions(v, t, path, add)
+				continue
+			}
+			keyPath := append(path[:len(path):len(path)], k.Value)
+			if t.Kind() == reflect.Map {
+				walkUnknownOptions(v, t.Elem(), keyPath, add)
+				continue
+			}
+			f, ok := optionField(t, k.Value)
+			if !ok {
+				add(keyPath, k.Line)
+				continue
+			}
+			walkUnknownOptions(v, f.Type, keyPath, add)
+		}
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			return
+		}
+		// items share the path like they do in toml
+		for _, item := range n.Content {
+			walkUnknownOptions(item, t.Elem(), path, add)
+		}
+	}
+}
+
+func optionField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.IsExported() && strings.EqualFold(f.Name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// tomlLine finds the line of a key, toml doesn't tell. It is 0 when it isn't
+// found, like for keys of inline tables.
+func tomlLine(b []byte, key toml.Key) int {
+	var table []string
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		var k []string
+		switch {
+		case strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "[["):
+			header, _, _ := strings.Cut(line[2:], "]]")
+			table = tomlKeyParts(header)
+			k = table
+		case strings.HasPrefix(line, "["):
+			header, _, _ := strings.Cut(line[1:], "]")
+			table = tomlKeyParts(header)
+			k = table
+		default:
+			name, _, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+			k = append(table[:len(table):len(table)], tomlKeyParts(name)...)
+		}
+		if reflect.DeepEqual(k, []string(key)) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// tomlKeyParts splits a dotted key, quoted parts lose their quotes and keep
+// their dots.
+func tomlKeyParts(s string) []string {
+	var parts []string
+	var part strings.Builder
+	var quote rune
+	for _, r := range s {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			part.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '.':
+			parts = append(parts, part.String())
+			part.Reset()
+		case r != ' ' && r != '\t':
+			part.WriteRune(r)
+		}
+	}
+	return append(parts, part.String())
+}
+
+// newUnknownOption describes the key at path, the first key being the
+// profile, with the option it was likely meant to be.
+func newUnknownOption(source string, line int, path []string) unknownOption {
+	u := unknownOption{where: source}
+	if line > 0 {
+		u.where = fmt.Sprintf("%s:%d", source, line)
+	}
+	if len(path) < 2 {
+		u.what = fmt.Sprintf("%s isn't a profile", strings.Join(path, "."))
+		return u
+	}
+	in := "profile " + path[0]
+	if path[0] == configDefaults {
+		in = "the defaults"
+	}
+	u.what = fmt.Sprintf("%s in %s isn't an option", strings.Join(path[1:], "."), in)
+	if s := closestOption(optionType(profilesType, path[:len(path)-1]), path[len(path)-1]); len(s) > 0 {
+		u.what += ", did you mean " + s + "?"
+	}
+	return u
+}
+
+// optionType is the type of the value at path.
+func optionType(t reflect.Type, path []string) reflect.Type {
+	for {
+		for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+		if len(path) < 1 {
+			return t
+		}
+		switch t.Kind() {
+		case reflect.Map:
+			t = t.Elem()
+		case reflect.Struct:
+			f, ok := optionField(t, path[0])
+			if !ok {
+				return nil
+			}
+			t = f.Type
+		default:
+			return nil
+		}
+		path = path[1:]
+	}
+}
+
+// closestOption is the field of t that key is a misspelling of, empty when
+// none is close enough.
+func closestOption(t reflect.Type, key string) string {
+	if t == nil || t.Kind() != reflect.Struct {
+		return ""
+	}
+	best, bestDist := "", 3 // at most two edits
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if d := editDistance(strings.ToLower(key), strings.ToLower(f.Name)); d < bestDist {
+			best, bestDist = f.Name, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance of a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// missingAddress tells why a profile can't run, when it has no listen or no
+// destination address.
+func (p *Profile) missingAddress() error {
+	if len(p.Listen) < 1 {
+		return errors.New("there is no listen address, set Listen")
+	}
+	if !isUnix(p.sendNetwork()) && len(sendAddrs(p)) < 1 && len(p.Routes) < 1 {
+		return errors.New("there is no destination address, set Proxy or Routes")
+	}
+	return nil
+}
+
+// strictProblems are what strict parsing rejects: keys and variables that
+// aren't options, and profiles without a listen or destination address.
+func strictProblems(layers []configLayer, ps []*Profile) []error {
+	var problems []error
+	for _, l := range layers {
+		for _, u := range l.unknown {
+			problems = append(problems, u)
+		}
+	}
+	for _, p := range ps {
+		if err := p.missingAddress(); err != nil {
+			problems = append(problems, fmt.Errorf("profile %s: %w", p.Name, err))
+		}
+	}
+	return problems
+}
+
+// checkStrict fails with every problem in strict mode, and only logs them
+// otherwise.
+func (c Configurations) checkStrict(layers []configLayer, ps []*Profile) error {
+	problems := strictProblems(layers, ps)
+	if len(problems) < 1 {
+		return nil
+	}
+	if c.Strict {
+		return fmt.Errorf("strict configuration: %w", errors.Join(problems...))
+	}
+	for _, err := range problems {
+		slog.Warn("configuration problem, rejected with -strict", "problem", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"proxy", "proxy", 0},
+		{"proxi", "proxy", 1},
+		{"prxoy", "proxy", 2},
+		{"", "abc", 3},
+		{"listen", "silent", 4},
+	} {
+		if got := editDistance(c.a, c.b); got != c.want {
+			t.Errorf("%q, %q: got %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+// unknownWhat lists what the unknown options are.
+func unknownWhat(unknown []unknownOption) []string {
+	var what []string
+	for _, u := range unknown {
+		what = append(what, u.Error())
+	}
+	return what
+}
+
+func TestFindUnknownOptions(t *testing.T) {
+	toml := `[vars]
+anything = "goes"
+
+[web]
+# Proxi = "commented out"
+Proxi = "10.0.0.1:443"
+proxy = "10.0.0.1:443"
+
+[web.Routes."api.example.test"]
+Proxyy = "10.0.0.2:443"
+
+[defaults]
+Timeuot = "5s"
+`
+	got := unknownWhat(findUnknownOptions([]byte(toml), ConfigTOML, "proxy.toml", ""))
+	want := []string{
+		"proxy.toml:6: Proxi in profile web isn't an option, did you mean Proxy?",
+		"proxy.toml:10: Routes.api.example.test.Proxyy in profile web isn't an option, did you mean Proxy?",
+		"proxy.toml:13: Timeuot in the defaults isn't an option",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	yaml := "web:\n  listen: 127.0.0.1:8443\n  listenalowedcns: [alice]\n  listencertificates:\n    - certpath: a.pem\n      keypath: a.key\n"
+	got = unknownWhat(findUnknownOptions([]byte(yaml), ConfigYAML, "proxy.yaml", ""))
+	if len(got) != 2 || !strings.HasPrefix(got[0], "proxy.yaml:3: listenalowedcns in profile web isn't an option, did you mean ListenAllowedCNs?") ||
+		!strings.HasPrefix(got[1], "proxy.yaml:6: listencertificates.keypath in profile web") {
+		t.Errorf("got %q", got)
+	}
+
+	// the value of an etcd key is one profile
+	got = unknownWhat(findUnknownOptions([]byte(`{"Proxy": "a", "Lsten": "b"}`), ConfigJSON, "/mtlsproxy/web", "web"))
+	if len(got) != 1 || got[0] != "/mtlsproxy/web:1: Lsten in profile web isn't an option, did you mean Listen?" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestStrictConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, dir, "proxy.toml", "[web]\nListen = \"127.0.0.1:8443\"\nProxi = \"10.0.0.1:443\"\n")
+	c := Configurations{ConfigFiles: []string{path}}
+	if ps, err := c.getProfiles(); err != nil || len(ps) != 1 {
+		t.Errorf("got %v, %v without -strict", ps, err)
+	}
+	c.Strict = true
+	_, err := c.getProfiles()
+	if err == nil || !strings.Contains(err.Error(), "did you mean Proxy?") || !strings.Contains(err.Error(), "there is no destination address") {
+		t.Errorf("got %v", err)
+	}
+
+	t.Setenv(EnvProfilePrefix+"WEB_PROXI", "10.0.0.1:443")
+	_, unknown, err := profilesFromEnv()
+	if err != nil || len(unknown) != 1 || !strings.Contains(unknown[0].what, EnvProfilePrefix+"WEB_PROXI") {
+		t.Errorf("got %v, %v", unknown, err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	syslogFacility     = 3 // daemon
+	syslogDefaultPort  = "514"
+	syslogTimeout      = 2 * time.Second
+	syslogRetryBackoff = 5 * time.Second // before dialing again after failing to
+)
+
+// syslogLocalPaths are where the local syslog daemon may be listening.
+var syslogLocalPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// syslogSender writes records to the local syslog daemon in its traditional
+// format, or to a remote one in the RFC 5424 format. TCP messages are framed
+// with their length, as RFC 6587 has it.
+type syslogSender struct {
+	network, addr string // empty for the local daemon
+	hostname      string
+	conn          net.Conn
+	retryAt       time.Time
+}
+
+func newSyslogSender(output string) (*syslogSender, error) {
+	s := &syslogSender{}
+	if output != LogOutputSyslog {
+		u, err := url.Parse(output)
+		if err != nil {
+			return nil, fmt.Errorf("parsing log output: %w", err)
+		}
+		switch u.Scheme {
+		case "syslog", "syslog+udp":
+			s.network = "udp"
+		case "syslog+tcp":
+			s.network = "tcp"
+		default:
+			return nil, fmt.Errorf("log output %q isn't syslog://, syslog+udp:// or syslog+tcp://", output)
+		}
+		if len(u.Host) < 1 {
+			return nil, fmt.Errorf("log output %q has no host", output)
+		}
+		s.addr = u.Host
+		if len(u.Port()) < 1 {
+			s.addr = net.JoinHostPort(u.Host, syslogDefaultPort)
+		}
+		if s.hostname, err = os.Hostname(); err != nil || len(s.hostname) < 1 {
+			s.hostname = "-"
+		}
+	}
+	if err := s.dial(); err != nil {
+		return nil, fmt.Errorf("connecting to syslog: %w", err)
+	}
+	return s, nil
+}
+
+func (s *syslogSender) dial() error {
+	if len(s.network) > 0 {
+		c, err := net.DialTimeout(s.network, s.addr, syslogTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = c
+		return nil
+	}
+	for _, path := range syslogLocalPaths {
+		for _, network := range []string{"unixgram", "unix"} {
+			if c, err := net.Dial(network, path); err == nil {
+				s.conn = c
+				return nil
+			}
+		}
+	}
+	return errors.New("no local syslog daemon found")
+}
+
+// send is only called by one record at a time, the sink is locked.
+func (s *syslogSender) send(level slog.Level, msg string) error {
+	line := s.format(level, msg)
+	if s.conn != nil {
+		s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+		if _, err := s.conn.Write(line); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	// the daemon restarted or the connection broke, try again once
+	if time.Now().Before(s.retryAt) {
+		return errors.New("syslog is unreachable")
+	}
+	if err := s.dial(); err != nil {
+		s.retryAt = time.Now().Add(syslogRetryBackoff)
+		return err
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	_, err := s.conn.Write(line)
+	return err
+}
+
+func (s *syslogSender) format(level slog.Level, msg string) []byte {
+	pri := syslogFacility*8 + severity(level)
+	if len(s.network) < 1 {
+		return []byte(fmt.Sprintf("<%d>%s mtlsproxy[%d]: %s", pri, time.Now().Format(time.Stamp), os.Getpid(), msg))
+	}
+	line := fmt.Sprintf("<%d>1 %s %s mtlsproxy %d - - %s", pri, time.Now().Format("2006-01-02T15:04:05.000000Z07:00"), s.hostname, os.Getpid(), msg)
+	if s.network == "tcp" {
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+	return []byte(line)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSyslogUDP receives datagrams like a remote syslog daemon.
+func testSyslogUDP(t *testing.T) (net.PacketConn, string) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc, pc.LocalAddr().String()
+}
+
+func readDatagram(t *testing.T, pc net.PacketConn) string {
+	t.Helper()
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 2048)
+	n, _, err := pc.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b[:n])
+}
+
+func TestSyslogSender(t *testing.T) {
+	pc, addr := testSyslogUDP(t)
+	s, err := newSyslogSender("syslog://" + addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.send(slog.LevelWarn, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	got := readDatagram(t, pc)
+	suffix := fmt.Sprintf(" mtlsproxy %d - - hello", os.Getpid())
+	if !strings.HasPrefix(got, "<28>1 ") || !strings.HasSuffix(got, suffix) {
+		t.Errorf("got %q", got)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if s, err = newSyslogSender("syslog+tcp://" + l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s.send(slog.LevelError, "one")
+	s.send(slog.LevelDebug, "two")
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(c)
+	for _, want := range []string{"<27>1 ", "<31>1 "} {
+		var n int
+		if _, err := fmt.Fscanf(br, "%d ", &n); err != nil {
+			t.Fatal(err)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(br, msg); err != nil || !strings.HasPrefix(string(msg), want) {
+			t.Errorf("got %q, %v, want it framed and starting with %q", msg, err, want)
+		}
+	}
+
+	for _, output := range []string{"syslog+tls://127.0.0.1:514", "syslog://", "syslog+tcp://" + closedAddr(t)} {
+		if _, err := newSyslogSender(output); err == nil {
+			t.Errorf("%s accepted", output)
+		}
+	}
+}
+
+func TestSetupLoggingSyslog(t *testing.T) {
+	pc, addr := testSyslogUDP(t)
+	prev := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	if err := setupLogging(&Configurations{LogOutput: "syslog://" + addr, LogFormat: LogFormatText}); err != nil {
+		t.Fatal(err)
+	}
+	slog.Error("failed", "profile", "web")
+	got := readDatagram(t, pc)
+	if !strings.HasPrefix(got, "<27>1 ") || !strings.HasSuffix(got, " - - level=ERROR msg=failed profile=web") {
+		t.Errorf("got %q", got)
+	}
+
+	if err := setupLogging(&Configurations{LogOutput: "file"}); err == nil {
+		t.Error("unknown output accepted")
+	}
+}
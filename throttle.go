@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// parseByteRate reads bytes per second with an optional K, M or G suffix in
+// powers of 1024, like 512K or 10MB.
+func parseByteRate(s string) (int, error) {
+	num := strings.ToUpper(strings.TrimSpace(s))
+	num = strings.TrimSuffix(num, "/S")
+	num = strings.TrimSuffix(num, "B")
+	mult := 1
+	switch {
+	case strings.HasSuffix(num, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(num, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(num, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		num = num[:len(num)-1]
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n*float64(mult) < 1 {
+		return 0, fmt.Errorf("%q isn't a byte rate like 512K or 10MB", s)
+	}
+	return int(n * float64(mult)), nil
+}
+
+// newByteLimiter allows bytesPerSecond with a second's worth of burst.
+func newByteLimiter(bytesPerSecond int) *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(bytesPerSecond), bytesPerSecond)
+}
+
+// throttledReader holds reads back to the rate of all its limiters, a
+// connection's own and the one shared by the profile.
+type throttledReader struct {
+	r         io.Reader
+	lims      []*rate.Limiter
+	datagrams bool // reads can't be shortened, they are whole datagrams
+}
+
+func throttle(r io.Reader, lims ...*rate.Limiter) io.Reader {
+	var active []*rate.Limiter
+	for _, lim := range lims {
+		if lim != nil {
+			active = append(active, lim)
+		}
+	}
+	if len(active) < 1 {
+		return r
+	}
+	return &throttledReader{r: r, lims: active}
+}
+
+// throttleDatagrams is throttle for a packet connection, a datagram larger
+// than the burst is read whole and waited for in several steps.
+func throttleDatagrams(r io.Reader, lims ...*rate.Limiter) io.Reader {
+	r = throttle(r, lims...)
+	if t, ok := r.(*throttledReader); ok {
+		t.datagrams = true
+	}
+	return r
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	if !t.datagrams {
+		for _, lim := range t.lims {
+			if lim.Burst() < len(b) {
+				b = b[:lim.Burst()]
+			}
+		}
+	}
+	n, err := t.r.Read(b)
+	if n > 0 {
+		for _, lim := range t.lims {
+			// WaitN fails for more than the burst
+			for left := n; left > 0; left -= lim.Burst() {
+				if werr := lim.WaitN(context.Background(), min(left, lim.Burst())); werr != nil {
+					if err == nil {
+						err = werr
+					}
+					break
+				}
+			}
+		}
+	}
+	return n, err
+}
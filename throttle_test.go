@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestParseByteRate(t *testing.T) {
+	for s, want := range map[string]int{"100": 100, "512K": 512 << 10, "10MB": 10 << 20, "1.5M/s": 3 << 19, "1g": 1 << 30} {
+		if got, err := parseByteRate(s); err != nil || got != want {
+			t.Errorf("%q: got %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "fast", "0", "-5K"} {
+		if _, err := parseByteRate(s); err == nil {
+			t.Errorf("%q parsed", s)
+		}
+	}
+}
+
+func TestThrottleShortensReads(t *testing.T) {
+	r := throttle(bytes.NewReader(make([]byte, 300)), newByteLimiter(100))
+	if n, err := r.Read(make([]byte, 300)); n != 100 || err != nil {
+		t.Errorf("read %d, %v, want the burst", n, err)
+	}
+	if r := throttle(bytes.NewReader(nil), nil, nil); r == nil {
+		t.Error("no reader without limiters")
+	} else if _, ok := r.(*throttledReader); ok {
+		t.Error("throttled without limiters")
+	}
+}
+
+// datagramReader returns one datagram per read, like a packet connection.
+type datagramReader [][]byte
+
+func (d *datagramReader) Read(b []byte) (int, error) {
+	if len(*d) < 1 {
+		return 0, io.EOF
+	}
+	pkt := (*d)[0]
+	*d = (*d)[1:]
+	if len(pkt) > len(b) {
+		return copy(b, pkt), io.ErrShortBuffer
+	}
+	return copy(b, pkt), nil
+}
+
+func TestThrottleDatagramsWhole(t *testing.T) {
+	d := datagramReader{make([]byte, 250)}
+	r := throttleDatagrams(&d, newByteLimiter(100<<10), newByteLimiter(100))
+	if n, err := r.Read(make([]byte, maxDatagram)); n != 250 || err != nil {
+		t.Errorf("read %d, %v, want the whole datagram", n, err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// parseTicketKeys reads base64 encoded 32 byte keys, one per line.
+func parseTicketKeys(raw string) ([][32]byte, error) {
+	var keys [][32]byte
+	for i, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) < 1 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if len(b) != 32 {
+			return nil, fmt.Errorf("line %d: key is %d bytes, not 32", i+1, len(b))
+		}
+		var k [32]byte
+		copy(k[:], b)
+		keys = append(keys, k)
+	}
+	if len(keys) < 1 {
+		return nil, fmt.Errorf("no keys found")
+	}
+	return keys, nil
+}
+
+// ticketRotator replaces the session ticket keys of a tls.Config at the start
+// of every period. The keys only depend on the seed and the period number, so
+// every proxy with the same seed uses the same keys at the same time.
+type ticketRotator struct {
+	conf   *tls.Config
+	seed   [32]byte
+	period time.Duration
+	stop   chan struct{}
+}
+
+func newTicketRotator(conf *tls.Config, seed [32]byte, period time.Duration) *ticketRotator {
+	tr := &ticketRotator{
+		conf:   conf,
+		seed:   seed,
+		period: period,
+		stop:   make(chan struct{}),
+	}
+	tr.rotate(time.Now())
+	go tr.run()
+	return tr
+}
+
+func (tr *ticketRotator) close() {
+	close(tr.stop)
+}
+
+func (tr *ticketRotator) run() {
+	for {
+		next := time.Unix(0, int64(tr.period)*int64(tr.periodOf(time.Now())+1))
+		select {
+		case <-tr.stop:
+			return
+		case <-time.After(time.Until(next)):
+			tr.rotate(time.Now())
+		}
+	}
+}
+
+// rotate sets the key for the current period first, followed by the previous
+// period so its tickets still resume, and the next in case of clock skew
+// between proxies.
+func (tr *ticketRotator) rotate(now time.Time) {
+	n := tr.periodOf(now)
+	tr.conf.SetSessionTicketKeys([][32]byte{tr.key(n), tr.key(n - 1), tr.key(n + 1)})
+}
+
+func (tr *ticketRotator) periodOf(t time.Time) uint64 {
+	return uint64(t.UnixNano() / int64(tr.period))
+}
+
+func (tr *ticketRotator) key(n uint64) (k [32]byte) {
+	mac := hmac.New(sha256.New, tr.seed[:])
+	mac.Write([]byte("mtlsproxy session ticket key"))
+	binary.Write(mac, binary.BigEndian, n)
+	copy(k[:], mac.Sum(nil))
+	return
+}
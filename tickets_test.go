@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTicketKeys(t *testing.T) {
+	a := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("a", 32)))
+	b := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("b", 32)))
+	keys, err := parseTicketKeys("# current first\n" + a + "\n\n " + b + " \n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0][0] != 'a' || keys[1][31] != 'b' {
+		t.Errorf("got %v", keys)
+	}
+	for _, raw := range []string{"", "# nothing\n", "not base64", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := parseTicketKeys(raw); err == nil {
+			t.Errorf("parsed %q", raw)
+		}
+	}
+}
+
+func TestTicketRotatorKeys(t *testing.T) {
+	seed := [32]byte{1}
+	a := &ticketRotator{seed: seed, period: time.Hour}
+	b := &ticketRotator{seed: seed, period: time.Hour}
+	other := &ticketRotator{seed: [32]byte{2}, period: time.Hour}
+	now := time.Now()
+	n := a.periodOf(now)
+	if a.key(n) != b.key(n) {
+		t.Error("same seed gave different keys")
+	}
+	if a.key(n) == a.key(n+1) {
+		t.Error("same key for two periods")
+	}
+	if a.key(n) == other.key(n) {
+		t.Error("different seeds gave the same key")
+	}
+	if a.periodOf(now.Add(time.Hour)) != n+1 {
+		t.Error("period didn't change after a period")
+	}
+}
+
+// resumes connects to the first address and then the second with the same
+// session cache, telling if the second connection resumed the session.
+func resumes(t *testing.T, ca *testCA, first, second string) bool {
+	t.Helper()
+	tlsconf := ca.clientConfig(t, "client")
+	tlsconf.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	if _, err := tlsEchoes(first, tlsconf); err != nil {
+		t.Fatal(err)
+	}
+	cs, err := tlsEchoes(second, tlsconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cs.DidResume
+}
+
+func TestSessionTicketKeysShared(t *testing.T) {
+	ca := newTestCA(t)
+	keys := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	echo := testEcho(t)
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		p := &Profile{Proxy: echo, ListenSessionTicketKeysRaw: keys}
+		ca.listenTLS(t, p)
+		addrs = append(addrs, testInstance(t, p).ListenAddr())
+	}
+	if !resumes(t, ca, addrs[0], addrs[1]) {
+		t.Error("session from one proxy not resumed on another with the same keys")
+	}
+
+	p := &Profile{Proxy: echo, ListenSessionTicketsDisabled: true}
+	ca.listenTLS(t, p)
+	addr := testInstance(t, p).ListenAddr()
+	if resumes(t, ca, addr, addr) {
+		t.Error("session resumed with tickets disabled")
+	}
+}
+
+func TestSessionTicketsResolve(t *testing.T) {
+	keys := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	for _, c := range []struct {
+		name string
+		p    Profile
+		ok   bool
+	}{
+		{"rotation", Profile{ListenSessionTicketKeysRaw: keys, ListenSessionTicketRotation: "1h"}, true},
+		{"disabled", Profile{ListenSessionTicketKeysRaw: keys, ListenSessionTicketsDisabled: true}, false},
+		{"rotation without keys", Profile{ListenSessionTicketRotation: "1h"}, false},
+		{"short rotation", Profile{ListenSessionTicketKeysRaw: keys, ListenSessionTicketRotation: "30s"}, false},
+	} {
+		if err := c.p.sessionTickets(); (err == nil) != c.ok {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseTLSVersion reads a version like "1.2" or "TLS1.2", an empty string is
+// zero which leaves the crypto/tls default in place.
+func parseTLSVersion(s string) (uint16, error) {
+	if len(s) < 1 {
+		return 0, nil
+	}
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToUpper(s), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", s)
+	}
+	return v, nil
+}
+
+// tlsVersionRange picks the side specific version over the shared one and
+// checks the range makes sense.
+func tlsVersionRange(min, max, sideMin, sideMax string) (uint16, uint16, error) {
+	if len(sideMin) > 0 {
+		min = sideMin
+	}
+	if len(sideMax) > 0 {
+		max = sideMax
+	}
+
+	vmin, err := parseTLSVersion(min)
+	if err != nil {
+		return 0, 0, err
+	}
+	vmax, err := parseTLSVersion(max)
+	if err != nil {
+		return 0, 0, err
+	}
+	if vmin > 0 && vmax > 0 && vmin > vmax {
+		return 0, 0, fmt.Errorf("minimum TLS version %s is above the maximum %s", min, max)
+	}
+	return vmin, vmax, nil
+}
+
+var renegotiationSupport = map[string]tls.RenegotiationSupport{
+	"never":  tls.RenegotiateNever,
+	"once":   tls.RenegotiateOnceAsClient,
+	"freely": tls.RenegotiateFreelyAsClient,
+}
+
+// parseRenegotiation reads the send side renegotiation policy, empty is never.
+func parseRenegotiation(s string) (tls.RenegotiationSupport, error) {
+	if len(s) < 1 {
+		return tls.RenegotiateNever, nil
+	}
+	r, ok := renegotiationSupport[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown renegotiation policy %q", s)
+	}
+	return r, nil
+}
+
+// parseCipherSuites translates IANA cipher suite names to their IDs, nil
+// leaves the crypto/tls default in place.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) < 1 {
+		return nil, nil
+	}
+
+	known := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		known[cs.Name] = cs.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, n := range names {
+		id, ok := known[strings.ToUpper(strings.TrimSpace(n))]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", n)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":               tls.NoClientCert,
+	"request":            tls.RequestClientCert,
+	"require":            tls.RequireAnyClientCert,
+	"verify-if-given":    tls.VerifyClientCertIfGiven,
+	"require-and-verify": tls.RequireAndVerifyClientCert,
+}
+
+// parseClientAuth reads a client auth policy, the default depends on if there
+// is an authority to verify clients with.
+func parseClientAuth(s string, authority bool) (tls.ClientAuthType, error) {
+	if len(s) < 1 {
+		if authority {
+			return tls.RequireAndVerifyClientCert, nil
+		}
+		return tls.NoClientCert, nil
+	}
+	ca, ok := clientAuthTypes[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown client auth policy %q", s)
+	}
+	if !authority && (ca == tls.VerifyClientCertIfGiven || ca == tls.RequireAndVerifyClientCert) {
+		return 0, fmt.Errorf("client auth policy %q requires a listen authority", s)
+	}
+	return ca, nil
+}
+
+// deniedCertError is returned by checks refusing a verified client
+// certificate, reason is a handshake failure reason.
+type deniedCertError struct {
+	leaf   *x509.Certificate
+	reason string
+	err    error
+}
+
+func (e *deniedCertError) Error() string { return e.err.Error() }
+
+// optionalCert skips a VerifyPeerCertificate check when the client didn't send
+// a certificate.
+func optionalCert(check func([][]byte, [][]*x509.Certificate) error) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, chains [][]*x509.Certificate) error {
+		if len(raw) < 1 {
+			return nil
+		}
+		return check(raw, chains)
+	}
+}
+
+// clientAllowlist returns a VerifyPeerCertificate func that only accepts client
+// certificates carrying one of the allowed names. It runs after the chain is
+// verified so only the leaf needs checking.
+func clientAllowlist(profile string, cns, dnsNames, uris []string) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, chains [][]*x509.Certificate) error {
+		if len(chains) < 1 || len(chains[0]) < 1 {
+			return errors.New("no verified client certificate")
+		}
+
+		leaf := chains[0][0]
+		for _, cn := range cns {
+			if strings.EqualFold(cn, leaf.Subject.CommonName) {
+				return nil
+			}
+		}
+		for _, want := range dnsNames {
+			for _, name := range leaf.DNSNames {
+				if strings.EqualFold(want, name) {
+					return nil
+				}
+			}
+		}
+		for _, want := range uris {
+			for _, u := range leaf.URIs {
+				if want == u.String() {
+					return nil
+				}
+			}
+		}
+
+		slog.Warn("denied client certificate not in the allow list", "profile", profile, "subject", leaf.Subject.String(), "serial", leaf.SerialNumber.String())
+		return &deniedCertError{leaf: leaf, reason: "not_allowed", err: fmt.Errorf("client certificate %q is not allowed", leaf.Subject.String())}
+	}
+}
+
+// parseCRLs reads the revocation lists in raw (PEM, or a single DER list) and
+// checks each one is signed by a certificate in the authority and not expired.
+func parseCRLs(raw, authorityRaw string) ([]*x509.RevocationList, error) {
+	var ders [][]byte
+	rest := []byte(raw)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) < 1 {
+		ders = [][]byte{[]byte(raw)}
+	}
+
+	cas, err := parseCertificates(authorityRaw)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	crls := make([]*x509.RevocationList, 0, len(ders))
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return nil, err
+		}
+		if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+			return nil, fmt.Errorf("revocation list from %q expired at %s", crl.Issuer.String(), crl.NextUpdate.Format(time.RFC3339))
+		}
+
+		var signed bool
+		for _, ca := range cas {
+			if crl.CheckSignatureFrom(ca) == nil {
+				signed = true
+				break
+			}
+		}
+		if !signed {
+			return nil, fmt.Errorf("revocation list from %q isn't signed by the authority", crl.Issuer.String())
+		}
+		crls = append(crls, crl)
+	}
+	return crls, nil
+}
+
+// crlsExpired tells if any of crls is past its next update at now.
+func crlsExpired(crls []*x509.RevocationList, now time.Time) bool {
+	for _, crl := range crls {
+		if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+			return true
+		}
+	}
+	return false
+}
+
+// describeTLS summarizes a negotiated connection for the logs.
+func describeTLS(cs tls.ConnectionState) string {
+	client := "no client certificate"
+	if len(cs.PeerCertificates) > 0 {
+		leaf := cs.PeerCertificates[0]
+		client = fmt.Sprintf("client %q serial %s", leaf.Subject.String(), leaf.SerialNumber.String())
+	}
+	return fmt.Sprintf("%s %s, server name %q, ALPN %q, %s", tls.VersionName(cs.Version), tls.CipherSuiteName(cs.CipherSuite), cs.ServerName, cs.NegotiatedProtocol, client)
+}
+
+// keyPair loads the certificate chain with its private key, or with the signer
+// when the key lives on a token.
+func keyPair(certRaw, privateRaw string, signer crypto.Signer) (tls.Certificate, error) {
+	if signer == nil {
+		return tls.X509KeyPair([]byte(certRaw), []byte(privateRaw))
+	}
+
+	certs, err := parseCertificates(certRaw)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if len(certs) < 1 {
+		return tls.Certificate{}, errors.New("no certificates found")
+	}
+	if pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(certs[0].PublicKey) {
+		return tls.Certificate{}, errors.New("private key does not match the certificate")
+	}
+	cert := tls.Certificate{PrivateKey: signer, Leaf: certs[0]}
+	for _, c := range certs {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, nil
+}
+
+// parseCertificates reads every certificate in PEM data.
+func parseCertificates(raw string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(raw)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// revocationCheck returns a VerifyPeerCertificate func rejecting chains with a
+// certificate revoked by one of the lists.
+func revocationCheck(profile string, crls []*x509.RevocationList) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, chains [][]*x509.Certificate) error {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				for _, crl := range crls {
+					if string(crl.RawIssuer) != string(cert.RawIssuer) {
+						continue
+					}
+					for _, rc := range crl.RevokedCertificateEntries {
+						if rc.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+							slog.Warn("denied revoked client certificate", "profile", profile, "subject", cert.Subject.String(), "serial", cert.SerialNumber.String())
+							return &deniedCertError{leaf: chain[0], reason: "revoked", err: fmt.Errorf("certificate %q is revoked", cert.Subject.String())}
+						}
+					}
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// parsePins decodes base64 SHA-256 SPKI fingerprints.
+func parsePins(pins []string) ([][]byte, error) {
+	if len(pins) < 1 {
+		return nil, nil
+	}
+	decoded := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(pin))
+		if err != nil {
+			return nil, fmt.Errorf("pinned fingerprint %q: %w", pin, err)
+		}
+		if len(b) != sha256.Size {
+			return nil, fmt.Errorf("pinned fingerprint %q isn't a SHA-256 hash", pin)
+		}
+		decoded = append(decoded, b)
+	}
+	return decoded, nil
+}
+
+// pinCheck returns a VerifyPeerCertificate func requiring a certificate in the
+// verified chain, or the presented one without verification, to match one of
+// the pins. Pinning an intermediate or root
+// keeps working when the leaf is renewed with a new key.
+func pinCheck(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(raw [][]byte, chains [][]*x509.Certificate) error {
+		if len(chains) < 1 {
+			// verification is skipped, check what was presented instead
+			var presented []*x509.Certificate
+			for _, der := range raw {
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return err
+				}
+				presented = append(presented, cert)
+			}
+			chains = [][]*x509.Certificate{presented}
+		}
+		for _, chain := range chains {
+			for _, cert := range chain {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				for _, pin := range pins {
+					if bytes.Equal(sum[:], pin) {
+						return nil
+					}
+				}
+			}
+		}
+		return errors.New("no certificate in the chain matches a pinned fingerprint")
+	}
+}
+
+// alpnCheck returns a VerifyConnection func rejecting connections that
+// negotiated a protocol outside of protos, or none when one is required.
+func alpnCheck(profile, side string, protos []string, required bool) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.NegotiatedProtocol) < 1 {
+			if !required {
+				return nil
+			}
+			slog.Warn("rejected connection, no ALPN protocol negotiated", "profile", profile, "side", side)
+			return errors.New("no ALPN protocol negotiated")
+		}
+		for _, proto := range protos {
+			if proto == cs.NegotiatedProtocol {
+				return nil
+			}
+		}
+		slog.Warn("rejected connection, ALPN protocol isn't allowed", "profile", profile, "side", side, "alpn", cs.NegotiatedProtocol)
+		return fmt.Errorf("ALPN protocol %q isn't allowed", cs.NegotiatedProtocol)
+	}
+}
+
+// verifyAll combines VerifyPeerCertificate funcs, nil when there are none.
+func verifyAll(checks ...func([][]byte, [][]*x509.Certificate) error) func([][]byte, [][]*x509.Certificate) error {
+	if len(checks) < 1 {
+		return nil
+	}
+	return func(raw [][]byte, chains [][]*x509.Certificate) error {
+		for _, check := range checks {
+			if err := check(raw, chains); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority for tests.
+type testCA struct {
+	cert   *x509.Certificate
+	key    crypto.Signer
+	pem    string
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), serial: 1}
+}
+
+// issue returns the certificate and key PEM for cn, valid for 127.0.0.1 and
+// localhost, usable by servers and clients.
+func (ca *testCA) issue(t *testing.T, cn string) (string, string) {
+	t.Helper()
+	return ca.issueFor(t, cn, "localhost", "127.0.0.1")
+}
+
+// issueFor is issue with the certificate valid for names, DNS names or IPs.
+func (ca *testCA) issueFor(t *testing.T, cn string, names ...string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: kb}))
+}
+
+// clientConfig trusts the authority and presents a certificate for cn.
+func (ca *testCA) clientConfig(t *testing.T, cn string) *tls.Config {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, cn)
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(ca.pem))
+	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool, ServerName: "localhost"}
+}
+
+// listenTLS sets the listen side of p to a certificate of the authority and
+// to require client certificates from it.
+func (ca *testCA) listenTLS(t *testing.T, p *Profile) {
+	t.Helper()
+	p.ListenCertRaw, p.ListenPrivateRaw = ca.issue(t, "proxy")
+	p.ListenAuthorityRaw = ca.pem
+}
+
+// crl returns a revocation list of the authority in PEM, revoking serials
+// until nextUpdate.
+func (ca *testCA) crl(t *testing.T, nextUpdate time.Time, serials ...int64) string {
+	t.Helper()
+	var revoked []x509.RevocationListEntry
+	for _, serial := range serials {
+		revoked = append(revoked, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+	}
+	ca.serial++
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(ca.serial),
+		ThisUpdate:                time.Now().Add(-time.Minute),
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: revoked,
+	}, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}))
+}
+
+func TestParseCRLs(t *testing.T) {
+	ca := newTestCA(t)
+	if crls, err := parseCRLs(ca.crl(t, time.Now().Add(time.Hour), 5), ca.pem); err != nil || len(crls) != 1 {
+		t.Errorf("got %d lists, %v", len(crls), err)
+	}
+	if _, err := parseCRLs(ca.crl(t, time.Now().Add(-time.Second)), ca.pem); err == nil {
+		t.Error("expired list was parsed")
+	}
+	if _, err := parseCRLs(ca.crl(t, time.Now().Add(time.Hour)), newTestCA(t).pem); err == nil {
+		t.Error("list of another authority was parsed")
+	}
+}
+
+func TestCRLsExpired(t *testing.T) {
+	now := time.Now()
+	crls := []*x509.RevocationList{{NextUpdate: now.Add(time.Hour)}, {}}
+	if crlsExpired(crls, now) {
+		t.Error("current lists are expired")
+	}
+	if !crlsExpired(append(crls, &x509.RevocationList{NextUpdate: now.Add(-time.Second)}), now) {
+		t.Error("list past its next update isn't expired")
+	}
+}
+
+func TestCRLFromEnvironment(t *testing.T) {
+	t.Setenv(EnvProfilePrefix+"CRLTEST"+EnvListenCRLSuffix, "-----BEGIN X509 CRL-----")
+	ps, _, err := profilesFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range ps {
+		if p.Name == "CRLTEST" {
+			if p.ListenCRLRaw != "-----BEGIN X509 CRL-----" || len(p.ListenCRLPath) > 0 {
+				t.Errorf("got raw %q, path %q", p.ListenCRLRaw, p.ListenCRLPath)
+			}
+			return
+		}
+	}
+	t.Error("no profile from the environment")
+}
+
+func TestRevokedClientRejected(t *testing.T) {
+	ca := newTestCA(t)
+	revoked := ca.clientConfig(t, "revoked")
+	p := &Profile{Proxy: testEcho(t)}
+	ca.listenTLS(t, p)
+	p.ListenCRLRaw = ca.crl(t, time.Now().Add(time.Hour), ca.serial-1)
+	inst := testInstance(t, p)
+
+	for _, c := range []struct {
+		name string
+		conf *tls.Config
+		ok   bool
+	}{{"revoked", revoked, false}, {"good", ca.clientConfig(t, "good"), true}} {
+		conn, err := tls.Dial("tcp", inst.ListenAddr(), c.conf)
+		if err != nil {
+			if c.ok {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if echoes(conn) != c.ok {
+			t.Errorf("%s: proxied %t", c.name, !c.ok)
+		}
+		conn.Close()
+	}
+}
+
+// tlsEchoes connects to addr with conf, the state is of a connection that was
+// proxied, the error says why it wasn't.
+func tlsEchoes(addr string, conf *tls.Config) (tls.ConnectionState, error) {
+	c, err := tls.Dial("tcp", addr, conf)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer c.Close()
+	// with TLS 1.3 the client hears about a rejected certificate on reading
+	if !echoes(c) {
+		return tls.ConnectionState{}, errors.New("not proxied")
+	}
+	return c.ConnectionState(), nil
+}
+
+func TestTLSVersionRange(t *testing.T) {
+	for _, c := range []struct {
+		min, max, sideMin, sideMax string
+		vmin, vmax                 uint16
+		ok                         bool
+	}{
+		{"", "", "", "", 0, 0, true},
+		{"1.2", "1.3", "", "", tls.VersionTLS12, tls.VersionTLS13, true},
+		{"1.2", "", "TLS1.3", "", tls.VersionTLS13, 0, true},
+		{"1.2", "1.3", "", "tls1.2", tls.VersionTLS12, tls.VersionTLS12, true},
+		{"1.3", "1.2", "", "", 0, 0, false},
+		{"1.4", "", "", "", 0, 0, false},
+	} {
+		vmin, vmax, err := tlsVersionRange(c.min, c.max, c.sideMin, c.sideMax)
+		if (err == nil) != c.ok || vmin != c.vmin || vmax != c.vmax {
+			t.Errorf("%+v: got %x %x %v", c, vmin, vmax, err)
+		}
+	}
+}
+
+func TestListenTLSVersions(t *testing.T) {
+	ca := newTestCA(t)
+	p := &Profile{Proxy: testEcho(t), MinTLSVersion: "1.3", ListenMinTLSVersion: "1.2", ListenMaxTLSVersion: "1.2"}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+
+	cs, err := tlsEchoes(inst.ListenAddr(), ca.clientConfig(t, "client"))
+	if err != nil || cs.Version != tls.VersionTLS12 {
+		t.Errorf("negotiated %s, %v, want TLS 1.2", tls.VersionName(cs.Version), err)
+	}
+	conf := ca.clientConfig(t, "client")
+	conf.MinVersion = tls.VersionTLS13
+	if _, err := tlsEchoes(inst.ListenAddr(), conf); err == nil {
+		t.Error("TLS 1.3 accepted above the listen maximum")
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	ids, err := parseCipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", " tls_ecdhe_rsa_with_rc4_128_sha"})
+	if err != nil || len(ids) != 2 || ids[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 || ids[1] != tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA {
+		t.Errorf("got %x, %v", ids, err)
+	}
+	if ids, err := parseCipherSuites(nil); ids != nil || err != nil {
+		t.Errorf("got %x, %v for none", ids, err)
+	}
+	if _, err := parseCipherSuites([]string{"TLS_NOT_A_SUITE"}); err == nil {
+		t.Error("parsed an unknown suite")
+	}
+}
+
+func TestListenCipherSuites(t *testing.T) {
+	ca := newTestCA(t)
+	p := &Profile{Proxy: testEcho(t), ListenMaxTLSVersion: "1.2", ListenCipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"}}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+
+	cs, err := tlsEchoes(inst.ListenAddr(), ca.clientConfig(t, "client"))
+	if err != nil || cs.CipherSuite != tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256 {
+		t.Errorf("negotiated %s, %v", tls.CipherSuiteName(cs.CipherSuite), err)
+	}
+	conf := ca.clientConfig(t, "client")
+	conf.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	if _, err := tlsEchoes(inst.ListenAddr(), conf); err == nil {
+		t.Error("suite outside the allow list negotiated")
+	}
+}
+
+func TestClientAllowlist(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.test/web")
+	leaf := &x509.Certificate{Subject: pkix.Name{CommonName: "Alice"}, DNSNames: []string{"alice.example.test"}, URIs: []*url.URL{spiffe}, SerialNumber: big.NewInt(1)}
+	for _, c := range []struct {
+		name                string
+		cns, dnsNames, uris []string
+		ok                  bool
+	}{
+		{"cn", []string{"alice"}, nil, nil, true},
+		{"dns", []string{"bob"}, []string{"ALICE.example.test"}, nil, true},
+		{"uri", nil, nil, []string{"spiffe://example.test/web"}, true},
+		{"none", []string{"bob"}, []string{"bob.example.test"}, []string{"spiffe://example.test/db"}, false},
+	} {
+		err := clientAllowlist("test", c.cns, c.dnsNames, c.uris)(nil, [][]*x509.Certificate{{leaf}})
+		if (err == nil) != c.ok {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+		var denied *deniedCertError
+		if err != nil && !errors.As(err, &denied) {
+			t.Errorf("%s: %v isn't a denied certificate", c.name, err)
+		}
+	}
+}
+
+func TestListenAllowedCNs(t *testing.T) {
+	ca := newTestCA(t)
+	p := &Profile{Proxy: testEcho(t), ListenAllowedCNs: []string{"alice"}}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+
+	if _, err := tlsEchoes(inst.ListenAddr(), ca.clientConfig(t, "alice")); err != nil {
+		t.Errorf("allowed client: %v", err)
+	}
+	if _, err := tlsEchoes(inst.ListenAddr(), ca.clientConfig(t, "bob")); err == nil {
+		t.Error("client outside the allow list proxied")
+	}
+}
+
+func TestKeyPairSigner(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "token")
+	pair, err := tls.X509KeyPair([]byte(certPEM+ca.pem), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := pair.PrivateKey.(crypto.Signer)
+	cert, err := keyPair(certPEM+ca.pem, "", signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.PrivateKey != signer || len(cert.Certificate) != 2 || cert.Leaf.Subject.CommonName != "token" {
+		t.Errorf("got %d certificates for %s", len(cert.Certificate), cert.Leaf.Subject)
+	}
+	if _, err := keyPair(certPEM, "", ca.key); err == nil {
+		t.Error("paired a certificate with another key")
+	}
+	if _, err := keyPair("", "", signer); err == nil {
+		t.Error("paired a signer without a certificate")
+	}
+}
+
+func TestPKCS11Keys(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, keyPEM := ca.issue(t, "token")
+	for _, c := range []struct {
+		name string
+		p    Profile
+	}{
+		{"no module", Profile{ListenPKCS11KeyLabel: "key", PKCS11TokenLabel: "token", ListenCertRaw: certPEM}},
+		{"no token", Profile{ListenPKCS11KeyLabel: "key", PKCS11Module: "/lib/module.so", ListenCertRaw: certPEM}},
+		{"with a key", Profile{ListenPKCS11KeyLabel: "key", PKCS11Module: "/lib/module.so", PKCS11TokenLabel: "token", ListenCertRaw: certPEM, ListenPrivateRaw: keyPEM}},
+		{"no certificate", Profile{SendPKCS11KeyLabel: "key", PKCS11Module: "/lib/module.so", PKCS11Slot: "0"}},
+	} {
+		if err := c.p.pkcs11Keys(); err == nil {
+			t.Errorf("%s: found keys", c.name)
+		}
+	}
+	var p Profile
+	if err := p.pkcs11Keys(); err != nil || p.listenSigner != nil || p.sendSigner != nil {
+		t.Errorf("without labels: %v", err)
+	}
+}
+
+func spkiPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestParsePins(t *testing.T) {
+	ca := newTestCA(t)
+	pins, err := parsePins([]string{" " + spkiPin(ca.cert) + " "})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 1 || len(pins[0]) != sha256.Size {
+		t.Errorf("got %v", pins)
+	}
+	for _, pin := range []string{"not base64!", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := parsePins([]string{pin}); err == nil {
+			t.Errorf("parsed %q", pin)
+		}
+	}
+}
+
+func TestPinCheck(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	certPEM, _ := ca.issue(t, "server")
+	leaf, err := parseCertificates(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chains := [][]*x509.Certificate{{leaf[0], ca.cert}}
+	for _, c := range []struct {
+		name string
+		pin  *x509.Certificate
+		ok   bool
+	}{
+		{"leaf", leaf[0], true},
+		{"authority", ca.cert, true},
+		{"other", other.cert, false},
+	} {
+		pins, _ := parsePins([]string{spkiPin(c.pin)})
+		if err := pinCheck(pins)(nil, chains); (err == nil) != c.ok {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+	}
+}
+
+// readsBanner connects to addr in plain text and reads the destination's name,
+// empty when the proxy closed the connection instead.
+func readsBanner(t *testing.T, addr string) string {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	line, _ := bufio.NewReader(c).ReadString('\n')
+	return line
+}
+
+func TestSendPins(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	dest := testTLSBanner(t, ca, "localhost")
+	p := &Profile{Proxy: dest, SendAuthorityRaw: ca.pem, SendPinnedFingerprints: []string{spkiPin(ca.cert)}}
+	if got := readsBanner(t, testInstance(t, p).ListenAddr()); got != "localhost\n" {
+		t.Errorf("pinned destination: got %q", got)
+	}
+	p = &Profile{Proxy: dest, SendAuthorityRaw: ca.pem, SendPinnedFingerprints: []string{spkiPin(other.cert)}}
+	if got := readsBanner(t, testInstance(t, p).ListenAddr()); len(got) > 0 {
+		t.Errorf("destination not matching the pin: got %q", got)
+	}
+}
+
+func TestDescribeTLS(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, _ := ca.issue(t, "client")
+	certs, err := parseCertificates(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256, ServerName: "localhost", NegotiatedProtocol: "h2", PeerCertificates: certs}
+	want := `TLS 1.3 TLS_AES_128_GCM_SHA256, server name "localhost", ALPN "h2", client "CN=client" serial ` + certs[0].SerialNumber.String()
+	if got := describeTLS(cs); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	cs.PeerCertificates = nil
+	if got := describeTLS(cs); !strings.HasSuffix(got, "no client certificate") {
+		t.Errorf("got %s without a client certificate", got)
+	}
+}
+
+// logBuffer collects what is logged while a test runs.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (lb *logBuffer) Write(b []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.Write(b)
+}
+
+func (lb *logBuffer) String() string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.buf.String()
+}
+
+// captureLog sends the default logger to a buffer until the test ends.
+func captureLog(t *testing.T) *logBuffer {
+	lb := &logBuffer{}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(lb, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return lb
+}
+
+func TestAccessLog(t *testing.T) {
+	ca := newTestCA(t)
+	p := &Profile{Proxy: testEcho(t), AccessLog: true}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+	lb := captureLog(t)
+	if _, err := tlsEchoes(inst.ListenAddr(), ca.clientConfig(t, "alice")); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "access log", func() bool { return strings.Contains(lb.String(), "msg=accepted") })
+	if got := lb.String(); !strings.Contains(got, `client \"CN=alice\"`) {
+		t.Errorf("access log without the client: %s", got)
+	}
+}
+
+func TestALPNCheck(t *testing.T) {
+	for _, c := range []struct {
+		negotiated string
+		required   bool
+		ok         bool
+	}{
+		{"h2", true, true},
+		{"", false, true},
+		{"", true, false},
+		{"http/1.1", false, false},
+	} {
+		err := alpnCheck("test", "listen", []string{"h2", "acme-tls/1"}, c.required)(tls.ConnectionState{NegotiatedProtocol: c.negotiated})
+		if (err == nil) != c.ok {
+			t.Errorf("%q required %v: got %v", c.negotiated, c.required, err)
+		}
+	}
+}
+
+func TestListenALPN(t *testing.T) {
+	ca := newTestCA(t)
+	p := &Profile{Proxy: testEcho(t), ListenALPN: []string{"h2"}, ListenALPNRequired: true}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+
+	tlsconf := ca.clientConfig(t, "client")
+	tlsconf.NextProtos = []string{"h2", "http/1.1"}
+	cs, err := tlsEchoes(inst.ListenAddr(), tlsconf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cs.NegotiatedProtocol != "h2" {
+		t.Errorf("negotiated %q", cs.NegotiatedProtocol)
+	}
+	for _, protos := range [][]string{nil, {"http/1.1"}} {
+		tlsconf.NextProtos = protos
+		if _, err := tlsEchoes(inst.ListenAddr(), tlsconf); err == nil {
+			t.Errorf("proxied offering %v", protos)
+		}
+	}
+}
+
+func TestParseClientAuth(t *testing.T) {
+	for _, c := range []struct {
+		s         string
+		authority bool
+		want      tls.ClientAuthType
+		ok        bool
+	}{
+		{"", true, tls.RequireAndVerifyClientCert, true},
+		{"", false, tls.NoClientCert, true},
+		{"Request", false, tls.RequestClientCert, true},
+		{"verify-if-given", true, tls.VerifyClientCertIfGiven, true},
+		{"verify-if-given", false, 0, false},
+		{"require-and-verify", false, 0, false},
+		{"sometimes", true, 0, false},
+	} {
+		got, err := parseClientAuth(c.s, c.authority)
+		if (err == nil) != c.ok || got != c.want {
+			t.Errorf("%q with authority %v: got %v, %v", c.s, c.authority, got, err)
+		}
+	}
+}
+
+func TestClientAuthVerifyIfGiven(t *testing.T) {
+	ca := newTestCA(t)
+	p := &Profile{Proxy: testEcho(t), ClientAuth: "verify-if-given", ListenAllowedCNs: []string{"alice"}}
+	ca.listenTLS(t, p)
+	inst := testInstance(t, p)
+
+	anonymous := ca.clientConfig(t, "client")
+	anonymous.Certificates = nil
+	if _, err := tlsEchoes(inst.ListenAddr(), anonymous); err != nil {
+		t.Errorf("client without a certificate: %v", err)
+	}
+	if _, err := tlsEchoes(inst.ListenAddr(), ca.clientConfig(t, "alice")); err != nil {
+		t.Errorf("allowed client: %v", err)
+	}
+	if _, err := tlsEchoes(inst.ListenAddr(), ca.clientConfig(t, "bob")); err == nil {
+		t.Error("certificate outside the allow list proxied")
+	}
+
+	p = &Profile{Name: "test", Listen: ":0", Proxy: "127.0.0.1:1", ClientAuth: "request", ListenAllowedCNs: []string{"alice"}}
+	ca.listenTLS(t, p)
+	if err := p.Resolve(); err == nil {
+		t.Error("resolved an allow list with certificates that aren't verified")
+	}
+}
+
+func TestSendServerName(t *testing.T) {
+	ca := newTestCA(t)
+	dest := testTLSBanner(t, ca, "dest", "dest.example.test")
+	p := &Profile{Proxy: dest, SendAuthorityRaw: ca.pem}
+	if got := readsBanner(t, testInstance(t, p).ListenAddr()); len(got) > 0 {
+		t.Errorf("verified a certificate not for the address: got %q", got)
+	}
+	p = &Profile{Proxy: dest, SendAuthorityRaw: ca.pem, SendServerName: "dest.example.test"}
+	if got := readsBanner(t, testInstance(t, p).ListenAddr()); got != "dest\n" {
+		t.Errorf("with the server name: got %q", got)
+	}
+}
+
+func TestSendInsecureSkipVerify(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+	dest := testTLSBanner(t, other, "dest")
+	p := &Profile{Proxy: dest, SendAuthorityRaw: ca.pem}
+	if got := readsBanner(t, testInstance(t, p).ListenAddr()); len(got) > 0 {
+		t.Errorf("verified a certificate of another authority: got %q", got)
+	}
+	p = &Profile{Proxy: dest, SendInsecureSkipVerify: true}
+	if got := readsBanner(t, testInstance(t, p).ListenAddr()); got != "dest\n" {
+		t.Errorf("skipping verification: got %q", got)
+	}
+	// pins still hold without verification, against what was presented
+	p = &Profile{Proxy: dest, SendInsecureSkipVerify: true, SendPinnedFingerprints: []string{spkiPin(ca.cert)}}
+	if got := readsBanner(t, testInstance(t, p).ListenAddr()); len(got) > 0 {
+		t.Errorf("unverified destination not matching the pin: got %q", got)
+	}
+}
+
+func TestSendUseSystemRoots(t *testing.T) {
+	p := &Profile{}
+	if tlsconf, err := sendTLSConfig(p, "", "", "", nil); err != nil || tlsconf != nil {
+		t.Fatalf("got %v, %v without send TLS options", tlsconf, err)
+	}
+	p.SendUseSystemRoots = true
+	tlsconf, err := sendTLSConfig(p, "", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsconf == nil || tlsconf.RootCAs != nil {
+		t.Errorf("got %v, want TLS verified by the system roots", tlsconf)
+	}
+
+	ca := newTestCA(t)
+	dest := testTLSBanner(t, ca, "dest")
+	p = &Profile{Proxy: dest, SendUseSystemRoots: true}
+	if got := readsBanner(t, testInstance(t, p).ListenAddr()); len(got) > 0 {
+		t.Errorf("private authority trusted by the system roots: got %q", got)
+	}
+	p = &Profile{Proxy: dest, SendUseSystemRoots: true, SendAuthorityRaw: ca.pem}
+	if got := readsBanner(t, testInstance(t, p).ListenAddr()); got != "dest\n" {
+		t.Errorf("authority added to the system roots: got %q", got)
+	}
+}
+
+func TestParseRenegotiation(t *testing.T) {
+	for s, want := range map[string]tls.RenegotiationSupport{"": tls.RenegotiateNever, "Once": tls.RenegotiateOnceAsClient, "freely": tls.RenegotiateFreelyAsClient} {
+		if got, err := parseRenegotiation(s); err != nil || got != want {
+			t.Errorf("%q: got %v, %v", s, got, err)
+		}
+	}
+	if _, err := parseRenegotiation("always"); err == nil {
+		t.Error("parsed an unknown policy")
+	}
+}
+
+// testResumptions is a TLS destination of ca closing every connection once
+// the handshake is done, telling on the channel if it resumed a session.
+func testResumptions(t *testing.T, ca *testCA) (string, <-chan bool) {
+	t.Helper()
+	certPEM, keyPEM := ca.issue(t, "dest")
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, MaxVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	resumed := make(chan bool, 4)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if err := c.(*tls.Conn).Handshake(); err == nil {
+				resumed <- c.(*tls.Conn).ConnectionState().DidResume
+			}
+			c.Close()
+		}
+	}()
+	return l.Addr().String(), resumed
+}
+
+func TestSendSessionResumption(t *testing.T) {
+	ca := newTestCA(t)
+	for _, enabled := range []bool{false, true} {
+		dest, resumed := testResumptions(t, ca)
+		p := &Profile{Proxy: dest, SendAuthorityRaw: ca.pem, SendSessionResumption: enabled}
+		addr := testInstance(t, p).ListenAddr()
+		var got bool
+		for i := 0; i < 2; i++ {
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = <-resumed
+			c.Close()
+		}
+		if got != enabled {
+			t.Errorf("resumption %v: second connection resumed %v", enabled, got)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer makes the spans of connections, they are only exported once
+// startTracing set up an exporter.
+var tracer = otel.Tracer("github.com/bryanaustin/mtlsproxy")
+
+// startTracing exports spans with OTLP over gRPC when an endpoint is set, in
+// the flag or the standard OTEL_EXPORTER_OTLP variables. The returned function
+// flushes what is left to export.
+func startTracing(c *Configurations) (func(context.Context) error, error) {
+	var opts []otlptracegrpc.Option
+	if len(c.OTLPEndpoint) > 0 {
+		opts = append(opts, otlptracegrpc.WithEndpointURL(c.OTLPEndpoint))
+	} else if len(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")) < 1 && len(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")) < 1 {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	ctx := context.Background()
+	exp, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	res, err := resource.New(ctx, resource.WithAttributes(attribute.String("service.name", "mtlsproxy")), resource.WithFromEnv(), resource.WithTelemetrySDK())
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return tp.Shutdown, nil
+}
+
+// endSpan ends the span of a connection with what its access record has.
+func endSpan(span trace.Span, rec *accessRecord) {
+	span.SetAttributes(
+		attribute.String("mtlsproxy.server_name", rec.ServerName),
+		attribute.String("mtlsproxy.client_subject", rec.ClientSubject),
+		attribute.String("mtlsproxy.destination", rec.Destination),
+		attribute.Int64("mtlsproxy.bytes_up", rec.BytesUp),
+		attribute.Int64("mtlsproxy.bytes_down", rec.BytesDown),
+		attribute.String("mtlsproxy.reason", rec.Reason),
+	)
+	if rec.err != nil {
+		span.SetStatus(codes.Error, rec.Reason)
+	}
+	span.End()
+}
+
+// propagate makes the connection's span the parent of the destination's work
+// on a request, the context the client sent becomes a link.
+func propagate(ctx context.Context, hdr http.Header) {
+	p := otel.GetTextMapPropagator()
+	carrier := propagation.HeaderCarrier(hdr)
+	if sc := trace.SpanContextFromContext(p.Extract(context.Background(), carrier)); sc.IsValid() {
+		trace.SpanFromContext(ctx).AddLink(trace.Link{SpanContext: sc})
+	}
+	p.Inject(ctx, carrier)
+}
+
+// startSpan starts the span of a connection.
+func startSpan(profile, ident, id string, remote net.Addr) (context.Context, trace.Span) {
+	return tracer.Start(context.Background(), "connection", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("mtlsproxy.profile", profile),
+		attribute.String("mtlsproxy.conn", ident),
+		attribute.String("mtlsproxy.conn_id", id),
+		attribute.String("mtlsproxy.client", remote.String()),
+	))
+}
+
+// traced runs a step of a connection in a span of its own.
+func traced(ctx context.Context, name string, step func() error) error {
+	_, span := tracer.Start(ctx, name)
+	defer span.End()
+	err := step()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans makes connections record their spans for the rest of the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	rec := tracetest.NewSpanRecorder()
+	prev := tracer
+	tracer = sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)).Tracer("test")
+	t.Cleanup(func() { tracer = prev })
+	return rec
+}
+
+// endedSpan finds the ended span called name.
+func endedSpan(rec *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, s := range rec.Ended() {
+		if s.Name() == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func spanAttr(s sdktrace.ReadOnlySpan, key string) attribute.Value {
+	for _, kv := range s.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestInstanceTracing(t *testing.T) {
+	rec := recordSpans(t)
+	inst := testInstance(t, &Profile{Proxy: testBanner(t, "dest")})
+	if got := readsBanner(t, inst.ListenAddr()); got != "dest\n" {
+		t.Fatalf("got %q", got)
+	}
+	waitFor(t, "the connection span", func() bool { return endedSpan(rec, "connection") != nil })
+	conn, dial := endedSpan(rec, "connection"), endedSpan(rec, "dial")
+	if spanAttr(conn, "mtlsproxy.profile").AsString() != "test" || spanAttr(conn, "mtlsproxy.bytes_down").AsInt64() != 5 {
+		t.Errorf("connection span has %v", conn.Attributes())
+	}
+	if conn.Status().Code == codes.Error {
+		t.Errorf("connection span failed with %q", conn.Status().Description)
+	}
+	if dial == nil || dial.Parent().SpanID() != conn.SpanContext().SpanID() {
+		t.Error("dial isn't a step of the connection span")
+	}
+
+	rec = recordSpans(t)
+	inst = testInstance(t, &Profile{Proxy: closedAddr(t)})
+	readsBanner(t, inst.ListenAddr())
+	waitFor(t, "the connection span", func() bool { return endedSpan(rec, "connection") != nil })
+	if conn := endedSpan(rec, "connection"); conn.Status().Code != codes.Error {
+		t.Errorf("connection span of a failed dial has status %v", conn.Status())
+	}
+	if dial := endedSpan(rec, "dial"); dial == nil || dial.Status().Code != codes.Error {
+		t.Error("failed dial span isn't an error")
+	}
+}
+
+func TestPropagate(t *testing.T) {
+	prev := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(prev) })
+	rec := recordSpans(t)
+
+	ctx, span := tracer.Start(context.Background(), "connection")
+	hdr := http.Header{"Traceparent": {"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}}
+	propagate(ctx, hdr)
+	span.End()
+
+	sc := span.SpanContext()
+	if want := "00-" + sc.TraceID().String() + "-" + sc.SpanID().String() + "-01"; hdr.Get("Traceparent") != want {
+		t.Errorf("destination gets %q, want %q", hdr.Get("Traceparent"), want)
+	}
+	links := endedSpan(rec, "connection").Links()
+	if len(links) != 1 || links[0].SpanContext.TraceID().String() != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("client's context linked as %v", links)
+	}
+}
+
+func TestStartTracingDisabled(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	stop, err := startTracing(&Configurations{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stop(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if _, ok := otel.GetTracerProvider().(*sdktrace.TracerProvider); ok {
+		t.Error("spans are exported without an endpoint")
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/dtls/v3"
+)
+
+const (
+	defaultUDPIdleTimeout = time.Minute
+	udpBacklog            = 64 // datagrams queued per session before dropping
+	udpAcceptBacklog      = 64 // new sessions queued for Accept before dropping
+	maxDatagram           = 64 << 10
+	dtlsHandshakeTimeout  = 30 * time.Second
+)
+
+// isPacket reports if the network is datagram based.
+func isPacket(network string) bool {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return true
+	}
+	return false
+}
+
+// udpListener turns a UDP socket into a net.Listener, every new peer address
+// is accepted as a connection carrying its datagrams, like a NAT session.
+type udpListener struct {
+	pc       net.PacketConn
+	accept   chan *udpSession
+	closed   chan struct{}
+	close    sync.Once
+	mu       sync.Mutex // guards sessions
+	sessions map[string]*udpSession
+}
+
+func listenUDP(network, addr string) (*udpListener, error) {
+	pc, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &udpListener{
+		pc:       pc,
+		accept:   make(chan *udpSession, udpAcceptBacklog),
+		closed:   make(chan struct{}),
+		sessions: make(map[string]*udpSession),
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *udpListener) run() {
+	buf := make([]byte, maxDatagram)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			l.Close()
+			return
+		}
+		pkt := make([]byte, n)
+		copy(pkt, buf[:n])
+
+		l.mu.Lock()
+		s, ok := l.sessions[addr.String()]
+		if !ok {
+			s = &udpSession{l: l, raddr: addr, in: make(chan []byte, udpBacklog), closed: make(chan struct{})}
+			l.sessions[addr.String()] = s
+		}
+		l.mu.Unlock()
+
+		if !ok {
+			select {
+			case l.accept <- s:
+			case <-l.closed:
+				return
+			default:
+				// sessions come in faster than they are accepted, drop the
+				// peer's datagram like the network would, it tries again
+				l.remove(s)
+				continue
+			}
+		}
+		select {
+		case s.in <- pkt:
+		default: // the session isn't keeping up, drop like the network would
+		}
+	}
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case s := <-l.accept:
+		return s, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *udpListener) Close() error {
+	var err error
+	l.close.Do(func() {
+		close(l.closed)
+		err = l.pc.Close()
+	})
+	return err
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+func (l *udpListener) remove(s *udpSession) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sessions[s.raddr.String()] == s {
+		delete(l.sessions, s.raddr.String())
+	}
+}
+
+// udpSession is the datagrams of one peer of a udpListener.
+type udpSession struct {
+	l        *udpListener
+	raddr    net.Addr
+	in       chan []byte
+	closed   chan struct{}
+	close    sync.Once
+	deadline atomic.Int64 // read deadline in unix nanoseconds, zero for none
+}
+
+func (s *udpSession) Read(b []byte) (int, error) {
+	var timeout <-chan time.Time
+	if d := s.deadline.Load(); d > 0 {
+		t := time.NewTimer(time.Until(time.Unix(0, d)))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case pkt := <-s.in:
+		if len(pkt) > len(b) {
+			return copy(b, pkt), fmt.Errorf("datagram of %d bytes: %w", len(pkt), io.ErrShortBuffer)
+		}
+		return copy(b, pkt), nil
+	case <-s.closed:
+		return 0, io.EOF
+	case <-s.l.closed:
+		return 0, io.EOF
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+func (s *udpSession) Write(b []byte) (int, error) {
+	select {
+	case <-s.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return s.l.pc.WriteTo(b, s.raddr)
+}
+
+func (s *udpSession) Close() error {
+	s.close.Do(func() {
+		close(s.closed)
+		s.l.remove(s)
+	})
+	return nil
+}
+
+func (s *udpSession) LocalAddr() net.Addr  { return s.l.pc.LocalAddr() }
+func (s *udpSession) RemoteAddr() net.Addr { return s.raddr }
+
+func (s *udpSession) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+func (s *udpSession) SetReadDeadline(t time.Time) error {
+	if t.IsZero() {
+		s.deadline.Store(0)
+	} else {
+		s.deadline.Store(t.UnixNano())
+	}
+	return nil
+}
+
+func (s *udpSession) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// idleListener closes the accepted connections once nothing has been sent or
+// received for the idle timeout, UDP peers never say they are done.
+type idleListener struct {
+	net.Listener
+	idle time.Duration
+}
+
+func (l *idleListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newIdleConn(c, l.idle), nil
+}
+
+// idleConn ends reads with io.EOF once nothing has been read or written for
+// the idle timeout.
+type idleConn struct {
+	net.Conn
+	idle time.Duration
+	last atomic.Int64 // unix nanoseconds of the last read or write
+}
+
+func newIdleConn(c net.Conn, idle time.Duration) *idleConn {
+	ic := &idleConn{Conn: c, idle: idle}
+	ic.touch()
+	return ic
+}
+
+func (c *idleConn) touch() {
+	c.last.Store(time.Now().UnixNano())
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Unix(0, c.last.Load()).Add(c.idle))
+		n, err := c.Conn.Read(b)
+		if err == nil || n > 0 {
+			c.touch()
+			return n, err
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) && time.Since(time.Unix(0, c.last.Load())) < c.idle {
+			continue // written to since the deadline was set
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, io.EOF
+		}
+		return n, err
+	}
+}
+
+func (c *idleConn) isDTLS() bool {
+	_, ok := c.Conn.(*dtls.Conn)
+	return ok
+}
+
+// handshake finishes the DTLS handshake, which otherwise happens on the first
+// read or write.
+func (c *idleConn) handshake() error {
+	dc, ok := c.Conn.(*dtls.Conn)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dtlsHandshakeTimeout)
+	defer cancel()
+	return dc.HandshakeContext(ctx)
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.touch()
+	return c.Conn.Write(b)
+}
+
+// dtlsConfig carries the TLS settings over to DTLS. Settings DTLS doesn't have,
+// like versions and ALPN enforcement, are left behind.
+func dtlsConfig(tc *tls.Config) *dtls.Config {
+	return &dtls.Config{
+		Certificates:          tc.Certificates,
+		ClientAuth:            dtls.ClientAuthType(tc.ClientAuth),
+		ClientCAs:             tc.ClientCAs,
+		RootCAs:               tc.RootCAs,
+		ServerName:            tc.ServerName,
+		InsecureSkipVerify:    tc.InsecureSkipVerify,
+		VerifyPeerCertificate: tc.VerifyPeerCertificate,
+		KeyLogWriter:          tc.KeyLogWriter,
+		ExtendedMasterSecret:  dtls.RequireExtendedMasterSecret,
+	}
+}
+
+func listenDTLS(network, addr string, tc *tls.Config) (net.Listener, error) {
+	laddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return dtls.Listen(network, laddr, dtlsConfig(tc))
+}
+
+func dialDTLS(ctx context.Context, network, addr string, tc *tls.Config) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	conf := dtlsConfig(tc)
+	if len(conf.ServerName) < 1 {
+		conf.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	c, err := dtls.Dial(network, raddr, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dtlsHandshakeTimeout)
+	defer cancel()
+	if err := c.HandshakeContext(ctx); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func testUDPListener(t *testing.T) *udpListener {
+	t.Helper()
+	l, err := listenUDP("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func testUDPPeer(t *testing.T, addr net.Addr) *net.UDPConn {
+	t.Helper()
+	c, err := net.DialUDP("udp", nil, addr.(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func acceptSession(t *testing.T, l *udpListener) net.Conn {
+	t.Helper()
+	done := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		done <- c
+	}()
+	select {
+	case c := <-done:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("no session accepted")
+		return nil
+	}
+}
+
+func TestUDPSessions(t *testing.T) {
+	l := testUDPListener(t)
+	a, b := testUDPPeer(t, l.Addr()), testUDPPeer(t, l.Addr())
+	a.Write([]byte("from a"))
+	sa := acceptSession(t, l)
+	b.Write([]byte("from b"))
+	sb := acceptSession(t, l)
+	a.Write([]byte("again a"))
+
+	buf := make([]byte, maxDatagram)
+	for _, c := range []struct {
+		s    net.Conn
+		want []string
+	}{{sa, []string{"from a", "again a"}}, {sb, []string{"from b"}}} {
+		c.s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for _, want := range c.want {
+			n, err := c.s.Read(buf)
+			if err != nil || string(buf[:n]) != want {
+				t.Errorf("got %q, %v, want %q", buf[:n], err, want)
+			}
+		}
+	}
+
+	// answers go back to the peer of the session
+	sb.Write([]byte("to b"))
+	b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := b.Read(buf)
+	if err != nil || string(buf[:n]) != "to b" {
+		t.Errorf("peer got %q, %v", buf[:n], err)
+	}
+
+	// a closed session is forgotten, the next datagram starts a new one
+	sa.Close()
+	a.Write([]byte("new a"))
+	if s := acceptSession(t, l); s.RemoteAddr().String() != a.LocalAddr().String() {
+		t.Errorf("new session for %s", s.RemoteAddr())
+	}
+}
+
+func TestUDPSessionShortBuffer(t *testing.T) {
+	l := testUDPListener(t)
+	a := testUDPPeer(t, l.Addr())
+	a.Write([]byte("a datagram too long"))
+	s := acceptSession(t, l)
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.Read(make([]byte, 4)); !errors.Is(err, io.ErrShortBuffer) {
+		t.Errorf("got %v, want %v", err, io.ErrShortBuffer)
+	}
+}
+
+func TestUDPAcceptBacklog(t *testing.T) {
+	l := testUDPListener(t)
+	first := testUDPPeer(t, l.Addr())
+	first.Write([]byte("first"))
+	s := acceptSession(t, l)
+
+	// nothing accepts these, once the backlog is full they are dropped
+	for i := 0; i < udpAcceptBacklog+16; i++ {
+		testUDPPeer(t, l.Addr()).Write([]byte("waiting"))
+	}
+
+	// the sessions already accepted still get their datagrams
+	first.Write([]byte("still there"))
+	buf := make([]byte, maxDatagram)
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, want := range []string{"first", "still there"} {
+		n, err := s.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("got %q, %v, want %q", buf[:n], err, want)
+		}
+	}
+	l.mu.Lock()
+	sessions := len(l.sessions)
+	l.mu.Unlock()
+	if sessions > udpAcceptBacklog+1 {
+		t.Errorf("%d sessions, want the ones over the backlog dropped", sessions)
+	}
+}
+
+// testUDPEcho answers every datagram with itself.
+func testUDPEcho(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, maxDatagram)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestInstanceProxiesUDP(t *testing.T) {
+	inst := testInstance(t, &Profile{Protocol: "udp", Proxy: testUDPEcho(t), ConnectionBandwidth: "1K"})
+	addr, err := net.ResolveUDPAddr("udp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testUDPPeer(t, addr)
+
+	// larger than the burst of the bandwidth limit
+	big := make([]byte, 1500)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	for _, msg := range [][]byte{[]byte("ping"), big} {
+		if _, err := c.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, maxDatagram)
+		c.SetReadDeadline(time.Now().Add(10 * time.Second))
+		n, err := c.Read(buf)
+		if err != nil || string(buf[:n]) != string(msg) {
+			t.Fatalf("got %d bytes, %v, want %d", n, err, len(msg))
+		}
+	}
+}
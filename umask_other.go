@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// withUmask runs f, there is no umask here.
+func withUmask(mask int, f func() error) error {
+	return f()
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package main
+
+import (
+	"sync"
+	"syscall"
+)
+
+// umaskMu keeps the umask of one bind from being restored under another, the
+// umask belongs to the whole process.
+var umaskMu sync.Mutex
+
+// withUmask runs f with mask as the file mode creation mask. Files other
+// goroutines create meanwhile get it too, it can only take permissions away.
+func withUmask(mask int, f func() error) error {
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return f()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// staleDialTimeout bounds the check for a process still serving an existing
+// socket file.
+const staleDialTimeout = time.Second
+
+// isUnix reports if the network is a unix domain socket with a file path.
+func isUnix(network string) bool {
+	switch network {
+	case "unix", "unixpacket":
+		return true
+	}
+	return false
+}
+
+// socketPerms is the ownership and mode applied to a listen socket file, -1
+// ids and a zero mode are left as created.
+type socketPerms struct {
+	mode     os.FileMode
+	uid, gid int
+}
+
+// parseSocketPerms reads the ListenSocket options.
+func parseSocketPerms(p *Profile) (socketPerms, error) {
+	perms := socketPerms{uid: -1, gid: -1}
+	if len(p.ListenSocketMode) > 0 {
+		m, err := strconv.ParseUint(p.ListenSocketMode, 8, 32)
+		if err != nil || m > 0o7777 {
+			return perms, fmt.Errorf("ListenSocketMode %q isn't an octal file mode", p.ListenSocketMode)
+		}
+		perms.mode = os.FileMode(m)
+	}
+	if len(p.ListenSocketOwner) > 0 {
+		id, err := lookupID(p.ListenSocketOwner, func(name string) (string, error) {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return perms, fmt.Errorf("ListenSocketOwner: %w", err)
+		}
+		perms.uid = id
+	}
+	if len(p.ListenSocketGroup) > 0 {
+		id, err := lookupID(p.ListenSocketGroup, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return perms, fmt.Errorf("ListenSocketGroup: %w", err)
+		}
+		perms.gid = id
+	}
+	return perms, nil
+}
+
+// lookupID takes a numeric id as is, anything else is looked up by name.
+func lookupID(s string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(s); err == nil {
+		return id, nil
+	}
+	sid, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(sid)
+}
+
+func (perms socketPerms) set() bool {
+	return perms.mode != 0 || perms.uid > -1 || perms.gid > -1
+}
+
+// apply sets the ownership and mode of the socket file at path.
+func (perms socketPerms) apply(path string) error {
+	if perms.uid > -1 || perms.gid > -1 {
+		if err := os.Lchown(path, perms.uid, perms.gid); err != nil {
+			return err
+		}
+	}
+	if perms.mode != 0 {
+		if err := os.Chmod(path, perms.mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeStaleSocket removes a socket file left behind by a process that is
+// gone, binding fails while it exists. Anything else at the path, or a socket
+// something still answers on, is left alone.
+func removeStaleSocket(network, path string) error {
+	if strings.HasPrefix(path, "@") {
+		return nil // abstract socket, no file
+	}
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+	if c, err := net.DialTimeout(network, path, staleDialTimeout); err == nil {
+		c.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,87 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestWithUmask(t *testing.T) {
+	defer syscall.Umask(syscall.Umask(0o022))
+	path := filepath.Join(t.TempDir(), "s.sock")
+	err := withUmask(0o177, func() error {
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return err
+		}
+		l.(*net.UnixListener).SetUnlinkOnClose(false)
+		return l.Close()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket bound as %v, %v, want owner only", fi.Mode(), err)
+	}
+	if mask := syscall.Umask(0o022); mask != 0o022 {
+		t.Errorf("umask left at %#o", mask)
+	}
+}
+
+func TestInstanceUnixListener(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy.sock")
+
+	// a socket file of a process that is gone is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	// the configured mode is applied whatever the umask
+	defer syscall.Umask(syscall.Umask(0))
+	inst := testInstance(t, &Profile{ListenProtocol: "unix", Listen: path, ListenSocketMode: "0640", Proxy: testEcho(t)})
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o640 {
+		t.Errorf("socket is %v, %v, want 0640", fi.Mode(), err)
+	}
+	c, err := net.Dial("unix", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c) {
+		t.Error("connection over the socket wasn't proxied")
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	live := filepath.Join(dir, "live.sock")
+	l, err := net.Listen("unix", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := removeStaleSocket("unix", live); err == nil {
+		t.Error("removed a socket in use")
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeStaleSocket("unix", file); err == nil {
+		t.Error("removed something that isn't a socket")
+	}
+
+	if err := removeStaleSocket("unix", filepath.Join(dir, "missing.sock")); err != nil {
+		t.Errorf("missing socket: %v", err)
+	}
+}
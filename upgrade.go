@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// upgradeEnv lists the sockets handed to the new binary, their descriptors
+	// follow the ready pipe on descriptor 3.
+	upgradeEnv = "MTLSPROXY_UPGRADE_SOCKETS"
+	// upgradeTimeout is how long the new binary gets to be ready before it is
+	// stopped and the running one carries on.
+	upgradeTimeout = time.Minute
+)
+
+// handedSocket is a listening socket passed to the new binary.
+type handedSocket struct {
+	Net   string `json:"net"`
+	Addr  string `json:"addr"`
+	Shard int    `json:"shard,omitempty"` // of the listeners sharing the address, from 1
+}
+
+func (h handedSocket) key() string {
+	if h.Shard > 0 {
+		return fmt.Sprintf("%s %s #%d", h.Net, h.Addr, h.Shard)
+	}
+	return h.Net + " " + h.Addr
+}
+
+// sockets are the open stream listeners of the profiles and servers, so an
+// upgrade can hand them to the new binary.
+var sockets = &socketRegistry{open: make(map[string]*registeredListener)}
+
+type socketRegistry struct {
+	mu        sync.Mutex
+	open      map[string]*registeredListener
+	inherited map[string]*os.File // from the binary that started this one, until they are claimed
+	unlink    []*net.UnixListener // inherited, removed when closed once this binary took over
+	ready     *os.File            // tells the binary that started this one that it can stop
+}
+
+// registeredListener leaves the registry when it is closed, which it can be
+// more than once.
+type registeredListener struct {
+	net.Listener
+	socket   handedSocket
+	registry *socketRegistry
+	close    sync.Once
+	err      error
+}
+
+func (l *registeredListener) Close() error {
+	l.close.Do(func() {
+		r := l.registry
+		r.mu.Lock()
+		if key := l.socket.key(); r.open[key] == l {
+			delete(r.open, key)
+		}
+		r.mu.Unlock()
+		l.err = l.Listener.Close()
+	})
+	return l.err
+}
+
+// listenSocket opens a stream listener, or takes the one inherited for the
+// address from the binary that started this one.
+func listenSocket(network, addr string) (net.Listener, error) {
+	return sockets.listen(handedSocket{Net: network, Addr: addr}, net.Listen)
+}
+
+// listen opens the socket h with listen, unless it is inherited.
+func (r *socketRegistry) listen(h handedSocket, listen func(network, addr string) (net.Listener, error)) (net.Listener, error) {
+	l, err := r.inherit(h)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		if isUnix(h.Net) {
+			if err := removeStaleSocket(h.Net, h.Addr); err != nil {
+				return nil, err
+			}
+		}
+		if l, err = listen(h.Net, h.Addr); err != nil {
+			return nil, err
+		}
+	}
+	rl := &registeredListener{Listener: l, socket: h, registry: r}
+	r.mu.Lock()
+	r.open[h.key()] = rl
+	r.mu.Unlock()
+	return rl, nil
+}
+
+// loadInherited reads the sockets handed over by an upgrade from the
+// environment, it is called before anything listens.
+func (r *socketRegistry) loadInherited() error {
+	env := os.Getenv(upgradeEnv)
+	if len(env) < 1 {
+		return nil
+	}
+	os.Unsetenv(upgradeEnv)
+	var hs []handedSocket
+	if err := json.Unmarshal([]byte(env), &hs); err != nil {
+		return fmt.Errorf("reading %s: %w", upgradeEnv, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ready = os.NewFile(3, "upgrade ready")
+	r.inherited = make(map[string]*os.File, len(hs))
+	for i, h := range hs {
+		r.inherited[h.key()] = os.NewFile(uintptr(4+i), h.key())
+	}
+	slog.Info("taking over sockets from the running binary", "sockets", len(hs))
+	return nil
+}
+
+// inherit turns the inherited socket of h into a listener, nil when there is
+// none.
+func (r *socketRegistry) inherit(h handedSocket) (net.Listener, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, ok := r.inherited[h.key()]
+	if !ok {
+		return nil, nil
+	}
+	delete(r.inherited, h.key())
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("inheriting %s: %w", h.key(), err)
+	}
+	if ul, ok := l.(*net.UnixListener); ok {
+		// the running binary still serves it until this one is ready
+		ul.SetUnlinkOnClose(false)
+		r.unlink = append(r.unlink, ul)
+	}
+	return l, nil
+}
+
+// upgrading tells if this binary was started by an upgrade and hasn't told
+// the running one it is ready yet.
+func (r *socketRegistry) upgrading() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ready != nil
+}
+
+// tookOver tells the binary that started this one that it is ready, and
+// closes the sockets no profile or server claimed.
+func (r *socketRegistry) tookOver() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ready == nil {
+		return
+	}
+	if _, err := r.ready.Write([]byte("ready\n")); err != nil {
+		slog.Error("error telling the previous binary this one is ready", "err", err)
+	}
+	r.ready.Close()
+	r.ready = nil
+	for key, f := range r.inherited {
+		slog.Debug("closing inherited socket no profile listens on", "socket", key)
+		f.Close()
+	}
+	r.inherited = nil
+	for _, ul := range r.unlink {
+		ul.SetUnlinkOnClose(true)
+	}
+	r.unlink = nil
+}
+
+// fds duplicates the descriptors of the open sockets to hand them over.
+func (r *socketRegistry) fds() ([]handedSocket, []int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var hs []handedSocket
+	var fds []int
+	for key, l := range r.open {
+		fd, err := dupSocket(l.Listener)
+		if err != nil {
+			closeFds(fds)
+			return nil, nil, fmt.Errorf("handing over %s: %w", key, err)
+		}
+		hs = append(hs, l.socket)
+		fds = append(fds, fd)
+	}
+	return hs, fds, nil
+}
+
+// release closes the sockets after the new binary took them over, unix
+// sockets are left in place for it.
+func (r *socketRegistry) release() {
+	r.mu.Lock()
+	open := make([]*registeredListener, 0, len(r.open))
+	for _, l := range r.open {
+		open = append(open, l)
+	}
+	r.mu.Unlock()
+	for _, l := range open {
+		if ul, ok := l.Listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		l.Close()
+	}
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		closeFd(fd)
+	}
+}
+
+// upgrade is a new binary being started with the sockets of this one.
+type upgrade struct {
+	proc   *os.Process
+	paused []*Instance // packet listeners closed for the new binary to bind
+	done   chan error  // nil when the new binary is ready
+}
+
+// startUpgrade starts the binary at the path of this one, which may have been
+// replaced, with the same arguments and the open sockets. Packet listeners
+// can't be shared, they are closed for the new binary to bind them.
+func (s *Supervisor) startUpgrade() (*upgrade, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	hs, fds, err := sockets.fds()
+	if err != nil {
+		return nil, err
+	}
+	defer closeFds(fds)
+	env, err := json.Marshal(hs)
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer w.Close()
+
+	up := &upgrade{done: make(chan error, 1)}
+	for _, inst := range s.Instances() {
+		if n := inst.Profile().listenNetwork(); isPacket(n) || isQUIC(n) {
+			inst.StopListening()
+			up.paused = append(up.paused, inst)
+		}
+	}
+
+	files := []uintptr{os.Stdin.Fd(), os.Stdout.Fd(), os.Stderr.Fd(), w.Fd()}
+	for _, fd := range fds {
+		files = append(files, uintptr(fd))
+	}
+	// the watchdog of the new binary only counts once systemd is told its PID
+	var environ []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "WATCHDOG_PID=") && !strings.HasPrefix(kv, upgradeEnv+"=") {
+			environ = append(environ, kv)
+		}
+	}
+	environ = append(environ, upgradeEnv+"="+string(env))
+	if up.proc, err = startBinary(exe, os.Args, environ, files); err != nil {
+		r.Close()
+		up.resume()
+		return nil, err
+	}
+	slog.Info("upgrading, started the new binary", "path", exe, "pid", up.proc.Pid, "sockets", len(hs))
+	go up.wait(r)
+	return up, nil
+}
+
+// wait reads the ready pipe until the new binary is ready or exits. It is
+// stopped when it isn't ready in time.
+func (up *upgrade) wait(r *os.File) {
+	defer r.Close()
+	timer := time.AfterFunc(upgradeTimeout, func() {
+		slog.Error("the new binary isn't ready, stopping it", "pid", up.proc.Pid, "timeout", upgradeTimeout)
+		up.proc.Signal(syscall.SIGTERM)
+	})
+	defer timer.Stop()
+	b, err := io.ReadAll(io.LimitReader(r, 64))
+	if err == nil && strings.TrimSpace(string(b)) == "ready" {
+		up.done <- nil
+		return
+	}
+	state, err := up.proc.Wait()
+	if err != nil {
+		up.done <- fmt.Errorf("the new binary exited before it was ready: %w", err)
+		return
+	}
+	up.done <- fmt.Errorf("the new binary exited before it was ready: %s", state)
+}
+
+// resume listens again on the packet listeners closed for a failed upgrade.
+func (up *upgrade) resume() {
+	for _, inst := range up.paused {
+		if err := inst.ResumeListening(); err != nil {
+			slog.Error("error listening again after the upgrade failed", "profile", inst.ident, "err", err)
+		}
+	}
+}
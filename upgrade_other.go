@@ -0,0 +1,25 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// upgradeSignals make the binary be upgraded, sockets can't be handed over
+// here.
+var upgradeSignals []os.Signal
+
+var errNoUpgrade = errors.New("sockets can't be handed to a new binary on this platform")
+
+func dupSocket(l net.Listener) (int, error) {
+	return -1, errNoUpgrade
+}
+
+func closeFd(fd int) {}
+
+func startBinary(exe string, args, env []string, files []uintptr) (*os.Process, error) {
+	return nil, errNoUpgrade
+}
@@ -0,0 +1,146 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestRegistry() *socketRegistry {
+	return &socketRegistry{open: make(map[string]*registeredListener)}
+}
+
+// handOver gives the sockets open in from to a registry like a new binary
+// would find them, ready tells from it took over.
+func handOver(t *testing.T, from *socketRegistry) (to *socketRegistry, ready *os.File) {
+	t.Helper()
+	hs, fds, err := from.fds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ready.Close() })
+	to = newTestRegistry()
+	to.ready = w
+	to.inherited = make(map[string]*os.File, len(hs))
+	for i, h := range hs {
+		to.inherited[h.key()] = os.NewFile(uintptr(fds[i]), h.key())
+	}
+	return to, ready
+}
+
+func noListen(network, addr string) (net.Listener, error) {
+	return nil, errors.New("bound instead of inherited")
+}
+
+func acceptOne(t *testing.T, l net.Listener, network, addr string) {
+	t.Helper()
+	c, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	a, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+}
+
+func TestSocketHandoff(t *testing.T) {
+	old := newTestRegistry()
+	h := handedSocket{Net: "tcp", Addr: "127.0.0.1:0"}
+	l, err := old.listen(h, net.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	unclaimed, err := old.listen(handedSocket{Net: "tcp", Addr: "127.0.0.1:0", Shard: 2}, net.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unclaimed.Close()
+
+	nu, ready := handOver(t, old)
+	if !nu.upgrading() {
+		t.Error("not upgrading with sockets handed over")
+	}
+	nl, err := nu.listen(h, noListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nl.Close()
+	if nl.Addr().String() != addr {
+		t.Errorf("inherited %s, want %s", nl.Addr(), addr)
+	}
+
+	nu.tookOver()
+	if b, err := io.ReadAll(ready); err != nil || string(b) != "ready\n" {
+		t.Errorf("previous binary got %q, %v", b, err)
+	}
+	if nu.upgrading() || len(nu.inherited) > 0 {
+		t.Error("sockets nobody claimed are kept after taking over")
+	}
+
+	// the old binary lets go, the new one serves the address on its own
+	old.release()
+	if len(old.open) > 0 {
+		t.Errorf("%d sockets still open after release", len(old.open))
+	}
+	acceptOne(t, nl, "tcp", addr)
+}
+
+func TestSocketHandoffUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	h := handedSocket{Net: "unix", Addr: path}
+	old := newTestRegistry()
+	if _, err := old.listen(h, net.Listen); err != nil {
+		t.Fatal(err)
+	}
+
+	nu, _ := handOver(t, old)
+	old.release()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("released socket file is gone: %v", err)
+	}
+	nl, err := nu.listen(h, noListen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acceptOne(t, nl, "unix", path)
+
+	nu.tookOver()
+	nl.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left behind once closed by the new binary: %v", err)
+	}
+}
+
+func TestRegisteredListenerClose(t *testing.T) {
+	r := newTestRegistry()
+	h := handedSocket{Net: "tcp", Addr: "127.0.0.1:0"}
+	l, err := r.listen(h, net.Listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.open[h.key()]; !ok {
+		t.Fatal("listener isn't registered")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Errorf("closing again: %v", err)
+	}
+	if _, ok := r.open[h.key()]; ok {
+		t.Error("closed listener is still handed over")
+	}
+}
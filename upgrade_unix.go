@@ -0,0 +1,54 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// upgradeSignals make the binary be upgraded by starting it again with the
+// open sockets.
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
+
+// dupSocket duplicates the descriptor of a listener. It doesn't go through
+// os.File, which puts the socket it shares with the listener into blocking
+// mode, after which closing the listener waits for a connection.
+func dupSocket(l net.Listener) (int, error) {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return -1, errors.New("the listener has no descriptor")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd, derr := -1, error(nil)
+	err = rc.Control(func(s uintptr) {
+		syscall.ForkLock.RLock()
+		defer syscall.ForkLock.RUnlock()
+		if fd, derr = syscall.Dup(int(s)); derr == nil {
+			syscall.CloseOnExec(fd)
+		}
+	})
+	if err != nil {
+		return -1, err
+	}
+	return fd, derr
+}
+
+func closeFd(fd int) {
+	syscall.Close(fd)
+}
+
+// startBinary starts exe with files as its descriptors from 0, like os/exec
+// without making them blocking.
+func startBinary(exe string, args, env []string, files []uintptr) (*os.Process, error) {
+	pid, err := syscall.ForkExec(exe, args, &syscall.ProcAttr{Env: env, Files: files})
+	if err != nil {
+		return nil, err
+	}
+	return os.FindProcess(pid)
+}
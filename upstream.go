@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// contextDialer opens the connection the destination is reached over.
+type contextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// httpConnectDialer tunnels through a forward proxy with HTTP CONNECT.
+type httpConnectDialer struct {
+	proxy *url.URL
+	// timeout bounds the handshake with the proxy when ctx has no deadline.
+	timeout time.Duration
+}
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host := d.proxy.Host
+	if len(d.proxy.Port()) < 1 {
+		if d.proxy.Scheme == "https" {
+			host = net.JoinHostPort(d.proxy.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(d.proxy.Hostname(), "80")
+		}
+	}
+
+	var nd net.Dialer
+	c, err := nd.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP proxy: %w", err)
+	}
+	// a proxy that accepts and never answers mustn't hold the dial forever
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		timeout := d.timeout
+		if timeout <= 0 {
+			timeout = defaultDialTimeout
+		}
+		deadline = time.Now().Add(timeout)
+	}
+	c.SetDeadline(deadline)
+	if d.proxy.Scheme == "https" {
+		tc := tls.Client(c, &tls.Config{ServerName: d.proxy.Hostname(), KeyLogWriter: keyLog})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("HTTP proxy: %w", err)
+		}
+		c = tc
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := d.proxy.User; u != nil {
+		pass, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+pass)))
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("HTTP proxy: %w", err)
+	}
+
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("HTTP proxy: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("HTTP proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+	c.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		// the destination spoke first and the proxy sent it along with the answer
+		return &replayConn{Conn: c, r: io.MultiReader(br, c)}, nil
+	}
+	return c, nil
+}
+
+// parseHTTPProxy checks an HTTPProxy URL.
+func parseHTTPProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%q isn't an http or https URL", s)
+	}
+	if len(u.Hostname()) < 1 {
+		return nil, fmt.Errorf("%q has no host", s)
+	}
+	return u, nil
+}
+
+// parseSOCKSProxy checks a SOCKSProxy URL.
+func parseSOCKSProxy(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("%q isn't a socks5 URL", s)
+	}
+	if len(u.Hostname()) < 1 {
+		return nil, fmt.Errorf("%q has no host", s)
+	}
+	return u, nil
+}
+
+// socksDialer tunnels through a SOCKS5 proxy, the destination's name is
+// passed to the proxy to resolve.
+func socksDialer(u *url.URL) (contextDialer, error) {
+	host := u.Host
+	if len(u.Port()) < 1 {
+		host = net.JoinHostPort(u.Hostname(), "1080")
+	}
+	var auth *proxy.Auth
+	if u.User != nil {
+		auth = &proxy.Auth{User: u.User.Username()}
+		auth.Password, _ = u.User.Password()
+	}
+	d, err := proxy.SOCKS5("tcp", host, auth, &net.Dialer{})
+	if err != nil {
+		return nil, err
+	}
+	cd, ok := d.(contextDialer)
+	if !ok {
+		return nil, errors.New("SOCKS5 dialer doesn't support contexts")
+	}
+	return socksErrDialer{cd}, nil
+}
+
+// socksErrDialer names the proxy in dial errors.
+type socksErrDialer struct {
+	contextDialer
+}
+
+func (d socksErrDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := d.contextDialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS proxy: %w", err)
+	}
+	return c, nil
+}
+
+// upstream is the forward proxy destinations are dialed through, nil to dial
+// them directly.
+func (p *Profile) upstream() contextDialer {
+	if p.httpProxy != nil {
+		return &httpConnectDialer{proxy: p.httpProxy, timeout: p.dialTimeout}
+	}
+	if p.socksProxy != nil {
+		d, _ := socksDialer(p.socksProxy) // checked in Resolve
+		return d
+	}
+	return nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConnectProxy accepts CONNECT requests and hands them to answer.
+func testConnectProxy(t *testing.T, answer func(c net.Conn, req *http.Request)) *url.URL {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil {
+					return
+				}
+				answer(c, req)
+			}()
+		}
+	}()
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	echo := testEcho(t)
+	reqs := make(chan *http.Request, 2)
+	u := testConnectProxy(t, func(c net.Conn, req *http.Request) {
+		reqs <- req
+		dst, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			c.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+			return
+		}
+		defer dst.Close()
+		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go io.Copy(dst, c)
+		io.Copy(c, dst)
+	})
+	u.User = url.UserPassword("user", "secret")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := (&httpConnectDialer{proxy: u}).DialContext(ctx, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c) {
+		t.Error("tunnel doesn't reach the destination")
+	}
+	got := <-reqs
+	if got.Method != http.MethodConnect || got.Host != echo {
+		t.Errorf("proxy got %s %s", got.Method, got.Host)
+	}
+	if user, pass, _ := (&http.Request{Header: http.Header{"Authorization": got.Header["Proxy-Authorization"]}}).BasicAuth(); user != "user" || pass != "secret" {
+		t.Errorf("proxy got credentials %q %q", user, pass)
+	}
+
+	if _, err := (&httpConnectDialer{proxy: u}).DialContext(ctx, "tcp", "127.0.0.1:1"); err == nil {
+		t.Error("refused CONNECT succeeded")
+	}
+}
+
+func TestHTTPConnectDialerTimeout(t *testing.T) {
+	u := testConnectProxy(t, func(c net.Conn, req *http.Request) {
+		time.Sleep(5 * time.Second)
+	})
+	start := time.Now()
+	_, err := (&httpConnectDialer{proxy: u, timeout: 100 * time.Millisecond}).DialContext(context.Background(), "tcp", "127.0.0.1:1")
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("CONNECT waited past the dial timeout")
+	}
+}
+
+func TestHTTPConnectDialerDefaultPort(t *testing.T) {
+	for _, c := range []struct{ url, addr string }{
+		{"http://[::1]", "[::1]:80"},
+		{"https://[::1]", "[::1]:443"},
+		{"http://127.0.0.1", "127.0.0.1:80"},
+	} {
+		u, err := parseHTTPProxy(c.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = (&httpConnectDialer{proxy: u}).DialContext(ctx, "tcp", "example.com:443")
+		if err == nil || !strings.Contains(err.Error(), " "+c.addr+":") {
+			t.Errorf("%s: got %v, want a dial to %s", c.url, err, c.addr)
+		}
+	}
+}
+
+// envProfile reads the profiles from the environment and returns the one
+// named name, failing when there are others.
+func envProfile(t *testing.T, name string) *Profile {
+	t.Helper()
+	ps, unknown, err := profilesFromEnv()
+	if err != nil || len(unknown) > 0 {
+		t.Fatalf("got %v, %v", unknown, err)
+	}
+	if len(ps) != 1 || ps[0].Name != name {
+		for _, p := range ps {
+			t.Errorf("profile %s from the environment", p.Name)
+		}
+		t.FailNow()
+	}
+	return ps[0]
+}
+
+func TestHTTPProxyFromEnvironment(t *testing.T) {
+	t.Setenv(EnvProfilePrefix+"DB"+EnvProxySuffix, "db.internal:5432")
+	t.Setenv(EnvProfilePrefix+"DB"+EnvHTTPProxySuffix, "http://corp:3128")
+	if p := envProfile(t, "DB"); p.Proxy != "db.internal:5432" || p.HTTPProxy != "http://corp:3128" {
+		t.Errorf("got Proxy %q, HTTPProxy %q", p.Proxy, p.HTTPProxy)
+	}
+}
+
+func TestSOCKSProxyFromEnvironment(t *testing.T) {
+	t.Setenv(EnvProfilePrefix+"DB"+EnvProxySuffix, "db.internal:5432")
+	t.Setenv(EnvProfilePrefix+"DB"+EnvSOCKSProxySuffix, "socks5://bastion:1080")
+	if p := envProfile(t, "DB"); p.Proxy != "db.internal:5432" || p.SOCKSProxy != "socks5://bastion:1080" {
+		t.Errorf("got Proxy %q, SOCKSProxy %q", p.Proxy, p.SOCKSProxy)
+	}
+}
+
+// testSOCKSProxy is a SOCKS5 proxy requiring user and pass when user is set,
+// the targets it was asked for go on the channel.
+func testSOCKSProxy(t *testing.T, user, pass string) (string, <-chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	targets := make(chan string, 8)
+	serve := func(c net.Conn) {
+		defer c.Close()
+		br := bufio.NewReader(c)
+		hdr := make([]byte, 2)
+		if _, err := io.ReadFull(br, hdr); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(br, make([]byte, hdr[1])); err != nil {
+			return
+		}
+		if len(user) < 1 {
+			c.Write([]byte{5, 0})
+		} else {
+			c.Write([]byte{5, 2})
+			ver, _ := br.ReadByte()
+			n, _ := br.ReadByte()
+			u := make([]byte, n)
+			io.ReadFull(br, u)
+			n, _ = br.ReadByte()
+			p := make([]byte, n)
+			io.ReadFull(br, p)
+			if ver != 1 || string(u) != user || string(p) != pass {
+				c.Write([]byte{1, 1})
+				return
+			}
+			c.Write([]byte{1, 0})
+		}
+
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(br, req); err != nil {
+			return
+		}
+		var host string
+		switch req[3] {
+		case 1, 4:
+			ip := make([]byte, 4)
+			if req[3] == 4 {
+				ip = make([]byte, 16)
+			}
+			io.ReadFull(br, ip)
+			host = net.IP(ip).String()
+		case 3:
+			n, _ := br.ReadByte()
+			name := make([]byte, n)
+			io.ReadFull(br, name)
+			host = string(name)
+		}
+		port := make([]byte, 2)
+		io.ReadFull(br, port)
+		target := net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1])))
+		targets <- target
+		d, err := net.Dial("tcp", target)
+		if err != nil {
+			c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer d.Close()
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+		go io.Copy(d, br)
+		io.Copy(c, d)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c)
+		}
+	}()
+	return l.Addr().String(), targets
+}
+
+func TestSOCKSDialer(t *testing.T) {
+	addr, targets := testSOCKSProxy(t, "user", "secret")
+	_, port, _ := net.SplitHostPort(testEcho(t))
+	dest := net.JoinHostPort("localhost", port)
+
+	u, _ := parseSOCKSProxy("socks5://user:secret@" + addr)
+	d, err := socksDialer(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := d.DialContext(context.Background(), "tcp", dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c) {
+		t.Error("nothing came back through the tunnel")
+	}
+	if got := <-targets; got != dest {
+		t.Errorf("proxy asked for %s, want the name %s", got, dest)
+	}
+
+	u, _ = parseSOCKSProxy("socks5://user:wrong@" + addr)
+	d, _ = socksDialer(u)
+	if _, err := d.DialContext(context.Background(), "tcp", dest); err == nil || !strings.HasPrefix(err.Error(), "SOCKS proxy:") {
+		t.Errorf("wrong password: got %v", err)
+	}
+}
+
+func TestInstanceSOCKSProxy(t *testing.T) {
+	addr, targets := testSOCKSProxy(t, "", "")
+	echo := testEcho(t)
+	inst := testInstance(t, &Profile{Proxy: echo, SOCKSProxy: "socks5://" + addr})
+	c, err := net.Dial("tcp", inst.ListenAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if !echoes(c) {
+		t.Fatal("nothing came back through the SOCKS proxy")
+	}
+	if got := <-targets; got != echo {
+		t.Errorf("proxy asked for %s, want %s", got, echo)
+	}
+
+	for _, p := range []*Profile{
+		{SOCKSProxy: "http://" + addr},
+		{SOCKSProxy: "socks5://" + addr, HTTPProxy: "http://" + addr},
+	} {
+		p.Name, p.Listen, p.Proxy = "test", ":0", echo
+		if err := p.Resolve(); err == nil {
+			t.Errorf("resolved SOCKSProxy %q with HTTPProxy %q", p.SOCKSProxy, p.HTTPProxy)
+		}
+	}
+}
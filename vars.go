@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// expandLayers replaces the variables in the values of the profiles from
+// config files. The vars sections of all files are shared, like profiles the
+// ones from files given later win. Variables of layers that aren't expanded,
+// like the keys of Secrets, are taken as they are.
+func expandLayers(layers []configLayer) error {
+	vars := make(map[string]string)
+	for _, l := range layers {
+		for name, v := range l.vars {
+			if _, ok := vars[name]; ok {
+				continue
+			}
+			if !l.expand {
+				vars[name] = v
+				continue
+			}
+			// variables can use the environment, not each other
+			x, err := expandVars(v, nil)
+			if err != nil {
+				return fmt.Errorf("expanding %q: variable %q: %w", l.source, name, err)
+			}
+			vars[name] = x
+		}
+	}
+
+	for _, l := range layers {
+		if !l.expand {
+			continue
+		}
+		for _, p := range l.profiles {
+			if err := expandValue(reflect.ValueOf(p).Elem(), vars); err != nil {
+				return fmt.Errorf("expanding %q: profile %q: %w", l.source, p.Name, err)
+			}
+		}
+		if l.defaults != nil {
+			if err := expandValue(reflect.ValueOf(l.defaults).Elem(), vars); err != nil {
+				return fmt.Errorf("expanding %q: defaults: %w", l.source, err)
+			}
+		}
+	}
+	return nil
+}
+
+// expandValue expands the strings of a profile, a route or a certificate pair,
+// the names of profiles and routes aren't.
+func expandValue(v reflect.Value, vars map[string]string) error {
+	switch v.Kind() {
+	case reflect.String:
+		x, err := expandVars(v.String(), vars)
+		if err != nil {
+			return err
+		}
+		v.SetString(x)
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandValue(v.Index(i), vars); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		for _, k := range keys {
+			if err := expandValue(v.MapIndex(k), vars); err != nil {
+				return fmt.Errorf("%s: %w", k.String(), err)
+			}
+		}
+	case reflect.Pointer:
+		if !v.IsNil() {
+			return expandValue(v.Elem(), vars)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if !f.IsExported() || f.Name == "Name" || f.Name == "Source" {
+				continue
+			}
+			if err := expandValue(v.Field(i), vars); err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// expandVars replaces ${NAME} with the variable or, when there is none, the
+// environment variable, {{ .Env.NAME }} with the environment variable and
+// {{ .Vars.NAME }} with the variable. $${ is a literal ${.
+func expandVars(s string, vars map[string]string) (string, error) {
+	if !strings.Contains(s, "${") && !strings.Contains(s, "{{") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for len(s) > 0 {
+		i := strings.IndexAny(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+
+		switch {
+		case strings.HasPrefix(s, "$${"):
+			b.WriteString("${")
+			s = s[3:]
+		case strings.HasPrefix(s, "${"):
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				return "", fmt.Errorf("%q isn't closed", s)
+			}
+			name := s[2:end]
+			x, ok := vars[name]
+			if !ok {
+				x, ok = os.LookupEnv(name)
+			}
+			if !ok {
+				return "", fmt.Errorf("%s isn't a variable or environment variable", name)
+			}
+			b.WriteString(x)
+			s = s[end+1:]
+		case strings.HasPrefix(s, "{{"):
+			end := strings.Index(s, "}}")
+			expr := ""
+			if end > -1 {
+				expr = strings.TrimSpace(s[2:end])
+			}
+			if !strings.HasPrefix(expr, ".") {
+				// not ours
+				b.WriteString(s[:2])
+				s = s[2:]
+				continue
+			}
+			x, err := templateValue(expr, vars)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(x)
+			s = s[end+2:]
+		default:
+			b.WriteString(s[:1])
+			s = s[1:]
+		}
+	}
+	return b.String(), nil
+}
+
+// templateValue is .Env.NAME or .Vars.NAME.
+func templateValue(expr string, vars map[string]string) (string, error) {
+	if name, ok := strings.CutPrefix(expr, ".Env."); ok {
+		if x, ok := os.LookupEnv(name); ok {
+			return x, nil
+		}
+		return "", fmt.Errorf("environment variable %s isn't set", name)
+	}
+	if name, ok := strings.CutPrefix(expr, ".Vars."); ok {
+		if x, ok := vars[name]; ok {
+			return x, nil
+		}
+		return "", fmt.Errorf("%s isn't a variable", name)
+	}
+	return "", fmt.Errorf("{{ %s }} isn't .Env.NAME or .Vars.NAME", expr)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandVars(t *testing.T) {
+	t.Setenv("MTLSPROXY_TEST_HOST", "db.example.test")
+	vars := map[string]string{"port": "5432", "MTLSPROXY_TEST_HOST": "shadowed.example.test"}
+	for _, c := range []struct {
+		in, want string
+		err      bool
+	}{
+		{"plain", "plain", false},
+		{"${MTLSPROXY_TEST_HOST}:${port}", "shadowed.example.test:5432", false},
+		{"{{ .Env.MTLSPROXY_TEST_HOST }}:{{.Vars.port}}", "db.example.test:5432", false},
+		{"$${port} costs $5", "${port} costs $5", false},
+		{"{{ not ours }}", "{{ not ours }}", false},
+		{"${missing}", "", true},
+		{"${port", "", true},
+		{"{{ .Vars.missing }}", "", true},
+		{"{{ .Env.MTLSPROXY_TEST_MISSING }}", "", true},
+		{"{{ .Other.port }}", "", true},
+	} {
+		got, err := expandVars(c.in, vars)
+		if got != c.want || (err != nil) != c.err {
+			t.Errorf("%q: got %q, %v", c.in, got, err)
+		}
+	}
+}
+
+func TestExpandConfig(t *testing.T) {
+	t.Setenv("MTLSPROXY_TEST_DEST", "10.0.0.1")
+	dir := t.TempDir()
+	base := writeConfig(t, dir, "base.toml", `[vars]
+port = "443"
+cn = "alice"
+
+[web]
+Listen = "127.0.0.1:8443"
+Proxy = "${MTLSPROXY_TEST_DEST}:${port}"
+ListenAllowedCNs = ["{{ .Vars.cn }}", "bob"]
+
+[web.Routes."${port}.example.test"]
+Proxy = "10.0.0.2:${port}"
+`)
+	local := writeConfig(t, dir, "local.yaml", "vars:\n  port: \"8443\"\n")
+	env := &Profile{Name: "api", Listen: "127.0.0.1:9443", Proxy: "${port}"}
+
+	ps, err := Configurations{Profiles: []*Profile{env}, ConfigFiles: []string{base, local}}.getProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	web, api := profileNamed(ps, "web"), profileNamed(ps, "api")
+	if web == nil || api == nil {
+		t.Fatalf("got %v", ps)
+	}
+	// the later file's variables win, names aren't expanded
+	if web.Proxy != "10.0.0.1:8443" || web.ListenAllowedCNs[0] != "alice" || web.Routes["${port}.example.test"] == nil ||
+		web.Routes["${port}.example.test"].Proxy != "10.0.0.2:8443" {
+		t.Errorf("got %+v", web)
+	}
+	if api.Proxy != "${port}" {
+		t.Errorf("environment profile expanded to %q", api.Proxy)
+	}
+
+	writeConfig(t, dir, "local.yaml", "web:\n  SendServerName: ${missing}\n")
+	if _, err := (Configurations{ConfigFiles: []string{base, local}}).getProfiles(); err == nil || !strings.Contains(err.Error(), "SendServerName") {
+		t.Errorf("got %v", err)
+	}
+}
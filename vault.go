@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultVaultMount = "pki"
+	vaultTimeout      = 30 * time.Second
+	// vaultRetry is how long a failed renewal waits before trying again, the
+	// current certificate is kept meanwhile.
+	vaultRetry = time.Minute
+)
+
+// vaultCert is a certificate issued by Vault, shared by the profiles asking
+// for the same one. It is renewed after two thirds of its lifetime.
+type vaultCert struct {
+	certRaw      string // with the intermediates
+	privateRaw   string
+	authorityRaw string
+	notAfter     time.Time
+	renewAt      time.Time
+	retryAt      time.Time // after a failed renewal
+}
+
+var (
+	vaultCerts   = make(map[string]*vaultCert)
+	vaultCertsMu sync.Mutex
+	// vaultRenewals is sent on when a certificate is due for renewal.
+	vaultRenewals = make(chan struct{}, 1)
+)
+
+// vaultRequest is what is asked of Vault for a certificate.
+type vaultRequest struct {
+	addr, mount, role, ttl string
+	tokenPath, authority   string
+	commonName             string
+	altNames               []string
+}
+
+func (r vaultRequest) key() string {
+	return strings.Join([]string{r.addr, r.mount, r.role, r.ttl, r.commonName, strings.Join(r.altNames, ",")}, "|")
+}
+
+func (p *Profile) vaultRequest(role, commonName string, altNames []string) vaultRequest {
+	r := vaultRequest{
+		addr:       p.VaultAddress,
+		mount:      p.VaultMount,
+		role:       role,
+		ttl:        p.VaultTTL,
+		tokenPath:  p.VaultTokenPath,
+		authority:  p.VaultAuthorityPath,
+		commonName: commonName,
+		altNames:   altNames,
+	}
+	if len(r.addr) < 1 {
+		r.addr = os.Getenv("VAULT_ADDR")
+	}
+	if len(r.mount) < 1 {
+		r.mount = defaultVaultMount
+	}
+	return r
+}
+
+// vaultCertificate returns the certificate for the request, issuing one when
+// there is none yet or it is due for renewal. When renewing fails the current
+// one is returned until it expires.
+func vaultCertificate(r vaultRequest) (*vaultCert, error) {
+	vaultCertsMu.Lock()
+	defer vaultCertsMu.Unlock()
+
+	key := r.key()
+	vc, ok := vaultCerts[key]
+	now := time.Now()
+	if ok && (now.Before(vc.renewAt) || now.Before(vc.retryAt)) {
+		return vc, nil
+	}
+
+	nu, err := issueVaultCert(r)
+	if err != nil {
+		if !ok {
+			return nil, err
+		}
+		vc.retryAt = now.Add(vaultRetry)
+		time.AfterFunc(vaultRetry, signalVaultRenewal)
+		if now.After(vc.notAfter) {
+			return nil, err
+		}
+		slog.Error("error renewing certificate from Vault", "role", r.role, "common_name", r.commonName, "expiry", vc.notAfter, "err", err)
+		return vc, nil
+	}
+	vaultCerts[key] = nu
+	time.AfterFunc(time.Until(nu.renewAt), signalVaultRenewal)
+	slog.Info("certificate issued by Vault", "role", r.role, "common_name", r.commonName, "expiry", nu.notAfter)
+	return nu, nil
+}
+
+func signalVaultRenewal() {
+	select {
+	case vaultRenewals <- struct{}{}:
+	default:
+	}
+}
+
+func issueVaultCert(r vaultRequest) (*vaultCert, error) {
+	if len(r.addr) < 1 {
+		return nil, errors.New("there is no Vault address, set VaultAddress or VAULT_ADDR")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if len(r.tokenPath) > 0 {
+		b, err := os.ReadFile(r.tokenPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading file %q: %w", r.tokenPath, err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if len(token) < 1 {
+		return nil, errors.New("there is no Vault token, set VaultTokenPath or VAULT_TOKEN")
+	}
+
+	tlsconf := &tls.Config{}
+	if len(r.authority) > 0 {
+		ca, err := os.ReadFile(r.authority)
+		if err != nil {
+			return nil, fmt.Errorf("reading file %q: %w", r.authority, err)
+		}
+		capool := x509.NewCertPool()
+		if ok := capool.AppendCertsFromPEM(ca); !ok {
+			return nil, errors.New("no certs found for the Vault authority")
+		}
+		tlsconf.RootCAs = capool
+	}
+	client := &http.Client{
+		Timeout:   vaultTimeout,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsconf},
+	}
+
+	var dnsNames, ips []string
+	for _, n := range r.altNames {
+		if net.ParseIP(n) != nil {
+			ips = append(ips, n)
+		} else {
+			dnsNames = append(dnsNames, n)
+		}
+	}
+	body, err := json.Marshal(map[string]string{
+		"common_name": r.commonName,
+		"alt_names":   strings.Join(dnsNames, ","),
+		"ip_sans":     strings.Join(ips, ","),
+		"ttl":         r.ttl,
+	})
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.JoinPath(r.addr, "v1", r.mount, "issue", r.role)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var issued struct {
+		Errors []string `json:"errors"`
+		Data   struct {
+			Certificate string   `json:"certificate"`
+			PrivateKey  string   `json:"private_key"`
+			IssuingCA   string   `json:"issuing_ca"`
+			CAChain     []string `json:"ca_chain"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&issued); err != nil {
+		return nil, fmt.Errorf("issuing from %s: %s: %w", r.role, resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("issuing from %s: %s: %s", r.role, resp.Status, strings.Join(issued.Errors, ", "))
+	}
+
+	block, _ := pem.Decode([]byte(issued.Data.Certificate))
+	if block == nil {
+		return nil, errors.New("no certificate in the response of Vault")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate from Vault: %w", err)
+	}
+
+	// the chain ends with the root, the authority peers are verified with
+	vc := &vaultCert{
+		certRaw:      issued.Data.Certificate,
+		privateRaw:   issued.Data.PrivateKey,
+		authorityRaw: issued.Data.IssuingCA,
+		notAfter:     cert.NotAfter,
+	}
+	if n := len(issued.Data.CAChain); n > 0 {
+		for _, ca := range issued.Data.CAChain[:n-1] {
+			vc.certRaw += "\n" + ca
+		}
+		vc.authorityRaw = issued.Data.CAChain[n-1]
+	}
+	now := time.Now()
+	vc.renewAt = now.Add(cert.NotAfter.Sub(now) * 2 / 3)
+	return vc, nil
+}
+
+// resolveVault sets the listen and send certificates the profile asks Vault
+// for, and the authorities when the profile has none.
+func (p *Profile) resolveVault() error {
+	if len(p.VaultTTL) > 0 {
+		if _, err := time.ParseDuration(p.VaultTTL); err != nil {
+			return fmt.Errorf("parsing VaultTTL %q: %w", p.VaultTTL, err)
+		}
+	}
+	if len(p.ListenVaultRole) > 0 {
+		if len(p.ListenCertRaw) > 0 || len(p.ListenCertPath) > 0 || len(p.ListenP12Path) > 0 {
+			return errors.New("a listen Vault role can't be combined with a listen certificate")
+		}
+		vc, err := vaultCertificate(p.vaultRequest(p.ListenVaultRole, p.ListenVaultCommonName, p.ListenVaultAltNames))
+		if err != nil {
+			return withCode(codeCertParse, fmt.Errorf("listen certificate from Vault: %w", err))
+		}
+		p.ListenCertRaw, p.ListenPrivateRaw = vc.certRaw, vc.privateRaw
+		if len(p.ListenAuthorityRaw) < 1 && len(p.ListenAuthorityPath) < 1 {
+			p.ListenAuthorityRaw = vc.authorityRaw
+		}
+	}
+	if len(p.SendVaultRole) > 0 {
+		if len(p.SendCertRaw) > 0 || len(p.SendCertPath) > 0 || len(p.SendP12Path) > 0 {
+			return errors.New("a send Vault role can't be combined with a send certificate")
+		}
+		vc, err := vaultCertificate(p.vaultRequest(p.SendVaultRole, p.SendVaultCommonName, nil))
+		if err != nil {
+			return withCode(codeCertParse, fmt.Errorf("send certificate from Vault: %w", err))
+		}
+		p.SendCertRaw, p.SendPrivateRaw = vc.certRaw, vc.privateRaw
+		if len(p.SendAuthorityRaw) < 1 && len(p.SendAuthorityPath) < 1 {
+			p.SendAuthorityRaw = vc.authorityRaw
+		}
+	}
+	return nil
+}
+
+// usesVault reports if the profile has certificates issued by Vault.
+func (p *Profile) usesVault() bool {
+	return len(p.ListenVaultRole) > 0 || len(p.SendVaultRole) > 0
+}
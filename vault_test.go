@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testVault issues certificates of ca like the issue endpoint of Vault PKI,
+// failing while fail is set. It counts the certificates issued.
+type testVault struct {
+	mu     sync.Mutex
+	issued int
+	fail   bool
+	got    map[string]string // the last request
+}
+
+func (v *testVault) serve(t *testing.T, ca *testCA, token string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		if r.Header.Get("X-Vault-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+		if v.fail || r.URL.Path != "/v1/pki/issue/web" {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"unavailable"}})
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&v.got)
+		names := []string{v.got["common_name"]}
+		for _, n := range strings.Split(v.got["alt_names"]+","+v.got["ip_sans"], ",") {
+			if len(n) > 0 {
+				names = append(names, n)
+			}
+		}
+		certPEM, keyPEM := ca.issueFor(t, v.got["common_name"], names...)
+		v.issued++
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{
+			"certificate": certPEM,
+			"private_key": keyPEM,
+			"issuing_ca":  ca.pem,
+			"ca_chain":    []string{ca.pem},
+		}})
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() {
+		vaultCertsMu.Lock()
+		defer vaultCertsMu.Unlock()
+		for k := range vaultCerts {
+			if strings.HasPrefix(k, srv.URL+"|") {
+				delete(vaultCerts, k)
+			}
+		}
+	})
+	return srv.URL
+}
+
+func (v *testVault) count() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.issued
+}
+
+func TestInstanceVault(t *testing.T) {
+	ca := newTestCA(t)
+	v := &testVault{}
+	addr := v.serve(t, ca, "s.token")
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenPath, []byte("s.token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := &Profile{Proxy: testBanner(t, "dest"), VaultAddress: addr, VaultTokenPath: tokenPath, VaultTTL: "1h",
+		ListenVaultRole: "web", ListenVaultCommonName: "proxy.example.test", ListenVaultAltNames: []string{"localhost", "127.0.0.1"}}
+	inst := testInstance(t, p)
+	if v.got["alt_names"] != "localhost" || v.got["ip_sans"] != "127.0.0.1" || v.got["ttl"] != "1h" {
+		t.Errorf("Vault got %v", v.got)
+	}
+	// the issuing authority verifies clients when the profile has none
+	if cn := servedCN(t, inst.ListenAddr(), ca.clientConfig(t, "client")); cn != "proxy.example.test" {
+		t.Errorf("served %q", cn)
+	}
+	if got := banner(t, inst.ListenAddr(), ca.clientConfig(t, "client")); got != "dest\n" {
+		t.Errorf("got %q", got)
+	}
+	for _, lc := range profileCerts(p) {
+		if lc.use == "listen" {
+			t.Error("Vault certificate is checked for expiry")
+		}
+	}
+
+	// profiles asking for the same certificate share it until it's renewed
+	other := &Profile{Name: "other", VaultAddress: addr, VaultTokenPath: tokenPath, VaultTTL: "1h",
+		ListenVaultRole: "web", ListenVaultCommonName: "proxy.example.test", ListenVaultAltNames: []string{"localhost", "127.0.0.1"}}
+	if err := other.resolveVault(); err != nil || other.ListenCertRaw != p.ListenCertRaw || v.count() != 1 {
+		t.Errorf("got %v, issued %d", err, v.count())
+	}
+
+	// a failed renewal keeps the current certificate
+	r := p.vaultRequest("web", "proxy.example.test", []string{"localhost", "127.0.0.1"})
+	vaultCertsMu.Lock()
+	vaultCerts[r.key()].renewAt = time.Now().Add(-time.Second)
+	vaultCertsMu.Unlock()
+	v.mu.Lock()
+	v.fail = true
+	v.mu.Unlock()
+	vc, err := vaultCertificate(r)
+	if err != nil || vc.certRaw != p.ListenCertRaw || vc.retryAt.Before(time.Now()) {
+		t.Errorf("got %v after a failed renewal", err)
+	}
+	v.mu.Lock()
+	v.fail = false
+	v.mu.Unlock()
+	vaultCertsMu.Lock()
+	vaultCerts[r.key()].retryAt = time.Time{}
+	vaultCertsMu.Unlock()
+	if vc, err = vaultCertificate(r); err != nil || vc.certRaw == p.ListenCertRaw || v.count() != 2 {
+		t.Errorf("got %v, issued %d once Vault is back", err, v.count())
+	}
+}
+
+func TestResolveVaultErrors(t *testing.T) {
+	ca := newTestCA(t)
+	v := &testVault{}
+	addr := v.serve(t, ca, "s.token")
+	t.Setenv("VAULT_TOKEN", "s.wrong")
+	for _, c := range []struct {
+		p    Profile
+		want string
+	}{
+		{Profile{VaultAddress: addr, ListenVaultRole: "web", ListenCertRaw: "cert"}, "can't be combined"},
+		{Profile{VaultAddress: addr, SendVaultRole: "web", SendCertPath: "cert.pem"}, "can't be combined"},
+		{Profile{VaultAddress: addr, ListenVaultRole: "web", VaultTTL: "a day"}, "VaultTTL"},
+		{Profile{VaultAddress: addr, ListenVaultRole: "web", ListenVaultCommonName: "a"}, "permission denied"},
+		{Profile{VaultAddress: addr, VaultTokenPath: filepath.Join(t.TempDir(), "missing"), SendVaultRole: "web"}, "missing"},
+	} {
+		if err := c.p.resolveVault(); err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%+v: got %v, want %q", c.p, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// version is set when building a release, with
+// -ldflags "-X main.version=v1.2.3".
+var version string
+
+// features are the optional integrations of this build, so a fleet running
+// different builds can tell which can do what.
+func features() []string {
+	fs := []string{"acme", "aws", "azure", "dtls", "etcd", "kubernetes", "otlp"}
+	if pkcs11Support {
+		fs = append(fs, "pkcs11")
+	}
+	fs = append(fs, "quic")
+	if reusePortSupport {
+		fs = append(fs, "reuseport")
+	}
+	return append(fs, "sops", "spiffe", "vault")
+}
+
+// buildInfo is what build is running, for the version command, the startup
+// log and the admin API.
+type buildInfo struct {
+	Version   string   `json:"version"`
+	Revision  string   `json:"revision,omitempty"` // of the commit built
+	Time      string   `json:"time,omitempty"`     // of the commit
+	Modified  bool     `json:"modified"`           // built with uncommitted changes
+	GoVersion string   `json:"go_version"`
+	Platform  string   `json:"platform"`
+	Features  []string `json:"features"`
+}
+
+// getBuildInfo falls back to the module version when no version was set, which
+// go install sets, and reads the commit from what go build stamps into the
+// binary.
+func getBuildInfo() buildInfo {
+	bi := buildInfo{
+		Version:   version,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Features:  features(),
+	}
+	info, ok := debug.ReadBuildInfo()
+	if ok {
+		if len(bi.Version) < 1 && info.Main.Version != "(devel)" {
+			bi.Version = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				bi.Revision = s.Value
+			case "vcs.time":
+				bi.Time = s.Value
+			case "vcs.modified":
+				bi.Modified = s.Value == "true"
+			}
+		}
+	}
+	if len(bi.Version) < 1 {
+		bi.Version = "devel"
+	}
+	return bi
+}
+
+// printVersion is the version command.
+func printVersion(w io.Writer) {
+	bi := getBuildInfo()
+	fmt.Fprintf(w, "mtlsproxy %s\n", bi.Version)
+	if len(bi.Revision) > 0 {
+		revision := bi.Revision
+		if bi.Modified {
+			revision += " (modified)"
+		}
+		fmt.Fprintf(w, "revision: %s\n", revision)
+	}
+	if len(bi.Time) > 0 {
+		fmt.Fprintf(w, "commit time: %s\n", bi.Time)
+	}
+	fmt.Fprintf(w, "go: %s %s\n", bi.GoVersion, bi.Platform)
+	fmt.Fprintf(w, "features: %s\n", strings.Join(bi.Features, ", "))
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestBuildInfo(t *testing.T) {
+	prev := version
+	t.Cleanup(func() { version = prev })
+
+	version = ""
+	bi := getBuildInfo()
+	// tests are built without a module version
+	if bi.Version != "devel" || bi.GoVersion != runtime.Version() || bi.Platform != runtime.GOOS+"/"+runtime.GOARCH {
+		t.Errorf("got %+v", bi)
+	}
+	if !slices.IsSorted(bi.Features) || !slices.Contains(bi.Features, "sops") || slices.Contains(bi.Features, "pkcs11") != pkcs11Support {
+		t.Errorf("features %v", bi.Features)
+	}
+
+	version = "v1.2.3"
+	var w strings.Builder
+	printVersion(&w)
+	if !strings.HasPrefix(w.String(), "mtlsproxy v1.2.3\n") || !strings.Contains(w.String(), "\ngo: "+runtime.Version()) ||
+		!strings.HasSuffix(w.String(), "features: "+strings.Join(bi.Features, ", ")+"\n") {
+		t.Errorf("printed\n%s", w.String())
+	}
+
+	rec := adminDo(&Supervisor{}, http.MethodGet, "/version", "")
+	var got buildInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got.Version != "v1.2.3" {
+		t.Errorf("admin server shows %s", rec.Body)
+	}
+	if rec = adminDo(&Supervisor{}, http.MethodPost, "/version", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /version: %d", rec.Code)
+	}
+}